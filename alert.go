@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto_trader/exchange"
+	"fmt"
+	"time"
+)
+
+const maxCommentLength = 256
+
+// validateAlert checks the optional alert fields. At most one of qty,
+// quote_amount and percent_of_equity may be set, and limit_price only goes
+// with limit and post-only orders.
+func validateAlert(alert Alert) error {
+	if alert.Signal != "buy" && alert.Signal != "sell" {
+		return fmt.Errorf("invalid signal %q, expected buy or sell", alert.Signal)
+	}
+
+	sizes := 0
+	for _, field := range []struct {
+		name  string
+		value float64
+	}{
+		{"qty", alert.Qty},
+		{"quote_amount", alert.QuoteAmount},
+		{"percent_of_equity", alert.PercentOfEquity},
+	} {
+		if field.value < 0 {
+			return fmt.Errorf("%s must be positive, got %v", field.name, field.value)
+		}
+		if field.value > 0 {
+			sizes++
+		}
+	}
+	if sizes > 1 {
+		return fmt.Errorf("only one of qty, quote_amount and percent_of_equity may be set")
+	}
+	if alert.PercentOfEquity > 100 {
+		return fmt.Errorf("percent_of_equity must be at most 100, got %v", alert.PercentOfEquity)
+	}
+
+	switch alert.OrderType {
+	case "", exchange.OrderLimit, exchange.OrderMarket, exchange.OrderPostOnly:
+	default:
+		return fmt.Errorf("invalid order_type %q, expected market, limit or post_only", alert.OrderType)
+	}
+	if alert.LimitPrice < 0 {
+		return fmt.Errorf("limit_price must be positive, got %v", alert.LimitPrice)
+	}
+	if alert.LimitPrice > 0 && alert.OrderType == exchange.OrderMarket {
+		return fmt.Errorf("limit_price can't be used with a market order")
+	}
+	if alert.ExpireAfter != "" {
+		if !alert.resting() {
+			return fmt.Errorf("expire_after only goes with limit_price or post-only orders")
+		}
+		if d, err := time.ParseDuration(alert.ExpireAfter); err != nil || d <= 0 {
+			return fmt.Errorf("invalid expire_after %q, expected a duration such as 30m", alert.ExpireAfter)
+		}
+	}
+
+	if _, ok := cfg.Strategy(alertStrategy(alert)); !ok {
+		return fmt.Errorf("unknown strategy %q", alert.Strategy)
+	}
+	if len(alert.Comment) > maxCommentLength {
+		return fmt.Errorf("comment is longer than %d characters", maxCommentLength)
+	}
+	return nil
+}
+
+// sized reports whether the alert says how much to trade, rather than
+// leaving it to equal-weight sizing.
+func (a Alert) sized() bool {
+	return a.Qty > 0 || a.QuoteAmount > 0 || a.PercentOfEquity > 0
+}
+
+// requestedSize converts the alert's size into the base currency. equity is
+// the value of everything held in the pair's quote currency.
+func (a Alert) requestedSize(price, equity float64) float64 {
+	switch {
+	case a.Qty > 0:
+		return a.Qty
+	case a.QuoteAmount > 0:
+		return a.QuoteAmount / price
+	case a.PercentOfEquity > 0:
+		return equity * a.PercentOfEquity / 100 / price
+	}
+	return 0
+}
+
+// resting reports whether the alert's order is left at its price rather
+// than repriced: an order at the alert's limit price or a post-only order.
+func (a Alert) resting() bool {
+	return a.OrderType == exchange.OrderPostOnly || a.LimitPrice > 0
+}
+
+// orderRequest builds the alert's order. The bot only reprices orders it
+// priced itself; market orders fill straight away, and resting orders are
+// left at their price for the alert's expire_after, or --rest-expiry, before
+// being canceled.
+func (a Alert) orderRequest(side string, size, lotSize float64, clOrdID string) (exchange.OrderRequest, exchange.ChasePolicy) {
+	req := exchange.OrderRequest{
+		Ticker:  a.Ticker,
+		Side:    side,
+		Type:    a.OrderType,
+		Size:    size,
+		LotSize: lotSize,
+		Price:   a.LimitPrice,
+		ClOrdID: clOrdID,
+	}
+	policy := chasePolicy
+	switch {
+	case a.resting():
+		policy.MaxAmends = 0
+		policy.Interval = restExpiry
+		if d, err := time.ParseDuration(a.ExpireAfter); err == nil {
+			policy.Interval = d
+		}
+	case a.OrderType == exchange.OrderMarket:
+		policy.MaxAmends = 0
+	}
+	return req, policy
+}
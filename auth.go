@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// webhookSecrets holds every secret currently accepted for /webhook. Keeping
+// more than one lets a new secret be rolled out before the old one is removed.
+var webhookSecrets [][]byte
+
+// loadWebhookSecrets reads WEBHOOK_SECRETS (comma separated) and WEBHOOK_SECRET.
+func loadWebhookSecrets() [][]byte {
+	var secrets [][]byte
+	for _, s := range strings.Split(os.Getenv("WEBHOOK_SECRETS")+","+os.Getenv("WEBHOOK_SECRET"), ",") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			secrets = append(secrets, []byte(s))
+		}
+	}
+	return secrets
+}
+
+// authenticateAlert accepts a request if either the X-Signature header holds a
+// hex HMAC-SHA256 of the body, or the alert passphrase matches a secret.
+// Every secret is compared so the time taken does not depend on which matched.
+func authenticateAlert(r *http.Request, body []byte, passphrase string) bool {
+	signature := strings.TrimPrefix(r.Header.Get("X-Signature"), "sha256=")
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		sig = nil
+	}
+
+	ok := false
+	for _, secret := range webhookSecrets {
+		if len(sig) > 0 {
+			mac := hmac.New(sha256.New, secret)
+			mac.Write(body)
+			if hmac.Equal(sig, mac.Sum(nil)) {
+				ok = true
+			}
+		}
+		if passphrase != "" && subtle.ConstantTimeCompare([]byte(passphrase), secret) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// adminToken authorizes the /admin endpoints, /alerts and /run-tests.
+// Without one they are disabled.
+var adminToken = os.Getenv("ADMIN_TOKEN")
+
+// authenticateAdmin accepts a request carrying "Authorization: Bearer <ADMIN_TOKEN>".
+func authenticateAdmin(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// trustedProxies are the networks whose forwarding headers name the caller.
+// Anyone else could set those headers to whatever they like.
+var trustedProxies []*net.IPNet
+
+// loadTrustedProxies reads TRUSTED_PROXIES, a comma separated list of
+// addresses and CIDR ranges.
+func loadTrustedProxies() ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, s := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", s)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 128
+			}
+			s = fmt.Sprintf("%s/%d", s, bits)
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", s, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	for _, network := range trustedProxies {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the caller's address. Behind a trusted proxy that is the
+// address the proxy reports: Fly-Client-IP, or the last X-Forwarded-For hop
+// that isn't itself a trusted proxy.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+	if ip := r.Header.Get("Fly-Client-IP"); ip != "" {
+		return ip
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !trustedProxy(hop) {
+			return hop
+		}
+		host = hop
+	}
+	return host
+}
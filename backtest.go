@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto_trader/backtest"
+	"crypto_trader/clock"
+	"crypto_trader/config"
+	"crypto_trader/db"
+	"crypto_trader/exchange"
+	"crypto_trader/paper"
+	"crypto_trader/risk"
+	"crypto_trader/strategy"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const backtestUsage = `Usage: crypto_trader backtest -candles FILE[,FILE...] [-signals FILE] [flags]
+
+Replays a signal file and the pairs' signal rules through the bot's alert
+processing against a paper account, with prices from the candle files and
+time from a virtual clock.
+Writes equity.csv and trades.csv to -out and prints a summary.
+
+Flags:
+`
+
+func runBacktest(args []string) int {
+	fs := flag.NewFlagSet("backtest", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, backtestUsage)
+		fs.PrintDefaults()
+	}
+	configPath := fs.String("config", "config.yaml", "path to the YAML config file")
+	candlesFlag := fs.String("candles", "", "comma-separated CSV files of OHLCV candles")
+	signalsPath := fs.String("signals", "", "CSV file of timestamped signals")
+	outDir := fs.String("out", "backtest-results", "directory to write equity.csv and trades.csv to")
+	dbPath := fs.String("db", "", "new SQLite database to keep the simulation in, a temporary one by default")
+	paperCfg := paper.Config{}
+	fs.Float64Var(&paperCfg.StartingUSDT, "usdt", 10000, "starting USDT balance")
+	fs.Float64Var(&paperCfg.TakerFee, "taker-fee", 0.001, "taker fee as a fraction of notional")
+	fs.Float64Var(&paperCfg.MakerFee, "maker-fee", 0.0008, "maker fee as a fraction of notional")
+	var from, to timeFlag
+	fs.Var(&from, "from", "replay from this time (RFC 3339 or 2006-01-02), the first candle by default")
+	fs.Var(&to, "to", "replay up to this time, the last candle by default")
+	verbose := fs.Bool("v", false, "log every alert and order, as the bot does when live")
+	exact := fs.Bool("exact-config", false, "use the config file as is, without environment overrides or defaults")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *candlesFlag == "" {
+		fs.Usage()
+		return 2
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+	fail := func(format string, args ...interface{}) int {
+		fmt.Fprintf(os.Stderr, "backtest: "+format+"\n", args...)
+		return 1
+	}
+
+	var err error
+	if *exact {
+		cfg, err = config.LoadExact(*configPath)
+	} else {
+		cfg, err = config.Load(*configPath)
+	}
+	if err != nil {
+		return fail("failed to load config: %v", err)
+	}
+	candles, err := loadBacktestCandles(strings.Split(*candlesFlag, ","))
+	if err != nil {
+		return fail("%v", err)
+	}
+	var signals []backtest.Signal
+	if *signalsPath != "" {
+		if signals, err = backtest.LoadSignals(*signalsPath); err != nil {
+			return fail("%v", err)
+		}
+	}
+	// Only pairs with history can be traded
+	var pairs []config.Pair
+	for _, pair := range cfg.Pairs {
+		if _, ok := candles[pair.Ticker]; ok {
+			pairs = append(pairs, pair)
+		} else {
+			fmt.Fprintf(os.Stderr, "backtest: no candles for %s, leaving it out\n", pair.Ticker)
+		}
+	}
+	if len(pairs) == 0 {
+		return fail("none of the configured pairs have candles")
+	}
+	cfg.Pairs = pairs
+	var rules int
+	for _, pair := range cfg.Pairs {
+		rules += len(pair.Signals)
+	}
+	if len(signals) == 0 && rules == 0 {
+		return fail("nothing to trade on, give -signals or configure signal rules")
+	}
+
+	if *dbPath == "" {
+		dir, err := os.MkdirTemp("", "backtest")
+		if err != nil {
+			return fail("%v", err)
+		}
+		defer os.RemoveAll(dir)
+		*dbPath = filepath.Join(dir, "backtest.db")
+	} else if _, err := os.Stat(*dbPath); !errors.Is(err, os.ErrNotExist) {
+		// State left by another run would carry into this one
+		return fail("%s already exists", *dbPath)
+	}
+	db.InitDB(*dbPath, cfg)
+	defer db.Close()
+
+	equity, trades, err := replay(backtest.NewMarket(candles), signals, paperCfg, from.Time, to.Time)
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	if err := os.MkdirAll(*outDir, 0o755); err != nil {
+		return fail("%v", err)
+	}
+	summary := backtest.Summarize(equity, trades)
+	for name, write := range map[string]func(io.Writer) error{
+		"equity.csv":   func(w io.Writer) error { return backtest.WriteEquity(w, equity) },
+		"trades.csv":   func(w io.Writer) error { return backtest.WriteTrades(w, trades) },
+		"summary.json": func(w io.Writer) error { return json.NewEncoder(w).Encode(summary) },
+	} {
+		if err := writeFile(filepath.Join(*outDir, name), write); err != nil {
+			return fail("%v", err)
+		}
+	}
+	summary.Write(os.Stdout)
+	return 0
+}
+
+func loadBacktestCandles(paths []string) (map[string][]exchange.Candle, error) {
+	candles := make(map[string][]exchange.Candle)
+	for _, path := range paths {
+		loaded, err := backtest.LoadCandles(strings.TrimSpace(path))
+		if err != nil {
+			return nil, err
+		}
+		for ticker, list := range loaded {
+			if _, ok := candles[ticker]; ok {
+				return nil, fmt.Errorf("candles for %s are in more than one file", ticker)
+			}
+			candles[ticker] = list
+		}
+	}
+	return candles, nil
+}
+
+// timeFlag is a flag.Value for a time given like the times in backtest
+// files.
+type timeFlag struct{ time.Time }
+
+func (f *timeFlag) String() string {
+	if f.IsZero() {
+		return ""
+	}
+	return f.Format(time.RFC3339)
+}
+
+func (f *timeFlag) Set(v string) error {
+	t, err := backtest.ParseTime(v)
+	if err != nil {
+		return err
+	}
+	f.Time = t
+	return nil
+}
+
+func writeFile(path string, write func(io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing %s: %v", path, err)
+	}
+	return f.Close()
+}
+
+// replay runs signals through the alert queue and workers' processing on a
+// virtual clock, against a paper account priced by market. At every candle
+// close it checks the pairs' signal rules and trailing stops, rebalances when
+// due and records the account's value. Stops see each candle's whole range,
+// not only its close. Only closes and signals from from up
+// to to are replayed, though rules see the candles before from; zero times
+// leave either end open. It returns the equity curve and every fill.
+func replay(market *backtest.Market, signals []backtest.Signal, paperCfg paper.Config, from, to time.Time) ([]backtest.EquityPoint, []backtest.Trade, error) {
+	var closes []time.Time
+	for _, t := range market.Closes() {
+		if !t.Before(from) && (to.IsZero() || t.Before(to)) {
+			closes = append(closes, t)
+		}
+	}
+	if len(closes) == 0 {
+		return nil, nil, fmt.Errorf("no candles to replay")
+	}
+	next := sort.Search(len(signals), func(i int) bool { return !signals[i].Time.Before(from) })
+	start := closes[0]
+	if next < len(signals) && signals[next].Time.Before(start) {
+		start = signals[next].Time
+	}
+	vclock := clock.NewVirtual(start)
+	clock.Use(vclock)
+	defer clock.Use(nil)
+
+	paperEx, err := paper.New(market, paperCfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start paper exchange: %v", err)
+	}
+	ex = &risk.Guard{Exchange: paperEx, Limits: cfg.Risk}
+	if err := loadInstruments(); err != nil {
+		return nil, nil, fmt.Errorf("failed to load instruments: %v", err)
+	}
+	engine := strategy.NewEngine(cfg.Pairs, market, queueSignal)
+
+	var equity []backtest.EquityPoint
+	var last time.Time
+	lastRebalance := closes[0]
+	for _, t := range closes {
+		for ; next < len(signals) && !signals[next].Time.After(t); next++ {
+			vclock.AdvanceTo(signals[next].Time)
+			replaySignal(signals[next])
+		}
+		now := vclock.AdvanceTo(t)
+
+		engine.Check()
+		trailInBar(market, last)
+		checkTrailingStops()
+		drainAlerts()
+		last = t
+		if cfg.Rebalance.Interval > 0 && now.Sub(lastRebalance) >= cfg.Rebalance.Interval {
+			lastRebalance = now
+			if _, err := rebalance(); err != nil {
+				log.Printf("Rebalance failed: %v", err)
+			}
+		}
+
+		// Reading positions also fills resting orders and triggers
+		// stop-losses the price has reached
+		positions, err := ex.GetPositions()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get positions at %s: %v", now.Format(time.RFC3339), err)
+		}
+		value, _ := accountValue(positions, market.Prices())
+		equity = append(equity, backtest.EquityPoint{Time: t, Equity: value})
+	}
+	if skipped := len(signals) - next; skipped > 0 && to.IsZero() {
+		fmt.Fprintf(os.Stderr, "backtest: %d signals after the last candle were not replayed\n", skipped)
+	}
+
+	orders, err := db.GetPaperOrders("filled")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get fills: %v", err)
+	}
+	var trades []backtest.Trade
+	for _, o := range orders {
+		trades = append(trades, backtest.Trade{
+			Time:   o.Timestamp,
+			Ticker: o.Ticker,
+			Side:   o.Side,
+			Size:   o.Filled,
+			Price:  o.AvgPrice,
+			Fee:    o.Fee,
+		})
+	}
+	backtest.Realize(trades, cfg.PnLMethod)
+	return equity, trades, nil
+}
+
+// trailInBar runs the trailing stops over the range of the candles that
+// closed after since, before checkTrailingStops looks at their closes. A low
+// at or under a stop sells at the stop, or at the open if the candle opened
+// under it; otherwise the high raises the stop. A stop only sees candles
+// that closed after it started.
+func trailInBar(market *backtest.Market, since time.Time) {
+	stops, err := db.GetTrailingStops()
+	if err != nil {
+		log.Printf("Error getting trailing stops: %v", err)
+		return
+	}
+	for _, t := range stops {
+		c, closed, ok := market.LastCandle(t.Ticker)
+		if !ok || !closed.After(since) || !closed.After(t.CreatedAt) {
+			continue
+		}
+		if state, err := db.GetState(t.Strategy, t.Ticker); err != nil || state.Signal != "buy" || state.Position <= 0 {
+			continue
+		}
+		if c.Low > t.StopPrice {
+			trail(t, c.High)
+			continue
+		}
+		// The sell is priced from the stop like a live one is from the last
+		// price
+		market.Override(t.Ticker, math.Min(t.StopPrice, c.Open))
+		trail(t, c.Low)
+		drainAlerts()
+		market.Override(t.Ticker, 0)
+	}
+}
+
+// replaySignal submits a signal as the alert TradingView would have sent and
+// processes it straight away.
+func replaySignal(s backtest.Signal) {
+	alert := Alert{
+		Ticker:          s.Ticker,
+		Signal:          s.Signal,
+		Strategy:        s.Strategy,
+		Qty:             s.Qty,
+		QuoteAmount:     s.QuoteAmount,
+		PercentOfEquity: s.PercentOfEquity,
+		OrderType:       s.OrderType,
+		LimitPrice:      s.LimitPrice,
+		Comment:         s.Comment,
+		// Only a row repeated exactly counts as a repeat
+		Timestamp: s.Time.Format(time.RFC3339Nano),
+	}
+	body, _ := json.Marshal(alert)
+	if _, _, err := submitAlert(alert, body); err != nil {
+		log.Printf("Signal at %s rejected: %v", s.Time.Format(time.RFC3339), err)
+		return
+	}
+	drainAlerts()
+}
+
+// drainAlerts processes every queued alert, as the workers would.
+func drainAlerts() {
+	for {
+		record, ok, err := db.ClaimAlert()
+		if err != nil {
+			log.Printf("Error claiming alert: %v", err)
+		}
+		if !ok {
+			return
+		}
+		runAlert(record)
+	}
+}
@@ -0,0 +1,150 @@
+package backtest
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// curve makes an hourly equity curve from start.
+func curve(values ...float64) []EquityPoint {
+	equity := make([]EquityPoint, len(values))
+	for i, v := range values {
+		equity[i] = EquityPoint{Time: start.Add(time.Duration(i) * time.Hour), Equity: v}
+	}
+	return equity
+}
+
+func TestSummarize(t *testing.T) {
+	trades := []Trade{
+		{Side: "buy", Fee: 1},
+		{Side: "sell", Fee: 1, PnL: 5},
+		{Side: "buy", Fee: 0.5},
+		{Side: "sell", Fee: 0.5, PnL: -2},
+	}
+	s := Summarize(curve(100, 120, 90, 110), trades)
+	if s.StartEquity != 100 || s.EndEquity != 110 || math.Abs(s.Return-0.1) > 1e-12 {
+		t.Errorf("unexpected equity and return: %+v", s)
+	}
+	if math.Abs(s.MaxDrawdown-0.25) > 1e-12 {
+		t.Errorf("expected the fall from 120 to 90 as the drawdown, got %v", s.MaxDrawdown)
+	}
+	if s.Trades != 4 || s.Buys != 2 || s.Sells != 2 || s.Wins != 1 || s.Fees != 3 {
+		t.Errorf("unexpected trade counts: %+v", s)
+	}
+	if !s.Start.Equal(start) || !s.End.Equal(start.Add(3*time.Hour)) {
+		t.Errorf("unexpected period %s to %s", s.Start, s.End)
+	}
+
+	year := []EquityPoint{{Time: start, Equity: 100}, {Time: start.Add(2 * hoursPerYear * time.Hour), Equity: 121}}
+	if s := Summarize(year, nil); math.Abs(s.CAGR-0.1) > 1e-9 {
+		t.Errorf("expected 21%% over two years to be 10%% a year, got %v", s.CAGR)
+	}
+	// Doubling in an hour compounds past what a float can hold
+	if s := Summarize(curve(100, 200), nil); s.CAGR != 0 || s.Return != 1 {
+		t.Errorf("expected an overflowing CAGR to be 0, got %+v", s)
+	}
+	if s := Summarize(nil, nil); s != (Summary{}) {
+		t.Errorf("expected an empty summary without equity, got %+v", s)
+	}
+}
+
+func TestSharpe(t *testing.T) {
+	if got := sharpe(curve(100, 101)); got != 0 {
+		t.Errorf("expected 0 with a single return, got %v", got)
+	}
+	if got := sharpe(curve(100, 200, 400)); got != 0 {
+		t.Errorf("expected 0 for returns without deviation, got %v", got)
+	}
+	// Returns of +10% and -10% average 0
+	if got := sharpe(curve(100, 110, 99)); math.Abs(got) > 1e-9 {
+		t.Errorf("expected 0 for a zero mean return, got %v", got)
+	}
+	// Returns 0.02 and 0.04 an hour apart: mean 0.03, sample deviation
+	// 0.01 * √2
+	got := sharpe(curve(100, 102, 106.08))
+	if want := 3 / math.Sqrt2 * math.Sqrt(hoursPerYear); math.Abs(got-want) > 1e-6 {
+		t.Errorf("sharpe = %v, want %v", got, want)
+	}
+	daily := []EquityPoint{{start, 100}, {start.Add(24 * time.Hour), 102}, {start.Add(48 * time.Hour), 106.08}}
+	if got, want := sharpe(daily), 3/math.Sqrt2*math.Sqrt(365); math.Abs(got-want) > 1e-6 {
+		t.Errorf("daily sharpe = %v, want %v", got, want)
+	}
+}
+
+func TestEquityRoundTrip(t *testing.T) {
+	equity := curve(1000, 1012.5, 998.25)
+	var buf bytes.Buffer
+	if err := WriteEquity(&buf, equity); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadEquity(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(equity) {
+		t.Fatalf("expected %d points, got %+v", len(equity), got)
+	}
+	for i := range equity {
+		if !got[i].Time.Equal(equity[i].Time) || got[i].Equity != equity[i].Equity {
+			t.Errorf("point %d: got %+v, want %+v", i, got[i], equity[i])
+		}
+	}
+
+	if _, err := ReadEquity(bytes.NewBufferString("time,equity\nyesterday,100\n")); err == nil {
+		t.Error("expected an error for an invalid time")
+	}
+}
+
+func TestLoadCandles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// Named after the pair, out of order, with Unix and date-time times
+	candles, err := LoadCandles(write("trxusdt.csv", `Time,Open,High,Low,Close,Volume
+1704070800,0.21,0.22,0.2,0.215,500
+2024-01-01 00:00,0.2,0.21,0.19,0.205,1000
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	trx := candles["TRXUSDT"]
+	if len(candles) != 1 || len(trx) != 2 {
+		t.Fatalf("expected two TRXUSDT candles, got %+v", candles)
+	}
+	if !trx[0].Time.Equal(start) || trx[0].Close != 0.205 || trx[0].Volume != 1000 || !trx[1].Time.Equal(start.Add(time.Hour)) || trx[1].Low != 0.2 {
+		t.Errorf("expected the candles oldest first, got %+v", trx)
+	}
+
+	// A ticker column splits one file into pairs
+	candles, err = LoadCandles(write("all.csv", `timestamp,ticker,open,high,low,close
+1704067200000,btcusdt,60000,61000,59000,60500
+1704067200000,TRXUSDT,0.2,0.21,0.19,0.205
+`))
+	if err != nil || len(candles["BTCUSDT"]) != 1 || len(candles["TRXUSDT"]) != 1 || !candles["BTCUSDT"][0].Time.Equal(start) {
+		t.Errorf("expected one candle for each pair, got %+v (%v)", candles, err)
+	}
+
+	for name, content := range map[string]string{
+		"no close":       "time,open,high,low\n2024-01-01,1,1,1\n",
+		"bad price":      "time,open,high,low,close\n2024-01-01,1,x,1,1\n",
+		"zero close":     "time,open,high,low,close\n2024-01-01,1,1,1,0\n",
+		"bad time":       "time,open,high,low,close\nsoon,1,1,1,1\n",
+		"no time column": "open,high,low,close\n1,1,1,1\n",
+	} {
+		if _, err := LoadCandles(write("BAD.csv", content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
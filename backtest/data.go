@@ -0,0 +1,199 @@
+// Package backtest loads the history a backtest replays and reports how it
+// went. The replay itself drives the bot's own alert processing against the
+// paper exchange, with Market standing in for live prices and the clock
+// package's virtual clock standing in for time.
+package backtest
+
+import (
+	"crypto_trader/exchange"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signal is one row of a signal file: what an alert would have said, and
+// when.
+type Signal struct {
+	Time            time.Time
+	Ticker          string
+	Signal          string
+	Strategy        string
+	Qty             float64
+	QuoteAmount     float64
+	PercentOfEquity float64
+	OrderType       string
+	LimitPrice      float64
+	Comment         string
+}
+
+// csvTable reads a CSV file with a header row and returns its rows along
+// with a lookup from lower-cased column name to index.
+func csvTable(path string) ([][]string, map[string]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, nil, fmt.Errorf("%s is empty", path)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	return rows, columns, nil
+}
+
+// column returns the index of the first of names present in columns.
+func column(columns map[string]int, names ...string) (int, bool) {
+	for _, name := range names {
+		if i, ok := columns[name]; ok {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// ParseTime reads a time as Unix seconds or milliseconds, RFC 3339, or a
+// UTC date with an optional time of day.
+func ParseTime(v string) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		// Milliseconds since the epoch run to 13 digits
+		if n > 1e11 {
+			return time.UnixMilli(n).UTC(), nil
+		}
+		return time.Unix(n, 0).UTC(), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised time %q", v)
+}
+
+// LoadCandles reads OHLCV candles from a CSV file with time, open, high, low
+// and close columns and an optional volume. Times are when each candle
+// opened. A ticker column lets one file hold several pairs; without one the
+// file is named after its pair, e.g. BTCUSDT.csv.
+func LoadCandles(path string) (map[string][]exchange.Candle, error) {
+	rows, columns, err := csvTable(path)
+	if err != nil {
+		return nil, err
+	}
+	timeCol, ok := column(columns, "time", "timestamp", "ts", "date")
+	if !ok {
+		return nil, fmt.Errorf("%s has no time column", path)
+	}
+	var ohlc [4]int
+	for i, name := range []string{"open", "high", "low", "close"} {
+		if ohlc[i], ok = column(columns, name); !ok {
+			return nil, fmt.Errorf("%s has no %s column", path, name)
+		}
+	}
+	volumeCol, hasVolume := column(columns, "volume", "vol")
+	tickerCol, hasTicker := column(columns, "ticker", "symbol")
+	fileTicker := strings.ToUpper(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+
+	candles := make(map[string][]exchange.Candle)
+	for n, row := range rows {
+		line := n + 2
+		t, err := ParseTime(row[timeCol])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		c := exchange.Candle{Time: t}
+		for i, field := range []*float64{&c.Open, &c.High, &c.Low, &c.Close} {
+			if *field, err = strconv.ParseFloat(strings.TrimSpace(row[ohlc[i]]), 64); err != nil {
+				return nil, fmt.Errorf("%s line %d: invalid price %q", path, line, row[ohlc[i]])
+			}
+		}
+		if c.Close <= 0 {
+			return nil, fmt.Errorf("%s line %d: close must be positive", path, line)
+		}
+		if hasVolume {
+			c.Volume, _ = strconv.ParseFloat(strings.TrimSpace(row[volumeCol]), 64)
+		}
+		ticker := fileTicker
+		if hasTicker {
+			ticker = strings.ToUpper(strings.TrimSpace(row[tickerCol]))
+		}
+		candles[ticker] = append(candles[ticker], c)
+	}
+	for _, list := range candles {
+		sort.SliceStable(list, func(i, j int) bool { return list[i].Time.Before(list[j].Time) })
+	}
+	return candles, nil
+}
+
+// LoadSignals reads a CSV signal file with time, ticker and signal columns,
+// oldest first. The optional strategy, qty, quote_amount,
+// percent_of_equity, order_type, limit_price and comment columns are passed
+// on like the alert fields of the same name.
+func LoadSignals(path string) ([]Signal, error) {
+	rows, columns, err := csvTable(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"time", "ticker", "signal"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("%s has no %s column", path, name)
+		}
+	}
+	field := func(row []string, name string) string {
+		if i, ok := columns[name]; ok {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	var signals []Signal
+	for n, row := range rows {
+		line := n + 2
+		t, err := ParseTime(field(row, "time"))
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		s := Signal{
+			Time:      t,
+			Ticker:    strings.ToUpper(field(row, "ticker")),
+			Signal:    strings.ToLower(field(row, "signal")),
+			Strategy:  field(row, "strategy"),
+			OrderType: field(row, "order_type"),
+			Comment:   field(row, "comment"),
+		}
+		for name, dest := range map[string]*float64{
+			"qty":               &s.Qty,
+			"quote_amount":      &s.QuoteAmount,
+			"percent_of_equity": &s.PercentOfEquity,
+			"limit_price":       &s.LimitPrice,
+		} {
+			if v := field(row, name); v != "" {
+				if *dest, err = strconv.ParseFloat(v, 64); err != nil {
+					return nil, fmt.Errorf("%s line %d: invalid %s %q", path, line, name, v)
+				}
+			}
+		}
+		signals = append(signals, s)
+	}
+	sort.SliceStable(signals, func(i, j int) bool { return signals[i].Time.Before(signals[j].Time) })
+	return signals, nil
+}
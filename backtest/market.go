@@ -0,0 +1,138 @@
+package backtest
+
+import (
+	"crypto_trader/clock"
+	"crypto_trader/exchange"
+	"crypto_trader/paper"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Market replays candles as a paper.CandleMarket. A pair's price is the
+// close of its last candle to have closed by the clock's time, so the replay
+// never sees a price before it happened.
+type Market struct {
+	candles map[string][]exchange.Candle // ticker -> oldest first
+	bars    map[string]time.Duration
+
+	mu sync.Mutex
+	// overrides stand in for the close while an order fills inside a candle
+	overrides map[string]float64
+}
+
+var _ paper.CandleMarket = (*Market)(nil)
+
+func NewMarket(candles map[string][]exchange.Candle) *Market {
+	m := &Market{candles: candles, bars: make(map[string]time.Duration), overrides: make(map[string]float64)}
+	for ticker, list := range candles {
+		m.bars[ticker] = barSize(list)
+	}
+	return m
+}
+
+// barSize is the shortest gap between candles, which gaps in the data
+// can't inflate.
+func barSize(candles []exchange.Candle) time.Duration {
+	var bar time.Duration
+	for i := 1; i < len(candles); i++ {
+		if d := candles[i].Time.Sub(candles[i-1].Time); d > 0 && (bar == 0 || d < bar) {
+			bar = d
+		}
+	}
+	return bar
+}
+
+// closed returns ticker's candles that have closed by now.
+func (m *Market) closed(ticker string) []exchange.Candle {
+	list := m.candles[ticker]
+	now := clock.Now()
+	n := sort.Search(len(list), func(i int) bool {
+		return list[i].Time.Add(m.bars[ticker]).After(now)
+	})
+	return list[:n]
+}
+
+func (m *Market) GetPrice(ticker string) (float64, error) {
+	if _, ok := m.candles[ticker]; !ok {
+		return 0, fmt.Errorf("no candles for %s", ticker)
+	}
+	m.mu.Lock()
+	price, ok := m.overrides[ticker]
+	m.mu.Unlock()
+	if ok {
+		return price, nil
+	}
+	closed := m.closed(ticker)
+	if len(closed) == 0 {
+		return 0, fmt.Errorf("no %s candle has closed by %s", ticker, clock.Now().Format(time.RFC3339))
+	}
+	return closed[len(closed)-1].Close, nil
+}
+
+// LastCandle returns ticker's last closed candle and when it closed.
+func (m *Market) LastCandle(ticker string) (exchange.Candle, time.Time, bool) {
+	closed := m.closed(ticker)
+	if len(closed) == 0 {
+		return exchange.Candle{}, time.Time{}, false
+	}
+	c := closed[len(closed)-1]
+	return c, c.Time.Add(m.bars[ticker]), true
+}
+
+// Override makes price ticker's price until it is called again with 0, so
+// an order can fill at a price the candle passed through rather than at its
+// close.
+func (m *Market) Override(ticker string, price float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if price > 0 {
+		m.overrides[ticker] = price
+	} else {
+		delete(m.overrides, ticker)
+	}
+}
+
+// GetCandles serves the loaded candles whatever bar is asked for, since
+// they are the only history there is.
+func (m *Market) GetCandles(ticker, bar string, limit int) ([]exchange.Candle, error) {
+	closed := m.closed(ticker)
+	if limit > 0 && len(closed) > limit {
+		closed = closed[len(closed)-limit:]
+	}
+	return append([]exchange.Candle(nil), closed...), nil
+}
+
+// GetInstruments lists nothing, so pairs use the lot sizes in the config.
+func (m *Market) GetInstruments() ([]exchange.Instrument, error) {
+	return nil, nil
+}
+
+// Closes returns the time every candle closes, across all pairs, in order.
+func (m *Market) Closes() []time.Time {
+	seen := make(map[time.Time]bool)
+	var times []time.Time
+	for ticker, list := range m.candles {
+		for _, c := range list {
+			t := c.Time.Add(m.bars[ticker])
+			if !seen[t] {
+				seen[t] = true
+				times = append(times, t)
+			}
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return times
+}
+
+// Prices returns the current price of every pair with a closed candle.
+func (m *Market) Prices() map[string]float64 {
+	prices := make(map[string]float64)
+	for ticker := range m.candles {
+		if price, err := m.GetPrice(ticker); err == nil {
+			prices[ticker] = price
+		}
+	}
+	return prices
+}
@@ -0,0 +1,217 @@
+package backtest
+
+import (
+	"crypto_trader/indicator"
+	"crypto_trader/pnl"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// EquityPoint is the account's USDT value at a candle close.
+type EquityPoint struct {
+	Time   time.Time
+	Equity float64
+}
+
+// Trade is a fill on the simulated exchange. Fee and PnL are in the pair's
+// quote currency.
+type Trade struct {
+	Time   time.Time
+	Ticker string
+	Side   string
+	Size   float64
+	Price  float64
+	Fee    float64
+	// PnL is what a sell realized against the cost of the lots it sold,
+	// net of fees; 0 for buys
+	PnL float64
+}
+
+// Realize sets the PnL of every sell from the lots of the buys before it,
+// matched by a pnl method.
+func Realize(trades []Trade, method string) {
+	books := make(map[string]*pnl.Book)
+	for i := range trades {
+		t := &trades[i]
+		book, ok := books[t.Ticker]
+		if !ok {
+			book = pnl.NewBook(method)
+			books[t.Ticker] = book
+		}
+		if t.Side == "buy" {
+			book.Buy(t.Time, t.Size, t.Price, t.Fee)
+		} else {
+			t.PnL = book.Sell(t.Size, t.Price, t.Fee)
+		}
+	}
+}
+
+type Summary struct {
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	StartEquity float64   `json:"start_equity"`
+	EndEquity   float64   `json:"end_equity"`
+	Return      float64   `json:"return"` // fraction of the starting equity
+	CAGR        float64   `json:"cagr"`   // Return as a yearly rate, compounded; 0 if it overflows
+	// Sharpe is the mean return between equity points over its standard
+	// deviation, annualized, with no risk-free rate
+	Sharpe      float64 `json:"sharpe"`
+	MaxDrawdown float64 `json:"max_drawdown"` // largest fall from a peak, as a fraction of the peak
+	Trades      int     `json:"trades"`
+	Buys        int     `json:"buys"`
+	Sells       int     `json:"sells"`
+	Wins        int     `json:"wins"` // sells with a positive PnL
+	Fees        float64 `json:"fees"`
+}
+
+const hoursPerYear = 365 * 24
+
+// sharpe annualizes the Sharpe ratio of the returns between equity points
+// by how many of the typical interval between them fit in a year.
+func sharpe(equity []EquityPoint) float64 {
+	if len(equity) < 3 {
+		return 0
+	}
+	values := make([]float64, len(equity))
+	intervals := make([]float64, 0, len(equity)-1)
+	for i, p := range equity {
+		values[i] = p.Equity
+		if i > 0 {
+			intervals = append(intervals, p.Time.Sub(equity[i-1].Time).Hours())
+		}
+	}
+	returns := indicator.Returns(values)
+	dev := indicator.StdDev(returns, len(returns))
+	sort.Float64s(intervals)
+	interval := intervals[len(intervals)/2]
+	if dev == 0 || interval <= 0 {
+		return 0
+	}
+	var mean float64
+	for _, r := range returns {
+		mean += r
+	}
+	mean /= float64(len(returns))
+	return mean / dev * math.Sqrt(hoursPerYear/interval)
+}
+
+func Summarize(equity []EquityPoint, trades []Trade) Summary {
+	var s Summary
+	if len(equity) > 0 {
+		s.Start, s.StartEquity = equity[0].Time, equity[0].Equity
+		last := equity[len(equity)-1]
+		s.End, s.EndEquity = last.Time, last.Equity
+		if s.StartEquity > 0 {
+			s.Return = s.EndEquity/s.StartEquity - 1
+			if years := s.End.Sub(s.Start).Hours() / hoursPerYear; years > 0 && s.EndEquity > 0 {
+				s.CAGR = math.Pow(s.EndEquity/s.StartEquity, 1/years) - 1
+				// Compounding a few hours into a year can overflow
+				if math.IsInf(s.CAGR, 0) {
+					s.CAGR = 0
+				}
+			}
+		}
+		s.Sharpe = sharpe(equity)
+	}
+	var peak float64
+	for _, p := range equity {
+		peak = max(peak, p.Equity)
+		if peak > 0 {
+			s.MaxDrawdown = max(s.MaxDrawdown, 1-p.Equity/peak)
+		}
+	}
+	for _, t := range trades {
+		s.Trades++
+		s.Fees += t.Fee
+		if t.Side == "buy" {
+			s.Buys++
+			continue
+		}
+		s.Sells++
+		if t.PnL > 0 {
+			s.Wins++
+		}
+	}
+	return s
+}
+
+func (s Summary) Write(w io.Writer) error {
+	winRate := 0.0
+	if s.Sells > 0 {
+		winRate = float64(s.Wins) / float64(s.Sells)
+	}
+	_, err := fmt.Fprintf(w, `Period:        %s to %s
+Start equity:  %.2f USDT
+End equity:    %.2f USDT
+Return:        %.2f%%
+CAGR:          %.2f%%
+Sharpe:        %.2f
+Max drawdown:  %.2f%%
+Trades:        %d (%d buys, %d sells)
+Winning sells: %d (%.1f%%)
+Fees:          %.4f
+`,
+		s.Start.Format(time.RFC3339), s.End.Format(time.RFC3339),
+		s.StartEquity, s.EndEquity, s.Return*100, s.CAGR*100, s.Sharpe, s.MaxDrawdown*100,
+		s.Trades, s.Buys, s.Sells, s.Wins, winRate*100, s.Fees)
+	return err
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func WriteEquity(w io.Writer, equity []EquityPoint) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "equity"})
+	for _, p := range equity {
+		cw.Write([]string{p.Time.Format(time.RFC3339), formatFloat(p.Equity)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ReadEquity reads an equity curve written by WriteEquity.
+func ReadEquity(r io.Reader) ([]EquityPoint, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var equity []EquityPoint
+	for i, row := range rows {
+		if i == 0 {
+			continue
+		}
+		if len(row) != 2 {
+			return nil, fmt.Errorf("line %d: expected time and equity", i+1)
+		}
+		t, err := time.Parse(time.RFC3339, row[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		v, err := strconv.ParseFloat(row[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		equity = append(equity, EquityPoint{Time: t, Equity: v})
+	}
+	return equity, nil
+}
+
+func WriteTrades(w io.Writer, trades []Trade) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "ticker", "side", "size", "price", "fee", "pnl"})
+	for _, t := range trades {
+		cw.Write([]string{
+			t.Time.Format(time.RFC3339), t.Ticker, t.Side,
+			formatFloat(t.Size), formatFloat(t.Price), formatFloat(t.Fee), formatFloat(t.PnL),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
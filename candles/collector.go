@@ -0,0 +1,183 @@
+// Package candles keeps the candle history of the configured pairs in the
+// database: it backfills each pair and bar size, follows the latest closed
+// candles and repairs gaps the stored history has.
+package candles
+
+import (
+	"crypto_trader/clock"
+	"crypto_trader/config"
+	"crypto_trader/db"
+	"crypto_trader/exchange"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// pageSize is the most candles OKX returns from history-candles at once.
+const pageSize = 100
+
+// Source pages back through a pair's candle history.
+type Source interface {
+	GetHistoryCandles(ticker, bar string, end time.Time, limit int) ([]exchange.Candle, error)
+}
+
+// Collector syncs the history of every pair in Tickers at every bar size in
+// Bars into the candles table.
+type Collector struct {
+	Source   Source
+	Tickers  []string
+	Bars     []string
+	Backfill time.Duration
+	// Pause between requests, which keeps a long backfill inside OKX's rate
+	// limit for history-candles
+	Pause time.Duration
+
+	mu sync.Mutex
+	// unfillable are gaps, and history before the first stored candle, the
+	// exchange has no candles for, so they aren't asked for on every sync
+	unfillable map[string]bool
+}
+
+func New(source Source, cfg *config.Config) *Collector {
+	return &Collector{
+		Source:     source,
+		Tickers:    cfg.Tickers(),
+		Bars:       cfg.Candles.Bars,
+		Backfill:   cfg.Candles.Backfill,
+		Pause:      110 * time.Millisecond,
+		unfillable: make(map[string]bool),
+	}
+}
+
+// Sync brings every pair and bar size up to date. A failure for one doesn't
+// stop the others; it is retried on the next sync.
+func (c *Collector) Sync() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, ticker := range c.Tickers {
+		for _, bar := range c.Bars {
+			if err := c.sync(ticker, bar); err != nil {
+				log.Printf("Error syncing %s %s candles: %v", ticker, bar, err)
+			}
+		}
+	}
+}
+
+// sync fetches the candles that closed since the last stored one, extends
+// the history back to the backfill horizon and repairs gaps, in that order,
+// so a newly closed candle is never behind a long backfill.
+func (c *Collector) sync(ticker, bar string) error {
+	step, ok := config.BarDuration(bar)
+	if !ok {
+		return fmt.Errorf("unknown bar %q", bar)
+	}
+	horizon := clock.Now().Add(-c.Backfill)
+	first, last, ok, err := db.CandleRange(ticker, bar)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		n, err := c.fetch(ticker, bar, step, time.Time{}, horizon)
+		if err == nil {
+			log.Printf("Backfilled %d %s %s candles", n, ticker, bar)
+		}
+		return err
+	}
+
+	if _, err := c.fetch(ticker, bar, step, time.Time{}, last); err != nil {
+		return err
+	}
+	// The horizon moves on with time, or further back if backfill is raised
+	key := fmt.Sprintf("before/%s/%s/%d", ticker, bar, first.UnixMilli())
+	if first.After(horizon) && !c.unfillable[key] {
+		n, err := c.fetch(ticker, bar, step, first, horizon)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Printf("Backfilled %d %s %s candles before %s", n, ticker, bar, first.Format(time.RFC3339))
+		} else {
+			// The pair's history starts here
+			c.unfillable[key] = true
+		}
+	}
+
+	gaps, err := db.CandleGaps(ticker, bar, step)
+	if err != nil {
+		return err
+	}
+	for _, gap := range gaps {
+		key := fmt.Sprintf("gap/%s/%s/%d", ticker, bar, gap.From.UnixMilli())
+		if c.unfillable[key] {
+			continue
+		}
+		n, err := c.fetch(ticker, bar, step, gap.To, gap.From)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			log.Printf("No %s %s candles between %s and %s, leaving the gap", ticker, bar, gap.From.Format(time.RFC3339), gap.To.Format(time.RFC3339))
+			c.unfillable[key] = true
+			continue
+		}
+		log.Printf("Repaired gap in %s %s candles after %s with %d candles", ticker, bar, gap.From.Format(time.RFC3339), n)
+	}
+	return nil
+}
+
+// fetch pages back from end, or from the latest candle if end is zero, and
+// stores the closed candles that opened after stop. It returns how many it
+// stored.
+func (c *Collector) fetch(ticker, bar string, step time.Duration, end, stop time.Time) (int, error) {
+	var stored int
+	for {
+		candles, err := c.Source.GetHistoryCandles(ticker, bar, end, pageSize)
+		if err != nil {
+			return stored, err
+		}
+		if len(candles) == 0 {
+			return stored, nil
+		}
+		oldest := candles[0].Time
+
+		now := clock.Now()
+		var keep []exchange.Candle
+		for _, candle := range candles {
+			if candle.Time.After(stop) && !candle.Time.Add(step).After(now) {
+				keep = append(keep, candle)
+			}
+		}
+		if err := db.SaveCandles(ticker, bar, keep); err != nil {
+			return stored, err
+		}
+		stored += len(keep)
+		// A page that doesn't reach further back would be fetched forever
+		if !oldest.After(stop) || (!end.IsZero() && !oldest.Before(end)) {
+			return stored, nil
+		}
+		end = oldest
+		clock.Sleep(c.Pause)
+	}
+}
+
+// Start syncs now and then every interval until the returned function is
+// called.
+func (c *Collector) Start(interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	stop := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		c.Sync()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				c.Sync()
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
@@ -0,0 +1,67 @@
+package candles
+
+import (
+	"crypto_trader/clock"
+	"crypto_trader/config"
+	"crypto_trader/db"
+	"crypto_trader/exchange"
+	"crypto_trader/okxfake"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func hourly(from, to int) []exchange.Candle {
+	var candles []exchange.Candle
+	for i := from; i < to; i++ {
+		p := float64(100 + i)
+		candles = append(candles, exchange.Candle{Time: start.Add(time.Duration(i) * time.Hour), Open: p, High: p + 1, Low: p - 1, Close: p, Volume: 1})
+	}
+	return candles
+}
+
+func TestSyncBackfillsFollowsAndRepairsGaps(t *testing.T) {
+	cfg := config.Default()
+	cfg.Pairs = []config.Pair{{Ticker: "BTCUSDT"}}
+	cfg.Candles = config.Candles{Bars: []string{"1H"}, Backfill: 100 * time.Hour}
+	db.InitDB(filepath.Join(t.TempDir(), "candles.db"), cfg)
+	t.Cleanup(db.Close)
+
+	vclock := clock.NewVirtual(start.Add(250 * time.Hour))
+	clock.Use(vclock)
+	t.Cleanup(func() { clock.Use(nil) })
+
+	fake := okxfake.New()
+	t.Cleanup(fake.Close)
+	fake.SetCandles("BTC-USDT", "1H", hourly(0, 300))
+
+	// Stored history from an earlier run, with hours 170-179 missing
+	if err := db.SaveCandles("BTCUSDT", "1H", append(hourly(160, 170), hourly(180, 190)...)); err != nil {
+		t.Fatal(err)
+	}
+	collector := New(fake.Client(), cfg)
+	collector.Pause = 0
+	collector.Sync()
+
+	// Back to the 100h horizon, up to the last closed candle
+	stored, err := db.GetCandles("BTCUSDT", "1H", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 99 || !stored[0].Time.Equal(start.Add(151*time.Hour)) || !stored[98].Time.Equal(start.Add(249*time.Hour)) {
+		t.Fatalf("expected the candles opened from 151h to 249h, got %d from %v to %v", len(stored), stored[0].Time, stored[len(stored)-1].Time)
+	}
+	if gaps, err := db.CandleGaps("BTCUSDT", "1H", time.Hour); err != nil || len(gaps) != 0 {
+		t.Errorf("expected the gap to be repaired, got %+v (%v)", gaps, err)
+	}
+
+	// Once the next candle closes it is added
+	vclock.AdvanceTo(start.Add(251 * time.Hour))
+	collector.Sync()
+	stored, err = db.GetCandles("BTCUSDT", "1H", start.Add(250*time.Hour), start.Add(260*time.Hour))
+	if err != nil || len(stored) != 1 || stored[0].Close != 350 {
+		t.Errorf("expected the candle opened at 250h, got %+v (%v)", stored, err)
+	}
+}
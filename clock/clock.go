@@ -0,0 +1,99 @@
+// Package clock is the time source for everything the bot records or waits
+// on while trading, so a backtest can replay history on a virtual clock. It
+// reads the system clock unless Use installs another.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type system struct{}
+
+func (system) Now() time.Time        { return time.Now() }
+func (system) Sleep(d time.Duration) { time.Sleep(d) }
+
+var (
+	mu      sync.RWMutex
+	current Clock = system{}
+)
+
+// Use makes c the clock for the whole process, nil meaning the system clock.
+func Use(c Clock) {
+	mu.Lock()
+	defer mu.Unlock()
+	if c == nil {
+		c = system{}
+	}
+	current = c
+}
+
+func get() Clock {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+func Now() time.Time {
+	return get().Now()
+}
+
+func Sleep(d time.Duration) {
+	get().Sleep(d)
+}
+
+// Throttle waits d on the system clock, to keep inside a real API's rate
+// limit. Simulated time has no API to spare, so on any other clock it
+// returns at once without moving time on.
+func Throttle(d time.Duration) {
+	if _, ok := get().(system); ok {
+		time.Sleep(d)
+	}
+}
+
+func Since(t time.Time) time.Duration {
+	return Now().Sub(t)
+}
+
+// Virtual is a clock that only moves when told to. Sleeping on it moves it
+// forward instead of waiting, so code that polls for something runs through
+// simulated time at full speed.
+type Virtual struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewVirtual(start time.Time) *Virtual {
+	return &Virtual{now: start}
+}
+
+func (v *Virtual) Now() time.Time {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.now
+}
+
+func (v *Virtual) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.now = v.now.Add(d)
+}
+
+// AdvanceTo moves the clock to t, or leaves it where it is if sleeping has
+// already taken it past t. It returns the new time.
+func (v *Virtual) AdvanceTo(t time.Time) time.Time {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if t.After(v.now) {
+		v.now = t
+	}
+	return v.now
+}
@@ -0,0 +1,695 @@
+// Package config holds the settings shared by every part of the bot. They
+// come from a YAML file, with environment variables taking precedence so a
+// deployment can be adjusted without rebuilding the image.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Pairs      []Pair     `yaml:"pairs"`
+	Strategies []Strategy `yaml:"strategies"`
+	// Sizing and Protection are used for pairs and strategies that don't set
+	// their own
+	Sizing     *Sizing     `yaml:"sizing"`
+	Protection *Protection `yaml:"protection"`
+	// Workers is how many alerts are processed at once, at most one per ticker
+	Workers int `yaml:"workers"`
+	// DedupeWindow is how long a repeated alert is answered with the result
+	// of the first one instead of being processed again
+	DedupeWindow time.Duration `yaml:"dedupe_window"`
+	Rebalance    Rebalance     `yaml:"rebalance"`
+	Risk         Risk          `yaml:"risk"`
+	// TrailingInterval is how often trailing stops are checked against the
+	// latest prices
+	TrailingInterval time.Duration `yaml:"trailing_interval"`
+	Candles          Candles       `yaml:"candles"`
+	// PnLMethod matches sells to buys for the dashboard's profit figures
+	PnLMethod string `yaml:"pnl_method"`
+}
+
+// PnL methods.
+const (
+	PnLFIFO        = "fifo"
+	PnLAverageCost = "average_cost"
+)
+
+// Used when the config doesn't set them.
+const (
+	DefaultWorkers            = 4
+	DefaultDedupeWindow       = 10 * time.Minute
+	DefaultRebalanceThreshold = 0.05
+	DefaultTrailingInterval   = 10 * time.Second
+	DefaultCandleBackfill     = 30 * 24 * time.Hour
+	DefaultCandleInterval     = time.Minute
+)
+
+// Rebalance controls how positions are traded back to their target weights.
+type Rebalance struct {
+	// Interval between scheduled rebalances; 0 only rebalances on request
+	Interval time.Duration `yaml:"interval"`
+	// Threshold is how far a pair's weight may drift from its target, as a
+	// fraction of equity, before it is traded
+	Threshold float64 `yaml:"threshold"`
+}
+
+// Candles are the bar sizes whose history is kept in the database for every
+// pair. Without any bars nothing is collected.
+type Candles struct {
+	Bars []string `yaml:"bars"`
+	// Backfill is how far back history is fetched
+	Backfill time.Duration `yaml:"backfill"`
+	// Interval between syncs of the latest candles
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Risk limits every order is checked against before it is placed. A limit
+// left at 0 is not enforced. Amounts are in USDT.
+type Risk struct {
+	// MaxPairNotional caps what a buy may bring one pair's holdings to
+	MaxPairNotional float64 `yaml:"max_pair_notional"`
+	// MaxExposure caps what a buy may bring all crypto holdings to
+	MaxExposure      float64 `yaml:"max_exposure"`
+	MaxOrdersPerHour int     `yaml:"max_orders_per_hour"`
+	// MaxOpenPairs stops buys of a pair not already held once this many are
+	MaxOpenPairs int `yaml:"max_open_pairs"`
+	// MaxDailyLoss stops buys once the account has lost this much since
+	// the start of the UTC day, realized or not
+	MaxDailyLoss float64 `yaml:"max_daily_loss"`
+	// AutoHalt stops buys, by turning on close-only, when the daily loss
+	// limit is hit
+	AutoHalt bool `yaml:"auto_halt"`
+}
+
+// Pair is a tradable ticker plus any settings that differ from the defaults.
+type Pair struct {
+	Ticker string `yaml:"ticker"`
+	// Base and Quote are only needed when OKX doesn't list the pair and the
+	// ticker doesn't end in a known quote currency
+	Base  string `yaml:"base"`
+	Quote string `yaml:"quote"`
+	// LotSize is used when OKX doesn't report a valid lot size for the pair
+	LotSize    float64     `yaml:"lot_size"`
+	Sizing     *Sizing     `yaml:"sizing"`
+	Protection *Protection `yaml:"protection"`
+	// Signals are indicator rules the bot trades the pair on itself, as if
+	// their signals had come in as alerts
+	Signals []SignalRule `yaml:"signals"`
+}
+
+var strategyName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// DefaultStrategy trades alerts that don't name a strategy. It is always
+// available, with no budget unless the config gives it one.
+const DefaultStrategy = "default"
+
+// Strategy is a sub-portfolio of the account with its own signals and
+// positions. Budget caps what it may spend, in USDT; 0 means it may spend
+// whatever the strategies with a budget haven't set aside.
+type Strategy struct {
+	Name       string      `yaml:"name"`
+	Budget     float64     `yaml:"budget"`
+	Sizing     *Sizing     `yaml:"sizing"`
+	Protection *Protection `yaml:"protection"`
+}
+
+// Sizing methods.
+const (
+	SizingEqualWeight   = "equal_weight"
+	SizingFixedQuote    = "fixed_quote"
+	SizingFixedFraction = "fixed_fraction"
+	SizingVolTarget     = "vol_target"
+	SizingKelly         = "kelly"
+)
+
+// Sizing picks how buy alerts that don't give their own size are sized.
+type Sizing struct {
+	Method string `yaml:"method"` // one of the Sizing* methods, equal_weight by default
+	// fixed_quote: position value in the quote currency
+	Amount float64 `yaml:"amount"`
+	// fixed_fraction: position value as a fraction of equity.
+	// kelly: multiplier on the Kelly fraction, 0.5 (half Kelly) by default
+	Fraction float64 `yaml:"fraction"`
+	// vol_target: fraction of equity one bar's volatility may move the
+	// position by, measured by atr (default) or the stdev of returns over
+	// period (default 14) candles of size bar (default 1D)
+	TargetVol  float64 `yaml:"target_vol"`
+	Volatility string  `yaml:"volatility"`
+	Bar        string  `yaml:"bar"`
+	Period     int     `yaml:"period"`
+	// kelly: chance a trade wins and average win over average loss
+	WinRate float64 `yaml:"win_rate"`
+	Payoff  float64 `yaml:"payoff"`
+	// vol_target and kelly: largest position as a fraction of equity, 1 by default
+	MaxFraction float64 `yaml:"max_fraction"`
+}
+
+func (s Sizing) Validate() error {
+	switch s.Method {
+	case "", SizingEqualWeight:
+	case SizingFixedQuote:
+		if s.Amount <= 0 {
+			return fmt.Errorf("fixed_quote sizing needs a positive amount")
+		}
+	case SizingFixedFraction:
+		if s.Fraction <= 0 || s.Fraction > 1 {
+			return fmt.Errorf("fixed_fraction sizing needs a fraction in (0, 1]")
+		}
+	case SizingVolTarget:
+		if s.TargetVol <= 0 {
+			return fmt.Errorf("vol_target sizing needs a positive target_vol")
+		}
+		if s.Volatility != "" && s.Volatility != "atr" && s.Volatility != "stdev" {
+			return fmt.Errorf("invalid volatility %q, expected atr or stdev", s.Volatility)
+		}
+		if s.Period < 0 || s.Period == 1 {
+			return fmt.Errorf("invalid period %d", s.Period)
+		}
+	case SizingKelly:
+		if s.WinRate <= 0 || s.WinRate >= 1 || s.Payoff <= 0 {
+			return fmt.Errorf("kelly sizing needs a win_rate in (0, 1) and a positive payoff")
+		}
+		if s.Fraction < 0 || s.Fraction > 1 {
+			return fmt.Errorf("kelly fraction must be in (0, 1]")
+		}
+	default:
+		return fmt.Errorf("unknown sizing method %q", s.Method)
+	}
+	if s.MaxFraction < 0 || s.MaxFraction > 1 {
+		return fmt.Errorf("max_fraction must be in (0, 1]")
+	}
+	return nil
+}
+
+// Signal rule types.
+const (
+	RuleEMACross  = "ema_cross"
+	RuleSMACross  = "sma_cross"
+	RuleRSI       = "rsi"
+	RuleMACD      = "macd"
+	RuleBollinger = "bollinger"
+)
+
+// SignalRule buys and sells a pair on an indicator, checked as each bar
+// closes. Periods left at 0 take the usual defaults.
+type SignalRule struct {
+	Type string `yaml:"type"` // one of the Rule* types
+	Bar  string `yaml:"bar"`  // OKX bar size, 1H by default
+	// Strategy the signals trade for, the default strategy if unset
+	Strategy string `yaml:"strategy"`
+	// ema_cross and sma_cross: buy when the fast average crosses above the
+	// slow one and sell when it crosses below. macd: the EMAs of the MACD
+	// line, 12 and 26 by default, with a signal line of signal_period (9)
+	Fast         int `yaml:"fast"`
+	Slow         int `yaml:"slow"`
+	SignalPeriod int `yaml:"signal_period"`
+	// rsi: buy when RSI over period (14) rises back above oversold (30) and
+	// sell when it falls back below overbought (70). bollinger: buy when the
+	// close drops below the lower band and sell when it rises above the
+	// upper one, with bands width (2) deviations around a period (20) SMA
+	Period     int     `yaml:"period"`
+	Oversold   float64 `yaml:"oversold"`
+	Overbought float64 `yaml:"overbought"`
+	Width      float64 `yaml:"width"`
+}
+
+// WithDefaults fills in the periods and levels r leaves unset.
+func (r SignalRule) WithDefaults() SignalRule {
+	if r.Bar == "" {
+		r.Bar = "1H"
+	}
+	if r.Strategy == "" {
+		r.Strategy = DefaultStrategy
+	}
+	switch r.Type {
+	case RuleMACD:
+		if r.Fast == 0 {
+			r.Fast = 12
+		}
+		if r.Slow == 0 {
+			r.Slow = 26
+		}
+		if r.SignalPeriod == 0 {
+			r.SignalPeriod = 9
+		}
+	case RuleRSI:
+		if r.Period == 0 {
+			r.Period = 14
+		}
+		if r.Oversold == 0 {
+			r.Oversold = 30
+		}
+		if r.Overbought == 0 {
+			r.Overbought = 70
+		}
+	case RuleBollinger:
+		if r.Period == 0 {
+			r.Period = 20
+		}
+		if r.Width == 0 {
+			r.Width = 2
+		}
+	}
+	return r
+}
+
+func (r SignalRule) Validate() error {
+	r = r.WithDefaults()
+	if _, ok := BarDuration(r.Bar); !ok {
+		return fmt.Errorf("unknown bar %q", r.Bar)
+	}
+	if !strategyName.MatchString(r.Strategy) {
+		return fmt.Errorf("invalid strategy name %q", r.Strategy)
+	}
+	switch r.Type {
+	case RuleEMACross, RuleSMACross, RuleMACD:
+		if r.Fast <= 0 || r.Slow <= r.Fast {
+			return fmt.Errorf("%s needs a fast period shorter than the slow one", r.Type)
+		}
+		if r.SignalPeriod < 0 {
+			return fmt.Errorf("invalid signal_period %d", r.SignalPeriod)
+		}
+	case RuleRSI:
+		if r.Period < 2 {
+			return fmt.Errorf("invalid period %d", r.Period)
+		}
+		if r.Oversold <= 0 || r.Overbought >= 100 || r.Oversold >= r.Overbought {
+			return fmt.Errorf("rsi needs 0 < oversold < overbought < 100")
+		}
+	case RuleBollinger:
+		if r.Period < 2 {
+			return fmt.Errorf("invalid period %d", r.Period)
+		}
+		if r.Width <= 0 {
+			return fmt.Errorf("bollinger needs a positive width")
+		}
+	default:
+		return fmt.Errorf("unknown signal rule type %q", r.Type)
+	}
+	return nil
+}
+
+// String describes r, e.g. "ema_cross 20/50 4H".
+func (r SignalRule) String() string {
+	r = r.WithDefaults()
+	switch r.Type {
+	case RuleEMACross, RuleSMACross:
+		return fmt.Sprintf("%s %d/%d %s", r.Type, r.Fast, r.Slow, r.Bar)
+	case RuleMACD:
+		return fmt.Sprintf("%s %d/%d/%d %s", r.Type, r.Fast, r.Slow, r.SignalPeriod, r.Bar)
+	case RuleRSI:
+		return fmt.Sprintf("%s %d %g/%g %s", r.Type, r.Period, r.Oversold, r.Overbought, r.Bar)
+	case RuleBollinger:
+		return fmt.Sprintf("%s %d/%g %s", r.Type, r.Period, r.Width, r.Bar)
+	}
+	return r.Type
+}
+
+// bars are the OKX bar sizes. Bars of 6H and up close on Hong Kong time
+// unless they end in utc, which changes when they close but not how long
+// they are.
+var bars = map[string]time.Duration{
+	"1m": time.Minute, "3m": 3 * time.Minute, "5m": 5 * time.Minute,
+	"15m": 15 * time.Minute, "30m": 30 * time.Minute,
+	"1H": time.Hour, "2H": 2 * time.Hour, "4H": 4 * time.Hour,
+	"6H": 6 * time.Hour, "12H": 12 * time.Hour,
+	"1D": 24 * time.Hour, "2D": 48 * time.Hour, "3D": 72 * time.Hour,
+	"1W": 7 * 24 * time.Hour,
+}
+
+// BarDuration is how long one bar of an OKX bar size lasts.
+func BarDuration(bar string) (time.Duration, bool) {
+	d, ok := bars[strings.TrimSuffix(bar, "utc")]
+	return d, ok
+}
+
+// Protection is the stop-loss and take-profit placed after a buy fills, and
+// the trailing stop the bot manages itself. Each is either a fraction of the
+// price or a multiple of ATR; one left at 0 is off.
+type Protection struct {
+	StopLoss      float64 `yaml:"stop_loss"`   // e.g. 0.05 for 5% below entry
+	TakeProfit    float64 `yaml:"take_profit"` // e.g. 0.1 for 10% above entry
+	StopLossATR   float64 `yaml:"stop_loss_atr"`
+	TakeProfitATR float64 `yaml:"take_profit_atr"`
+	// TrailingStop sells once the price falls this far below the highest
+	// price since entry
+	TrailingStop    float64 `yaml:"trailing_stop"`
+	TrailingStopATR float64 `yaml:"trailing_stop_atr"`
+	// Bar and Period describe the ATR, 1H and 14 by default
+	Bar    string `yaml:"bar"`
+	Period int    `yaml:"period"`
+}
+
+func (p Protection) Validate() error {
+	if p.StopLoss < 0 || p.StopLoss >= 1 || p.TrailingStop < 0 || p.TrailingStop >= 1 {
+		return fmt.Errorf("stop_loss and trailing_stop must be in [0, 1)")
+	}
+	if p.TakeProfit < 0 || p.StopLossATR < 0 || p.TakeProfitATR < 0 || p.TrailingStopATR < 0 {
+		return fmt.Errorf("distances can't be negative")
+	}
+	if p.StopLoss > 0 && p.StopLossATR > 0 || p.TakeProfit > 0 && p.TakeProfitATR > 0 || p.TrailingStop > 0 && p.TrailingStopATR > 0 {
+		return fmt.Errorf("set each side as a fraction or an ATR multiple, not both")
+	}
+	if p.Period < 0 || p.Period == 1 {
+		return fmt.Errorf("invalid period %d", p.Period)
+	}
+	return nil
+}
+
+// Enabled reports whether p places any order on the exchange.
+func (p Protection) Enabled() bool {
+	return p.StopLoss > 0 || p.TakeProfit > 0 || p.StopLossATR > 0 || p.TakeProfitATR > 0
+}
+
+// Trails reports whether p has a trailing stop.
+func (p Protection) Trails() bool {
+	return p.TrailingStop > 0 || p.TrailingStopATR > 0
+}
+
+// Default is the pair universe the bot traded before it was configurable.
+func Default() *Config {
+	return &Config{Pairs: []Pair{
+		{Ticker: "BTCUSDT", LotSize: 0.000001},
+		{Ticker: "TRXUSDT", LotSize: 0.1},
+		{Ticker: "SUIUSDT", LotSize: 0.0001},
+		{Ticker: "SOLUSDT", LotSize: 0.0001},
+		{Ticker: "NEARUSDT", LotSize: 0.0001},
+		{Ticker: "TONUSDT", LotSize: 0.0001},
+		{Ticker: "ICPUSDT", LotSize: 0.0001},
+	},
+		Strategies:       []Strategy{{Name: DefaultStrategy}},
+		Workers:          DefaultWorkers,
+		DedupeWindow:     DefaultDedupeWindow,
+		Rebalance:        Rebalance{Threshold: DefaultRebalanceThreshold},
+		TrailingInterval: DefaultTrailingInterval,
+		Candles:          Candles{Backfill: DefaultCandleBackfill, Interval: DefaultCandleInterval},
+		PnLMethod:        PnLFIFO,
+	}
+}
+
+// Load reads the YAML file at path, falling back to Default when it doesn't
+// exist, then applies environment overrides:
+//
+//	PAIRS=BTCUSDT,SOLUSDT     replaces the pair list, keeping file settings for listed pairs
+//	LOT_SIZE_BTCUSDT=0.00001  overrides one pair's fallback lot size
+//	WORKERS=8                 overrides workers
+//	DEDUPE_WINDOW=1h          overrides dedupe_window
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	data, err := os.ReadFile(path)
+	if err == nil {
+		// A threshold of 0 is a valid setting, so its default is filled in
+		// before the file is read rather than after
+		cfg = &Config{Rebalance: Rebalance{Threshold: DefaultRebalanceThreshold}}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	if cfg.Workers == 0 {
+		cfg.Workers = DefaultWorkers
+	}
+	if cfg.DedupeWindow == 0 {
+		cfg.DedupeWindow = DefaultDedupeWindow
+	}
+	if cfg.TrailingInterval == 0 {
+		cfg.TrailingInterval = DefaultTrailingInterval
+	}
+	if cfg.Candles.Backfill == 0 {
+		cfg.Candles.Backfill = DefaultCandleBackfill
+	}
+	if cfg.Candles.Interval == 0 {
+		cfg.Candles.Interval = DefaultCandleInterval
+	}
+	if cfg.PnLMethod == "" {
+		cfg.PnLMethod = PnLFIFO
+	}
+	if _, ok := cfg.Strategy(DefaultStrategy); !ok {
+		cfg.Strategies = append([]Strategy{{Name: DefaultStrategy}}, cfg.Strategies...)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// LoadExact reads a config file written out whole, such as one Load
+// returned, without environment overrides or defaults, so every value in it
+// is used as is.
+func LoadExact(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) applyEnv() error {
+	if env := os.Getenv("PAIRS"); env != "" {
+		var pairs []Pair
+		for _, ticker := range strings.Split(env, ",") {
+			ticker = strings.ToUpper(strings.TrimSpace(ticker))
+			if ticker == "" {
+				continue
+			}
+			pair, ok := c.Pair(ticker)
+			if !ok {
+				pair = Pair{Ticker: ticker}
+			}
+			pairs = append(pairs, pair)
+		}
+		c.Pairs = pairs
+	}
+
+	for i := range c.Pairs {
+		if env := os.Getenv("LOT_SIZE_" + c.Pairs[i].Ticker); env != "" {
+			lotSize, err := strconv.ParseFloat(env, 64)
+			if err != nil {
+				return fmt.Errorf("invalid LOT_SIZE_%s: %v", c.Pairs[i].Ticker, err)
+			}
+			c.Pairs[i].LotSize = lotSize
+		}
+	}
+
+	if env := os.Getenv("WORKERS"); env != "" {
+		workers, err := strconv.Atoi(env)
+		if err != nil {
+			return fmt.Errorf("invalid WORKERS: %v", err)
+		}
+		c.Workers = workers
+	}
+
+	if env := os.Getenv("DEDUPE_WINDOW"); env != "" {
+		window, err := time.ParseDuration(env)
+		if err != nil {
+			return fmt.Errorf("invalid DEDUPE_WINDOW: %v", err)
+		}
+		c.DedupeWindow = window
+	}
+
+	if env := os.Getenv("REBALANCE_INTERVAL"); env != "" {
+		interval, err := time.ParseDuration(env)
+		if err != nil {
+			return fmt.Errorf("invalid REBALANCE_INTERVAL: %v", err)
+		}
+		c.Rebalance.Interval = interval
+	}
+	if env := os.Getenv("REBALANCE_THRESHOLD"); env != "" {
+		threshold, err := strconv.ParseFloat(env, 64)
+		if err != nil {
+			return fmt.Errorf("invalid REBALANCE_THRESHOLD: %v", err)
+		}
+		c.Rebalance.Threshold = threshold
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	if len(c.Pairs) == 0 {
+		return fmt.Errorf("no pairs configured")
+	}
+	if c.Workers < 0 {
+		return fmt.Errorf("invalid workers %d", c.Workers)
+	}
+	if c.DedupeWindow < 0 {
+		return fmt.Errorf("invalid dedupe_window %s", c.DedupeWindow)
+	}
+	if c.Rebalance.Interval < 0 {
+		return fmt.Errorf("invalid rebalance interval %s", c.Rebalance.Interval)
+	}
+	if c.Rebalance.Threshold < 0 || c.Rebalance.Threshold >= 1 {
+		return fmt.Errorf("invalid rebalance threshold %f, expected a fraction in [0, 1)", c.Rebalance.Threshold)
+	}
+	if c.TrailingInterval < 0 {
+		return fmt.Errorf("invalid trailing_interval %s", c.TrailingInterval)
+	}
+	for _, bar := range c.Candles.Bars {
+		if _, ok := BarDuration(bar); !ok {
+			return fmt.Errorf("unknown candle bar %q", bar)
+		}
+	}
+	if c.Candles.Backfill < 0 || c.Candles.Interval < 0 {
+		return fmt.Errorf("invalid candles backfill or interval")
+	}
+	if c.PnLMethod != "" && c.PnLMethod != PnLFIFO && c.PnLMethod != PnLAverageCost {
+		return fmt.Errorf("invalid pnl_method %q, expected fifo or average_cost", c.PnLMethod)
+	}
+	if c.Risk.MaxPairNotional < 0 || c.Risk.MaxExposure < 0 || c.Risk.MaxOrdersPerHour < 0 || c.Risk.MaxDailyLoss < 0 || c.Risk.MaxOpenPairs < 0 {
+		return fmt.Errorf("risk limits can't be negative")
+	}
+	names := make(map[string]bool)
+	for _, strategy := range c.Strategies {
+		if !strategyName.MatchString(strategy.Name) {
+			return fmt.Errorf("invalid strategy name %q, expected up to 64 letters, digits, '.', '_' or '-'", strategy.Name)
+		}
+		if names[strategy.Name] {
+			return fmt.Errorf("strategy %s is configured twice", strategy.Name)
+		}
+		names[strategy.Name] = true
+		if strategy.Budget < 0 {
+			return fmt.Errorf("invalid budget %f for strategy %s", strategy.Budget, strategy.Name)
+		}
+		if strategy.Sizing != nil {
+			if err := strategy.Sizing.Validate(); err != nil {
+				return fmt.Errorf("invalid sizing for strategy %s: %v", strategy.Name, err)
+			}
+		}
+		if strategy.Protection != nil {
+			if err := strategy.Protection.Validate(); err != nil {
+				return fmt.Errorf("invalid protection for strategy %s: %v", strategy.Name, err)
+			}
+		}
+	}
+	if c.Sizing != nil {
+		if err := c.Sizing.Validate(); err != nil {
+			return fmt.Errorf("invalid sizing: %v", err)
+		}
+	}
+	if c.Protection != nil {
+		if err := c.Protection.Validate(); err != nil {
+			return fmt.Errorf("invalid protection: %v", err)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, pair := range c.Pairs {
+		if pair.Ticker == "" || pair.Ticker != strings.ToUpper(pair.Ticker) {
+			return fmt.Errorf("invalid ticker %q, expected e.g. BTCUSDT", pair.Ticker)
+		}
+		if seen[pair.Ticker] {
+			return fmt.Errorf("pair %s is configured twice", pair.Ticker)
+		}
+		seen[pair.Ticker] = true
+		if (pair.Base != "" || pair.Quote != "") && pair.Base+pair.Quote != pair.Ticker {
+			return fmt.Errorf("base %q and quote %q don't make up %s", pair.Base, pair.Quote, pair.Ticker)
+		}
+		if pair.LotSize < 0 || pair.LotSize > 1 {
+			return fmt.Errorf("invalid lot_size %f for %s", pair.LotSize, pair.Ticker)
+		}
+		if pair.Sizing != nil {
+			if err := pair.Sizing.Validate(); err != nil {
+				return fmt.Errorf("invalid sizing for %s: %v", pair.Ticker, err)
+			}
+		}
+		if pair.Protection != nil {
+			if err := pair.Protection.Validate(); err != nil {
+				return fmt.Errorf("invalid protection for %s: %v", pair.Ticker, err)
+			}
+		}
+		for _, rule := range pair.Signals {
+			if err := rule.Validate(); err != nil {
+				return fmt.Errorf("invalid signal rule for %s: %v", pair.Ticker, err)
+			}
+			if _, ok := c.Strategy(rule.WithDefaults().Strategy); !ok {
+				return fmt.Errorf("signal rule for %s trades for unknown strategy %s", pair.Ticker, rule.Strategy)
+			}
+		}
+	}
+	return nil
+}
+
+// Tickers lists the configured tickers in file order.
+func (c *Config) Tickers() []string {
+	tickers := make([]string, len(c.Pairs))
+	for i, pair := range c.Pairs {
+		tickers[i] = pair.Ticker
+	}
+	return tickers
+}
+
+// StrategyNames lists the configured strategies in file order.
+func (c *Config) StrategyNames() []string {
+	names := make([]string, len(c.Strategies))
+	for i, strategy := range c.Strategies {
+		names[i] = strategy.Name
+	}
+	return names
+}
+
+func (c *Config) Strategy(name string) (Strategy, bool) {
+	for _, strategy := range c.Strategies {
+		if strategy.Name == name {
+			return strategy, true
+		}
+	}
+	return Strategy{}, false
+}
+
+// SizingFor is the sizing for a strategy's buys in a pair: the strategy's
+// own, else the pair's, else the config-wide one, else equal weight.
+func (c *Config) SizingFor(strategy, ticker string) Sizing {
+	if s, ok := c.Strategy(strategy); ok && s.Sizing != nil {
+		return *s.Sizing
+	}
+	if p, ok := c.Pair(ticker); ok && p.Sizing != nil {
+		return *p.Sizing
+	}
+	if c.Sizing != nil {
+		return *c.Sizing
+	}
+	return Sizing{Method: SizingEqualWeight}
+}
+
+// ProtectionFor is the protection for a strategy's buys in a pair, resolved
+// like SizingFor. The zero Protection places nothing.
+func (c *Config) ProtectionFor(strategy, ticker string) Protection {
+	if s, ok := c.Strategy(strategy); ok && s.Protection != nil {
+		return *s.Protection
+	}
+	if p, ok := c.Pair(ticker); ok && p.Protection != nil {
+		return *p.Protection
+	}
+	if c.Protection != nil {
+		return *c.Protection
+	}
+	return Protection{}
+}
+
+func (c *Config) Pair(ticker string) (Pair, bool) {
+	for _, pair := range c.Pairs {
+		if pair.Ticker == ticker {
+			return pair, true
+		}
+	}
+	return Pair{}, false
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadExactSkipsEnvAndDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := "pairs:\n  - ticker: TRXUSDT\nrebalance:\n  threshold: 0\n"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("REBALANCE_THRESHOLD", "0.2")
+
+	cfg, err := Load(path)
+	if err != nil || cfg.Rebalance.Threshold != 0.2 {
+		t.Fatalf("expected Load to apply the environment, got %+v (%v)", cfg, err)
+	}
+	cfg, err = LoadExact(path)
+	if err != nil || cfg.Rebalance.Threshold != 0 {
+		t.Errorf("expected LoadExact to keep the threshold of 0, got %+v (%v)", cfg, err)
+	}
+}
+
+func TestLoadKeepsAZeroThreshold(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	for rebalance, want := range map[string]float64{
+		"rebalance:\n  threshold: 0\n":   0,
+		"rebalance:\n  threshold: 0.1\n": 0.1,
+		"rebalance:\n  interval: 1h\n":   DefaultRebalanceThreshold,
+		"":                               DefaultRebalanceThreshold,
+	} {
+		data := "pairs:\n  - ticker: TRXUSDT\n" + rebalance
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := Load(path)
+		if err != nil || cfg.Rebalance.Threshold != want {
+			t.Errorf("expected a threshold of %v from %q, got %+v (%v)", want, rebalance, cfg, err)
+		}
+	}
+}
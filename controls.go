@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto_trader/db"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tradingBlocked returns why the controls don't allow an order on side in
+// ticker, or "" if they do.
+func tradingBlocked(ticker, side string) (string, error) {
+	controls, err := db.GetControls()
+	if err != nil {
+		return "", err
+	}
+	if c, ok := controls[db.ControlHalt]; ok {
+		return withReason("trading is halted", c), nil
+	}
+	if c, ok := controls[db.PauseControl(ticker)]; ok {
+		return withReason(ticker+" is paused", c), nil
+	}
+	if c, ok := controls[db.ControlCloseOnly]; ok && side == "buy" {
+		return withReason("close-only mode, buys are not allowed", c), nil
+	}
+	return "", nil
+}
+
+func withReason(msg string, c db.Control) string {
+	if c.Reason != "" {
+		return msg + ": " + c.Reason
+	}
+	return msg
+}
+
+// controlRequest switches a control on or off through /admin/controls.
+type controlRequest struct {
+	Control string `json:"control"`          // halt, close_only or pause
+	Ticker  string `json:"ticker,omitempty"` // the pair to pause
+	On      bool   `json:"on"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+type controlStatus struct {
+	Control   string    `json:"control"`
+	Ticker    string    `json:"ticker,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (req controlRequest) name() (string, error) {
+	switch req.Control {
+	case db.ControlHalt, db.ControlCloseOnly:
+		return req.Control, nil
+	case "pause":
+		if !isValidTicker(req.Ticker) {
+			return "", fmt.Errorf("invalid ticker %q", req.Ticker)
+		}
+		return db.PauseControl(req.Ticker), nil
+	}
+	return "", fmt.Errorf("unknown control %q, expected halt, close_only or pause", req.Control)
+}
+
+// activeControls lists the controls that are on, halt first, then
+// close-only, then paused pairs.
+func activeControls() ([]controlStatus, error) {
+	controls, err := db.GetControls()
+	if err != nil {
+		return nil, err
+	}
+	statuses := []controlStatus{}
+	for _, c := range controls {
+		status := controlStatus{Control: c.Name, Reason: c.Reason, UpdatedAt: c.UpdatedAt}
+		if ticker := c.PausedTicker(); ticker != "" {
+			status.Control, status.Ticker = "pause", ticker
+		}
+		statuses = append(statuses, status)
+	}
+	order := map[string]int{db.ControlHalt: 0, db.ControlCloseOnly: 1, "pause": 2}
+	sort.Slice(statuses, func(i, j int) bool {
+		if order[statuses[i].Control] != order[statuses[j].Control] {
+			return order[statuses[i].Control] < order[statuses[j].Control]
+		}
+		return statuses[i].Ticker < statuses[j].Ticker
+	})
+	return statuses, nil
+}
+
+// controlsHandler lists the active controls on GET /admin/controls and
+// switches one on or off on POST. It needs the ADMIN_TOKEN bearer token.
+func controlsHandler(w http.ResponseWriter, r *http.Request) {
+	if !authenticateAdmin(r) {
+		log.Printf("Rejected unauthenticated admin request from %s", clientIP(r))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req controlRequest
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+			return
+		}
+		name, err := req.name()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := db.SetControl(name, req.On, req.Reason); err != nil {
+			log.Printf("Error setting control %s: %v", name, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Control %s switched on=%t by %s: %s", name, req.On, clientIP(r), req.Reason)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	statuses, err := activeControls()
+	if err != nil {
+		log.Printf("Error getting controls: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+const controlUsage = `usage: crypto_trader control [--url URL] <command>
+
+Commands:
+  status                      list the active controls
+  halt [reason]               stop all trading
+  resume                      lift a halt
+  close-only on|off [reason]  allow sells only
+  pause TICKER [reason]       stop trading one pair
+  unpause TICKER              resume trading one pair
+
+The ADMIN_TOKEN environment variable must hold the bot's admin token.
+`
+
+// runControl is the "control" subcommand. It drives /admin/controls on a
+// running bot and returns the exit code.
+func runControl(args []string) int {
+	fs := flag.NewFlagSet("control", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, controlUsage) }
+	url := fs.String("url", "http://localhost:8080", "base URL of the running bot")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	args = fs.Args()
+	if len(args) == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	reason := func(from int) string {
+		if len(args) > from {
+			return strings.Join(args[from:], " ")
+		}
+		return ""
+	}
+	var req *controlRequest
+	switch {
+	case args[0] == "status":
+	case args[0] == "halt":
+		req = &controlRequest{Control: db.ControlHalt, On: true, Reason: reason(1)}
+	case args[0] == "resume":
+		req = &controlRequest{Control: db.ControlHalt}
+	case args[0] == "close-only" && len(args) > 1 && (args[1] == "on" || args[1] == "off"):
+		req = &controlRequest{Control: db.ControlCloseOnly, On: args[1] == "on", Reason: reason(2)}
+	case args[0] == "pause" && len(args) > 1:
+		req = &controlRequest{Control: "pause", Ticker: strings.ToUpper(args[1]), On: true, Reason: reason(2)}
+	case args[0] == "unpause" && len(args) > 1:
+		req = &controlRequest{Control: "pause", Ticker: strings.ToUpper(args[1])}
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	method, body := http.MethodGet, []byte(nil)
+	if req != nil {
+		method = http.MethodPost
+		body, _ = json.Marshal(req)
+	}
+	httpReq, err := http.NewRequest(method, strings.TrimRight(*url, "/")+"/admin/controls", bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+os.Getenv("ADMIN_TOKEN"))
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		fmt.Fprintf(os.Stderr, "%s: %s", resp.Status, msg)
+		return 1
+	}
+
+	var statuses []controlStatus
+	if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid response: %v\n", err)
+		return 1
+	}
+	if len(statuses) == 0 {
+		fmt.Println("Trading normally, no controls active")
+	}
+	for _, s := range statuses {
+		fmt.Printf("%s %s since %s %s\n", s.Control, s.Ticker, s.UpdatedAt.Format("2006-01-02 15:04:05"), s.Reason)
+	}
+	return 0
+}
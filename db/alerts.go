@@ -0,0 +1,128 @@
+package db
+
+import (
+	"crypto_trader/clock"
+	"database/sql"
+	"time"
+)
+
+// Alert is a webhook alert waiting in, or taken from, the processing queue.
+type Alert struct {
+	ID        int64
+	Ticker    string
+	Signal    string
+	Payload   string
+	DedupeKey string
+	Status    string // pending, processing, done, failed
+	Result    string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func initAlertsTable() error {
+	alertsSQL := `
+		CREATE TABLE IF NOT EXISTS alerts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ticker TEXT,
+			signal TEXT,
+			payload TEXT,
+			status TEXT,
+			result TEXT,
+			created_at TIMESTAMP,
+			updated_at TIMESTAMP
+		)`
+	if _, err := db.Exec(alertsSQL); err != nil {
+		return err
+	}
+	if err := addColumn("alerts", "dedupe_key", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	_, err := db.Exec("CREATE INDEX IF NOT EXISTS alerts_dedupe_key ON alerts (dedupe_key, created_at)")
+	return err
+}
+
+// EnqueueAlert stores a pending alert and returns its ID. If an alert with the
+// same dedupe key was stored after since, nothing is stored and the earlier
+// alert's ID is returned with duplicate set.
+func EnqueueAlert(ticker, signal, payload, dedupeKey string, since time.Time) (id int64, duplicate bool, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if dedupeKey != "" {
+		err = db.QueryRow("SELECT id FROM alerts WHERE dedupe_key = ? AND created_at > ? ORDER BY id LIMIT 1", dedupeKey, since).Scan(&id)
+		if err == nil {
+			return id, true, nil
+		}
+		if err != sql.ErrNoRows {
+			return 0, false, err
+		}
+	}
+
+	now := clock.Now()
+	res, err := db.Exec("INSERT INTO alerts (ticker, signal, payload, dedupe_key, status, result, created_at, updated_at) VALUES (?, ?, ?, ?, 'pending', '', ?, ?)",
+		ticker, signal, payload, dedupeKey, now, now)
+	if err != nil {
+		return 0, false, err
+	}
+	id, err = res.LastInsertId()
+	return id, false, err
+}
+
+// ClaimAlert marks the oldest pending alert as processing and returns it.
+// Alerts for a ticker that already has one processing are left queued so each
+// ticker's alerts run one at a time and in order. ok is false when there is
+// nothing to claim.
+func ClaimAlert() (a Alert, ok bool, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	err = db.QueryRow(`SELECT id, ticker, signal, payload, dedupe_key, status, result, created_at, updated_at FROM alerts
+		WHERE status = 'pending' AND ticker NOT IN (SELECT ticker FROM alerts WHERE status = 'processing')
+		ORDER BY id LIMIT 1`).Scan(
+		&a.ID, &a.Ticker, &a.Signal, &a.Payload, &a.DedupeKey, &a.Status, &a.Result, &a.CreatedAt, &a.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return Alert{}, false, nil
+	}
+	if err != nil {
+		return Alert{}, false, err
+	}
+
+	a.Status = "processing"
+	a.UpdatedAt = clock.Now()
+	if _, err := db.Exec("UPDATE alerts SET status = ?, updated_at = ? WHERE id = ?", a.Status, a.UpdatedAt, a.ID); err != nil {
+		return Alert{}, false, err
+	}
+	return a, true, nil
+}
+
+// CompleteAlert records how processing an alert ended: status is done or failed.
+func CompleteAlert(id int64, status, result string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	_, err := db.Exec("UPDATE alerts SET status = ?, result = ?, updated_at = ? WHERE id = ?", status, result, clock.Now(), id)
+	return err
+}
+
+func GetAlert(id int64) (Alert, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var a Alert
+	err := db.QueryRow("SELECT id, ticker, signal, payload, dedupe_key, status, result, created_at, updated_at FROM alerts WHERE id = ?", id).Scan(
+		&a.ID, &a.Ticker, &a.Signal, &a.Payload, &a.DedupeKey, &a.Status, &a.Result, &a.CreatedAt, &a.UpdatedAt)
+	return a, err
+}
+
+// RequeueProcessingAlerts returns alerts left processing by a previous run to
+// the queue. It must only be called before any worker starts.
+func RequeueProcessingAlerts() (int64, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	res, err := db.Exec("UPDATE alerts SET status = 'pending', updated_at = ? WHERE status = 'processing'", clock.Now())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
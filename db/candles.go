@@ -0,0 +1,127 @@
+package db
+
+import (
+	"crypto_trader/exchange"
+	"time"
+)
+
+// Gap is a stretch of missing candles: bars opening after From and before
+// To, the open times of the stored candles either side of it.
+type Gap struct {
+	From time.Time
+	To   time.Time
+}
+
+func initCandlesTable() error {
+	// Open times are Unix milliseconds, as OKX gives them, so ranges compare
+	// as integers
+	candlesSQL := `
+		CREATE TABLE IF NOT EXISTS candles (
+			ticker TEXT,
+			bar TEXT,
+			ts INTEGER,
+			open REAL,
+			high REAL,
+			low REAL,
+			close REAL,
+			volume REAL,
+			PRIMARY KEY (ticker, bar, ts)
+		)`
+	_, err := db.Exec(candlesSQL)
+	return err
+}
+
+// SaveCandles stores closed candles of a pair and bar size, replacing any
+// stored for the same open times.
+func SaveCandles(ticker, bar string, candles []exchange.Candle) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO candles (ticker, bar, ts, open, high, low, close, volume) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, c := range candles {
+		if _, err := stmt.Exec(ticker, bar, c.Time.UnixMilli(), c.Open, c.High, c.Low, c.Close, c.Volume); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetCandles returns the stored candles of a pair and bar size that opened
+// from from up to but not including to, oldest first. A zero to has no end.
+func GetCandles(ticker, bar string, from, to time.Time) ([]exchange.Candle, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	end := int64(1<<63 - 1)
+	if !to.IsZero() {
+		end = to.UnixMilli()
+	}
+	rows, err := db.Query("SELECT ts, open, high, low, close, volume FROM candles WHERE ticker = ? AND bar = ? AND ts >= ? AND ts < ? ORDER BY ts",
+		ticker, bar, from.UnixMilli(), end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candles []exchange.Candle
+	for rows.Next() {
+		var c exchange.Candle
+		var ts int64
+		if err := rows.Scan(&ts, &c.Open, &c.High, &c.Low, &c.Close, &c.Volume); err != nil {
+			return nil, err
+		}
+		c.Time = time.UnixMilli(ts).UTC()
+		candles = append(candles, c)
+	}
+	return candles, rows.Err()
+}
+
+// CandleRange returns the open times of the first and last stored candles of
+// a pair and bar size, and whether there are any.
+func CandleRange(ticker, bar string) (time.Time, time.Time, bool, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var first, last *int64
+	err := db.QueryRow("SELECT MIN(ts), MAX(ts) FROM candles WHERE ticker = ? AND bar = ?", ticker, bar).Scan(&first, &last)
+	if err != nil || first == nil {
+		return time.Time{}, time.Time{}, false, err
+	}
+	return time.UnixMilli(*first).UTC(), time.UnixMilli(*last).UTC(), true, nil
+}
+
+// CandleGaps finds where consecutive stored candles of a pair and bar size
+// are further apart than step, oldest first.
+func CandleGaps(ticker, bar string, step time.Duration) ([]Gap, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	rows, err := db.Query(`
+		SELECT prev, ts FROM (
+			SELECT ts, LAG(ts) OVER (ORDER BY ts) AS prev
+			FROM candles WHERE ticker = ? AND bar = ?
+		) WHERE ts - prev > ? ORDER BY ts`, ticker, bar, step.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var gaps []Gap
+	for rows.Next() {
+		var from, to int64
+		if err := rows.Scan(&from, &to); err != nil {
+			return nil, err
+		}
+		gaps = append(gaps, Gap{From: time.UnixMilli(from).UTC(), To: time.UnixMilli(to).UTC()})
+	}
+	return gaps, rows.Err()
+}
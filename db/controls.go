@@ -0,0 +1,80 @@
+package db
+
+import (
+	"crypto_trader/clock"
+	"strings"
+	"time"
+)
+
+// Controls that stop the bot trading. A control is on while its row exists.
+const (
+	ControlHalt      = "halt"       // no orders at all
+	ControlCloseOnly = "close_only" // sells only
+)
+
+// PauseControl is the control that stops trading in one pair.
+func PauseControl(ticker string) string {
+	return "pause:" + ticker
+}
+
+// Control is a control that is switched on.
+type Control struct {
+	Name      string
+	Reason    string
+	UpdatedAt time.Time
+}
+
+// PausedTicker is the pair a pause control is for, or "" for other controls.
+func (c Control) PausedTicker() string {
+	if ticker, ok := strings.CutPrefix(c.Name, PauseControl("")); ok {
+		return ticker
+	}
+	return ""
+}
+
+func initControlsTable() error {
+	controlsSQL := `
+		CREATE TABLE IF NOT EXISTS controls (
+			name TEXT PRIMARY KEY,
+			reason TEXT,
+			updated_at TIMESTAMP
+		)`
+	_, err := db.Exec(controlsSQL)
+	return err
+}
+
+// SetControl switches a control on, replacing its reason, or off.
+func SetControl(name string, on bool, reason string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var err error
+	if on {
+		_, err = db.Exec("INSERT OR REPLACE INTO controls (name, reason, updated_at) VALUES (?, ?, ?)", name, reason, clock.Now())
+	} else {
+		_, err = db.Exec("DELETE FROM controls WHERE name = ?", name)
+	}
+	return err
+}
+
+// GetControls returns the controls that are on, keyed by name.
+func GetControls() (map[string]Control, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	rows, err := db.Query("SELECT name, reason, updated_at FROM controls ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	controls := make(map[string]Control)
+	for rows.Next() {
+		var c Control
+		if err := rows.Scan(&c.Name, &c.Reason, &c.UpdatedAt); err != nil {
+			return nil, err
+		}
+		controls[c.Name] = c
+	}
+	return controls, rows.Err()
+}
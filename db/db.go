@@ -1,6 +1,8 @@
 package db
 
 import (
+	"crypto_trader/clock"
+	"crypto_trader/config"
 	"database/sql"
 	"fmt"
 	"log"
@@ -11,28 +13,33 @@ import (
 )
 
 var (
-	db   *sql.DB
-	mu   sync.Mutex
+	db *sql.DB
+	mu sync.Mutex
 )
 
 type State struct {
-	Ticker    string
-	Signal    string
-	Position  float64
+	Strategy   string
+	Ticker     string
+	Signal     string
+	Position   float64
 	LastUpdate time.Time
 }
 
 type Transaction struct {
 	ID        int
+	Strategy  string
 	Ticker    string
 	Signal    string
 	Amount    float64
 	Price     float64
 	USDTValue float64
+	Fee       float64
 	Timestamp time.Time
 }
 
-func InitDB(dataSourceName string) {
+// InitDB opens the database, creating any missing tables, and seeds a
+// states row for every configured strategy and pair.
+func InitDB(dataSourceName string, cfg *config.Config) {
 	var err error
 	db, err = sql.Open("sqlite3", dataSourceName)
 	if err != nil {
@@ -42,20 +49,26 @@ func InitDB(dataSourceName string) {
 	// Create states table if it doesn't exist
 	statesSQL := `
 		CREATE TABLE IF NOT EXISTS states (
-			ticker TEXT PRIMARY KEY,
+			strategy TEXT NOT NULL DEFAULT 'default',
+			ticker TEXT,
 			signal TEXT,
 			position REAL,
-			last_update TIMESTAMP
+			last_update TIMESTAMP,
+			PRIMARY KEY (strategy, ticker)
 		)`
 	if _, err := db.Exec(statesSQL); err != nil {
 		log.Fatal(err)
 	}
+	if err := migrateStates(); err != nil {
+		log.Fatal(err)
+	}
 
-	// Initialize default pairs if not present
-	defaultPairs := []string{"BTCUSDT", "TRXUSDT", "SUIUSDT", "SOLUSDT", "NEARUSDT", "TONUSDT", "ICPUSDT"}
-	for _, pair := range defaultPairs {
-		if err := initState(pair); err != nil {
-			log.Printf("Error initializing state for %s: %v", pair, err)
+	// Initialize configured pairs if not present
+	for _, strategy := range cfg.StrategyNames() {
+		for _, pair := range cfg.Tickers() {
+			if err := initState(strategy, pair); err != nil {
+				log.Printf("Error initializing state for %s %s: %v", strategy, pair, err)
+			}
 		}
 	}
 
@@ -73,6 +86,18 @@ func InitDB(dataSourceName string) {
 	if _, err := db.Exec(transactionsSQL); err != nil {
 		log.Fatal(err)
 	}
+	if err := addColumn("transactions", "fee", "REAL DEFAULT 0"); err != nil {
+		log.Fatal(err)
+	}
+	if err := addColumn("transactions", "strategy", "TEXT NOT NULL DEFAULT 'default'"); err != nil {
+		log.Fatal(err)
+	}
+	if err := addColumn("transactions", "ord_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS transactions_ord_id ON transactions (ord_id)"); err != nil {
+		log.Fatal(err)
+	}
 
 	// Create account_value table for historical totals
 	accountValueSQL := `
@@ -84,36 +109,124 @@ func InitDB(dataSourceName string) {
 	if _, err := db.Exec(accountValueSQL); err != nil {
 		log.Fatal(err)
 	}
-}
 
-func initState(ticker string) error {
-	mu.Lock()
-	defer mu.Unlock()
+	if err := initOrdersTable(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := initRiskTable(); err != nil {
+		log.Fatal(err)
+	}
 
+	if err := initControlsTable(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := initProtectiveTable(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := initTrailingTable(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := initPaperTables(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := initAlertsTable(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := initCandlesTable(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// migrateStates rebuilds a states table from before strategies, which was
+// keyed by ticker alone, moving its rows to the default strategy.
+func migrateStates() error {
 	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM states WHERE ticker = ?", ticker).Scan(&count)
+	if err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('states') WHERE name = 'strategy'").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	log.Printf("Migrating states table to per-strategy rows")
+
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
-	if count == 0 {
-		_, err = db.Exec("INSERT INTO states (ticker, signal, position, last_update) VALUES (?, ?, ?, ?)",
-			ticker, "sell", 0.0, time.Now())
-		if err != nil {
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		`CREATE TABLE states_new (
+			strategy TEXT NOT NULL DEFAULT 'default',
+			ticker TEXT,
+			signal TEXT,
+			position REAL,
+			last_update TIMESTAMP,
+			PRIMARY KEY (strategy, ticker)
+		)`,
+		"INSERT INTO states_new (strategy, ticker, signal, position, last_update) SELECT 'default', ticker, signal, position, last_update FROM states",
+		"DROP TABLE states",
+		"ALTER TABLE states_new RENAME TO states",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
 			return err
 		}
 	}
-	return nil
+	return tx.Commit()
 }
 
-func GetState(ticker string) (State, error) {
+// addColumn adds a column to an existing table unless it is already there,
+// so databases created by older versions pick up new fields.
+func addColumn(table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+func initState(strategy, ticker string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	_, err := db.Exec("INSERT OR IGNORE INTO states (strategy, ticker, signal, position, last_update) VALUES (?, ?, ?, ?, ?)",
+		strategy, ticker, "sell", 0.0, clock.Now())
+	return err
+}
+
+func GetState(strategy, ticker string) (State, error) {
 	mu.Lock()
 	defer mu.Unlock()
 
 	var state State
-	err := db.QueryRow("SELECT ticker, signal, position, last_update FROM states WHERE ticker = ?", ticker).Scan(
-		&state.Ticker, &state.Signal, &state.Position, &state.LastUpdate)
+	err := db.QueryRow("SELECT strategy, ticker, signal, position, last_update FROM states WHERE strategy = ? AND ticker = ?", strategy, ticker).Scan(
+		&state.Strategy, &state.Ticker, &state.Signal, &state.Position, &state.LastUpdate)
 	if err == sql.ErrNoRows {
-		return State{}, fmt.Errorf("no state found for %s", ticker)
+		return State{}, fmt.Errorf("no state found for %s %s", strategy, ticker)
 	}
 	if err != nil {
 		return State{}, err
@@ -121,23 +234,24 @@ func GetState(ticker string) (State, error) {
 	return state, nil
 }
 
-func UpdateState(ticker, signal string, position float64) error {
+func UpdateState(strategy, ticker, signal string, position float64) error {
 	mu.Lock()
 	defer mu.Unlock()
 
-	_, err := db.Exec("UPDATE states SET signal = ?, position = ?, last_update = ? WHERE ticker = ?",
-		signal, position, time.Now(), ticker)
+	_, err := db.Exec("UPDATE states SET signal = ?, position = ?, last_update = ? WHERE strategy = ? AND ticker = ?",
+		signal, position, clock.Now(), strategy, ticker)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// GetAllStates returns every strategy's states, ordered by strategy.
 func GetAllStates() ([]State, error) {
 	mu.Lock()
 	defer mu.Unlock()
 
-	rows, err := db.Query("SELECT ticker, signal, position, last_update FROM states")
+	rows, err := db.Query("SELECT strategy, ticker, signal, position, last_update FROM states ORDER BY strategy, rowid")
 	if err != nil {
 		return nil, err
 	}
@@ -146,7 +260,7 @@ func GetAllStates() ([]State, error) {
 	var states []State
 	for rows.Next() {
 		var state State
-		if err := rows.Scan(&state.Ticker, &state.Signal, &state.Position, &state.LastUpdate); err != nil {
+		if err := rows.Scan(&state.Strategy, &state.Ticker, &state.Signal, &state.Position, &state.LastUpdate); err != nil {
 			return nil, err
 		}
 		states = append(states, state)
@@ -157,23 +271,35 @@ func GetAllStates() ([]State, error) {
 	return states, nil
 }
 
-func RecordTransaction(ticker, signal string, amount, price, usdtValue float64) error {
+// UpsertTransaction records what an order has filled so far. An order has
+// one transaction, updated as more of it fills; an update that reports less
+// filled than already recorded arrived out of order and is ignored.
+func UpsertTransaction(ordID, strategy, ticker, signal string, amount, price, usdtValue, fee float64) error {
 	mu.Lock()
 	defer mu.Unlock()
 
-	_, err := db.Exec("INSERT INTO transactions (ticker, signal, amount, price, usdt_value, timestamp) VALUES (?, ?, ?, ?, ?, ?)",
-		ticker, signal, amount, price, usdtValue, time.Now())
-	if err != nil {
+	var id int64
+	var recorded float64
+	err := db.QueryRow("SELECT id, amount FROM transactions WHERE ord_id = ? AND ord_id != ''", ordID).Scan(&id, &recorded)
+	if err == sql.ErrNoRows {
+		_, err = db.Exec("INSERT INTO transactions (ord_id, strategy, ticker, signal, amount, price, usdt_value, fee, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			ordID, strategy, ticker, signal, amount, price, usdtValue, fee, clock.Now())
 		return err
 	}
-	return nil
+	if err != nil || amount < recorded {
+		return err
+	}
+	_, err = db.Exec("UPDATE transactions SET amount = ?, price = ?, usdt_value = ?, fee = ? WHERE id = ?", amount, price, usdtValue, fee, id)
+	return err
 }
 
-func GetTransactions(ticker string) ([]Transaction, error) {
+// GetTransactions returns a strategy's transactions for ticker, or every
+// strategy's when strategy is empty.
+func GetTransactions(strategy, ticker string) ([]Transaction, error) {
 	mu.Lock()
 	defer mu.Unlock()
 
-	rows, err := db.Query("SELECT id, ticker, signal, amount, price, usdt_value, timestamp FROM transactions WHERE ticker = ? ORDER BY timestamp", ticker)
+	rows, err := db.Query("SELECT id, strategy, ticker, signal, amount, price, usdt_value, fee, timestamp FROM transactions WHERE (? = '' OR strategy = ?) AND ticker = ? ORDER BY timestamp", strategy, strategy, ticker)
 	if err != nil {
 		return nil, err
 	}
@@ -182,7 +308,7 @@ func GetTransactions(ticker string) ([]Transaction, error) {
 	var transactions []Transaction
 	for rows.Next() {
 		var t Transaction
-		if err := rows.Scan(&t.ID, &t.Ticker, &t.Signal, &t.Amount, &t.Price, &t.USDTValue, &t.Timestamp); err != nil {
+		if err := rows.Scan(&t.ID, &t.Strategy, &t.Ticker, &t.Signal, &t.Amount, &t.Price, &t.USDTValue, &t.Fee, &t.Timestamp); err != nil {
 			return nil, err
 		}
 		transactions = append(transactions, t)
@@ -197,7 +323,7 @@ func RecordAccountValue(totalUSDT float64) error {
 	mu.Lock()
 	defer mu.Unlock()
 
-	_, err := db.Exec("INSERT INTO account_value (total_usdt, timestamp) VALUES (?, ?)", totalUSDT, time.Now())
+	_, err := db.Exec("INSERT INTO account_value (total_usdt, timestamp) VALUES (?, ?)", totalUSDT, clock.Now())
 	if err != nil {
 		return err
 	}
@@ -237,19 +363,35 @@ func GetAccountValues() ([]struct {
 	return values, nil
 }
 
+// FirstAccountValueSince returns the first account value recorded at or
+// after t. ok is false if none were.
+func FirstAccountValueSince(t time.Time) (value float64, ok bool, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	err = db.QueryRow("SELECT total_usdt FROM account_value WHERE timestamp >= ? ORDER BY timestamp LIMIT 1", t).Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return value, true, nil
+}
+
 func Close() {
 	if db != nil {
 		db.Close()
 	}
 }
 
-// ResetState resets the state for a given ticker
-func ResetState(ticker, signal string, position float64) error {
+// ResetState resets the state for a given strategy and ticker
+func ResetState(strategy, ticker, signal string, position float64) error {
 	mu.Lock()
 	defer mu.Unlock()
 
-	_, err := db.Exec("INSERT OR REPLACE INTO states (ticker, signal, position, last_update) VALUES (?, ?, ?, ?)",
-		ticker, signal, position, time.Now())
+	_, err := db.Exec("INSERT OR REPLACE INTO states (strategy, ticker, signal, position, last_update) VALUES (?, ?, ?, ?, ?)",
+		strategy, ticker, signal, position, clock.Now())
 	if err != nil {
 		return err
 	}
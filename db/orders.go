@@ -0,0 +1,95 @@
+package db
+
+import (
+	"crypto_trader/clock"
+	"database/sql"
+	"time"
+)
+
+// Order is an order the bot placed, with its outcome once it has settled.
+type Order struct {
+	OrdID     string
+	Ticker    string
+	Side      string
+	Size      float64
+	Price     float64
+	Filled    float64
+	AvgPrice  float64
+	Fee       float64
+	Status    string // live until settled, then filled, partial, canceled
+	Amends    int
+	Timestamp time.Time
+}
+
+func initOrdersTable() error {
+	ordersSQL := `
+		CREATE TABLE IF NOT EXISTS orders (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ord_id TEXT,
+			ticker TEXT,
+			side TEXT,
+			size REAL,
+			price REAL,
+			filled REAL,
+			avg_price REAL,
+			fee REAL,
+			status TEXT,
+			amends INTEGER,
+			timestamp TIMESTAMP
+		)`
+	_, err := db.Exec(ordersSQL)
+	return err
+}
+
+// RecordOrder records an order when it is placed and again when it settles.
+// The order keeps the time it was first recorded, so orders still being
+// chased count toward the hourly order limit.
+func RecordOrder(o Order) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var id int64
+	err := db.QueryRow("SELECT id FROM orders WHERE ord_id = ?", o.OrdID).Scan(&id)
+	if err == nil {
+		_, err = db.Exec("UPDATE orders SET size = ?, price = ?, filled = ?, avg_price = ?, fee = ?, status = ?, amends = ? WHERE id = ?",
+			o.Size, o.Price, o.Filled, o.AvgPrice, o.Fee, o.Status, o.Amends, id)
+		return err
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO orders (ord_id, ticker, side, size, price, filled, avg_price, fee, status, amends, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		o.OrdID, o.Ticker, o.Side, o.Size, o.Price, o.Filled, o.AvgPrice, o.Fee, o.Status, o.Amends, clock.Now())
+	return err
+}
+
+func GetOrders(ticker string) ([]Order, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	rows, err := db.Query("SELECT ord_id, ticker, side, size, price, filled, avg_price, fee, status, amends, timestamp FROM orders WHERE ticker = ? ORDER BY id", ticker)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []Order
+	for rows.Next() {
+		var o Order
+		if err := rows.Scan(&o.OrdID, &o.Ticker, &o.Side, &o.Size, &o.Price, &o.Filled, &o.AvgPrice, &o.Fee, &o.Status, &o.Amends, &o.Timestamp); err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
+
+// CountOrdersSince counts the orders placed after t, settled or not.
+func CountOrdersSince(t time.Time) (int, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM orders WHERE timestamp > ?", t).Scan(&n)
+	return n, err
+}
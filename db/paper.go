@@ -0,0 +1,290 @@
+package db
+
+import (
+	"crypto_trader/clock"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// PaperOrder is an order held by the simulated paper exchange.
+type PaperOrder struct {
+	ID        int64
+	Ticker    string
+	Side      string
+	Size      float64
+	Price     float64
+	Status    string // live, filled, canceled
+	Filled    float64
+	AvgPrice  float64
+	Fee       float64
+	ClOrdID   string
+	Timestamp time.Time
+}
+
+// PaperAlgoOrder is a stop-loss and/or take-profit order held by the paper
+// exchange until the price reaches one of its triggers.
+type PaperAlgoOrder struct {
+	ID         int64
+	Ticker     string
+	Side       string
+	Size       float64
+	StopLoss   float64
+	TakeProfit float64
+	Status     string // live, effective (triggered), canceled
+	ClOrdID    string
+	OrdID      int64 // the paper order it placed once triggered
+	Timestamp  time.Time
+}
+
+func initPaperTables() error {
+	balancesSQL := `
+		CREATE TABLE IF NOT EXISTS paper_balances (
+			ccy TEXT PRIMARY KEY,
+			amount REAL
+		)`
+	if _, err := db.Exec(balancesSQL); err != nil {
+		return err
+	}
+
+	ordersSQL := `
+		CREATE TABLE IF NOT EXISTS paper_orders (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ticker TEXT,
+			side TEXT,
+			size REAL,
+			price REAL,
+			status TEXT,
+			filled REAL,
+			avg_price REAL,
+			fee REAL,
+			timestamp TIMESTAMP
+		)`
+	if _, err := db.Exec(ordersSQL); err != nil {
+		return err
+	}
+	if err := addColumn("paper_orders", "cl_ord_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	algoSQL := `
+		CREATE TABLE IF NOT EXISTS paper_algo_orders (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ticker TEXT,
+			side TEXT,
+			size REAL,
+			stop_loss REAL,
+			take_profit REAL,
+			status TEXT,
+			cl_ord_id TEXT NOT NULL DEFAULT '',
+			timestamp TIMESTAMP
+		)`
+	if _, err := db.Exec(algoSQL); err != nil {
+		return err
+	}
+	return addColumn("paper_algo_orders", "ord_id", "INTEGER NOT NULL DEFAULT 0")
+}
+
+// InitPaperBalance seeds a paper balance the first time it is seen, so a
+// restart keeps the simulated account where it left off.
+func InitPaperBalance(ccy string, amount float64) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	_, err := db.Exec("INSERT OR IGNORE INTO paper_balances (ccy, amount) VALUES (?, ?)", ccy, amount)
+	return err
+}
+
+func GetPaperBalance(ccy string) (float64, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var amount float64
+	err := db.QueryRow("SELECT amount FROM paper_balances WHERE ccy = ?", ccy).Scan(&amount)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return amount, err
+}
+
+func GetPaperBalances() (map[string]float64, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	rows, err := db.Query("SELECT ccy, amount FROM paper_balances")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := make(map[string]float64)
+	for rows.Next() {
+		var ccy string
+		var amount float64
+		if err := rows.Scan(&ccy, &amount); err != nil {
+			return nil, err
+		}
+		balances[ccy] = amount
+	}
+	return balances, rows.Err()
+}
+
+func AdjustPaperBalance(ccy string, delta float64) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	_, err := db.Exec(`INSERT INTO paper_balances (ccy, amount) VALUES (?, ?)
+		ON CONFLICT(ccy) DO UPDATE SET amount = amount + excluded.amount`, ccy, delta)
+	return err
+}
+
+func InsertPaperOrder(o PaperOrder) (int64, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	res, err := db.Exec("INSERT INTO paper_orders (ticker, side, size, price, status, filled, avg_price, fee, cl_ord_id, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		o.Ticker, o.Side, o.Size, o.Price, o.Status, o.Filled, o.AvgPrice, o.Fee, o.ClOrdID, clock.Now())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func UpdatePaperOrder(o PaperOrder) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	_, err := db.Exec("UPDATE paper_orders SET price = ?, status = ?, filled = ?, avg_price = ?, fee = ? WHERE id = ?",
+		o.Price, o.Status, o.Filled, o.AvgPrice, o.Fee, o.ID)
+	return err
+}
+
+func GetPaperOrder(id int64) (PaperOrder, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var o PaperOrder
+	err := db.QueryRow("SELECT id, ticker, side, size, price, status, filled, avg_price, fee, cl_ord_id, timestamp FROM paper_orders WHERE id = ?", id).Scan(
+		&o.ID, &o.Ticker, &o.Side, &o.Size, &o.Price, &o.Status, &o.Filled, &o.AvgPrice, &o.Fee, &o.ClOrdID, &o.Timestamp)
+	if err == sql.ErrNoRows {
+		return PaperOrder{}, fmt.Errorf("no paper order %d", id)
+	}
+	return o, err
+}
+
+// FindPaperOrder returns the ID of the paper order placed with clOrdID.
+func FindPaperOrder(clOrdID string) (int64, bool, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var id int64
+	err := db.QueryRow("SELECT id FROM paper_orders WHERE cl_ord_id = ? AND cl_ord_id != ''", clOrdID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return id, err == nil, err
+}
+
+// GetPaperOrders returns paper orders with the given status, or all of them
+// when status is empty.
+func GetPaperOrders(status string) ([]PaperOrder, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	rows, err := db.Query("SELECT id, ticker, side, size, price, status, filled, avg_price, fee, cl_ord_id, timestamp FROM paper_orders WHERE ? = '' OR status = ? ORDER BY id", status, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []PaperOrder
+	for rows.Next() {
+		var o PaperOrder
+		if err := rows.Scan(&o.ID, &o.Ticker, &o.Side, &o.Size, &o.Price, &o.Status, &o.Filled, &o.AvgPrice, &o.Fee, &o.ClOrdID, &o.Timestamp); err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
+
+func InsertPaperAlgoOrder(o PaperAlgoOrder) (int64, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	res, err := db.Exec("INSERT INTO paper_algo_orders (ticker, side, size, stop_loss, take_profit, status, cl_ord_id, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		o.Ticker, o.Side, o.Size, o.StopLoss, o.TakeProfit, o.Status, o.ClOrdID, clock.Now())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func UpdatePaperAlgoOrderStatus(id int64, status string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	_, err := db.Exec("UPDATE paper_algo_orders SET status = ? WHERE id = ?", status, id)
+	return err
+}
+
+// TriggerPaperAlgoOrder marks a paper algo order effective, having placed
+// the paper order ordID.
+func TriggerPaperAlgoOrder(id, ordID int64) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	_, err := db.Exec("UPDATE paper_algo_orders SET status = 'effective', ord_id = ? WHERE id = ?", ordID, id)
+	return err
+}
+
+// GetPaperAlgoOrder returns a paper algo order in any state.
+func GetPaperAlgoOrder(id int64) (PaperAlgoOrder, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var o PaperAlgoOrder
+	err := db.QueryRow("SELECT id, ticker, side, size, stop_loss, take_profit, status, cl_ord_id, ord_id, timestamp FROM paper_algo_orders WHERE id = ?", id).Scan(
+		&o.ID, &o.Ticker, &o.Side, &o.Size, &o.StopLoss, &o.TakeProfit, &o.Status, &o.ClOrdID, &o.OrdID, &o.Timestamp)
+	if err == sql.ErrNoRows {
+		return PaperAlgoOrder{}, fmt.Errorf("no paper algo order %d", id)
+	}
+	return o, err
+}
+
+// FindPaperAlgoOrder returns the ID of the paper algo order placed with
+// clOrdID.
+func FindPaperAlgoOrder(clOrdID string) (int64, bool, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var id int64
+	err := db.QueryRow("SELECT id FROM paper_algo_orders WHERE cl_ord_id = ? AND cl_ord_id != ''", clOrdID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return id, err == nil, err
+}
+
+// GetPaperAlgoOrders returns the live paper algo orders, for ticker or for
+// every pair when ticker is empty.
+func GetPaperAlgoOrders(ticker string) ([]PaperAlgoOrder, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	rows, err := db.Query("SELECT id, ticker, side, size, stop_loss, take_profit, status, cl_ord_id, timestamp FROM paper_algo_orders WHERE status = 'live' AND (? = '' OR ticker = ?) ORDER BY id", ticker, ticker)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []PaperAlgoOrder
+	for rows.Next() {
+		var o PaperAlgoOrder
+		if err := rows.Scan(&o.ID, &o.Ticker, &o.Side, &o.Size, &o.StopLoss, &o.TakeProfit, &o.Status, &o.ClOrdID, &o.Timestamp); err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
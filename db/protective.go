@@ -0,0 +1,97 @@
+package db
+
+import (
+	"crypto_trader/clock"
+	"database/sql"
+	"time"
+)
+
+// ProtectiveOrder is a stop-loss and/or take-profit algo order placed to
+// protect a strategy's position after a buy.
+type ProtectiveOrder struct {
+	Strategy   string
+	Ticker     string
+	AlgoID     string
+	ClOrdID    string
+	Size       float64
+	StopLoss   float64 // trigger prices, 0 when unset
+	TakeProfit float64
+	Status     string // live, canceled, closed (no longer pending, usually triggered)
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+func initProtectiveTable() error {
+	protectiveSQL := `
+		CREATE TABLE IF NOT EXISTS protective_orders (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			strategy TEXT,
+			ticker TEXT,
+			algo_id TEXT,
+			cl_ord_id TEXT,
+			size REAL,
+			stop_loss REAL,
+			take_profit REAL,
+			status TEXT,
+			created_at TIMESTAMP,
+			updated_at TIMESTAMP
+		)`
+	_, err := db.Exec(protectiveSQL)
+	return err
+}
+
+// RecordProtectiveOrder stores a newly placed protective order as live.
+func RecordProtectiveOrder(p ProtectiveOrder) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := clock.Now()
+	_, err := db.Exec("INSERT INTO protective_orders (strategy, ticker, algo_id, cl_ord_id, size, stop_loss, take_profit, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, 'live', ?, ?)",
+		p.Strategy, p.Ticker, p.AlgoID, p.ClOrdID, p.Size, p.StopLoss, p.TakeProfit, now, now)
+	return err
+}
+
+// GetLiveProtectiveOrders returns a strategy's live protective orders in
+// ticker, oldest first.
+func GetLiveProtectiveOrders(strategy, ticker string) ([]ProtectiveOrder, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	rows, err := db.Query("SELECT strategy, ticker, algo_id, cl_ord_id, size, stop_loss, take_profit, status, created_at, updated_at FROM protective_orders WHERE strategy = ? AND ticker = ? AND status = 'live' ORDER BY id", strategy, ticker)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []ProtectiveOrder
+	for rows.Next() {
+		var p ProtectiveOrder
+		if err := rows.Scan(&p.Strategy, &p.Ticker, &p.AlgoID, &p.ClOrdID, &p.Size, &p.StopLoss, &p.TakeProfit, &p.Status, &p.CreatedAt, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		orders = append(orders, p)
+	}
+	return orders, rows.Err()
+}
+
+// FindProtectiveOrder returns the protective order with the given algo ID.
+func FindProtectiveOrder(algoID string) (ProtectiveOrder, bool, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var p ProtectiveOrder
+	err := db.QueryRow("SELECT strategy, ticker, algo_id, cl_ord_id, size, stop_loss, take_profit, status, created_at, updated_at FROM protective_orders WHERE algo_id = ?", algoID).
+		Scan(&p.Strategy, &p.Ticker, &p.AlgoID, &p.ClOrdID, &p.Size, &p.StopLoss, &p.TakeProfit, &p.Status, &p.CreatedAt, &p.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return p, false, nil
+	}
+	return p, err == nil, err
+}
+
+func UpdateProtectiveOrderStatus(algoID, status string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	_, err := db.Exec("UPDATE protective_orders SET status = ?, updated_at = ? WHERE algo_id = ?", status, clock.Now(), algoID)
+	return err
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"crypto_trader/clock"
+	"time"
+)
+
+// RiskRejection is an order the risk checks stopped before it was placed.
+type RiskRejection struct {
+	Ticker    string
+	Side      string
+	Size      float64
+	Price     float64
+	Rule      string
+	Reason    string
+	Timestamp time.Time
+}
+
+func initRiskTable() error {
+	riskSQL := `
+		CREATE TABLE IF NOT EXISTS risk_rejections (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ticker TEXT,
+			side TEXT,
+			size REAL,
+			price REAL,
+			rule TEXT,
+			reason TEXT,
+			timestamp TIMESTAMP
+		)`
+	_, err := db.Exec(riskSQL)
+	return err
+}
+
+func RecordRiskRejection(r RiskRejection) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	_, err := db.Exec("INSERT INTO risk_rejections (ticker, side, size, price, rule, reason, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		r.Ticker, r.Side, r.Size, r.Price, r.Rule, r.Reason, clock.Now())
+	return err
+}
+
+// GetRiskRejections returns the most recent rejections, newest first.
+func GetRiskRejections(limit int) ([]RiskRejection, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	rows, err := db.Query("SELECT ticker, side, size, price, rule, reason, timestamp FROM risk_rejections ORDER BY id DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rejections []RiskRejection
+	for rows.Next() {
+		var r RiskRejection
+		if err := rows.Scan(&r.Ticker, &r.Side, &r.Size, &r.Price, &r.Rule, &r.Reason, &r.Timestamp); err != nil {
+			return nil, err
+		}
+		rejections = append(rejections, r)
+	}
+	return rejections, rows.Err()
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"crypto_trader/clock"
+	"time"
+)
+
+// TrailingStop is a bot-managed stop that follows a strategy's position in
+// a pair up from its entry. The stop sits Percent below the high-water mark,
+// or Distance below it when the trail was set as an ATR multiple.
+type TrailingStop struct {
+	Strategy   string
+	Ticker     string
+	EntryPrice float64
+	HighWater  float64
+	StopPrice  float64
+	Percent    float64
+	Distance   float64
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// Level is the stop price for a high-water mark.
+func (t TrailingStop) Level(high float64) float64 {
+	return high*(1-t.Percent) - t.Distance
+}
+
+func initTrailingTable() error {
+	trailingSQL := `
+		CREATE TABLE IF NOT EXISTS trailing_stops (
+			strategy TEXT,
+			ticker TEXT,
+			entry_price REAL,
+			high_water REAL,
+			stop_price REAL,
+			percent REAL,
+			distance REAL,
+			created_at TIMESTAMP,
+			updated_at TIMESTAMP,
+			PRIMARY KEY (strategy, ticker)
+		)`
+	_, err := db.Exec(trailingSQL)
+	return err
+}
+
+// StartTrailingStop starts trailing a position. A position that is already
+// trailed, e.g. one being topped up, keeps its high-water mark.
+func StartTrailingStop(t TrailingStop) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := clock.Now()
+	_, err := db.Exec("INSERT OR IGNORE INTO trailing_stops (strategy, ticker, entry_price, high_water, stop_price, percent, distance, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		t.Strategy, t.Ticker, t.EntryPrice, t.HighWater, t.StopPrice, t.Percent, t.Distance, now, now)
+	return err
+}
+
+// RaiseTrailingStop records a new high-water mark and the stop price it
+// gives.
+func RaiseTrailingStop(strategy, ticker string, high, stop float64) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	_, err := db.Exec("UPDATE trailing_stops SET high_water = ?, stop_price = ?, updated_at = ? WHERE strategy = ? AND ticker = ?",
+		high, stop, clock.Now(), strategy, ticker)
+	return err
+}
+
+func DeleteTrailingStop(strategy, ticker string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	_, err := db.Exec("DELETE FROM trailing_stops WHERE strategy = ? AND ticker = ?", strategy, ticker)
+	return err
+}
+
+func GetTrailingStops() ([]TrailingStop, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	rows, err := db.Query("SELECT strategy, ticker, entry_price, high_water, stop_price, percent, distance, created_at, updated_at FROM trailing_stops ORDER BY strategy, ticker")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stops []TrailingStop
+	for rows.Next() {
+		var t TrailingStop
+		if err := rows.Scan(&t.Strategy, &t.Ticker, &t.EntryPrice, &t.HighWater, &t.StopPrice, &t.Percent, &t.Distance, &t.CreatedAt, &t.UpdatedAt); err != nil {
+			return nil, err
+		}
+		stops = append(stops, t)
+	}
+	return stops, rows.Err()
+}
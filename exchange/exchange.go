@@ -0,0 +1,324 @@
+package exchange
+
+import (
+	"crypto_trader/clock"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Instrument is the trading metadata the bot needs for a spot pair.
+type Instrument struct {
+	InstID  string // OKX form, e.g. "BTC-USDT"
+	Base    string
+	Quote   string
+	LotSize float64
+	MinSize float64
+}
+
+// Ticker is the bot's name for the pair, e.g. "BTCUSDT".
+func (i Instrument) Ticker() string {
+	return i.Base + i.Quote
+}
+
+// QuoteCurrencies are the quote suffixes ParseTicker recognises, tried in
+// order. A quote that ends in another one has to come before it.
+var QuoteCurrencies = []string{"USDT", "USDC", "BTC", "ETH"}
+
+var (
+	registryMu  sync.RWMutex
+	instruments = make(map[string]Instrument)
+)
+
+// Register records an instrument so its ticker resolves to the right base
+// and quote everywhere.
+func Register(inst Instrument) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	instruments[inst.Ticker()] = inst
+}
+
+// Registered returns every registered instrument.
+func Registered() []Instrument {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	list := make([]Instrument, 0, len(instruments))
+	for _, inst := range instruments {
+		list = append(list, inst)
+	}
+	return list
+}
+
+// ParseTicker returns the registered instrument for a ticker, or splits an
+// unregistered one on a known quote currency suffix.
+func ParseTicker(ticker string) (Instrument, bool) {
+	registryMu.RLock()
+	inst, ok := instruments[ticker]
+	registryMu.RUnlock()
+	if ok {
+		return inst, true
+	}
+	for _, quote := range QuoteCurrencies {
+		if base := strings.TrimSuffix(ticker, quote); base != ticker && base != "" {
+			return Instrument{InstID: base + "-" + quote, Base: base, Quote: quote}, true
+		}
+	}
+	return Instrument{}, false
+}
+
+// InstID converts a ticker to the exchange's instrument ID.
+func InstID(ticker string) string {
+	if inst, ok := ParseTicker(ticker); ok {
+		return inst.InstID
+	}
+	return ticker
+}
+
+// Exchange is everything the webhook handler needs from a trading venue.
+// Tickers are in the bot's own format, e.g. "BTCUSDT", and positions are
+// keyed by the ticker of every registered instrument.
+//
+// PlaceOrder takes a client order ID, unique per order, that the caller
+// derives deterministically. Placing an order again with the same client
+// order ID returns the original order's ID instead of submitting another.
+// Sizes are always in the base currency, market buys included.
+//
+// Positions include coins frozen by open orders and algo orders, so a
+// protected position still counts as held.
+type Exchange interface {
+	GetSpotBalance(ccy string) (float64, error)
+	GetPositions() (map[string]float64, error)
+	GetOpenOrders(ticker string) (bool, error)
+	GetInstruments() ([]Instrument, error)
+	GetPrice(ticker string) (float64, error)
+	GetCandles(ticker, bar string, limit int) ([]Candle, error)
+	PlaceOrder(req OrderRequest) (string, error)
+	GetOrder(ticker, ordID string) (Order, error)
+	AmendOrder(ticker, ordID string, price float64) error
+	CancelOrder(ticker, ordID string) error
+	PlaceAlgoOrder(req AlgoRequest) (string, error)
+	// GetAlgoOrders lists the algo orders for ticker that haven't triggered
+	// or been canceled
+	GetAlgoOrders(ticker string) ([]AlgoOrder, error)
+	// GetAlgoOrder looks up an algo order in any state, so a triggered one
+	// leads to the order it placed
+	GetAlgoOrder(ticker, algoID string) (AlgoOrder, error)
+	CancelAlgoOrders(ticker string, algoIDs []string) error
+}
+
+// AlgoRequest is a protective order that trades Size at market once the
+// price reaches StopLoss or TakeProfit. Either trigger may be 0, but not
+// both; with both set, whichever triggers first cancels the other (OCO).
+type AlgoRequest struct {
+	Ticker     string
+	Side       string
+	Size       float64 // in the base currency
+	LotSize    float64
+	StopLoss   float64 // trigger price
+	TakeProfit float64 // trigger price
+	ClOrdID    string
+}
+
+// AlgoOrder is the exchange's view of an algo order. States follow OKX:
+// live, effective (triggered) and canceled.
+type AlgoOrder struct {
+	AlgoID     string
+	Ticker     string
+	Side       string
+	Size       float64
+	StopLoss   float64
+	TakeProfit float64
+	State      string
+	OrdID      string // the order it placed once triggered
+}
+
+// Candle is one bar of OHLCV data. Slices of candles are oldest first, and
+// the last one may still be forming.
+type Candle struct {
+	Time   time.Time
+	Open   float64
+	High   float64
+	Low    float64
+	Close  float64
+	Volume float64 // in the base currency
+}
+
+// Order types accepted in OrderRequest.Type.
+const (
+	OrderLimit    = "limit"
+	OrderMarket   = "market"
+	OrderPostOnly = "post_only"
+)
+
+// OrderRequest describes an order to place. Type defaults to a limit order.
+// Limit and post-only orders without a Price are priced from the last trade:
+// limit orders at LimitPrice, post-only orders at PostOnlyPrice.
+type OrderRequest struct {
+	Ticker  string
+	Side    string
+	Type    string
+	Size    float64 // in the base currency
+	LotSize float64
+	Price   float64
+	ClOrdID string
+}
+
+// OrderPrice is the price to post req at given the last traded price, or 0
+// for a market order.
+func (req OrderRequest) OrderPrice(last float64) float64 {
+	switch {
+	case req.Type == OrderMarket:
+		return 0
+	case req.Price > 0:
+		return req.Price
+	case req.Type == OrderPostOnly:
+		return PostOnlyPrice(req.Side, last)
+	default:
+		return LimitPrice(req.Side, last)
+	}
+}
+
+// Order is the exchange's view of a placed order. States follow OKX:
+// live, partially_filled, filled and canceled.
+type Order struct {
+	OrdID    string
+	Ticker   string
+	Side     string
+	State    string
+	Price    float64 // limit price
+	Size     float64
+	FillSize float64
+	AvgPrice float64
+	Fee      float64 // in the quote currency
+}
+
+// Done reports whether the order can no longer fill.
+func (o Order) Done() bool {
+	return o.State == "filled" || o.State == "canceled"
+}
+
+// WaitForOrder polls an order until it is filled or canceled, or until the
+// timeout passes, and returns the last state seen. A timed out order may
+// still be live or partially filled.
+func WaitForOrder(ex Exchange, ticker, ordID string, timeout, interval time.Duration) (Order, error) {
+	deadline := clock.Now().Add(timeout)
+	for {
+		order, err := ex.GetOrder(ticker, ordID)
+		if err != nil {
+			return order, fmt.Errorf("error polling order %s: %v", ordID, err)
+		}
+		if order.Done() {
+			return order, nil
+		}
+		if clock.Now().After(deadline) {
+			log.Printf("Timed out waiting for order %s on %s: state=%s, filled %f/%f", ordID, ticker, order.State, order.FillSize, order.Size)
+			return order, nil
+		}
+		clock.Sleep(interval)
+	}
+}
+
+// LimitPrice is the limit price the bot posts for an order given the last
+// traded price: 0.1% above for buys and 0.1% below for sells, so the order
+// crosses the spread without chasing the book as a market order would.
+func LimitPrice(side string, last float64) float64 {
+	if side == "buy" {
+		return last * 1.001
+	}
+	return last * 0.999
+}
+
+// PostOnlyPrice is the mirror of LimitPrice: 0.1% on the passive side of the
+// last price, so a post-only order rests on the book instead of being
+// canceled for crossing it.
+func PostOnlyPrice(side string, last float64) float64 {
+	if side == "buy" {
+		return last * 0.999
+	}
+	return last * 1.001
+}
+
+// ChasePolicy controls how long an unfilled limit order is left alone, how
+// often it is repriced toward the market and when it is given up on.
+type ChasePolicy struct {
+	Interval     time.Duration // wait for a fill before each reprice
+	PollInterval time.Duration
+	MaxAmends    int
+	MaxSlippage  float64 // furthest a reprice may move from the first limit price, as a fraction
+}
+
+// cancelPolls is how many polls Chase waits for a cancel to be confirmed.
+const cancelPolls = 10
+
+// ChaseResult is how a chased order ended: filled, partial or canceled.
+type ChaseResult struct {
+	Order   Order
+	Amends  int
+	Outcome string
+}
+
+// Chase waits for an order to fill, moving an unfilled remainder to the
+// current LimitPrice up to MaxAmends times while staying within MaxSlippage
+// of the original price. Whatever is still open after that is canceled, so
+// no order is ever left resting.
+func Chase(ex Exchange, ticker, ordID string, policy ChasePolicy) (ChaseResult, error) {
+	result := ChaseResult{}
+	order, err := WaitForOrder(ex, ticker, ordID, policy.Interval, policy.PollInterval)
+	if err != nil {
+		return result, err
+	}
+	originalPrice := order.Price
+
+	for !order.Done() && result.Amends < policy.MaxAmends {
+		last, err := ex.GetPrice(ticker)
+		if err != nil {
+			log.Printf("Error fetching price to reprice order %s: %v", ordID, err)
+			break
+		}
+		newPrice := LimitPrice(order.Side, last)
+		if originalPrice > 0 && math.Abs(newPrice-originalPrice)/originalPrice > policy.MaxSlippage {
+			log.Printf("Not repricing order %s on %s to %f: more than %.2f%% from %f", ordID, ticker, newPrice, policy.MaxSlippage*100, originalPrice)
+			break
+		}
+		if err := ex.AmendOrder(ticker, ordID, newPrice); err != nil {
+			log.Printf("Error repricing order %s on %s: %v", ordID, ticker, err)
+			break
+		}
+		result.Amends++
+		log.Printf("Repriced order %s on %s from %f to %f (%d/%d)", ordID, ticker, order.Price, newPrice, result.Amends, policy.MaxAmends)
+
+		order, err = WaitForOrder(ex, ticker, ordID, policy.Interval, policy.PollInterval)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if !order.Done() {
+		if err := ex.CancelOrder(ticker, ordID); err != nil {
+			// It may have filled in the meantime; the final poll tells us
+			log.Printf("Error canceling order %s on %s: %v", ordID, ticker, err)
+		}
+		// A cancel takes effect within a few polls, however long the order
+		// was left to rest
+		order, err = WaitForOrder(ex, ticker, ordID, cancelPolls*policy.PollInterval, policy.PollInterval)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	result.Order = order
+	switch {
+	case !order.Done():
+		result.Outcome = order.State
+	case order.State == "filled":
+		result.Outcome = "filled"
+	case order.FillSize > 0:
+		result.Outcome = "partial"
+	default:
+		result.Outcome = "canceled"
+	}
+	return result, nil
+}
@@ -0,0 +1,41 @@
+package exchange
+
+import (
+	"crypto_trader/clock"
+	"testing"
+	"time"
+)
+
+// unconfirmed is an exchange whose order stays live after it is canceled.
+type unconfirmed struct {
+	Exchange
+	canceled bool
+}
+
+func (u *unconfirmed) GetOrder(ticker, ordID string) (Order, error) {
+	return Order{OrdID: ordID, Ticker: ticker, State: "live"}, nil
+}
+
+func (u *unconfirmed) CancelOrder(ticker, ordID string) error {
+	u.canceled = true
+	return nil
+}
+
+func TestChaseWaitsBrieflyAfterCancel(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock.Use(clock.NewVirtual(start))
+	defer clock.Use(nil)
+
+	ex := &unconfirmed{}
+	result, err := Chase(ex, "TRXUSDT", "1", ChasePolicy{Interval: time.Hour, PollInterval: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ex.canceled || result.Outcome != "live" {
+		t.Errorf("expected the order to be canceled and still reported live, got %+v", result)
+	}
+	// The order rests its hour, then the cancel is polled for a few seconds
+	if waited := clock.Since(start); waited < time.Hour || waited > time.Hour+10*time.Second {
+		t.Errorf("expected about an hour of waiting, got %s", waited)
+	}
+}
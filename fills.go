@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto_trader/clock"
+	"crypto_trader/db"
+	"crypto_trader/exchange"
+	"crypto_trader/okx"
+	"log"
+	"sync"
+	"time"
+)
+
+// orderTrackingTTL is how long a placed order's strategy is remembered for
+// streamed fills. Orders are settled well within it, and settleOrder records
+// the final fill either way.
+const orderTrackingTTL = time.Hour
+
+type trackedOrder struct {
+	strategy string
+	placed   time.Time
+}
+
+var (
+	trackedMu sync.Mutex
+	// tracked maps the client order IDs of placed orders to their strategy
+	tracked = make(map[string]trackedOrder)
+)
+
+// placeOrder places an order for a strategy, remembering the strategy so its
+// fills can be recorded as the private stream reports them, and records the
+// order.
+func placeOrder(strategy string, req exchange.OrderRequest) (string, error) {
+	trackedMu.Lock()
+	for id, o := range tracked {
+		if clock.Since(o.placed) > orderTrackingTTL {
+			delete(tracked, id)
+		}
+	}
+	tracked[req.ClOrdID] = trackedOrder{strategy: strategy, placed: clock.Now()}
+	trackedMu.Unlock()
+	ordID, err := ex.PlaceOrder(req)
+	if err != nil {
+		return "", err
+	}
+	// Recorded now so the order counts toward max_orders_per_hour while it
+	// is chased; settleOrder fills in the outcome
+	if err := db.RecordOrder(db.Order{OrdID: ordID, Ticker: req.Ticker, Side: req.Side, Size: req.Size, Price: req.Price, Status: "live"}); err != nil {
+		log.Printf("Error recording order %s: %v", ordID, err)
+	}
+	return ordID, nil
+}
+
+// fillStrategy is the strategy a streamed fill belongs to: the one that
+// placed the order, or whose protective order triggered it.
+func fillStrategy(u okx.OrderUpdate) (string, bool) {
+	if u.AlgoID != "" {
+		p, ok, err := db.FindProtectiveOrder(u.AlgoID)
+		if err != nil {
+			log.Printf("Error finding protective order %s: %v", u.AlgoID, err)
+		}
+		return p.Strategy, ok
+	}
+	trackedMu.Lock()
+	defer trackedMu.Unlock()
+	o, ok := tracked[u.ClOrdID]
+	return o.strategy, ok
+}
+
+// recordFill records a fill from the private stream as the order's
+// transaction. settleOrder records the final fill again when it is done.
+func recordFill(u okx.OrderUpdate) {
+	strategy, ok := fillStrategy(u)
+	if !ok {
+		log.Printf("Fill of %.8f %s on order %s the bot didn't place, not recording it", u.FillSize, u.Ticker, u.OrdID)
+		return
+	}
+	usdtValue := u.FillSize * u.AvgPrice
+	if err := db.UpsertTransaction(u.OrdID, strategy, u.Ticker, u.Side, u.FillSize, u.AvgPrice, usdtValue, u.Fee); err != nil {
+		log.Printf("Error recording fill of order %s: %v", u.OrdID, err)
+		return
+	}
+	log.Printf("Order %s for %s %s %s filled %.8f/%.8f at %.8f", u.OrdID, strategy, u.Ticker, u.Side, u.FillSize, u.Size, u.AvgPrice)
+}
@@ -2,4 +2,8 @@ module crypto_trader
 
 go 1.23
 
-require github.com/mattn/go-sqlite3 v1.14.22
+require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/mattn/go-sqlite3 v1.14.22
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,163 @@
+// Package indicator computes technical indicators over price series. Series
+// are oldest first; each function uses the most recent values it needs and
+// returns 0 when there aren't enough of them.
+package indicator
+
+import "math"
+
+// TrueRange is the largest of the bar's range and its gaps from the
+// previous close.
+func TrueRange(high, low, prevClose float64) float64 {
+	return math.Max(high-low, math.Max(math.Abs(high-prevClose), math.Abs(low-prevClose)))
+}
+
+// ATR is the average true range of the last period bars, using Wilder's
+// smoothing over all the bars given.
+func ATR(high, low, close []float64, period int) float64 {
+	n := len(close)
+	if period <= 0 || len(high) != n || len(low) != n || n < period+1 {
+		return 0
+	}
+	var atr float64
+	for i := 1; i <= period; i++ {
+		atr += TrueRange(high[i], low[i], close[i-1])
+	}
+	atr /= float64(period)
+	for i := period + 1; i < n; i++ {
+		atr = (atr*float64(period-1) + TrueRange(high[i], low[i], close[i-1])) / float64(period)
+	}
+	return atr
+}
+
+// Returns are the simple returns between consecutive values.
+func Returns(values []float64) []float64 {
+	if len(values) < 2 {
+		return nil
+	}
+	returns := make([]float64, 0, len(values)-1)
+	for i := 1; i < len(values); i++ {
+		if values[i-1] == 0 {
+			returns = append(returns, 0)
+			continue
+		}
+		returns = append(returns, values[i]/values[i-1]-1)
+	}
+	return returns
+}
+
+// StdDev is the sample standard deviation of the last period values.
+func StdDev(values []float64, period int) float64 {
+	if period < 2 || len(values) < period {
+		return 0
+	}
+	values = values[len(values)-period:]
+	var mean float64
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(period)
+	var sum float64
+	for _, v := range values {
+		sum += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(sum / float64(period-1))
+}
+
+// SMA is the mean of the last period values.
+func SMA(values []float64, period int) float64 {
+	if period <= 0 || len(values) < period {
+		return 0
+	}
+	var sum float64
+	for _, v := range values[len(values)-period:] {
+		sum += v
+	}
+	return sum / float64(period)
+}
+
+// EMA is the exponential moving average over all the values given, seeded
+// with the SMA of the first period of them.
+func EMA(values []float64, period int) float64 {
+	series := emaSeries(values, period)
+	if len(series) == 0 {
+		return 0
+	}
+	return series[len(series)-1]
+}
+
+// emaSeries is the EMA at every value from the period-th on.
+func emaSeries(values []float64, period int) []float64 {
+	if period <= 0 || len(values) < period {
+		return nil
+	}
+	k := 2 / float64(period+1)
+	series := make([]float64, 0, len(values)-period+1)
+	ema := SMA(values[:period], period)
+	series = append(series, ema)
+	for _, v := range values[period:] {
+		ema = v*k + ema*(1-k)
+		series = append(series, ema)
+	}
+	return series
+}
+
+// RSI is the relative strength index of the last period changes, using
+// Wilder's smoothing over all the values given.
+func RSI(values []float64, period int) float64 {
+	if period <= 0 || len(values) < period+1 {
+		return 0
+	}
+	var gain, loss float64
+	for i := 1; i <= period; i++ {
+		gain += math.Max(values[i]-values[i-1], 0)
+		loss += math.Max(values[i-1]-values[i], 0)
+	}
+	gain /= float64(period)
+	loss /= float64(period)
+	for i := period + 1; i < len(values); i++ {
+		gain = (gain*float64(period-1) + math.Max(values[i]-values[i-1], 0)) / float64(period)
+		loss = (loss*float64(period-1) + math.Max(values[i-1]-values[i], 0)) / float64(period)
+	}
+	if loss == 0 {
+		if gain == 0 {
+			return 50
+		}
+		return 100
+	}
+	return 100 - 100/(1+gain/loss)
+}
+
+// MACD is the fast EMA less the slow one, the signal EMA of that line, and
+// the histogram between them.
+func MACD(values []float64, fast, slow, signal int) (macd, signalLine, histogram float64) {
+	if fast <= 0 || fast >= slow || signal <= 0 || len(values) < slow+signal-1 {
+		return 0, 0, 0
+	}
+	fastSeries := emaSeries(values, fast)
+	slowSeries := emaSeries(values, slow)
+	// Line up the fast EMAs with the slow ones, which start later
+	fastSeries = fastSeries[slow-fast:]
+	line := make([]float64, len(slowSeries))
+	for i := range slowSeries {
+		line[i] = fastSeries[i] - slowSeries[i]
+	}
+	macd = line[len(line)-1]
+	signalLine = EMA(line, signal)
+	return macd, signalLine, macd - signalLine
+}
+
+// Bollinger is the SMA of the last period values and the bands width
+// standard deviations either side of it.
+func Bollinger(values []float64, period int, width float64) (middle, upper, lower float64) {
+	if period < 2 || len(values) < period {
+		return 0, 0, 0
+	}
+	middle = SMA(values, period)
+	// The bands use the population deviation, as charting tools do
+	var sum float64
+	for _, v := range values[len(values)-period:] {
+		sum += (v - middle) * (v - middle)
+	}
+	dev := math.Sqrt(sum / float64(period))
+	return middle, middle + width*dev, middle - width*dev
+}
@@ -1,36 +1,74 @@
 package main
 
 import (
+	"bytes"
+	"crypto_trader/candles"
+	"crypto_trader/clock"
+	"crypto_trader/config"
 	"crypto_trader/db"
+	"crypto_trader/exchange"
+	"crypto_trader/marketdata"
 	"crypto_trader/okx"
+	"crypto_trader/paper"
+	"crypto_trader/risk"
+	"crypto_trader/sizing"
+	"crypto_trader/strategy"
 	crypto_trader "crypto_trader/testsuite"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
 	"math"
+	"net"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
 type Alert struct {
-	Ticker string `json:"ticker"`
-	Signal string `json:"signal"`
+	Ticker     string `json:"ticker"`
+	Signal     string `json:"signal"`
+	Passphrase string `json:"passphrase,omitempty"`
+	// ID or Timestamp, when the sender includes one, identify repeats of an
+	// alert; otherwise repeats are recognised by an identical body
+	ID        string `json:"id,omitempty"`
+	Timestamp string `json:"timestamp,omitempty"`
+
+	// Optional sizing, at most one of them; without one, buys are sized by
+	// equal weight and sells close the whole position
+	Qty             float64 `json:"qty,omitempty"`               // base currency
+	QuoteAmount     float64 `json:"quote_amount,omitempty"`      // quote currency
+	PercentOfEquity float64 `json:"percent_of_equity,omitempty"` // of everything held in the quote currency
+	OrderType       string  `json:"order_type,omitempty"`        // limit (default), market or post_only
+	LimitPrice      float64 `json:"limit_price,omitempty"`
+	ExpireAfter     string  `json:"expire_after,omitempty"` // how long a resting order waits for a fill, e.g. 30m
+	Strategy        string  `json:"strategy,omitempty"`
+	Comment         string  `json:"comment,omitempty"`
 }
 
 type StateWithPrice struct {
+	Strategy      string
 	Ticker        string
+	Quote         string
 	Signal        string
 	Position      float64
 	Price         float64
-	PositionValue float64 // Value of the position in USDT
-	LastUpdate    time.Time
-	USDTBalance   float64
+	PositionValue float64 // Value of the position in the quote currency
+	// Profit of the strategy's trades in the pair, in the quote currency,
+	// from its lots. Performance is realized plus unrealized as a % of
+	// everything bought
+	AvgEntry    float64
+	CostBasis   float64
+	Realized    float64
+	Unrealized  float64
+	Performance float64
+	HasPnL      bool
+	LastUpdate  time.Time
 }
 
 type Transaction struct {
@@ -44,80 +82,62 @@ type Transaction struct {
 }
 
 var (
-	mu           sync.Mutex
-	defaultPairs = []string{"BTCUSDT", "TRXUSDT", "SUIUSDT", "SOLUSDT", "NEARUSDT", "TONUSDT", "ICPUSDT"}
-	lotSizes     = make(map[string]float64)
-)
-
-func fetchLotSizes() error {
-	baseURL := "https://www.okx.com"
-	endpoint := "/api/v5/public/instruments?instType=SPOT"
-	url := fmt.Sprintf("%s%s", baseURL, endpoint)
+	cfg *config.Config
+
+	// chasePolicy decides how unfilled limit orders are repriced and canceled
+	chasePolicy = exchange.ChasePolicy{
+		Interval:     5 * time.Second,
+		PollInterval: 500 * time.Millisecond,
+		MaxAmends:    3,
+		MaxSlippage:  0.005,
+	}
+	// restExpiry is how long an order at an alert's limit price or a
+	// post-only order rests unfilled before it is canceled, unless the alert
+	// says otherwise
+	restExpiry = time.Hour
 
-	for retries := 0; retries < 3; retries++ {
-		resp, err := http.Get(url)
-		if err != nil {
-			log.Printf("Retrying instruments fetch (%d/3): %v", retries+1, err)
-			time.Sleep(time.Second * time.Duration(retries+1))
-			continue
-		}
-		defer resp.Body.Close()
+	// listenAddr is where the server listens
+	listenAddr = ":8080"
 
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			log.Printf("Retrying instruments fetch (%d/3): status %d, body %s", retries+1, resp.StatusCode, string(body))
-			time.Sleep(time.Second * time.Duration(retries+1))
-			continue
-		}
+	// ex is the venue every handler trades against; main injects it at startup.
+	ex exchange.Exchange
 
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return fmt.Errorf("error reading instrument response: %v", err)
-		}
-		responseStr := string(bodyBytes)
-		if len(responseStr) > 1000 {
-			responseStr = responseStr[:1000] + "..."
-		}
-		log.Printf("OKX instruments response for SPOT: %s", responseStr)
+	// marketData streams tickers for the configured pairs. Prices it has no
+	// fresh quote for, or all of them when it is nil, come from REST.
+	marketData *marketdata.Feed
+)
 
-		var result struct {
-			Data []struct {
-				InstId string `json:"instId"`
-				LotSz  string `json:"lotSz"`
-			} `json:"data"`
-		}
-		if err := json.Unmarshal(bodyBytes, &result); err != nil {
-			return fmt.Errorf("error decoding instrument details: %v", err)
-		}
+// loadInstruments registers every configured pair with the metadata OKX
+// lists for it, falling back to the config when OKX doesn't list the pair or
+// reports an unusable lot size.
+func loadInstruments() error {
+	listed, err := ex.GetInstruments()
+	if err != nil {
+		return err
+	}
+	byTicker := make(map[string]exchange.Instrument)
+	for _, inst := range listed {
+		byTicker[inst.Ticker()] = inst
+	}
 
-		for _, inst := range result.Data {
-			ticker := strings.Replace(inst.InstId, "-USDT", "USDT", 1)
-			if contains(defaultPairs, ticker) {
-				lotSz, err := strconv.ParseFloat(inst.LotSz, 64)
-				if err != nil {
-					log.Printf("Error parsing lotSz for %s: %v", ticker, err)
-				 continue
-				}
-				if lotSz < 0.0000001 || lotSz > 1 {
-					log.Printf("Invalid lotSz for %s: %f, skipping", ticker, lotSz)
-					continue
-				}
-				lotSizes[ticker] = lotSz
-				log.Printf("Fetched lotSz: %f for %s", lotSz, ticker)
+	for _, pair := range cfg.Pairs {
+		inst, ok := byTicker[pair.Ticker]
+		if !ok {
+			if pair.Base != "" {
+				inst = exchange.Instrument{InstID: pair.Base + "-" + pair.Quote, Base: pair.Base, Quote: pair.Quote}
+			} else if inst, ok = exchange.ParseTicker(pair.Ticker); !ok {
+				return fmt.Errorf("can't tell the base and quote of %s, set them in the config", pair.Ticker)
 			}
+			log.Printf("%s is not listed by the exchange, using %s", pair.Ticker, inst.InstID)
 		}
-		return nil
-	}
-	return fmt.Errorf("failed to fetch instruments after 3 retries")
-}
-
-func contains(slice []string, item string) bool {
-	for _, s := range slice {
-		if s == item {
-			return true
+		if inst.LotSize < 0.0000001 || inst.LotSize > 1 {
+			log.Printf("Invalid lotSz for %s: %f, setting default: %f", pair.Ticker, inst.LotSize, pair.LotSize)
+			inst.LotSize = pair.LotSize
 		}
+		exchange.Register(inst)
+		log.Printf("Registered %s: base=%s quote=%s lotSz=%f", inst.InstID, inst.Base, inst.Quote, inst.LotSize)
 	}
-	return false
+	return nil
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
@@ -126,181 +146,356 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+	if err != nil {
+		log.Printf("Error reading payload from %s: %v", clientIP(r), err)
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
 	var alert Alert
-	if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+	if err := json.Unmarshal(body, &alert); err != nil {
 		log.Printf("Invalid JSON payload: %v", err)
 		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
 		return
 	}
+	// Senders may include fields of their own; they're ignored, but logged in
+	// case one is a misspelt option
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&Alert{}); err != nil {
+		log.Printf("Ignoring alert field: %v", err)
+	}
+
+	if !authenticateAlert(r, body, alert.Passphrase) {
+		log.Printf("Rejected unauthenticated alert from %s", clientIP(r))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 	log.Printf("Received alert: Ticker=%s, Signal=%s", alert.Ticker, alert.Signal)
 
-	if !isValidTicker(alert.Ticker) {
-		log.Printf("Invalid ticker: %s", alert.Ticker)
-		http.Error(w, "Invalid ticker", http.StatusBadRequest)
+	alert.Passphrase = ""
+	id, duplicate, err := submitAlert(alert, body)
+	if err != nil {
+		var rejected *alertRejection
+		if errors.As(err, &rejected) {
+			http.Error(w, rejected.Error(), rejected.status)
+		} else {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+		}
 		return
 	}
 
-	client := okx.NewClient(
-		os.Getenv("OKX_API_KEY"),
-		os.Getenv("OKX_SECRET_KEY"),
-		os.Getenv("OKX_PASSPHRASE"),
-	)
+	// ?wait=30s holds the response until the alert has been processed.
+	// Repeats are answered with the first alert's result when it has one.
+	wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+	record, done := waitForAlert(id, wait)
+	status := http.StatusAccepted
+	if done && (wait > 0 || duplicate) {
+		status = http.StatusOK
+		if record.Status == "failed" {
+			status = http.StatusInternalServerError
+		}
+	}
+	writeAlertStatus(w, status, record, duplicate)
+}
+
+// alertRejection is why an alert was turned away before it was queued.
+type alertRejection struct {
+	status int
+	msg    string
+}
 
-	mu.Lock()
-	defer mu.Unlock()
+func (r *alertRejection) Error() string {
+	return r.msg
+}
+
+// submitAlert checks an authenticated alert and queues it for the workers,
+// the way handler does for webhooks. body is what the sender sent, which
+// identifies repeats of alerts without an ID or timestamp. Alerts that fail
+// the checks are returned as an *alertRejection.
+func submitAlert(alert Alert, body []byte) (int64, bool, error) {
+	if !isValidTicker(alert.Ticker) {
+		log.Printf("Invalid ticker: %s", alert.Ticker)
+		return 0, false, &alertRejection{http.StatusBadRequest, "Invalid ticker"}
+	}
+	if err := validateAlert(alert); err != nil {
+		log.Printf("Invalid alert for %s: %v", alert.Ticker, err)
+		return 0, false, &alertRejection{http.StatusBadRequest, "Invalid alert: " + err.Error()}
+	}
+	if blocked, err := tradingBlocked(alert.Ticker, alert.Signal); err != nil {
+		log.Printf("Error checking controls: %v", err)
+		return 0, false, fmt.Errorf("database error: %v", err)
+	} else if blocked != "" {
+		log.Printf("Rejected alert for %s: %s", alert.Ticker, blocked)
+		return 0, false, &alertRejection{http.StatusServiceUnavailable, "Trading blocked: " + blocked}
+	}
 
-	currentState, err := db.GetState(alert.Ticker)
+	id, duplicate, err := enqueueAlert(alert, dedupeKey(alert, body))
 	if err != nil {
-		log.Printf("Error getting state for %s: %v", alert.Ticker, err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
+		log.Printf("Error queueing alert: %v", err)
+		return 0, false, fmt.Errorf("database error: %v", err)
+	}
+	if duplicate {
+		log.Printf("Alert is a repeat of alert %d, not processing it again", id)
+	} else {
+		log.Printf("Queued alert %d: Ticker=%s, Signal=%s", id, alert.Ticker, alert.Signal)
 	}
-	log.Printf("Retrieved state for %s: Signal=%s, Position=%f, LastUpdate=%s",
-		alert.Ticker, currentState.Signal, currentState.Position, currentState.LastUpdate)
+	return id, duplicate, nil
+}
 
-	if currentState.Signal == alert.Signal {
-		log.Printf("Ticker %s already in %s state, skipping order", alert.Ticker, alert.Signal)
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, "Alert processed (no action): %s %s", alert.Ticker, alert.Signal)
-		return
+// processAlert acts on one alert and returns a summary of what it did.
+// Workers never run two alerts for the same ticker at once. ref identifies
+// the alert in the client order IDs of the orders it places, so processing
+// the same alert again can't submit them twice.
+func processAlert(alert Alert, ref string) (string, error) {
+	// Each strategy keeps its own signal and position for the ticker
+	strategy := alertStrategy(alert)
+	currentState, err := db.GetState(strategy, alert.Ticker)
+	if err != nil {
+		log.Printf("Error getting state for %s %s: %v", strategy, alert.Ticker, err)
+		return "", fmt.Errorf("database error: %v", err)
 	}
+	log.Printf("Retrieved state for %s %s: Signal=%s, Position=%f, LastUpdate=%s",
+		strategy, alert.Ticker, currentState.Signal, currentState.Position, currentState.LastUpdate)
 
-	// Check for open orders across all pairs
-	for _, pair := range defaultPairs {
-		hasOpenOrders, err := client.GetOpenOrders(pair)
-		if err != nil {
-			log.Printf("Error checking open orders for %s: %v", pair, err)
-			http.Error(w, "Failed to check open orders", http.StatusInternalServerError)
-			return
-		}
-		if hasOpenOrders {
-			log.Printf("Open orders exist for %s, cannot place new order for %s", pair, alert.Ticker)
-			http.Error(w, "Open orders exist for other pairs", http.StatusInternalServerError)
-			return
+	if alert.Comment != "" {
+		log.Printf("Alert for %s from strategy %s: %s", alert.Ticker, strategy, alert.Comment)
+	}
+
+	// Controls may have changed while the alert was queued
+	if blocked, err := tradingBlocked(alert.Ticker, alert.Signal); err != nil {
+		return "", fmt.Errorf("database error: %v", err)
+	} else if blocked != "" {
+		log.Printf("Not processing alert for %s: %s", alert.Ticker, blocked)
+		return "", fmt.Errorf("trading blocked: %s", blocked)
+	}
+
+	// A stop-loss or take-profit may have sold the position since the last alert
+	currentState = syncProtection(strategy, alert.Ticker, currentState)
+
+	// An alert that gives its own size may scale into or out of a position,
+	// so only equal-weight alerts are skipped when the signal hasn't changed
+	if currentState.Signal == alert.Signal && !alert.sized() {
+		log.Printf("Ticker %s already in %s state for %s, skipping order", alert.Ticker, alert.Signal, strategy)
+		return fmt.Sprintf("Alert processed (no action): %s %s", alert.Ticker, alert.Signal), nil
+	}
+
+	// Orders are chased until they fill or are canceled, so one left open here
+	// means something else is trading this pair
+	hasOpenOrders, err := ex.GetOpenOrders(alert.Ticker)
+	if err != nil {
+		log.Printf("Error checking open orders for %s: %v", alert.Ticker, err)
+		return "", fmt.Errorf("failed to check open orders: %v", err)
+	}
+	if hasOpenOrders {
+		log.Printf("Open orders exist for %s, cannot place new order", alert.Ticker)
+		return "", fmt.Errorf("open orders exist for %s", alert.Ticker)
+	}
+
+	// Balances are read, orders sized and placed under the portfolio lock so
+	// concurrent alerts can't size against the same funds. Waiting for fills
+	// happens after it is released.
+	portfolioMu.Lock()
+	locked := true
+	unlock := func() {
+		if locked {
+			portfolioMu.Unlock()
+			locked = false
 		}
 	}
+	defer unlock()
 
-	spotBalance, err := client.GetSpotBalance()
+	// Sizing happens in the pair's quote currency
+	inst, _ := exchange.ParseTicker(alert.Ticker)
+	quote := inst.Quote
+	minOrderValueQuote, err := minOrderValue(quote)
+	if err != nil {
+		log.Printf("Error converting minimum order value to %s: %v", quote, err)
+		return "", fmt.Errorf("failed to get price: %v", err)
+	}
+
+	spotBalance, err := ex.GetSpotBalance(quote)
 	if err != nil {
 		log.Printf("Error getting available spot balance: %v", err)
-		http.Error(w, "Failed to get balance", http.StatusInternalServerError)
-		return
+		return "", fmt.Errorf("failed to get balance: %v", err)
 	}
-	log.Printf("Available spot balance: %.2f USDT", spotBalance)
+	log.Printf("Available spot balance: %.8f %s", spotBalance, quote)
 
-	// Minimum balance: 10 USDT (OKX minimum order value) plus 0.5 USDT buffer
-	minBalance := 10.5
-	if spotBalance < minBalance {
-		log.Printf("Insufficient available balance: %.2f USDT, need %.2f USDT", spotBalance, minBalance)
-		http.Error(w, "Insufficient available balance", http.StatusInternalServerError)
-		return
+	// The strategy only sizes against its share of the balance
+	cash, err := strategyCash(strategy, quote, spotBalance)
+	if err != nil {
+		log.Printf("Error getting %s cash for %s: %v", quote, strategy, err)
+		return "", fmt.Errorf("failed to get strategy cash: %v", err)
+	}
+	log.Printf("Cash available to %s: %.8f %s", strategy, cash, quote)
+
+	// Minimum balance: OKX's minimum order value of 10 USDT, in the quote
+	// currency, plus a 5% buffer. Sells don't spend the quote currency, so
+	// they go through regardless.
+	minBalance := minOrderValueQuote * 1.05
+	if alert.Signal == "buy" && cash < minBalance {
+		log.Printf("Insufficient available balance for %s: %.8f %s, need %.8f %s", strategy, cash, quote, minBalance, quote)
+		return "", fmt.Errorf("insufficient available balance: %.8f %s", cash, quote)
 	}
 
-	positions, err := client.GetPositions()
+	positions, err := ex.GetPositions()
 	if err != nil {
 		log.Printf("Error getting positions: %v", err)
-		http.Error(w, "Failed to get positions", http.StatusInternalServerError)
-		return
+		return "", fmt.Errorf("failed to get positions: %v", err)
 	}
 	log.Printf("Current positions: %v", positions)
 
 	price := getCurrentPrice(alert.Ticker)
 	if price == 0 {
 		log.Printf("Failed to get price for %s", alert.Ticker)
-		http.Error(w, "Failed to get price", http.StatusInternalServerError)
-		return
+		return "", fmt.Errorf("failed to get price for %s", alert.Ticker)
 	}
 	log.Printf("Current price for %s: %f", alert.Ticker, price)
+	// Orders are sized at the price they will be posted at
+	orderPrice := exchange.OrderRequest{Side: alert.Signal, Type: alert.OrderType, Price: alert.LimitPrice}.OrderPrice(price)
+	if orderPrice == 0 {
+		orderPrice = price // market order
+	}
 
-	var totalCryptoValue float64
-	for _, pair := range defaultPairs {
-		if pos, ok := positions[pair]; ok {
-			price := getCurrentPrice(pair)
-			totalCryptoValue += pos * price
+	// Only pairs sharing this quote currency draw on the same balance
+	var sameQuote []string
+	for _, pair := range cfg.Tickers() {
+		if other, ok := exchange.ParseTicker(pair); ok && other.Quote == quote {
+			sameQuote = append(sameQuote, pair)
 		}
 	}
-	availableFunds := spotBalance + totalCryptoValue
-	log.Printf("Total crypto value: %f, Available funds: %f", totalCryptoValue, availableFunds)
 
+	var totalCryptoValue float64
 	buyCount := 0
-	for _, pair := range defaultPairs {
-		state, _ := db.GetState(pair)
+	for _, pair := range sameQuote {
+		state, _ := db.GetState(strategy, pair)
+		if state.Position > 0 {
+			price := getCurrentPrice(pair)
+			totalCryptoValue += state.Position * price
+		}
 		if state.Signal == "buy" {
 			buyCount++
 		}
 	}
+	availableFunds := cash + totalCryptoValue
+	log.Printf("Total crypto value for %s: %f %s, Available funds: %f %s", strategy, totalCryptoValue, quote, availableFunds, quote)
 	log.Printf("Number of buy signals: %d", buyCount)
 
 	var size float64
 	var orderPlaced bool
-	lotSize, exists := lotSizes[alert.Ticker]
-	if !exists || lotSize < 0.0000001 || lotSize > 1 {
-		log.Printf("Invalid or missing lot size for %s (%f), using default 0.1", alert.Ticker, lotSize)
-		lotSize = 0.1 // Fallback for TRXUSDT
+	var delta float64 // change in the strategy's position
+	var boughtAt float64
+	var kept db.ProtectiveOrder // protection canceled to free coins for a sell
+	// Lot sizes come from the exchange, or the pair's lot_size when it has
+	// none; without either the size can't be rounded
+	lotSize := inst.LotSize
+	if lotSize <= 0 {
+		log.Printf("No lot size for %s, not trading it", alert.Ticker)
+		return "", fmt.Errorf("unknown lot size for %s, set lot_size in the config", alert.Ticker)
 	}
 	log.Printf("Using lot size for %s: %f", alert.Ticker, lotSize)
 
 	if alert.Signal == "buy" {
-		// Adjust allocation based on available funds and existing positions
-		targetAllocation := math.Min(spotBalance, availableFunds/float64(buyCount+1))
 		currentPos := currentState.Position
-		targetPos := targetAllocation / price
-		log.Printf("Target allocation for %s: %f, Target position: %f", alert.Ticker, targetAllocation, targetPos)
-
-		if currentPos > 0 {
-			if currentPos > targetPos {
-				size = currentPos - targetPos
-				log.Printf("Selling excess for %s: size=%f", alert.Ticker, size)
-				err = client.PlaceOrder(alert.Ticker, "sell", size, lotSize)
-				if err == nil {
-					usdtValue := size * price
-					db.RecordTransaction(alert.Ticker, "sell", size, price, usdtValue)
-					log.Printf("Sell order placed for %s, size=%f, USDT value=%f", alert.Ticker, size, usdtValue)
-					orderPlaced = true
-				}
-			}
+		if alert.sized() {
+			size = alert.requestedSize(orderPrice, availableFunds)
+			log.Printf("Buying requested size for %s: size=%f", alert.Ticker, size)
 		} else {
-			size = targetPos
-			log.Printf("Buying new position for %s: size=%f", alert.Ticker, size)
+			sizer, err := sizing.New(cfg.SizingFor(strategy, alert.Ticker), ex)
+			if err != nil {
+				return "", fmt.Errorf("invalid sizing for %s: %v", alert.Ticker, err)
+			}
+			targetPos, err := sizer.Target(sizing.Input{
+				Ticker:     alert.Ticker,
+				Price:      price,
+				Cash:       cash,
+				Equity:     availableFunds,
+				Position:   currentPos,
+				BuySignals: buyCount,
+			})
+			if err != nil {
+				log.Printf("Error sizing %s for %s: %v", alert.Ticker, strategy, err)
+				return "", fmt.Errorf("failed to size order: %v", err)
+			}
+			log.Printf("Target position for %s: %f, current position: %f", alert.Ticker, targetPos, currentPos)
+			size = targetPos - currentPos
 		}
 
-		// Enforce minimum order value of 10 USDT
-		minOrderValueUSDT := 10.0
-		minSizeForValue := minOrderValueUSDT / price
-		if size < minSizeForValue {
-			log.Printf("Adjusted size for %s from %.8f to %.8f to meet minimum order value of %.2f USDT", alert.Ticker, size, minSizeForValue, minOrderValueUSDT)
+		// Enforce the minimum order value, 10 USDT in the quote currency
+		minSizeForValue := minOrderValueQuote / orderPrice
+		switch {
+		case size < 0:
+			excess := -size
+			size = 0
+			if excess*price < minOrderValueQuote {
+				log.Printf("Excess of %f %s is below the minimum order value, not trimming", excess, alert.Ticker)
+				break
+			}
+			log.Printf("Selling excess for %s: size=%f", alert.Ticker, excess)
+			if kept, err = unprotect(strategy, alert.Ticker); err != nil {
+				log.Printf("Error canceling protection for %s: %v", alert.Ticker, err)
+				return "", err
+			}
+			var order exchange.Order
+			order, err = executeOrder(strategy, exchange.OrderRequest{Ticker: alert.Ticker, Side: "sell", Size: excess, LotSize: lotSize, ClOrdID: ref + "l1"})
+			delta += positionChange(order)
+			if err == nil && order.FillSize > 0 {
+				log.Printf("Sell order filled for %s, size=%f, value=%f %s", alert.Ticker, order.FillSize, order.FillSize*order.AvgPrice, quote)
+				orderPlaced = true
+			}
+		case size < minSizeForValue && alert.sized():
+			log.Printf("Requested size for %s is below the minimum order value: %.8f < %.8f", alert.Ticker, size, minSizeForValue)
+			return "", fmt.Errorf("requested size %.8f is below the minimum order value of %.8f %s", size, minOrderValueQuote, quote)
+		case size < minSizeForValue && currentPos > 0:
+			log.Printf("%s is within the minimum order value of its target position, not buying", alert.Ticker)
+			size = 0
+		case size < minSizeForValue:
+			log.Printf("Adjusted size for %s from %.8f to %.8f to meet minimum order value of %.8f %s", alert.Ticker, size, minSizeForValue, minOrderValueQuote, quote)
 			size = minSizeForValue
 		}
 
+		// Check if we have enough funds for the adjusted size. Sizers target
+		// cash at the last price, so their buys are trimmed to what the
+		// limit price allows.
+		if cost := size * orderPrice; cost > cash {
+			if alert.sized() {
+				log.Printf("Insufficient funds for %s: need %.8f %s, have %.8f %s", alert.Ticker, cost, quote, cash, quote)
+				return "", fmt.Errorf("insufficient funds: need %.8f %s, have %.8f %s", cost, quote, cash, quote)
+			}
+			size = cash / orderPrice
+			log.Printf("Reduced size for %s to %.8f to fit %.8f %s", alert.Ticker, size, cash, quote)
+		}
+
 		// Round size to lot size precision
-		if lotSize > 0 {
+		if lotSize > 0 && size > 0 {
 			size = float64(int(size/lotSize)) * lotSize
 			log.Printf("Rounded size for %s to %.8f (multiple of lotSize %f)", alert.Ticker, size, lotSize)
 		}
 
-		// Check if we have enough funds for the adjusted size
-		usdtValue := size * price
-		if usdtValue > spotBalance {
-			log.Printf("Insufficient funds for %s: need %.2f USDT, have %.2f USDT", alert.Ticker, usdtValue, spotBalance)
-			http.Error(w, "Insufficient funds", http.StatusInternalServerError)
-			return
-		}
-
 		// Validate size is a multiple of lotSize
 		if lotSize > 0 && math.Abs(math.Mod(size/lotSize, 1)) > 1e-10 {
 			log.Printf("Invalid size for %s: %f is not a multiple of lotSize %f", alert.Ticker, size, lotSize)
-			http.Error(w, "Invalid order size", http.StatusInternalServerError)
-			return
+			return "", fmt.Errorf("invalid order size %f for lot size %f", size, lotSize)
 		}
 
 		if size > 0 {
 			log.Printf("Attempting to place buy order for %s with size %.8f", alert.Ticker, size)
-			err = client.PlaceOrder(alert.Ticker, "buy", size, lotSize)
+			var order exchange.Order
+			var ordID string
+			req, policy := alert.orderRequest("buy", size, lotSize, ref+"l2")
+			ordID, err = placeOrder(strategy, req)
+			unlock()
 			if err == nil {
-				usdtValue := size * price
-				db.RecordTransaction(alert.Ticker, "buy", size, price, usdtValue)
-				log.Printf("Buy order placed for %s, size=%.8f, USDT value=%.2f", alert.Ticker, size, usdtValue)
-				orderPlaced = true
+				order, err = settleOrder(strategy, alert.Ticker, "buy", ordID, policy)
+				delta += positionChange(order)
+			}
+			if err == nil {
+				log.Printf("Buy order for %s filled %.8f of %.8f, value=%.8f %s", alert.Ticker, order.FillSize, size, order.FillSize*order.AvgPrice, quote)
+				orderPlaced = orderPlaced || order.FillSize > 0
+				if order.FillSize > 0 {
+					boughtAt = order.AvgPrice
+				}
 			} else {
 				log.Printf("Failed to place buy order for %s: %v", alert.Ticker, err)
 			}
@@ -308,13 +503,27 @@ func handler(w http.ResponseWriter, r *http.Request) {
 
 	} else if alert.Signal == "sell" {
 		if currentState.Position > 0 {
-			size = currentState.Position
-			// Enforce minimum order value of 10 USDT
-			minOrderValueUSDT := 10.0
-			minSizeForValue := minOrderValueUSDT / price
+			// Never sell more than the account actually holds
+			held := math.Min(currentState.Position, positions[alert.Ticker])
+			size = held
+			if size <= 0 {
+				log.Printf("%s holds %f %s but the account holds none", strategy, currentState.Position, alert.Ticker)
+				return "", fmt.Errorf("no %s held to sell", alert.Ticker)
+			}
+			if alert.sized() {
+				size = math.Min(size, alert.requestedSize(orderPrice, availableFunds))
+			}
+			// Enforce the minimum order value, 10 USDT in the quote currency
+			minSizeForValue := minOrderValueQuote / orderPrice
+			if size < minSizeForValue && size < currentState.Position {
+				log.Printf("Requested size for %s is below the minimum order value: %.8f < %.8f", alert.Ticker, size, minSizeForValue)
+				return "", fmt.Errorf("requested size %.8f is below the minimum order value of %.8f %s", size, minOrderValueQuote, quote)
+			}
 			if size < minSizeForValue {
-				log.Printf("Adjusted size for %s from %.8f to %.8f to meet minimum order value of %.2f USDT", alert.Ticker, size, minSizeForValue, minOrderValueUSDT)
-				size = minSizeForValue
+				// Other strategies' coins in the account aren't this one's to sell
+				adjusted := math.Min(minSizeForValue, held)
+				log.Printf("Adjusted size for %s from %.8f to %.8f to meet minimum order value of %.8f %s", alert.Ticker, size, adjusted, minOrderValueQuote, quote)
+				size = adjusted
 			}
 			// Round size to lot size precision
 			if lotSize > 0 {
@@ -324,59 +533,116 @@ func handler(w http.ResponseWriter, r *http.Request) {
 			// Validate size is a multiple of lotSize
 			if lotSize > 0 && math.Abs(math.Mod(size/lotSize, 1)) > 1e-10 {
 				log.Printf("Invalid size for %s: %f is not a multiple of lotSize %f", alert.Ticker, size, lotSize)
-				http.Error(w, "Invalid order size", http.StatusInternalServerError)
-				return
+				return "", fmt.Errorf("invalid order size %f for lot size %f", size, lotSize)
 			}
-			log.Printf("Selling entire position for %s: size=%.8f", alert.Ticker, size)
-			err = client.PlaceOrder(alert.Ticker, "sell", size, lotSize)
+			log.Printf("Selling %.8f of the %.8f position for %s", size, currentState.Position, alert.Ticker)
+			// Protective orders hold the coins, so they go first
+			if kept, err = unprotect(strategy, alert.Ticker); err != nil {
+				log.Printf("Error canceling protection for %s: %v", alert.Ticker, err)
+				return "", err
+			}
+			var order exchange.Order
+			var ordID string
+			req, policy := alert.orderRequest("sell", size, lotSize, ref+"l1")
+			ordID, err = placeOrder(strategy, req)
+			unlock()
 			if err == nil {
-				usdtValue := size * price
-				db.RecordTransaction(alert.Ticker, "sell", size, price, usdtValue)
-				log.Printf("Sell order placed for %s, size=%.8f, USDT value=%.2f", alert.Ticker, size, usdtValue)
-				orderPlaced = true
+				order, err = settleOrder(strategy, alert.Ticker, "sell", ordID, policy)
+				delta += positionChange(order)
+			}
+			if err == nil {
+				log.Printf("Sell order for %s filled %.8f of %.8f, value=%.8f %s", alert.Ticker, order.FillSize, size, order.FillSize*order.AvgPrice, quote)
+				orderPlaced = order.FillSize > 0
 			} else {
 				log.Printf("Failed to place sell order for %s: %v", alert.Ticker, err)
 			}
 		}
 	}
 
+	unlock()
 	if err != nil {
 		log.Printf("Error placing order for %s: %v", alert.Ticker, err)
-		http.Error(w, "Failed to place order", http.StatusInternalServerError)
-		return
+		if kept.AlgoID != "" {
+			placeProtection(strategy, alert.Ticker, kept.StopLoss, kept.TakeProfit, ref)
+		}
+		return "", fmt.Errorf("failed to place order: %v", err)
 	}
 
 	if orderPlaced {
-		time.Sleep(2 * time.Second)
-		positions, err = client.GetPositions()
+		positions, err = ex.GetPositions()
 		if err != nil {
 			log.Printf("Error updating positions after order: %v", err)
 		} else {
-			newPosition := positions[alert.Ticker]
-			db.UpdateState(alert.Ticker, alert.Signal, newPosition)
-			log.Printf("Updated state for %s: Signal=%s, Position=%.8f", alert.Ticker, alert.Signal, newPosition)
-		}
-
-		spotBalance, err = client.GetSpotBalance()
-		if err != nil {
-			log.Printf("Error getting spot balance after order: %v", err)
-		}
-		totalAccountValue := spotBalance
-		for _, pair := range defaultPairs {
-			if pos, ok := positions[pair]; ok {
-				totalAccountValue += pos * getCurrentPrice(pair)
+			newPosition := nettedPosition(strategy, alert.Ticker, currentState.Position, delta, positions[alert.Ticker])
+			db.UpdateState(strategy, alert.Ticker, alert.Signal, newPosition)
+			log.Printf("Updated state for %s %s: Signal=%s, Position=%.8f", strategy, alert.Ticker, alert.Signal, newPosition)
+			if alert.Signal == "sell" {
+				stopTrailing(strategy, alert.Ticker)
 			}
 		}
+
+		totalAccountValue, _ := accountValue(positions, getCurrentPrices(cfg.Tickers()))
 		db.RecordAccountValue(totalAccountValue)
-		log.Printf("Recorded total account value: %f", totalAccountValue)
+		log.Printf("Recorded total account value: %f USDT", totalAccountValue)
+	}
+
+	// A buy is protected from its fill price; what a sell leaves keeps the
+	// prices it was protected at
+	if boughtAt > 0 {
+		protect(strategy, alert.Ticker, boughtAt, ref)
+	} else if kept.AlgoID != "" {
+		placeProtection(strategy, alert.Ticker, kept.StopLoss, kept.TakeProfit, ref)
 	}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Alert processed: %s %s", alert.Ticker, alert.Signal)
+	return fmt.Sprintf("Alert processed: %s %s", alert.Ticker, alert.Signal), nil
+}
+
+// executeOrder places an order and settles it with the default chase policy.
+func executeOrder(strategy string, req exchange.OrderRequest) (exchange.Order, error) {
+	ordID, err := placeOrder(strategy, req)
+	if err != nil {
+		return exchange.Order{}, err
+	}
+	return settleOrder(strategy, req.Ticker, req.Side, ordID, chasePolicy)
+}
+
+// settleOrder chases a placed order until it fills or is canceled and
+// records the outcome along with what actually filled, at the average fill
+// price and net of fees.
+func settleOrder(strategy, ticker, side, ordID string, policy exchange.ChasePolicy) (exchange.Order, error) {
+	result, err := exchange.Chase(ex, ticker, ordID, policy)
+	if err != nil {
+		return result.Order, err
+	}
+	order := result.Order
+	err = db.RecordOrder(db.Order{
+		OrdID:    ordID,
+		Ticker:   ticker,
+		Side:     side,
+		Size:     order.Size,
+		Price:    order.Price,
+		Filled:   order.FillSize,
+		AvgPrice: order.AvgPrice,
+		Fee:      order.Fee,
+		Status:   result.Outcome,
+		Amends:   result.Amends,
+	})
+	if err != nil {
+		log.Printf("Error recording order %s: %v", ordID, err)
+	}
+	if order.FillSize > 0 {
+		// The value is in the pair's quote currency
+		value := order.FillSize * order.AvgPrice
+		if err := db.UpsertTransaction(ordID, strategy, ticker, side, order.FillSize, order.AvgPrice, value, order.Fee); err != nil {
+			log.Printf("Error recording transaction for order %s: %v", ordID, err)
+		}
+	}
+	log.Printf("Order %s for %s %s after %d amends: filled %.8f/%.8f at %.8f, fee %.8f", ordID, ticker, result.Outcome, result.Amends, order.FillSize, order.Size, order.AvgPrice, order.Fee)
+	return order, nil
 }
 
 func isValidTicker(ticker string) bool {
-	for _, pair := range defaultPairs {
+	for _, pair := range cfg.Tickers() {
 		if pair == ticker {
 			return true
 		}
@@ -390,9 +656,6 @@ func stateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mu.Lock()
-	defer mu.Unlock()
-
 	states, err := db.GetAllStates()
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -400,43 +663,55 @@ func stateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client := okx.NewClient(
-		os.Getenv("OKX_API_KEY"),
-		os.Getenv("OKX_SECRET_KEY"),
-		os.Getenv("OKX_PASSPHRASE"),
-	)
-	positions, err := client.GetPositions()
+	positions, err := ex.GetPositions()
 	if err != nil {
 		http.Error(w, "Failed to get positions", http.StatusInternalServerError)
 		log.Printf("Error getting positions: %v", err)
 		return
 	}
 
-	usdtBalance, err := client.GetSpotBalance()
-	if err != nil {
-		http.Error(w, "Failed to get USDT balance", http.StatusInternalServerError)
-		log.Printf("Error getting USDT balance: %v", err)
-		return
-	}
-
-	prices := getCurrentPrices(defaultPairs)
+	prices := getCurrentPrices(cfg.Tickers())
+	totalAccountValue, balances := accountValue(positions, prices)
 
 	var statesWithPrice []StateWithPrice
-	var totalAccountValue float64 = usdtBalance
+	allocated := make(map[string]float64)
 	for _, state := range states {
+		inst, _ := exchange.ParseTicker(state.Ticker)
 		price := prices[state.Ticker]
-		position := positions[state.Ticker]
-		positionValue := position * price
-		totalAccountValue += positionValue
-		statesWithPrice = append(statesWithPrice, StateWithPrice{
+		allocated[state.Ticker] += state.Position
+		row := StateWithPrice{
+			Strategy:      state.Strategy,
 			Ticker:        state.Ticker,
+			Quote:         inst.Quote,
 			Signal:        state.Signal,
-			Position:      position,
+			Position:      state.Position,
 			Price:         price,
-			PositionValue: positionValue,
+			PositionValue: state.Position * price,
 			LastUpdate:    state.LastUpdate,
-			USDTBalance:   usdtBalance,
-		})
+		}
+		if book, err := pairPnL(state.Strategy, state.Ticker); err != nil {
+			log.Printf("Error working out PnL: %v", err)
+		} else if book.Bought > 0 {
+			row.HasPnL = true
+			row.AvgEntry, row.CostBasis = book.AvgEntry(), book.CostBasis()
+			row.Realized, row.Unrealized = book.Realized, book.Unrealized(price)
+			row.Performance = book.Return(price) * 100
+		}
+		statesWithPrice = append(statesWithPrice, row)
+	}
+	// Holdings no strategy accounts for, e.g. dust or coins bought by hand
+	for _, ticker := range cfg.Tickers() {
+		if extra := positions[ticker] - allocated[ticker]; extra > 1e-9 {
+			inst, _ := exchange.ParseTicker(ticker)
+			statesWithPrice = append(statesWithPrice, StateWithPrice{
+				Strategy:      "(unallocated)",
+				Ticker:        ticker,
+				Quote:         inst.Quote,
+				Position:      extra,
+				Price:         prices[ticker],
+				PositionValue: extra * prices[ticker],
+			})
+		}
 	}
 
 	accountValues, err := db.GetAccountValues()
@@ -444,26 +719,19 @@ func stateHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Error getting account values: %v", err)
 	}
 
-	pairPerformance := make(map[string]float64)
-	for _, ticker := range defaultPairs {
-		transactions, err := db.GetTransactions(ticker)
-		if err != nil {
-			log.Printf("Error getting transactions for %s: %v", ticker, err)
-			continue
-		}
-		var totalBuyUSDT, totalSellUSDT float64
-		for _, t := range transactions {
-			if t.Signal == "buy" {
-				totalBuyUSDT += t.USDTValue
-			} else if t.Signal == "sell" {
-				totalSellUSDT += t.USDTValue
-			}
-		}
-		if totalBuyUSDT > 0 {
-			pairPerformance[ticker] = ((totalSellUSDT - totalBuyUSDT) / totalBuyUSDT) * 100
-		} else {
-			pairPerformance[ticker] = 0
-		}
+	rejections, err := db.GetRiskRejections(20)
+	if err != nil {
+		log.Printf("Error getting risk rejections: %v", err)
+	}
+
+	controls, err := activeControls()
+	if err != nil {
+		log.Printf("Error getting controls: %v", err)
+	}
+
+	trailing, err := trailingStatuses(prices)
+	if err != nil {
+		log.Printf("Error getting trailing stops: %v", err)
 	}
 
 	tmpl := template.Must(template.New("state").Parse(`
@@ -478,38 +746,136 @@ func stateHandler(w http.ResponseWriter, r *http.Request) {
 				.buy { color: green; }
 				.sell { color: red; }
 				.chart-container { width: 70%; height: 400px; }
+				.control { width: 70%; padding: 12px; margin-bottom: 8px; font-weight: bold; color: white; background-color: #c62828; }
+				.control.close_only { background-color: #ef6c00; }
+				.control.pause { background-color: #f9a825; color: black; }
 			</style>
 			<script src="https://cdn.jsdelivr.net/npm/chart.js"></script>
 		</head>
 		<body>
 			<h1>Ticker States</h1>
-			<p>USDT Balance: {{printf "%.2f" (index .States 0).USDTBalance}}</p>
+			{{range .Controls}}
+			<div class="control {{.Control}}">
+				{{if eq .Control "halt"}}TRADING HALTED{{else if eq .Control "close_only"}}CLOSE-ONLY: buys are blocked{{else}}{{.Ticker}} PAUSED{{end}}
+				since {{.UpdatedAt.Format "2006-01-02 15:04:05"}}{{if .Reason}}: {{.Reason}}{{end}}
+			</div>
+			{{end}}
+			{{range .Balances}}
+			<p>{{.Ccy}} Balance: {{printf "%.8g" .Balance}}</p>
+			{{end}}
 			<p>Total Account Value (USDT): {{printf "%.2f" .TotalAccountValue}}</p>
 			<div class="chart-container">
 				<canvas id="accountValueChart"></canvas>
 			</div>
+			<h2>Strategies</h2>
+			<table>
+				<tr>
+					<th>Strategy</th>
+					<th>Budget (USDT)</th>
+					<th>Unspent Budget (USDT)</th>
+					<th>Positions Value (USDT)</th>
+				</tr>
+				{{range .Strategies}}
+				<tr>
+					<td>{{.Name}}</td>
+					{{if gt .Budget 0.0}}
+					<td>{{printf "%.2f" .Budget}}</td>
+					<td>{{printf "%.2f" .Unspent}}</td>
+					{{else}}
+					<td>-</td>
+					<td>-</td>
+					{{end}}
+					<td>{{printf "%.2f" .PositionsValue}}</td>
+				</tr>
+				{{end}}
+			</table>
+			<h2>Positions</h2>
 			<table>
 				<tr>
+					<th>Strategy</th>
 					<th>Ticker</th>
 					<th>Signal</th>
 					<th>Position</th>
-					<th>Value (USDT)</th>
-					<th>Current Price (USDT)</th>
+					<th>Value</th>
+					<th>Current Price</th>
+					<th>Avg Entry</th>
+					<th>Cost Basis</th>
+					<th>Realized PnL</th>
+					<th>Unrealized PnL</th>
 					<th>% Gain/Loss</th>
 					<th>Last Update</th>
 				</tr>
 				{{range .States}}
 				<tr>
+					<td>{{.Strategy}}</td>
 					<td>{{.Ticker}}</td>
 					<td class="{{.Signal}}">{{.Signal}}</td>
 					<td>{{printf "%.8f" .Position}}</td>
-					<td>{{printf "%.2f" .PositionValue}}</td>
-					<td>{{printf "%.2f" .Price}}</td>
-					<td>{{printf "%.2f" (index $.PairPerformance .Ticker)}}%</td>
-					<td>{{.LastUpdate.Format "2006-01-02 15:04:05"}}</td>
+					<td>{{printf "%.8g" .PositionValue}} {{.Quote}}</td>
+					<td>{{printf "%.8g" .Price}} {{.Quote}}</td>
+					{{if .HasPnL}}
+					<td>{{if gt .AvgEntry 0.0}}{{printf "%.8g" .AvgEntry}} {{.Quote}}{{else}}-{{end}}</td>
+					<td>{{printf "%.8g" .CostBasis}} {{.Quote}}</td>
+					<td>{{printf "%.4f" .Realized}} {{.Quote}}</td>
+					<td>{{printf "%.4f" .Unrealized}} {{.Quote}}</td>
+					<td>{{printf "%.2f" .Performance}}%</td>
+					{{else}}
+					<td>-</td><td>-</td><td>-</td><td>-</td><td>-</td>
+					{{end}}
+					<td>{{if not .LastUpdate.IsZero}}{{.LastUpdate.Format "2006-01-02 15:04:05"}}{{end}}</td>
 				</tr>
 				{{end}}
 			</table>
+			{{if .TrailingStops}}
+			<h2>Trailing Stops</h2>
+			<table>
+				<tr>
+					<th>Strategy</th>
+					<th>Ticker</th>
+					<th>Entry</th>
+					<th>High</th>
+					<th>Stop</th>
+					<th>Current Price</th>
+					<th>Room to Stop</th>
+					<th>Since</th>
+				</tr>
+				{{range .TrailingStops}}
+				<tr>
+					<td>{{.Strategy}}</td>
+					<td>{{.Ticker}}</td>
+					<td>{{printf "%.8g" .EntryPrice}}</td>
+					<td>{{printf "%.8g" .HighWater}}</td>
+					<td>{{printf "%.8g" .StopPrice}}</td>
+					<td>{{printf "%.8g" .Price}}</td>
+					<td>{{printf "%.2f" .Room}}%</td>
+					<td>{{.CreatedAt.Format "2006-01-02 15:04:05"}}</td>
+				</tr>
+				{{end}}
+			</table>
+			{{end}}
+			{{if .Rejections}}
+			<h2>Risk Rejections</h2>
+			<table>
+				<tr>
+					<th>Time</th>
+					<th>Ticker</th>
+					<th>Side</th>
+					<th>Size</th>
+					<th>Rule</th>
+					<th>Reason</th>
+				</tr>
+				{{range .Rejections}}
+				<tr>
+					<td>{{.Timestamp.Format "2006-01-02 15:04:05"}}</td>
+					<td>{{.Ticker}}</td>
+					<td class="{{.Side}}">{{.Side}}</td>
+					<td>{{printf "%.8g" .Size}}</td>
+					<td>{{.Rule}}</td>
+					<td>{{.Reason}}</td>
+				</tr>
+				{{end}}
+			</table>
+			{{end}}
 			<script>
 				const ctx = document.getElementById('accountValueChart').getContext('2d');
 				const accountValueChart = new Chart(ctx, {
@@ -536,14 +902,25 @@ func stateHandler(w http.ResponseWriter, r *http.Request) {
 
 	data := struct {
 		States            []StateWithPrice
+		Strategies        []strategySummary
+		Balances          []quoteBalance
 		TotalAccountValue float64
-		AccountValues     []struct{ TotalUSDT float64; Timestamp time.Time }
-		PairPerformance   map[string]float64
+		AccountValues     []struct {
+			TotalUSDT float64
+			Timestamp time.Time
+		}
+		Rejections    []db.RiskRejection
+		Controls      []controlStatus
+		TrailingStops []trailingStatus
 	}{
 		States:            statesWithPrice,
+		Strategies:        summarizeStrategies(states, prices),
+		Balances:          balances,
 		TotalAccountValue: totalAccountValue,
 		AccountValues:     accountValues,
-		PairPerformance:   pairPerformance,
+		Rejections:        rejections,
+		Controls:          controls,
+		TrailingStops:     trailing,
 	}
 
 	err = tmpl.Execute(w, data)
@@ -553,20 +930,28 @@ func stateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// testHandler runs the testsuite scenarios against this server on GET
+// /run-tests. They trade real TRX with the webhook passphrase, so it needs
+// the ADMIN_TOKEN bearer token.
 func testHandler(w http.ResponseWriter, r *http.Request) {
+	if !authenticateAdmin(r) {
+		log.Printf("Rejected unauthenticated test run from %s", clientIP(r))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	log.Println("Starting test suite...")
-	client := okx.NewClient(
-		os.Getenv("OKX_API_KEY"),
-		os.Getenv("OKX_SECRET_KEY"),
-		os.Getenv("OKX_PASSPHRASE"),
-	)
-
-	results := crypto_trader.RunTests("https://crypto-trader15-delicate-flower-4267.fly.dev/webhook", client)
+	var passphrase string
+	if len(webhookSecrets) > 0 {
+		passphrase = string(webhookSecrets[0])
+	}
+	// The passphrase only ever goes to this server; the request's Host is
+	// the caller's to choose
+	results := crypto_trader.RunTests(localWebhookURL(), passphrase, ex)
 
 	w.Header().Set("Content-Type", "text/plain")
 	fmt.Fprintln(w, "Test Suite Results:")
@@ -580,49 +965,51 @@ func testHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("Test suite completed.")
 }
 
-func getCurrentPrice(ticker string) float64 {
-	baseURL := "https://www.okx.com"
-	endpoint := "/api/v5/market/ticker"
-	instId := strings.Replace(ticker, "USDT", "-USDT", 1)
-	url := fmt.Sprintf("%s%s?instId=%s", baseURL, endpoint, instId)
-
-	resp, err := http.Get(url)
+// localWebhookURL is this server's webhook on the loopback interface.
+func localWebhookURL() string {
+	_, port, err := net.SplitHostPort(listenAddr)
 	if err != nil {
-		log.Printf("Error fetching price for %s: %v", ticker, err)
-		return 0
+		port = "8080"
 	}
-	defer resp.Body.Close()
+	return "http://" + net.JoinHostPort("127.0.0.1", port) + "/webhook"
+}
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("OKX API error for %s: status %d", ticker, resp.StatusCode)
+// streamedPrice is the feed's last price for ticker, or 0 if it has no fresh
+// quote.
+func streamedPrice(ticker string) float64 {
+	if marketData == nil {
 		return 0
 	}
-
-	var result struct {
-		Data []struct {
-			Last string `json:"last"`
-		} `json:"data"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		log.Printf("Error decoding price for %s: %v", ticker, err)
+	q, ok := marketData.Last(ticker)
+	if !ok || q.Stale {
 		return 0
 	}
+	return q.Last
+}
 
-	if len(result.Data) == 0 {
-		log.Printf("No price data for %s", ticker)
-		return 0
+func getCurrentPrice(ticker string) float64 {
+	if price := streamedPrice(ticker); price > 0 {
+		return price
 	}
-
-	price, err := strconv.ParseFloat(result.Data[0].Last, 64)
+	price, err := ex.GetPrice(ticker)
 	if err != nil {
-		log.Printf("Error parsing price for %s: %v", ticker, err)
+		log.Printf("Error fetching price for %s: %v", ticker, err)
 		return 0
 	}
 	return price
 }
 
-func getCurrentPrices(tickers []string) map[string]float64 {
+func getCurrentPrices(all []string) map[string]float64 {
 	prices := make(map[string]float64)
+	var tickers []string
+	for _, ticker := range all {
+		if price := streamedPrice(ticker); price > 0 {
+			prices[ticker] = price
+		} else {
+			tickers = append(tickers, ticker)
+		}
+	}
+
 	var wg sync.WaitGroup
 	priceChan := make(chan struct {
 		ticker string
@@ -639,13 +1026,16 @@ func getCurrentPrices(tickers []string) map[string]float64 {
 			sem <- struct{}{}
 			defer func() { <-sem }()
 
-			price := getCurrentPrice(t)
+			price, err := ex.GetPrice(t)
+			if err != nil {
+				log.Printf("Error fetching price for %s: %v", t, err)
+			}
 			priceChan <- struct {
 				ticker string
 				price  float64
 			}{ticker: t, price: price}
 
-			time.Sleep(333 * time.Millisecond)
+			clock.Throttle(333 * time.Millisecond)
 		}(ticker)
 	}
 
@@ -662,40 +1052,122 @@ func getCurrentPrices(tickers []string) map[string]float64 {
 }
 
 func main() {
-	db.InitDB("/data/crypto_trader.db")
+	if len(os.Args) > 1 && os.Args[1] == "control" {
+		os.Exit(runControl(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "backtest" {
+		os.Exit(runBacktest(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "optimize" {
+		os.Exit(runOptimize(os.Args[2:]))
+	}
+
+	configPath := flag.String("config", "config.yaml", "path to the YAML config file")
+	exchangeName := flag.String("exchange", "okx", "exchange to trade on: okx or paper")
+	dbPath := flag.String("db", "/data/crypto_trader.db", "path to the SQLite database")
+	paperUSDT := flag.Float64("paper-usdt", 10000, "starting USDT balance for a new paper account")
+	paperTakerFee := flag.Float64("paper-taker-fee", 0.001, "paper exchange taker fee as a fraction of notional")
+	paperMakerFee := flag.Float64("paper-maker-fee", 0.0008, "paper exchange maker fee as a fraction of notional")
+	marketDataURL := flag.String("market-data-url", marketdata.DefaultURL, "OKX public WebSocket to stream tickers from, empty to poll REST for every price")
+	privateStreamURL := flag.String("private-stream-url", okx.PrivateURL, "OKX private WebSocket to follow orders and balances on, empty to poll REST for balances")
+	flag.DurationVar(&chasePolicy.Interval, "chase-interval", chasePolicy.Interval, "how long to wait for a limit order to fill before repricing it")
+	flag.IntVar(&chasePolicy.MaxAmends, "chase-max-amends", chasePolicy.MaxAmends, "reprices before an unfilled order is canceled")
+	flag.Float64Var(&chasePolicy.MaxSlippage, "chase-max-slippage", chasePolicy.MaxSlippage, "furthest a reprice may move from the first limit price, as a fraction")
+	flag.DurationVar(&restExpiry, "rest-expiry", restExpiry, "how long an order at an alert's limit_price or a post-only order rests before it is canceled")
+	flag.Parse()
+
+	var err error
+	cfg, err = config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	log.Printf("Trading pairs: %s", strings.Join(cfg.Tickers(), ", "))
+
+	db.InitDB(*dbPath, cfg)
 	defer db.Close()
 
-	if err := fetchLotSizes(); err != nil {
-		log.Fatalf("Failed to fetch lot sizes: %v", err)
+	client := okx.NewClient(
+		os.Getenv("OKX_API_KEY"),
+		os.Getenv("OKX_SECRET_KEY"),
+		os.Getenv("OKX_PASSPHRASE"),
+	)
+	switch *exchangeName {
+	case "okx":
+		ex = client
+		if *privateStreamURL != "" {
+			stream := okx.NewStream(client, *privateStreamURL)
+			stream.OnFill = recordFill
+			stream.Start()
+			ex = &okx.Cached{Exchange: client, Stream: stream}
+			log.Printf("Following orders and balances on %s", *privateStreamURL)
+		}
+	case "paper":
+		paperEx, err := paper.New(client, paper.Config{
+			StartingUSDT: *paperUSDT,
+			TakerFee:     *paperTakerFee,
+			MakerFee:     *paperMakerFee,
+		})
+		if err != nil {
+			log.Fatalf("Failed to start paper exchange: %v", err)
+		}
+		ex = paperEx
+		log.Printf("Paper trading enabled (taker fee %.4f, maker fee %.4f)", *paperTakerFee, *paperMakerFee)
+	default:
+		log.Fatalf("Unknown exchange %q, expected okx or paper", *exchangeName)
 	}
+	// Every order is checked against the risk limits before it is placed
+	guard := &risk.Guard{Exchange: ex, Limits: cfg.Risk}
+	ex = guard
 
-	// Set default lot sizes for missing or invalid pairs
-	defaultLotSizes := map[string]float64{
-		"BTCUSDT":  0.000001,
-		"TRXUSDT":  0.1,
-		"SUIUSDT":  0.0001,
-		"SOLUSDT":  0.0001,
-		"NEARUSDT": 0.0001,
-		"TONUSDT":  0.0001,
-		"ICPUSDT":  0.0001,
+	webhookSecrets = loadWebhookSecrets()
+	if len(webhookSecrets) == 0 {
+		log.Printf("Warning: no WEBHOOK_SECRETS configured, all webhook alerts will be rejected")
 	}
-	for _, ticker := range defaultPairs {
-		if _, exists := lotSizes[ticker]; !exists {
-			lotSizes[ticker] = defaultLotSizes[ticker]
-			log.Printf("No lotSz for %s, setting default: %f", ticker, defaultLotSizes[ticker])
-		}
+	trustedProxies, err = loadTrustedProxies()
+	if err != nil {
+		log.Fatalf("Failed to load TRUSTED_PROXIES: %v", err)
 	}
 
-	if len(lotSizes) != len(defaultPairs) {
-		log.Printf("Warning: fetched lot sizes for %d/%d pairs", len(lotSizes), len(defaultPairs))
+	if err := loadInstruments(); err != nil {
+		log.Fatalf("Failed to load instruments: %v", err)
+	}
+	if *marketDataURL != "" {
+		marketData = marketdata.New(*marketDataURL, streamedTickers())
+		marketData.Start()
+		// Risk checks, reprices and order placement read the feed too
+		guard.Exchange = &marketdata.Priced{Exchange: guard.Exchange, Feed: marketData}
+		log.Printf("Streaming tickers from %s", *marketDataURL)
+	}
+
+	if n, err := db.RequeueProcessingAlerts(); err != nil {
+		log.Fatalf("Failed to requeue alerts: %v", err)
+	} else if n > 0 {
+		log.Printf("Requeued %d alerts left processing by the last run", n)
+	}
+	startWorkers(cfg.Workers)
+	log.Printf("Started %d alert workers", cfg.Workers)
+	if cfg.Rebalance.Interval > 0 {
+		startRebalancer(cfg.Rebalance.Interval)
+		log.Printf("Rebalancing every %s", cfg.Rebalance.Interval)
+	}
+	startTrailingMonitor(cfg.TrailingInterval)
+	if len(cfg.Candles.Bars) > 0 {
+		candles.New(client, cfg).Start(cfg.Candles.Interval)
+		log.Printf("Collecting %s candles for every pair", strings.Join(cfg.Candles.Bars, ", "))
+	}
+	if signals := strategy.NewEngine(cfg.Pairs, ex, queueSignal); signals.Rules() > 0 {
+		signals.Start(signalCheckInterval)
+		log.Printf("Trading %d signal rules on closed bars", signals.Rules())
 	}
 
 	http.HandleFunc("/webhook", handler)
+	http.HandleFunc("/alerts", alertsHandler)
+	http.HandleFunc("/rebalance", rebalanceHandler)
+	http.HandleFunc("/admin/controls", controlsHandler)
 	http.HandleFunc("/state", stateHandler)
 	http.HandleFunc("/run-tests", testHandler)
-	port := ":8080"
-	log.Printf("Server starting on port %s...", port)
-	if err := http.ListenAndServe(port, nil); err != nil {
+	log.Printf("Server starting on port %s...", listenAddr)
+	if err := http.ListenAndServe(listenAddr, nil); err != nil {
 		log.Fatalf("Server failed: %v", err)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,1016 @@
+package main
+
+import (
+	"bytes"
+	"crypto_trader/clock"
+	"crypto_trader/config"
+	"crypto_trader/db"
+	"crypto_trader/exchange"
+	"crypto_trader/okx"
+	"crypto_trader/okxfake"
+	"crypto_trader/risk"
+	crypto_trader "crypto_trader/testsuite"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "test-secret"
+
+// newTestServer wires the webhook handler to a fresh database and a fake OKX
+// holding 10.5 USDT, with TRX priced so the whole balance buys 43 TRX.
+func newTestServer(t *testing.T) (*okxfake.Server, *httptest.Server) {
+	t.Helper()
+
+	fake := okxfake.New()
+	t.Cleanup(fake.Close)
+	fake.SetInstrument("TRX-USDT", 0.1)
+	fake.SetInstrument("BTC-USDT", 0.00001)
+	fake.SetPrice("TRX-USDT", 0.2437)
+	fake.SetPrice("BTC-USDT", 60000)
+	fake.SetBalance("USDT", 10.5)
+
+	cfg = config.Default()
+	db.InitDB(filepath.Join(t.TempDir(), "crypto_trader.db"), cfg)
+	t.Cleanup(db.Close)
+
+	ex = &risk.Guard{Exchange: fake.Client(), Limits: cfg.Risk}
+	webhookSecrets = [][]byte{[]byte(testSecret)}
+	if err := loadInstruments(); err != nil {
+		t.Fatalf("loadInstruments: %v", err)
+	}
+	crypto_trader.SettleDelay = 0
+	chasePolicy = exchange.ChasePolicy{MaxAmends: 2, MaxSlippage: 0.01}
+	restExpiry = 0
+	t.Cleanup(startWorkers(2))
+
+	srv := httptest.NewServer(http.HandlerFunc(handler))
+	t.Cleanup(srv.Close)
+	return fake, srv
+}
+
+// postAlert sends an alert and waits for a worker to process it.
+func postAlert(t *testing.T, url, payload string) *http.Response {
+	t.Helper()
+	resp, err := http.Post(url+"?wait=10s", "application/json", bytes.NewBufferString(payload))
+	if err != nil {
+		t.Fatalf("posting alert: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestBuyAndSellTRX(t *testing.T) {
+	_, srv := newTestServer(t)
+
+	results := crypto_trader.RunTests(srv.URL, testSecret, ex)
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d: %+v", len(results), results)
+	}
+	for _, result := range results {
+		if !result.Success {
+			t.Errorf("%s failed: %s", result.Step, result.Details)
+		}
+	}
+
+	transactions, err := db.GetTransactions(config.DefaultStrategy, "TRXUSDT")
+	if err != nil {
+		t.Fatalf("GetTransactions: %v", err)
+	}
+	if len(transactions) != 2 || transactions[0].Signal != "buy" || transactions[1].Signal != "sell" {
+		t.Errorf("expected a buy then a sell, got %+v", transactions)
+	}
+}
+
+func TestRunTestsIgnoresTheHostHeader(t *testing.T) {
+	fake, srv := newTestServer(t)
+	listenAddr = srv.Listener.Addr().String()
+	t.Cleanup(func() { listenAddr = ":8080" })
+
+	adminToken = "admin-token"
+	t.Cleanup(func() { adminToken = "" })
+
+	req := httptest.NewRequest("GET", "/run-tests", nil)
+	req.Host = "attacker.example"
+	rec := httptest.NewRecorder()
+	testHandler(rec, req)
+	if rec.Code != http.StatusUnauthorized || len(fake.Orders()) != 0 {
+		t.Fatalf("expected 401 and no orders without the admin token, got %d and %+v", rec.Code, fake.Orders())
+	}
+
+	req.Header.Set("Authorization", "Bearer admin-token")
+	rec = httptest.NewRecorder()
+	testHandler(rec, req)
+	if strings.Contains(rec.Body.String(), "FAIL") {
+		t.Errorf("expected the suite to run against this server, got %s", rec.Body.String())
+	}
+	if len(fake.Orders()) != 2 {
+		t.Errorf("expected a buy and a sell, got %+v", fake.Orders())
+	}
+}
+
+func TestRejectedOrderLeavesStateUnchanged(t *testing.T) {
+	fake, srv := newTestServer(t)
+	fake.RejectNextOrder("51008", "Order failed. Insufficient balance")
+
+	resp := postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"buy","passphrase":"`+testSecret+`"}`)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected 500 for rejected order, got %d", resp.StatusCode)
+	}
+
+	state, err := db.GetState(config.DefaultStrategy, "TRXUSDT")
+	if err != nil {
+		t.Fatalf("GetState: %v", err)
+	}
+	if state.Signal != "sell" || state.Position != 0 {
+		t.Errorf("state changed after rejected order: %+v", state)
+	}
+	if fake.Balance("USDT") != 10.5 {
+		t.Errorf("balance changed after rejected order: %f", fake.Balance("USDT"))
+	}
+}
+
+func TestBalanceErrorCodeFailsAlert(t *testing.T) {
+	fake, srv := newTestServer(t)
+	fake.FailNext("/api/v5/account/balance", "50001", "Service temporarily unavailable")
+
+	resp := postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"buy","passphrase":"`+testSecret+`"}`)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected 500 when balance fails, got %d", resp.StatusCode)
+	}
+	if len(fake.Orders()) != 0 {
+		t.Errorf("expected no orders, got %+v", fake.Orders())
+	}
+}
+
+func TestUnauthenticatedAlertIsRejected(t *testing.T) {
+	fake, srv := newTestServer(t)
+
+	resp := postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"buy","passphrase":"wrong"}`)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", resp.StatusCode)
+	}
+	if len(fake.Orders()) != 0 {
+		t.Errorf("expected no orders, got %+v", fake.Orders())
+	}
+}
+
+func TestClientIPTrustsOnlyConfiguredProxies(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 172.16.0.1")
+	proxies, err := loadTrustedProxies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxies = proxies
+	t.Cleanup(func() { trustedProxies = nil })
+
+	tests := []struct {
+		remote, fly, forwarded, want string
+	}{
+		{"203.0.113.9:1234", "1.2.3.4", "5.6.7.8", "203.0.113.9"},
+		{"10.1.2.3:1234", "1.2.3.4", "5.6.7.8", "1.2.3.4"},
+		{"10.1.2.3:1234", "", "6.6.6.6, 5.6.7.8, 172.16.0.1", "5.6.7.8"},
+		{"172.16.0.1:1234", "", "", "172.16.0.1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.fly != "" {
+			r.Header.Set("Fly-Client-IP", tt.fly)
+		}
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("expected %s from %+v, got %s", tt.want, tt, got)
+		}
+	}
+
+	t.Setenv("TRUSTED_PROXIES", "not-an-ip")
+	if _, err := loadTrustedProxies(); err == nil {
+		t.Error("expected an invalid proxy to be rejected")
+	}
+}
+
+func TestTransactionRecordsActualFill(t *testing.T) {
+	fake, srv := newTestServer(t)
+	fake.SetFillRatio(0.5)
+	fake.SetFeeRate(0.001)
+	chasePolicy.MaxAmends = 0
+
+	postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"buy","passphrase":"`+testSecret+`"}`)
+
+	transactions, err := db.GetTransactions(config.DefaultStrategy, "TRXUSDT")
+	if err != nil {
+		t.Fatalf("GetTransactions: %v", err)
+	}
+	if len(transactions) != 1 {
+		t.Fatalf("expected 1 transaction, got %+v", transactions)
+	}
+	tx := transactions[0]
+	limitPx := 0.2437 * 1.001
+	if math.Abs(tx.Amount-21.5) > 1e-9 || math.Abs(tx.Price-limitPx) > 1e-9 {
+		t.Errorf("expected 21.5 filled at %f, got %f at %f", limitPx, tx.Amount, tx.Price)
+	}
+	if math.Abs(tx.Fee-21.5*0.001*limitPx) > 1e-9 {
+		t.Errorf("expected fee %f USDT, got %f", 21.5*0.001*limitPx, tx.Fee)
+	}
+
+	orders, err := db.GetOrders("TRXUSDT")
+	if err != nil {
+		t.Fatalf("GetOrders: %v", err)
+	}
+	if len(orders) != 1 || orders[0].Status != "partial" {
+		t.Errorf("expected one partial order, got %+v", orders)
+	}
+}
+
+func TestUnfilledOrderIsChasedThenCanceled(t *testing.T) {
+	fake, srv := newTestServer(t)
+	fake.SetFillRatio(0)
+
+	postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"buy","passphrase":"`+testSecret+`"}`)
+
+	orders, err := db.GetOrders("TRXUSDT")
+	if err != nil {
+		t.Fatalf("GetOrders: %v", err)
+	}
+	if len(orders) != 1 || orders[0].Status != "canceled" || orders[0].Amends != 2 {
+		t.Fatalf("expected one canceled order after 2 amends, got %+v", orders)
+	}
+	if fake.Orders()[0].Amends != 2 || fake.Orders()[0].State != "canceled" {
+		t.Errorf("fake saw %+v", fake.Orders()[0])
+	}
+	if math.Abs(fake.Balance("USDT")-10.5) > 1e-9 {
+		t.Errorf("expected reserved USDT to be released, balance is %f", fake.Balance("USDT"))
+	}
+	state, _ := db.GetState(config.DefaultStrategy, "TRXUSDT")
+	if state.Signal != "sell" {
+		t.Errorf("expected state to stay sell, got %s", state.Signal)
+	}
+
+	// Nothing is left resting, so the next alert isn't blocked
+	fake.SetFillRatio(1)
+	resp := postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"buy","passphrase":"`+testSecret+`"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected follow-up alert to succeed, got %d", resp.StatusCode)
+	}
+}
+
+func TestBuyUSDCQuotedPair(t *testing.T) {
+	fake, srv := newTestServer(t)
+	fake.SetInstrument("SOL-USDC", 0.001)
+	fake.SetPrice("SOL-USDC", 150)
+	fake.SetPrice("USDC-USDT", 1)
+	fake.SetBalance("USDC", 30.1)
+	fake.SetBalance("SUIX", 500)
+
+	cfg.Pairs = append(cfg.Pairs, config.Pair{Ticker: "SOLUSDC"})
+	db.InitDB(filepath.Join(t.TempDir(), "usdc.db"), cfg)
+	if err := loadInstruments(); err != nil {
+		t.Fatalf("loadInstruments: %v", err)
+	}
+
+	resp := postAlert(t, srv.URL, `{"ticker":"SOLUSDC","signal":"buy","passphrase":"`+testSecret+`"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	orders := fake.Orders()
+	if len(orders) != 1 || orders[0].InstId != "SOL-USDC" || orders[0].Side != "buy" {
+		t.Fatalf("expected one SOL-USDC buy, got %+v", orders)
+	}
+	if fake.Balance("USDT") != 10.5 {
+		t.Errorf("USDT balance should be untouched, got %f", fake.Balance("USDT"))
+	}
+	if fake.Balance("USDC") >= 30.1 {
+		t.Errorf("expected USDC to be spent, balance is %f", fake.Balance("USDC"))
+	}
+
+	positions, err := ex.GetPositions()
+	if err != nil {
+		t.Fatalf("GetPositions: %v", err)
+	}
+	if positions["SOLUSDC"] != orders[0].Filled {
+		t.Errorf("expected SOLUSDC position %f, got %f", orders[0].Filled, positions["SOLUSDC"])
+	}
+	if positions["SUIUSDT"] != 0 {
+		t.Errorf("SUIX balance leaked into SUIUSDT: %f", positions["SUIUSDT"])
+	}
+}
+
+func TestAlertIsQueued(t *testing.T) {
+	_, srv := newTestServer(t)
+
+	resp, err := http.Post(srv.URL, "application/json", bytes.NewBufferString(`{"ticker":"TRXUSDT","signal":"buy","passphrase":"`+testSecret+`"}`))
+	if err != nil {
+		t.Fatalf("posting alert: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+	var queued alertStatus
+	if err := json.NewDecoder(resp.Body).Decode(&queued); err != nil || queued.ID == 0 {
+		t.Fatalf("expected an alert id, got %+v (%v)", queued, err)
+	}
+
+	if record, done := waitForAlert(queued.ID, 10*time.Second); !done || record.Status != "done" {
+		t.Fatalf("alert not processed: %+v", record)
+	}
+
+	adminToken = "admin-token"
+	t.Cleanup(func() { adminToken = "" })
+	req := httptest.NewRequest("GET", "/alerts?id="+strconv.FormatInt(queued.ID, 10), nil)
+	rec := httptest.NewRecorder()
+	alertsHandler(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without the admin token, got %d", rec.Code)
+	}
+	req.Header.Set("Authorization", "Bearer admin-token")
+	rec = httptest.NewRecorder()
+	alertsHandler(rec, req)
+	var status alertStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil || status.Status != "done" {
+		t.Errorf("expected /alerts to report done, got %+v (%v)", status, err)
+	}
+}
+
+func TestRepeatedAlertIsNotProcessedAgain(t *testing.T) {
+	fake, srv := newTestServer(t)
+
+	buy := `{"ticker":"TRXUSDT","signal":"buy","id":"a1","passphrase":"` + testSecret + `"}`
+	postAlert(t, srv.URL, buy)
+	postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"sell","id":"a2","passphrase":"`+testSecret+`"}`)
+	// A retry of the buy after the flip must not buy again
+	resp := postAlert(t, srv.URL, buy)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the first result for a repeat, got %d", resp.StatusCode)
+	}
+
+	if len(fake.Orders()) != 2 {
+		t.Errorf("expected 2 orders, got %+v", fake.Orders())
+	}
+	state, err := db.GetState(config.DefaultStrategy, "TRXUSDT")
+	if err != nil {
+		t.Fatalf("GetState: %v", err)
+	}
+	if state.Signal != "sell" {
+		t.Errorf("expected the repeat to leave TRXUSDT sold, got %+v", state)
+	}
+}
+
+func TestMinimumBalanceOnlyHoldsBackBuys(t *testing.T) {
+	fake, srv := newTestServer(t)
+	fake.SetBalance("USDT", 1)
+
+	if resp := postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"buy","passphrase":"`+testSecret+`"}`); resp.StatusCode == http.StatusOK {
+		t.Errorf("expected a buy with 1 USDT to fail")
+	}
+	if len(fake.Orders()) != 0 {
+		t.Fatalf("expected no orders, got %+v", fake.Orders())
+	}
+
+	// Selling doesn't spend USDT, so a spent balance doesn't stop it
+	fake.SetBalance("TRX", 50)
+	db.ResetState(config.DefaultStrategy, "TRXUSDT", "buy", 50)
+	if resp := postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"sell","passphrase":"`+testSecret+`"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for the sell, got %d", resp.StatusCode)
+	}
+	if orders := fake.Orders(); len(orders) != 1 || orders[0].Side != "sell" || orders[0].Size != 50 {
+		t.Errorf("expected a sell of 50 TRX, got %+v", orders)
+	}
+}
+
+func TestAlertWithoutLotSizeIsRejected(t *testing.T) {
+	fake, srv := newTestServer(t)
+	fake.SetBalance("USDT", 100)
+	exchange.Register(exchange.Instrument{InstID: "TRX-USDT", Base: "TRX", Quote: "USDT"})
+
+	if resp := postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"buy","passphrase":"`+testSecret+`"}`); resp.StatusCode == http.StatusOK {
+		t.Errorf("expected the buy to fail without a lot size")
+	}
+	if len(fake.Orders()) != 0 {
+		t.Errorf("expected no orders, got %+v", fake.Orders())
+	}
+}
+
+func TestAlertSizeAndOrderType(t *testing.T) {
+	fake, srv := newTestServer(t)
+	fake.SetBalance("USDT", 100)
+
+	resp := postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"buy","quote_amount":20,"order_type":"market","passphrase":"`+testSecret+`"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for a market buy, got %d", resp.StatusCode)
+	}
+	// A sized alert may add to a position even though the signal hasn't changed
+	resp = postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"buy","qty":50,"limit_price":0.25,"comment":"scale in","passphrase":"`+testSecret+`"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for a limit buy, got %d", resp.StatusCode)
+	}
+
+	orders := fake.Orders()
+	if len(orders) != 2 {
+		t.Fatalf("expected 2 orders, got %+v", orders)
+	}
+	if orders[0].Type != "market" || math.Abs(orders[0].Size-82) > 1e-9 || orders[0].Price != 0.2437 {
+		t.Errorf("expected a market buy of 82 TRX at 0.2437, got %+v", orders[0])
+	}
+	if orders[1].Type != "limit" || orders[1].Size != 50 || orders[1].Price != 0.25 {
+		t.Errorf("expected a limit buy of 50 TRX at 0.25, got %+v", orders[1])
+	}
+}
+
+func TestInvalidAlertIsRejected(t *testing.T) {
+	fake, srv := newTestServer(t)
+
+	for _, payload := range []string{
+		`{"ticker":"TRXUSDT","signal":"buy","qty":"5","passphrase":"` + testSecret + `"}`,
+		`{"ticker":"TRXUSDT","signal":"buy","qty":5,"quote_amount":5,"passphrase":"` + testSecret + `"}`,
+		`{"ticker":"TRXUSDT","signal":"buy","percent_of_equity":150,"passphrase":"` + testSecret + `"}`,
+		`{"ticker":"TRXUSDT","signal":"buy","order_type":"market","limit_price":0.2,"passphrase":"` + testSecret + `"}`,
+		`{"ticker":"TRXUSDT","signal":"hold","passphrase":"` + testSecret + `"}`,
+		`{"ticker":"TRXUSDT","signal":"buy","expire_after":"30m","passphrase":"` + testSecret + `"}`,
+		`{"ticker":"TRXUSDT","signal":"buy","limit_price":0.2,"expire_after":"soon","passphrase":"` + testSecret + `"}`,
+	} {
+		if resp := postAlert(t, srv.URL, payload); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", payload, resp.StatusCode)
+		}
+	}
+	if len(fake.Orders()) != 0 {
+		t.Errorf("expected no orders, got %+v", fake.Orders())
+	}
+}
+
+func TestAlertWithExtraFieldsIsAccepted(t *testing.T) {
+	fake, srv := newTestServer(t)
+
+	resp := postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"buy","interval":"1h","close":0.2437,"passphrase":"`+testSecret+`"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for an alert with extra fields, got %d", resp.StatusCode)
+	}
+	if len(fake.Orders()) != 1 {
+		t.Errorf("expected the buy to be placed, got %+v", fake.Orders())
+	}
+}
+
+func TestRestingOrdersWaitTheirExpiry(t *testing.T) {
+	chasePolicy = exchange.ChasePolicy{Interval: 5 * time.Second, MaxAmends: 3}
+	restExpiry = time.Hour
+	t.Cleanup(func() { restExpiry = 0 })
+
+	for _, tc := range []struct {
+		alert  Alert
+		expiry time.Duration
+		amends int
+	}{
+		{Alert{}, 5 * time.Second, 3},
+		{Alert{OrderType: exchange.OrderMarket}, 5 * time.Second, 0},
+		{Alert{LimitPrice: 0.2}, time.Hour, 0},
+		{Alert{OrderType: exchange.OrderPostOnly, ExpireAfter: "30m"}, 30 * time.Minute, 0},
+	} {
+		_, policy := tc.alert.orderRequest("buy", 1, 0.1, "ref")
+		if policy.Interval != tc.expiry || policy.MaxAmends != tc.amends {
+			t.Errorf("%+v: expected %s and %d amends, got %+v", tc.alert, tc.expiry, tc.amends, policy)
+		}
+	}
+}
+
+func TestStrategiesKeepSeparatePositions(t *testing.T) {
+	fake, srv := newTestServer(t)
+	fake.SetBalance("USDT", 100)
+	cfg.Strategies = append(cfg.Strategies, config.Strategy{Name: "trend", Budget: 20})
+	db.ResetState("trend", "TRXUSDT", "sell", 0)
+
+	// trend sizes against its 20 USDT budget at the limit price, default
+	// against the rest
+	postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"buy","strategy":"trend","passphrase":"`+testSecret+`"}`)
+	postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"buy","qty":100,"passphrase":"`+testSecret+`"}`)
+	trend, _ := db.GetState("trend", "TRXUSDT")
+	def, _ := db.GetState(config.DefaultStrategy, "TRXUSDT")
+	if math.Abs(trend.Position-81.9) > 1e-9 || def.Position != 100 {
+		t.Fatalf("expected trend to hold 81.9 TRX and default 100, got %+v and %+v", trend, def)
+	}
+
+	postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"sell","strategy":"trend","passphrase":"`+testSecret+`"}`)
+	trend, _ = db.GetState("trend", "TRXUSDT")
+	def, _ = db.GetState(config.DefaultStrategy, "TRXUSDT")
+	if trend.Position != 0 || trend.Signal != "sell" || def.Position != 100 || def.Signal != "buy" {
+		t.Errorf("expected trend's sell to leave default's 100 TRX alone, got %+v and %+v", trend, def)
+	}
+	if orders := fake.Orders(); len(orders) != 3 || math.Abs(orders[2].Size-81.9) > 1e-9 {
+		t.Errorf("expected trend to sell its 81.9 TRX, got %+v", orders)
+	}
+}
+
+func TestSellBelowMinimumKeepsOtherStrategiesCoins(t *testing.T) {
+	fake, srv := newTestServer(t)
+	fake.SetBalance("TRX", 120)
+	cfg.Strategies = append(cfg.Strategies, config.Strategy{Name: "trend"})
+	db.ResetState("trend", "TRXUSDT", "buy", 20)
+	db.ResetState(config.DefaultStrategy, "TRXUSDT", "buy", 100)
+
+	// 20 TRX is worth less than the minimum order, which 41 TRX would meet,
+	// but the rest belongs to default
+	postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"sell","strategy":"trend","passphrase":"`+testSecret+`"}`)
+	if orders := fake.Orders(); len(orders) != 1 || orders[0].Size != 20 {
+		t.Fatalf("expected trend to sell only its 20 TRX, got %+v", orders)
+	}
+	if def, _ := db.GetState(config.DefaultStrategy, "TRXUSDT"); def.Position != 100 {
+		t.Errorf("expected default to keep 100 TRX, got %+v", def)
+	}
+}
+
+func TestRebalanceTrimsOverweightPair(t *testing.T) {
+	fake, _ := newTestServer(t)
+	fake.SetBalance("USDT", 0)
+	fake.SetBalance("TRX", 400)
+	db.ResetState(config.DefaultStrategy, "TRXUSDT", "buy", 400)
+	db.ResetState(config.DefaultStrategy, "BTCUSDT", "buy", 0)
+
+	// Both pairs target half of the 97.48 USDT held in TRX
+	trades, err := rebalance()
+	if err != nil {
+		t.Fatalf("rebalance: %v", err)
+	}
+	if len(trades) != 2 || trades[0].Ticker != "TRXUSDT" || trades[0].Side != "sell" || trades[1].Ticker != "BTCUSDT" || trades[1].Side != "buy" {
+		t.Fatalf("expected a TRX trim then a BTC top-up, got %+v", trades)
+	}
+	if trades[0].Filled != 200 || math.Abs(trades[1].Filled-0.00081) > 1e-9 {
+		t.Errorf("expected 200 TRX sold and 0.00081 BTC bought, got %+v", trades)
+	}
+	trx, _ := db.GetState(config.DefaultStrategy, "TRXUSDT")
+	btc, _ := db.GetState(config.DefaultStrategy, "BTCUSDT")
+	if trx.Position != 200 || math.Abs(btc.Position-0.00081) > 1e-9 || trx.Signal != "buy" || btc.Signal != "buy" {
+		t.Errorf("expected states to follow the trades, got %+v and %+v", trx, btc)
+	}
+
+	// Back within the threshold, so nothing more is traded
+	if trades, err := rebalance(); err != nil || len(trades) != 0 {
+		t.Errorf("expected no trades on a balanced portfolio, got %+v, %v", trades, err)
+	}
+}
+
+func TestRebalanceReleasesLockWhileOrdersFill(t *testing.T) {
+	fake, _ := newTestServer(t)
+	fake.SetBalance("USDT", 0)
+	fake.SetBalance("TRX", 400)
+	fake.SetFillRatio(0)
+	db.ResetState(config.DefaultStrategy, "TRXUSDT", "buy", 400)
+	db.ResetState(config.DefaultStrategy, "BTCUSDT", "buy", 0)
+	chasePolicy = exchange.ChasePolicy{Interval: time.Second, PollInterval: 10 * time.Millisecond}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rebalance()
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(fake.Orders()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the trim to be placed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Alerts can size and place orders while the trim waits for a fill
+	if !portfolioMu.TryLock() {
+		t.Error("expected the portfolio lock to be free while the order fills")
+	} else {
+		portfolioMu.Unlock()
+	}
+	<-done
+}
+
+func TestRiskLimitRejectsOrder(t *testing.T) {
+	fake, srv := newTestServer(t)
+	ex.(*risk.Guard).Limits.MaxPairNotional = 5
+
+	resp, err := http.Post(srv.URL+"?wait=10s", "application/json", bytes.NewBufferString(`{"ticker":"TRXUSDT","signal":"buy","passphrase":"`+testSecret+`"}`))
+	if err != nil {
+		t.Fatalf("posting alert: %v", err)
+	}
+	defer resp.Body.Close()
+	var status alertStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil || status.Status != "failed" || !strings.Contains(status.Result, risk.RuleMaxPairNotional) {
+		t.Fatalf("expected the rejection in the response, got %+v (%v)", status, err)
+	}
+	if len(fake.Orders()) != 0 {
+		t.Errorf("expected no orders, got %+v", fake.Orders())
+	}
+	rejections, err := db.GetRiskRejections(10)
+	if err != nil || len(rejections) != 1 || rejections[0].Rule != risk.RuleMaxPairNotional || rejections[0].Ticker != "TRXUSDT" {
+		t.Errorf("expected the rejection to be recorded, got %+v (%v)", rejections, err)
+	}
+}
+
+func TestOrdersCountTowardTheLimitWhileChased(t *testing.T) {
+	fake, _ := newTestServer(t)
+	fake.SetFillRatio(0)
+	ex.(*risk.Guard).Limits.MaxOrdersPerHour = 1
+
+	req := exchange.OrderRequest{Ticker: "TRXUSDT", Side: "buy", Size: 10, LotSize: 0.1, ClOrdID: "limit1"}
+	ordID, err := placeOrder("default", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first order hasn't settled, but it was placed this hour
+	req.ClOrdID = "limit2"
+	if _, err := placeOrder("default", req); err == nil || !strings.Contains(err.Error(), risk.RuleMaxOrdersPerHour) {
+		t.Errorf("expected the second order to hit the hourly limit, got %v", err)
+	}
+
+	if _, err := settleOrder("default", "TRXUSDT", "buy", ordID, chasePolicy); err != nil {
+		t.Fatal(err)
+	}
+	orders, err := db.GetOrders("TRXUSDT")
+	if err != nil || len(orders) != 1 || orders[0].OrdID != ordID || orders[0].Status != "canceled" {
+		t.Errorf("expected the order recorded once with its outcome, got %+v (%v)", orders, err)
+	}
+}
+
+func setControl(t *testing.T, token, payload string) int {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/admin/controls", bytes.NewBufferString(payload))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	controlsHandler(rec, req)
+	return rec.Code
+}
+
+func TestControlsBlockAlerts(t *testing.T) {
+	fake, srv := newTestServer(t)
+	adminToken = "admin-token"
+	t.Cleanup(func() { adminToken = "" })
+
+	if code := setControl(t, "wrong", `{"control":"halt","on":true}`); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a bad admin token, got %d", code)
+	}
+
+	buy := `{"ticker":"TRXUSDT","signal":"buy","passphrase":"` + testSecret + `"}`
+	sell := `{"ticker":"TRXUSDT","signal":"sell","passphrase":"` + testSecret + `"}`
+	steps := []struct {
+		control string
+		alert   string
+		status  int
+	}{
+		{`{"control":"halt","on":true,"reason":"exchange outage"}`, sell, http.StatusServiceUnavailable},
+		{`{"control":"halt","on":false}`, "", 0},
+		{`{"control":"close_only","on":true}`, buy, http.StatusServiceUnavailable},
+		{"", sell, http.StatusOK},
+		{`{"control":"close_only","on":false}`, "", 0},
+		{`{"control":"pause","ticker":"TRXUSDT","on":true}`, sell, http.StatusServiceUnavailable},
+		{`{"control":"pause","ticker":"TRXUSDT","on":false}`, buy, http.StatusOK},
+	}
+	for i, step := range steps {
+		if step.control != "" {
+			if code := setControl(t, "admin-token", step.control); code != http.StatusOK {
+				t.Fatalf("step %d: setting %s returned %d", i, step.control, code)
+			}
+		}
+		if step.alert != "" {
+			if resp := postAlert(t, srv.URL, step.alert); resp.StatusCode != step.status {
+				t.Errorf("step %d: expected %d, got %d", i, step.status, resp.StatusCode)
+			}
+		}
+	}
+	if orders := fake.Orders(); len(orders) != 1 || orders[0].Side != "buy" {
+		t.Errorf("expected only the final buy to trade, got %+v", orders)
+	}
+}
+
+func TestDailyLossLimitStopsBuys(t *testing.T) {
+	fake, srv := newTestServer(t)
+	ex.(*risk.Guard).Limits = config.Risk{MaxDailyLoss: 100, AutoHalt: true}
+	db.RecordAccountValue(1000)
+
+	postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"buy","passphrase":"`+testSecret+`"}`)
+	if len(fake.Orders()) != 0 {
+		t.Errorf("expected no orders past the daily loss limit, got %+v", fake.Orders())
+	}
+	controls, err := db.GetControls()
+	if _, closeOnly := controls[db.ControlCloseOnly]; err != nil || !closeOnly {
+		t.Errorf("expected trading to be close-only, got %+v (%v)", controls, err)
+	}
+	if _, halted := controls[db.ControlHalt]; halted {
+		t.Errorf("expected sells to stay allowed, got %+v", controls)
+	}
+}
+
+func TestDailyLossIgnoresEarlierDays(t *testing.T) {
+	fake, srv := newTestServer(t)
+	ex.(*risk.Guard).Limits = config.Risk{MaxDailyLoss: 100, AutoHalt: true}
+	// The last snapshot is from three days ago, before a loss since
+	clock.Use(clock.NewVirtual(time.Now().Add(-72 * time.Hour)))
+	db.RecordAccountValue(1000)
+	clock.Use(nil)
+
+	postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"buy","passphrase":"`+testSecret+`"}`)
+	if len(fake.Orders()) != 1 {
+		t.Errorf("expected the buy to be placed, got %+v", fake.Orders())
+	}
+}
+
+func TestBuyIsProtectedUntilSold(t *testing.T) {
+	fake, srv := newTestServer(t)
+	cfg.Protection = &config.Protection{StopLoss: 0.05, TakeProfit: 0.1}
+
+	postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"buy","passphrase":"`+testSecret+`"}`)
+	buy := fake.Orders()[0]
+	state, _ := db.GetState(config.DefaultStrategy, "TRXUSDT")
+	algos := fake.AlgoOrders()
+	if len(algos) != 1 || algos[0].Type != "oco" || algos[0].Side != "sell" || algos[0].Size != state.Position {
+		t.Fatalf("expected an OCO sell of the %f TRX bought, got %+v", state.Position, algos)
+	}
+	entry := buy.Value / buy.Filled
+	if math.Abs(algos[0].StopLoss-entry*0.95) > 1e-6 || math.Abs(algos[0].TakeProfit-entry*1.1) > 1e-6 {
+		t.Errorf("expected triggers 5%% below and 10%% above %f, got %+v", entry, algos[0])
+	}
+
+	// The sell can only use the coins once the OCO is canceled
+	if resp := postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"sell","passphrase":"`+testSecret+`"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the sell to succeed, got %d", resp.StatusCode)
+	}
+	if algos := fake.AlgoOrders(); algos[0].State != "canceled" {
+		t.Errorf("expected the OCO to be canceled, got %+v", algos)
+	}
+	if orders := fake.Orders(); len(orders) != 2 || orders[1].Side != "sell" || orders[1].State != "filled" {
+		t.Errorf("expected the position to be sold, got %+v", orders)
+	}
+	if live, err := db.GetLiveProtectiveOrders(config.DefaultStrategy, "TRXUSDT"); err != nil || len(live) != 0 {
+		t.Errorf("expected no live protective orders, got %+v (%v)", live, err)
+	}
+}
+
+func TestTriggeredStopLossClosesPosition(t *testing.T) {
+	fake, srv := newTestServer(t)
+	cfg.Protection = &config.Protection{StopLoss: 0.05}
+
+	postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"buy","id":"1","passphrase":"`+testSecret+`"}`)
+	fake.SetPrice("TRX-USDT", 0.2)
+	if algos := fake.AlgoOrders(); len(algos) != 1 || algos[0].Type != "conditional" || algos[0].State != "effective" {
+		t.Fatalf("expected the stop-loss to trigger, got %+v", algos)
+	}
+
+	// The next buy signal opens a new, protected position
+	fake.SetBalance("USDT", 10.5)
+	if resp := postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"buy","id":"2","passphrase":"`+testSecret+`"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the buy to succeed, got %d", resp.StatusCode)
+	}
+	if orders := fake.Orders(); len(orders) != 3 || orders[2].Side != "buy" {
+		t.Errorf("expected a buy, the stop-loss sell and a new buy, got %+v", orders)
+	}
+	if algos := fake.AlgoOrders(); len(algos) != 2 || algos[1].State != "live" || math.Abs(algos[1].StopLoss-0.2*1.001*0.95) > 1e-6 {
+		t.Errorf("expected a new stop-loss below the new entry, got %+v", algos)
+	}
+	// Without the private stream the stop-loss sale is found on the buy
+	transactions, err := db.GetTransactions(config.DefaultStrategy, "TRXUSDT")
+	if err != nil || len(transactions) != 3 || transactions[1].Signal != "sell" || transactions[1].Amount != transactions[0].Amount {
+		t.Errorf("expected the stop-loss sale between the buys, got %+v (%v)", transactions, err)
+	}
+}
+
+func TestTrailingStopSellsOnRetrace(t *testing.T) {
+	fake, srv := newTestServer(t)
+	cfg.Protection = &config.Protection{TrailingStop: 0.1}
+
+	postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"buy","passphrase":"`+testSecret+`"}`)
+	fake.SetPrice("TRX-USDT", 0.3)
+	checkTrailingStops()
+	stops, err := db.GetTrailingStops()
+	if err != nil || len(stops) != 1 || stops[0].HighWater != 0.3 || math.Abs(stops[0].StopPrice-0.27) > 1e-9 {
+		t.Fatalf("expected the stop to trail 10%% below 0.3, got %+v (%v)", stops, err)
+	}
+	if len(fake.AlgoOrders()) != 0 {
+		t.Errorf("expected no exchange-side orders for a trailing stop, got %+v", fake.AlgoOrders())
+	}
+
+	// Above the stop nothing happens; at it the position is sold
+	fake.SetPrice("TRX-USDT", 0.28)
+	checkTrailingStops()
+	if len(fake.Orders()) != 1 {
+		t.Fatalf("expected no sell above the stop, got %+v", fake.Orders())
+	}
+	fake.SetPrice("TRX-USDT", 0.27)
+	checkTrailingStops()
+	deadline := time.Now().Add(10 * time.Second)
+	for state, _ := db.GetState(config.DefaultStrategy, "TRXUSDT"); state.Signal != "sell"; state, _ = db.GetState(config.DefaultStrategy, "TRXUSDT") {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the trailing stop to sell, state is %+v", state)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if orders := fake.Orders(); len(orders) != 2 || orders[1].Side != "sell" || orders[1].State != "filled" {
+		t.Errorf("expected the position to be sold, got %+v", orders)
+	}
+
+	// A buy straight after the sell trails from its own entry, not the old
+	// high-water mark
+	fake.SetBalance("USDT", 10.5)
+	postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"buy","id":"2","passphrase":"`+testSecret+`"}`)
+	stops, err = db.GetTrailingStops()
+	if err != nil || len(stops) != 1 || math.Abs(stops[0].HighWater-0.27*1.001) > 1e-9 {
+		t.Errorf("expected a new trailing stop from the new entry, got %+v (%v)", stops, err)
+	}
+}
+
+func TestStreamedFillsAreRecorded(t *testing.T) {
+	fake, srv := newTestServer(t)
+	cfg.Protection = &config.Protection{StopLoss: 0.05}
+	client := fake.Client()
+	stream := okx.NewStream(client, fake.PrivateWSURL())
+	stream.OnFill = recordFill
+	t.Cleanup(stream.Start())
+	ex = &risk.Guard{Exchange: &okx.Cached{Exchange: client, Stream: stream}, Limits: cfg.Risk}
+
+	postAlert(t, srv.URL, `{"ticker":"TRXUSDT","signal":"buy","passphrase":"`+testSecret+`"}`)
+	// The stop-loss sells without the bot placing an order, so only the
+	// stream reports it
+	fake.SetPrice("TRX-USDT", 0.2)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		transactions, err := db.GetTransactions(config.DefaultStrategy, "TRXUSDT")
+		if err != nil {
+			t.Fatalf("getting transactions: %v", err)
+		}
+		if len(transactions) == 2 {
+			if transactions[0].Signal != "buy" || transactions[1].Signal != "sell" || transactions[1].Amount != transactions[0].Amount {
+				t.Errorf("expected the buy and the stop-loss sell of the same amount, got %+v", transactions)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the buy and the stop-loss sell, got %+v", transactions)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestMain lets optimize run backtests by re-running the test binary, as it
+// re-runs crypto_trader.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == "backtest" {
+		os.Exit(runBacktest(os.Args[2:]))
+	}
+	os.Exit(m.Run())
+}
+
+// writeBacktestFiles writes a config for TRXUSDT and the given candles and
+// signals to a temporary directory, returning their paths.
+func writeBacktestFiles(t *testing.T, candles, signals string) (string, string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	return write("config.yaml", "pairs:\n  - ticker: TRXUSDT\n    lot_size: 0.1\n"), write("TRXUSDT.csv", candles), write("signals.csv", signals)
+}
+
+func TestBacktestReplaysSignals(t *testing.T) {
+	// The buy fills at the first close and the sell at the fourth
+	configPath, candles, signals := writeBacktestFiles(t, `time,open,high,low,close
+2024-01-01 00:00,0.2,0.2,0.2,0.2
+2024-01-01 01:00,0.2,0.21,0.2,0.21
+2024-01-01 02:00,0.21,0.22,0.21,0.22
+2024-01-01 03:00,0.22,0.25,0.22,0.25
+2024-01-01 04:00,0.25,0.25,0.24,0.24
+`, `time,ticker,signal
+2024-01-01T01:00:00Z,TRXUSDT,buy
+2024-01-01T04:30:00Z,TRXUSDT,sell
+`)
+	out := filepath.Join(t.TempDir(), "out")
+	if code := runBacktest([]string{"-config", configPath, "-candles", candles, "-signals", signals, "-out", out, "-usdt", "1000"}); code != 0 {
+		t.Fatalf("backtest exited with %d", code)
+	}
+
+	trades, err := os.ReadFile(filepath.Join(out, "trades.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(trades)), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "2024-01-01T01:00:00Z,TRXUSDT,buy,") ||
+		!strings.HasPrefix(lines[2], "2024-01-01T04:30:00Z,TRXUSDT,sell,") {
+		t.Fatalf("expected a buy at the first close and a sell at the fourth, got\n%s", trades)
+	}
+	if pnl, _ := strconv.ParseFloat(lines[2][strings.LastIndex(lines[2], ",")+1:], 64); pnl < 200 {
+		t.Errorf("expected the sell to realize about 25%%, got %s", lines[2])
+	}
+	equity, err := os.ReadFile(filepath.Join(out, "equity.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines = strings.Split(strings.TrimSpace(string(equity)), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("expected an equity point per candle, got\n%s", equity)
+	}
+	last := strings.Split(lines[5], ",")
+	if v, _ := strconv.ParseFloat(last[1], 64); v < 1200 || v > 1250 {
+		t.Errorf("expected the 25%% gain less fees, got %s", lines[5])
+	}
+}
+
+func TestBacktestStopsTriggerInsideCandles(t *testing.T) {
+	tests := []struct {
+		name       string
+		protection string
+		candles    string
+		sold       string
+		price      float64
+	}{
+		// The stop-loss 5% under the 0.2002 entry is only reached by the
+		// candle's low, and sells at the stop
+		{"stop-loss", "stop_loss: 0.05", `time,open,high,low,close
+2024-01-01 00:00,0.2,0.2,0.2,0.2
+2024-01-01 01:00,0.2,0.2,0.18,0.2
+2024-01-01 02:00,0.2,0.2,0.2,0.2
+`, "2024-01-01T02:00:00Z", 0.2002 * 0.95},
+		// The high raises the stop to 0.27 and the next low reaches it; the
+		// sell is priced from the stop like a live one from the last price
+		{"trailing stop", "trailing_stop: 0.1", `time,open,high,low,close
+2024-01-01 00:00,0.2,0.2,0.2,0.2
+2024-01-01 01:00,0.2,0.3,0.25,0.28
+2024-01-01 02:00,0.28,0.29,0.26,0.29
+`, "2024-01-01T03:00:00Z", 0.27 * 0.999},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath, candles, signals := writeBacktestFiles(t, tt.candles, "time,ticker,signal\n2024-01-01T01:00:00Z,TRXUSDT,buy\n")
+			f, err := os.OpenFile(configPath, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteString("protection:\n  " + tt.protection + "\n")
+			f.Close()
+			out := filepath.Join(t.TempDir(), "out")
+			if code := runBacktest([]string{"-config", configPath, "-candles", candles, "-signals", signals, "-out", out, "-usdt", "1000"}); code != 0 {
+				t.Fatalf("backtest exited with %d", code)
+			}
+
+			trades, err := os.ReadFile(filepath.Join(out, "trades.csv"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(trades)), "\n")
+			if len(lines) != 3 || !strings.HasPrefix(lines[2], tt.sold+",TRXUSDT,sell,") {
+				t.Fatalf("expected the stop to sell at %s, got\n%s", tt.sold, trades)
+			}
+			if price, _ := strconv.ParseFloat(strings.Split(lines[2], ",")[4], 64); math.Abs(price-tt.price) > 1e-9 {
+				t.Errorf("expected the sell at %v, got %s", tt.price, lines[2])
+			}
+		})
+	}
+}
+
+func TestOptimizeRanksCombinations(t *testing.T) {
+	// The dip to 0.19 trips a 2% stop-loss before the price recovers
+	configPath, candles, signals := writeBacktestFiles(t, `time,open,high,low,close
+2024-01-01 00:00,0.2,0.2,0.2,0.2
+2024-01-01 01:00,0.2,0.21,0.2,0.21
+2024-01-01 02:00,0.21,0.21,0.19,0.19
+2024-01-01 03:00,0.19,0.25,0.19,0.25
+2024-01-01 04:00,0.25,0.25,0.24,0.24
+`, `time,ticker,signal
+2024-01-01T01:00:00Z,TRXUSDT,buy
+2024-01-01T04:30:00Z,TRXUSDT,sell
+`)
+	out := filepath.Join(t.TempDir(), "out")
+	args := []string{"-config", configPath, "-candles", candles, "-signals", signals, "-out", out,
+		"-param", "stop_loss=0.02,0", "-rank", "return", "-train", "2h", "-test", "1h", "-parallel", "2"}
+	if code := runOptimize(args); code != 0 {
+		t.Fatalf("optimize exited with %d", code)
+	}
+
+	results, err := os.ReadFile(filepath.Join(out, "results.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(results)), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "1,0,") || !strings.HasPrefix(lines[2], "2,0.02,") {
+		t.Fatalf("expected holding through the dip to rank first, got\n%s", results)
+	}
+	walk, err := os.ReadFile(filepath.Join(out, "walkforward.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(walk)), "\n"); len(lines) != 3 {
+		t.Errorf("expected two walk-forward windows, got\n%s", walk)
+	}
+	var doc struct {
+		Results     []json.RawMessage `json:"results"`
+		OutOfSample *json.RawMessage  `json:"out_of_sample"`
+	}
+	data, err := os.ReadFile(filepath.Join(out, "results.json"))
+	if err != nil || json.Unmarshal(data, &doc) != nil || len(doc.Results) != 2 || doc.OutOfSample == nil {
+		t.Errorf("expected both results and the out-of-sample summary in results.json, got %s (%v)", data, err)
+	}
+}
@@ -0,0 +1,240 @@
+// Package marketdata keeps the latest OKX tickers for a set of pairs from the
+// public WebSocket, so reading a price doesn't cost a REST request. Callers
+// fall back to REST for pairs the feed has no fresh quote for.
+package marketdata
+
+import (
+	"crypto_trader/exchange"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultURL is OKX's public WebSocket.
+const DefaultURL = "wss://ws.okx.com:8443/ws/v5/public"
+
+// OKX closes connections that are quiet for 30s, so the feed pings well
+// inside that and gives up on a connection that stays silent past it.
+const (
+	pingInterval = 20 * time.Second
+	readTimeout  = 30 * time.Second
+	minBackoff   = time.Second
+	maxBackoff   = time.Minute
+)
+
+// Quote is the latest ticker for a pair.
+type Quote struct {
+	Ticker   string
+	Last     float64
+	Bid      float64
+	Ask      float64
+	Time     time.Time // when OKX produced it
+	Received time.Time
+	// Stale is set when the feed is disconnected or the quote is older than
+	// the feed's StaleAfter
+	Stale bool
+}
+
+// Feed subscribes to the tickers channel for its pairs and caches the latest
+// quote of each. It reconnects with exponential backoff, and its methods are
+// safe to call from any goroutine.
+type Feed struct {
+	URL string
+	// StaleAfter is how old a quote may get before it is flagged. OKX only
+	// pushes a ticker when it changes, so quiet pairs update rarely.
+	StaleAfter time.Duration
+
+	instIDs map[string]string // instId -> ticker
+
+	mu        sync.RWMutex
+	quotes    map[string]Quote
+	connected bool
+}
+
+// New returns a feed for tickers. Call Start to connect.
+func New(url string, tickers []string) *Feed {
+	f := &Feed{
+		URL:        url,
+		StaleAfter: time.Minute,
+		instIDs:    make(map[string]string),
+		quotes:     make(map[string]Quote),
+	}
+	for _, ticker := range tickers {
+		f.instIDs[exchange.InstID(ticker)] = ticker
+	}
+	return f
+}
+
+// Start connects in the background and keeps the feed connected until the
+// returned function is called.
+func (f *Feed) Start() func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.run(stop)
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// Last is the latest quote for ticker, if the feed has had one.
+func (f *Feed) Last(ticker string) (Quote, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	q, ok := f.quotes[ticker]
+	return f.flag(q), ok
+}
+
+// Snapshot returns every quote, keyed by ticker.
+func (f *Feed) Snapshot() map[string]Quote {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	quotes := make(map[string]Quote, len(f.quotes))
+	for ticker, q := range f.quotes {
+		quotes[ticker] = f.flag(q)
+	}
+	return quotes
+}
+
+// Connected reports whether the feed is subscribed and receiving quotes.
+func (f *Feed) Connected() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.connected
+}
+
+// flag sets q.Stale. Callers hold f.mu.
+func (f *Feed) flag(q Quote) Quote {
+	q.Stale = !f.connected || time.Since(q.Received) > f.StaleAfter
+	return q
+}
+
+func (f *Feed) setConnected(connected bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connected = connected
+}
+
+func (f *Feed) run(stop chan struct{}) {
+	backoff := minBackoff
+	for {
+		received, err := f.session(stop)
+		f.setConnected(false)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		// A connection that worked for a while starts the backoff over
+		if received {
+			backoff = minBackoff
+		}
+		log.Printf("Market data connection lost: %v, reconnecting in %s", err, backoff)
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// session connects, subscribes and reads quotes until the connection fails
+// or stop is closed. It reports whether any quote arrived.
+func (f *Feed) session(stop chan struct{}) (bool, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(f.URL, nil)
+	if err != nil {
+		return false, fmt.Errorf("error connecting to %s: %v", f.URL, err)
+	}
+	defer conn.Close()
+
+	var args []map[string]string
+	for instID := range f.instIDs {
+		args = append(args, map[string]string{"channel": "tickers", "instId": instID})
+	}
+	if err := conn.WriteJSON(map[string]interface{}{"op": "subscribe", "args": args}); err != nil {
+		return false, fmt.Errorf("error subscribing: %v", err)
+	}
+
+	// The pinger is the only writer from here on. Closing the connection
+	// unblocks the read below when the feed is stopped.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ping := time.NewTicker(pingInterval)
+		defer ping.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-stop:
+				conn.Close()
+				return
+			case <-ping.C:
+				conn.WriteMessage(websocket.TextMessage, []byte("ping"))
+			}
+		}
+	}()
+
+	received := false
+	for {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return received, err
+		}
+		if string(msg) == "pong" {
+			continue
+		}
+		var push struct {
+			Event string `json:"event"`
+			Code  string `json:"code"`
+			Msg   string `json:"msg"`
+			Data  []struct {
+				InstID string `json:"instId"`
+				Last   string `json:"last"`
+				BidPx  string `json:"bidPx"`
+				AskPx  string `json:"askPx"`
+				Ts     string `json:"ts"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(msg, &push); err != nil {
+			log.Printf("Invalid market data message %q: %v", msg, err)
+			continue
+		}
+		switch push.Event {
+		case "error":
+			return received, fmt.Errorf("OKX WebSocket error: code=%s, msg=%s", push.Code, push.Msg)
+		case "subscribe":
+			f.setConnected(true)
+			continue
+		}
+
+		now := time.Now()
+		f.mu.Lock()
+		for _, d := range push.Data {
+			ticker, ok := f.instIDs[d.InstID]
+			if !ok {
+				continue
+			}
+			q := Quote{Ticker: ticker, Received: now}
+			q.Last, _ = strconv.ParseFloat(d.Last, 64)
+			q.Bid, _ = strconv.ParseFloat(d.BidPx, 64)
+			q.Ask, _ = strconv.ParseFloat(d.AskPx, 64)
+			if ms, err := strconv.ParseInt(d.Ts, 10, 64); err == nil {
+				q.Time = time.UnixMilli(ms)
+			}
+			f.quotes[ticker] = q
+			received = true
+		}
+		f.mu.Unlock()
+	}
+}
@@ -0,0 +1,112 @@
+package marketdata
+
+import (
+	"crypto_trader/exchange"
+	"crypto_trader/okxfake"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or a few seconds pass.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFeedCachesPushedTickers(t *testing.T) {
+	fake := okxfake.New()
+	defer fake.Close()
+	fake.SetPrice("BTC-USDT", 60000)
+
+	feed := New(fake.WSURL(), []string{"BTCUSDT", "TRXUSDT"})
+	defer feed.Start()()
+
+	waitFor(t, "the first BTC quote", func() bool {
+		q, ok := feed.Last("BTCUSDT")
+		return ok && q.Last == 60000 && !q.Stale
+	})
+	if _, ok := feed.Last("TRXUSDT"); ok {
+		t.Errorf("expected no TRX quote before one is pushed")
+	}
+
+	fake.SetPrice("TRX-USDT", 0.25)
+	fake.SetPrice("BTC-USDT", 61000)
+	waitFor(t, "the pushed quotes", func() bool {
+		quotes := feed.Snapshot()
+		return quotes["BTCUSDT"].Last == 61000 && quotes["TRXUSDT"].Last == 0.25
+	})
+
+	feed.mu.Lock()
+	feed.StaleAfter = time.Millisecond
+	feed.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	if q, _ := feed.Last("BTCUSDT"); !q.Stale {
+		t.Errorf("expected an old quote to be flagged stale, got %+v", q)
+	}
+}
+
+func TestFeedReconnectsAfterDrop(t *testing.T) {
+	fake := okxfake.New()
+	defer fake.Close()
+	fake.SetPrice("BTC-USDT", 60000)
+
+	feed := New(fake.WSURL(), []string{"BTCUSDT"})
+	defer feed.Start()()
+	waitFor(t, "the feed to connect", feed.Connected)
+
+	fake.DropWebSockets()
+	waitFor(t, "the drop to be noticed", func() bool { return !feed.Connected() })
+	if q, ok := feed.Last("BTCUSDT"); !ok || !q.Stale {
+		t.Errorf("expected the cached quote to be stale while disconnected, got %+v", q)
+	}
+
+	// The feed resubscribes and gets the current price again
+	fake.SetPrice("BTC-USDT", 59000)
+	waitFor(t, "a quote after reconnecting", func() bool {
+		q, _ := feed.Last("BTCUSDT")
+		return q.Last == 59000 && !q.Stale
+	})
+}
+
+func TestPricedPrefersTheFeed(t *testing.T) {
+	fake := okxfake.New()
+	defer fake.Close()
+	fake.SetInstrument("BTC-USDT", 0.00001)
+	fake.SetPrice("BTC-USDT", 60000)
+	fake.SetPrice("TRX-USDT", 0.25)
+	fake.SetBalance("USDT", 1000)
+
+	feed := New(fake.WSURL(), []string{"BTCUSDT"})
+	defer feed.Start()()
+	waitFor(t, "the BTC quote", func() bool {
+		q, ok := feed.Last("BTCUSDT")
+		return ok && !q.Stale
+	})
+	priced := &Priced{Exchange: fake.Client(), Feed: feed}
+
+	// The next REST ticker request fails, so only the feed can answer
+	fake.FailNext("/api/v5/market/ticker", "50001", "Service temporarily unavailable")
+	if price, err := priced.GetPrice("BTCUSDT"); err != nil || price != 60000 {
+		t.Errorf("expected 60000 from the feed, got %v (%v)", price, err)
+	}
+	if _, err := priced.PlaceOrder(exchange.OrderRequest{Ticker: "BTCUSDT", Side: "buy", Size: 0.001, LotSize: 0.00001}); err != nil {
+		t.Fatalf("expected the order to be priced from the feed, got %v", err)
+	}
+	if orders := fake.Orders(); len(orders) != 1 || orders[0].Price != 60060 {
+		t.Errorf("expected a buy at 60060, got %+v", orders)
+	}
+
+	// A pair the feed doesn't follow goes to REST
+	if _, err := priced.GetPrice("TRXUSDT"); err == nil {
+		t.Errorf("expected the failing REST request for TRX")
+	}
+	if price, err := priced.GetPrice("TRXUSDT"); err != nil || price != 0.25 {
+		t.Errorf("expected 0.25 from REST, got %v (%v)", price, err)
+	}
+}
@@ -0,0 +1,39 @@
+package marketdata
+
+import "crypto_trader/exchange"
+
+// Priced answers price queries from a Feed, and from the wrapped exchange's
+// REST calls for pairs the feed has no fresh quote for. Limit and post-only
+// orders without a price are priced from the feed the same way, so placing
+// one doesn't fetch the price again.
+type Priced struct {
+	exchange.Exchange
+	Feed *Feed
+}
+
+var _ exchange.Exchange = (*Priced)(nil)
+
+// last is the feed's fresh last price for ticker.
+func (p *Priced) last(ticker string) (float64, bool) {
+	q, ok := p.Feed.Last(ticker)
+	if !ok || q.Stale || q.Last <= 0 {
+		return 0, false
+	}
+	return q.Last, true
+}
+
+func (p *Priced) GetPrice(ticker string) (float64, error) {
+	if last, ok := p.last(ticker); ok {
+		return last, nil
+	}
+	return p.Exchange.GetPrice(ticker)
+}
+
+func (p *Priced) PlaceOrder(req exchange.OrderRequest) (string, error) {
+	if req.Type != exchange.OrderMarket && req.Price <= 0 {
+		if last, ok := p.last(req.Ticker); ok {
+			req.Price = req.OrderPrice(last)
+		}
+	}
+	return p.Exchange.PlaceOrder(req)
+}
@@ -0,0 +1,72 @@
+package okx
+
+import "crypto_trader/exchange"
+
+// Cached answers balance and position queries from a Stream's account cache,
+// and from the wrapped exchange's REST calls while the cache is out of date.
+// Every call that can change the account invalidates the cache once it has
+// returned, until OKX pushes the change; a push that arrived while the call
+// was in flight may not include it.
+type Cached struct {
+	exchange.Exchange
+	Stream *Stream
+}
+
+var _ exchange.Exchange = (*Cached)(nil)
+
+func (c *Cached) GetSpotBalance(ccy string) (float64, error) {
+	if balances, ok := c.Stream.Balances(); ok {
+		// Like REST, the account channel leaves out currencies never held
+		return balances[ccy].Avail, nil
+	}
+	return c.Exchange.GetSpotBalance(ccy)
+}
+
+func (c *Cached) GetPositions() (map[string]float64, error) {
+	balances, ok := c.Stream.Balances()
+	if !ok {
+		return c.Exchange.GetPositions()
+	}
+	positions := make(map[string]float64)
+	for _, inst := range exchange.Registered() {
+		if b, ok := balances[inst.Base]; ok {
+			positions[inst.Ticker()] = b.Cash
+		}
+	}
+	return positions, nil
+}
+
+// GetOrder invalidates the cache when it sees a fill the stream hasn't
+// reported yet, so nothing reads balances from before it.
+func (c *Cached) GetOrder(ticker, ordID string) (exchange.Order, error) {
+	order, err := c.Exchange.GetOrder(ticker, ordID)
+	if err == nil && order.FillSize > c.Stream.Seen(ordID) {
+		c.Stream.Invalidate()
+	}
+	return order, err
+}
+
+func (c *Cached) PlaceOrder(req exchange.OrderRequest) (string, error) {
+	defer c.Stream.Invalidate()
+	return c.Exchange.PlaceOrder(req)
+}
+
+func (c *Cached) AmendOrder(ticker, ordID string, price float64) error {
+	defer c.Stream.Invalidate()
+	return c.Exchange.AmendOrder(ticker, ordID, price)
+}
+
+func (c *Cached) CancelOrder(ticker, ordID string) error {
+	defer c.Stream.Invalidate()
+	return c.Exchange.CancelOrder(ticker, ordID)
+}
+
+func (c *Cached) PlaceAlgoOrder(req exchange.AlgoRequest) (string, error) {
+	defer c.Stream.Invalidate()
+	return c.Exchange.PlaceAlgoOrder(req)
+}
+
+func (c *Cached) CancelAlgoOrders(ticker string, algoIDs []string) error {
+	defer c.Stream.Invalidate()
+	return c.Exchange.CancelAlgoOrders(ticker, algoIDs)
+}
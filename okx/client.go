@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto_trader/exchange"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -15,6 +16,8 @@ import (
 	"time"
 )
 
+var _ exchange.Exchange = (*Client)(nil)
+
 func NewClient(apiKey, secretKey, passphrase string) *Client {
 	return &Client{
 		APIKey:     apiKey,
@@ -46,21 +49,24 @@ func (c *Client) makeRequest(method, endpoint string, body interface{}, response
 		}
 	}
 
-	timestamp := time.Now().UTC().Format("2006-01-02T15:04:05.999Z")
-	bodyStr := ""
-	if body != nil {
-		bodyBytes, _ := json.Marshal(body)
-		bodyStr = string(bodyBytes)
-	}
-	message := timestamp + method + endpoint + bodyStr
-	log.Printf("Signing message: %s", message)
+	// Market data and public endpoints don't need signing
+	if !isPublicEndpoint(endpoint) {
+		timestamp := time.Now().UTC().Format("2006-01-02T15:04:05.999Z")
+		bodyStr := ""
+		if body != nil {
+			bodyBytes, _ := json.Marshal(body)
+			bodyStr = string(bodyBytes)
+		}
+		message := timestamp + method + endpoint + bodyStr
+		log.Printf("Signing message: %s", message)
 
-	signature := c.sign(message)
-	req.Header.Set("OK-ACCESS-KEY", c.APIKey)
-	req.Header.Set("OK-ACCESS-SIGN", signature)
-	req.Header.Set("OK-ACCESS-TIMESTAMP", timestamp)
-	req.Header.Set("OK-ACCESS-PASSPHRASE", c.Passphrase)
-	log.Printf("Generated signature: %s", signature)
+		signature := c.sign(message)
+		req.Header.Set("OK-ACCESS-KEY", c.APIKey)
+		req.Header.Set("OK-ACCESS-SIGN", signature)
+		req.Header.Set("OK-ACCESS-TIMESTAMP", timestamp)
+		req.Header.Set("OK-ACCESS-PASSPHRASE", c.Passphrase)
+		log.Printf("Generated signature: %s", signature)
+	}
 
 	client := &http.Client{}
 	log.Printf("Sending %s request to %s", method, url)
@@ -98,6 +104,10 @@ func (c *Client) makeRequest(method, endpoint string, body interface{}, response
 	return nil
 }
 
+func isPublicEndpoint(endpoint string) bool {
+	return strings.HasPrefix(endpoint, "/api/v5/public/") || strings.HasPrefix(endpoint, "/api/v5/market/")
+}
+
 func (c *Client) sign(message string) string {
 	key := []byte(c.SecretKey)
 	h := hmac.New(sha256.New, key)
@@ -117,8 +127,8 @@ func getPrecision(lotSize float64) int {
 	return 0
 }
 
-func (c *Client) GetSpotBalance() (float64, error) {
-	endpoint := "/api/v5/account/balance?ccy=USDT"
+func (c *Client) GetSpotBalance(ccy string) (float64, error) {
+	endpoint := "/api/v5/account/balance?ccy=" + ccy
 	var balance struct {
 		Code string `json:"code"`
 		Data []struct {
@@ -136,21 +146,26 @@ func (c *Client) GetSpotBalance() (float64, error) {
 	if balance.Code != "0" {
 		return 0, fmt.Errorf("OKX API balance error: code=%s", balance.Code)
 	}
+	if len(balance.Data) == 0 {
+		return 0, fmt.Errorf("%s balance not found", ccy)
+	}
 	for _, detail := range balance.Data[0].Details {
-		if detail.Ccy == "USDT" {
+		if detail.Ccy == ccy {
 			availBal, err := strconv.ParseFloat(detail.AvailBal, 64)
 			if err != nil {
-				return 0, fmt.Errorf("error parsing USDT availBal: %v", err)
+				return 0, fmt.Errorf("error parsing %s availBal: %v", ccy, err)
 			}
-			log.Printf("Available USDT balance: %.2f (Total: %s)", availBal, detail.CashBal)
+			log.Printf("Available %s balance: %.8f (Total: %s)", ccy, availBal, detail.CashBal)
 			return availBal, nil
 		}
 	}
-	return 0, fmt.Errorf("USDT balance not found")
+	// OKX omits currencies the account has never held
+	log.Printf("No %s balance reported, treating as 0", ccy)
+	return 0, nil
 }
 
 func (c *Client) GetOpenOrders(ticker string) (bool, error) {
-	instId := strings.Replace(ticker, "USDT", "-USDT", 1)
+	instId := exchange.InstID(ticker)
 	endpoint := fmt.Sprintf("/api/v5/trade/orders-pending?instId=%s", instId)
 	var response struct {
 		Code string `json:"code"`
@@ -168,8 +183,8 @@ func (c *Client) GetOpenOrders(ticker string) (bool, error) {
 	return len(response.Data) > 0, nil
 }
 
-func (c *Client) getCurrentPrice(ticker string) float64 {
-	instId := strings.Replace(ticker, "USDT", "-USDT", 1)
+func (c *Client) GetPrice(ticker string) (float64, error) {
+	instId := exchange.InstID(ticker)
 	endpoint := fmt.Sprintf("/api/v5/market/ticker?instId=%s", instId)
 	var result struct {
 		Code string `json:"code"`
@@ -178,47 +193,161 @@ func (c *Client) getCurrentPrice(ticker string) float64 {
 		} `json:"data"`
 	}
 	if err := c.makeRequest("GET", endpoint, nil, &result); err != nil {
-		log.Printf("Error fetching price for %s: %v", ticker, err)
-		return 0
+		return 0, fmt.Errorf("error fetching price for %s: %v", ticker, err)
 	}
 	if result.Code != "0" || len(result.Data) == 0 {
-		log.Printf("No price data for %s", ticker)
-		return 0
+		return 0, fmt.Errorf("no price data for %s: code=%s", ticker, result.Code)
 	}
 	price, err := strconv.ParseFloat(result.Data[0].Last, 64)
 	if err != nil {
-		log.Printf("Error parsing price for %s: %v", ticker, err)
-		return 0
+		return 0, fmt.Errorf("error parsing price for %s: %v", ticker, err)
 	}
-	return price
+	return price, nil
 }
 
-func (c *Client) PlaceOrder(ticker, side string, size, lotSize float64) error {
-	instId := strings.Replace(ticker, "USDT", "-USDT", 1)
-	precision := getPrecision(lotSize)
-	formattedSize := fmt.Sprintf("%.*f", precision, size)
+// GetCandles returns up to limit candles of the given bar size (1m, 1H, 1D,
+// ...), oldest first.
+func (c *Client) GetCandles(ticker, bar string, limit int) ([]exchange.Candle, error) {
+	instId := exchange.InstID(ticker)
+	return c.fetchCandles(ticker, fmt.Sprintf("/api/v5/market/candles?instId=%s&bar=%s&limit=%d", instId, bar, limit))
+}
 
-	// Limit order
-	price := c.getCurrentPrice(ticker)
-	if price == 0 {
-		return fmt.Errorf("failed to get price for %s", ticker)
+// GetHistoryCandles returns up to limit candles of the given bar size that
+// opened before end, or the latest ones if end is zero, oldest first. It
+// reaches back further than GetCandles, at most 100 candles at a time.
+func (c *Client) GetHistoryCandles(ticker, bar string, end time.Time, limit int) ([]exchange.Candle, error) {
+	endpoint := fmt.Sprintf("/api/v5/market/history-candles?instId=%s&bar=%s&limit=%d", exchange.InstID(ticker), bar, limit)
+	if !end.IsZero() {
+		endpoint += fmt.Sprintf("&after=%d", end.UnixMilli())
 	}
-	priceAdjust := price
-	if side == "buy" {
-		priceAdjust *= 1.001 // 0.1% above for buy
-	} else {
-		priceAdjust *= 0.999 // 0.1% below for sell
+	return c.fetchCandles(ticker, endpoint)
+}
+
+func (c *Client) fetchCandles(ticker, endpoint string) ([]exchange.Candle, error) {
+	var result struct {
+		Code string     `json:"code"`
+		Msg  string     `json:"msg"`
+		Data [][]string `json:"data"`
+	}
+	if err := c.makeRequest("GET", endpoint, nil, &result); err != nil {
+		return nil, fmt.Errorf("error fetching candles for %s: %v", ticker, err)
+	}
+	if result.Code != "0" {
+		return nil, fmt.Errorf("OKX API candles error for %s: code=%s, msg=%s", ticker, result.Code, result.Msg)
+	}
+
+	// OKX lists the newest candle first: [ts, o, h, l, c, vol, ...]
+	candles := make([]exchange.Candle, 0, len(result.Data))
+	for i := len(result.Data) - 1; i >= 0; i-- {
+		row := result.Data[i]
+		if len(row) < 6 {
+			return nil, fmt.Errorf("malformed candle for %s: %v", ticker, row)
+		}
+		var values [6]float64
+		for j := range values {
+			v, err := strconv.ParseFloat(row[j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing candle for %s: %v", ticker, err)
+			}
+			values[j] = v
+		}
+		candles = append(candles, exchange.Candle{
+			Time:   time.UnixMilli(int64(values[0])),
+			Open:   values[1],
+			High:   values[2],
+			Low:    values[3],
+			Close:  values[4],
+			Volume: values[5],
+		})
+	}
+	return candles, nil
+}
+
+func (c *Client) GetInstruments() ([]exchange.Instrument, error) {
+	endpoint := "/api/v5/public/instruments?instType=SPOT"
+	var result struct {
+		Code string `json:"code"`
+		Msg  string `json:"msg"`
+		Data []struct {
+			InstId   string `json:"instId"`
+			BaseCcy  string `json:"baseCcy"`
+			QuoteCcy string `json:"quoteCcy"`
+			LotSz    string `json:"lotSz"`
+			MinSz    string `json:"minSz"`
+		} `json:"data"`
+	}
+
+	var err error
+	for retries := 0; retries < 3; retries++ {
+		err = c.makeRequest("GET", endpoint, nil, &result)
+		if err == nil && result.Code != "0" {
+			err = fmt.Errorf("OKX API instruments error: code=%s, msg=%s", result.Code, result.Msg)
+		}
+		if err == nil {
+			break
+		}
+		log.Printf("Retrying instruments fetch (%d/3): %v", retries+1, err)
+		time.Sleep(time.Second * time.Duration(retries+1))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch instruments after 3 retries: %v", err)
+	}
+
+	var instruments []exchange.Instrument
+	for _, inst := range result.Data {
+		lotSz, err := strconv.ParseFloat(inst.LotSz, 64)
+		if err != nil {
+			log.Printf("Error parsing lotSz for %s: %v", inst.InstId, err)
+			continue
+		}
+		minSz, _ := strconv.ParseFloat(inst.MinSz, 64)
+		instruments = append(instruments, exchange.Instrument{
+			InstID:  inst.InstId,
+			Base:    inst.BaseCcy,
+			Quote:   inst.QuoteCcy,
+			LotSize: lotSz,
+			MinSize: minSz,
+		})
+	}
+	return instruments, nil
+}
+
+func (c *Client) PlaceOrder(req exchange.OrderRequest) (string, error) {
+	ticker, side, clOrdID := req.Ticker, req.Side, req.ClOrdID
+	instId := exchange.InstID(ticker)
+	precision := getPrecision(req.LotSize)
+	formattedSize := fmt.Sprintf("%.*f", precision, req.Size)
+
+	ordType := req.Type
+	if ordType == "" {
+		ordType = exchange.OrderLimit
 	}
 	bodyMap := map[string]string{
 		"instId":  instId,
-		"ordType": "limit",
+		"ordType": ordType,
 		"side":    side,
 		"sz":      formattedSize,
 		"tdMode":  "cash",
-		"px":      fmt.Sprintf("%.8f", priceAdjust),
+	}
+	if ordType == exchange.OrderMarket {
+		// Spot market buys are sized in the quote currency unless told otherwise
+		bodyMap["tgtCcy"] = "base_ccy"
+	} else {
+		price := req.Price
+		if price <= 0 {
+			last, err := c.GetPrice(ticker)
+			if err != nil {
+				return "", fmt.Errorf("failed to get price for %s: %v", ticker, err)
+			}
+			price = req.OrderPrice(last)
+		}
+		bodyMap["px"] = fmt.Sprintf("%.8f", price)
+	}
+	if clOrdID != "" {
+		bodyMap["clOrdId"] = clOrdID
 	}
 
-	log.Printf("Formatted order size for %s: %s (lotSize: %f, precision: %d)", ticker, formattedSize, lotSize, precision)
+	log.Printf("Formatted order size for %s: %s (lotSize: %f, precision: %d)", ticker, formattedSize, req.LotSize, precision)
 	log.Printf("Sending order request: %v", bodyMap)
 
 	var response struct {
@@ -232,13 +361,294 @@ func (c *Client) PlaceOrder(ticker, side string, size, lotSize float64) error {
 	}
 	err := c.makeRequest("POST", "/api/v5/trade/order", bodyMap, &response)
 	if err != nil {
-		return fmt.Errorf("error placing order: %v", err)
+		return "", fmt.Errorf("error placing order: %v", err)
+	}
+	if len(response.Data) == 0 {
+		log.Printf("Order failed for %s: code=%s, msg=%s", ticker, response.Code, response.Msg)
+		return "", fmt.Errorf("OKX API order error: code=%s, msg=%s", response.Code, response.Msg)
+	}
+	// A retry of an order OKX already accepted: hand back the original
+	if response.Data[0].SCode == "51016" && clOrdID != "" {
+		order, err := c.fetchOrder(ticker, "clOrdId="+clOrdID)
+		if err != nil {
+			return "", fmt.Errorf("error fetching duplicate order %s: %v", clOrdID, err)
+		}
+		log.Printf("Order %s for %s was already placed: ordId=%s", clOrdID, ticker, order.OrdID)
+		return order.OrdID, nil
 	}
-	if response.Code != "0" || len(response.Data) == 0 || response.Data[0].SCode != "0" {
+	if response.Code != "0" || response.Data[0].SCode != "0" {
 		log.Printf("Order failed for %s: code=%s, sCode=%s, sMsg=%s", ticker, response.Code, response.Data[0].SCode, response.Data[0].SMsg)
-		return fmt.Errorf("OKX API order error: code=%s, msg=%s", response.Data[0].SCode, response.Data[0].SMsg)
+		return "", fmt.Errorf("OKX API order error: code=%s, msg=%s", response.Data[0].SCode, response.Data[0].SMsg)
 	}
 	log.Printf("Order placed successfully for %s: ordId=%s", ticker, response.Data[0].OrdId)
+	return response.Data[0].OrdId, nil
+}
+
+func (c *Client) GetOrder(ticker, ordId string) (exchange.Order, error) {
+	return c.fetchOrder(ticker, "ordId="+ordId)
+}
+
+// fetchOrder looks an order up by ordId=... or clOrdId=...
+func (c *Client) fetchOrder(ticker, query string) (exchange.Order, error) {
+	instId := exchange.InstID(ticker)
+	endpoint := fmt.Sprintf("/api/v5/trade/order?instId=%s&%s", instId, query)
+	var response struct {
+		Code string      `json:"code"`
+		Msg  string      `json:"msg"`
+		Data []orderData `json:"data"`
+	}
+	err := c.makeRequest("GET", endpoint, nil, &response)
+	if err != nil {
+		return exchange.Order{}, fmt.Errorf("error fetching order: %v", err)
+	}
+	if response.Code != "0" || len(response.Data) == 0 {
+		return exchange.Order{}, fmt.Errorf("OKX API order query error: code=%s, msg=%s", response.Code, response.Msg)
+	}
+
+	return response.Data[0].order(ticker), nil
+}
+
+// orderData is an order as OKX reports it, from the REST API or the orders
+// channel.
+type orderData struct {
+	InstId    string `json:"instId"`
+	OrdId     string `json:"ordId"`
+	ClOrdId   string `json:"clOrdId"`
+	Side      string `json:"side"`
+	State     string `json:"state"`
+	Px        string `json:"px"`
+	Sz        string `json:"sz"`
+	AccFillSz string `json:"accFillSz"`
+	AvgPx     string `json:"avgPx"`
+	Fee       string `json:"fee"`
+	FeeCcy    string `json:"feeCcy"`
+}
+
+func (d orderData) order(ticker string) exchange.Order {
+	order := exchange.Order{
+		OrdID:  d.OrdId,
+		Ticker: ticker,
+		Side:   d.Side,
+		State:  d.State,
+	}
+	// OKX leaves numeric fields empty until there is something to report
+	parse := func(v string) float64 {
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	}
+	order.Price = parse(d.Px)
+	order.Size = parse(d.Sz)
+	order.FillSize = parse(d.AccFillSz)
+	order.AvgPrice = parse(d.AvgPx)
+	// Fees are reported as negative amounts; buys pay in the coin received
+	order.Fee = -parse(d.Fee)
+	if inst, ok := exchange.ParseTicker(ticker); ok && d.FeeCcy != "" && d.FeeCcy != inst.Quote {
+		order.Fee *= order.AvgPrice
+	}
+	return order
+}
+
+func (c *Client) AmendOrder(ticker, ordId string, price float64) error {
+	bodyMap := map[string]string{
+		"instId": exchange.InstID(ticker),
+		"ordId":  ordId,
+		"newPx":  fmt.Sprintf("%.8f", price),
+	}
+	return c.postOrderAction("/api/v5/trade/amend-order", bodyMap)
+}
+
+func (c *Client) CancelOrder(ticker, ordId string) error {
+	bodyMap := map[string]string{
+		"instId": exchange.InstID(ticker),
+		"ordId":  ordId,
+	}
+	return c.postOrderAction("/api/v5/trade/cancel-order", bodyMap)
+}
+
+// postOrderAction sends a request that acts on an existing order and checks
+// both the top-level and per-order result codes.
+func (c *Client) postOrderAction(endpoint string, bodyMap map[string]string) error {
+	var response struct {
+		Code string `json:"code"`
+		Msg  string `json:"msg"`
+		Data []struct {
+			OrdId string `json:"ordId"`
+			SCode string `json:"sCode"`
+			SMsg  string `json:"sMsg"`
+		} `json:"data"`
+	}
+	if err := c.makeRequest("POST", endpoint, bodyMap, &response); err != nil {
+		return fmt.Errorf("error sending %s: %v", endpoint, err)
+	}
+	if len(response.Data) == 0 {
+		return fmt.Errorf("OKX API error on %s: code=%s, msg=%s", endpoint, response.Code, response.Msg)
+	}
+	if response.Code != "0" || response.Data[0].SCode != "0" {
+		return fmt.Errorf("OKX API error on %s: code=%s, msg=%s", endpoint, response.Data[0].SCode, response.Data[0].SMsg)
+	}
+	return nil
+}
+
+// PlaceAlgoOrder places a conditional order, or an OCO order when both
+// triggers are set. Triggered orders execute at market.
+func (c *Client) PlaceAlgoOrder(req exchange.AlgoRequest) (string, error) {
+	bodyMap := map[string]string{
+		"instId":  exchange.InstID(req.Ticker),
+		"tdMode":  "cash",
+		"side":    req.Side,
+		"ordType": "conditional",
+		"sz":      fmt.Sprintf("%.*f", getPrecision(req.LotSize), req.Size),
+	}
+	if req.StopLoss > 0 && req.TakeProfit > 0 {
+		bodyMap["ordType"] = "oco"
+	}
+	if req.StopLoss > 0 {
+		bodyMap["slTriggerPx"] = fmt.Sprintf("%.8f", req.StopLoss)
+		bodyMap["slOrdPx"] = "-1"
+	}
+	if req.TakeProfit > 0 {
+		bodyMap["tpTriggerPx"] = fmt.Sprintf("%.8f", req.TakeProfit)
+		bodyMap["tpOrdPx"] = "-1"
+	}
+	if req.ClOrdID != "" {
+		bodyMap["algoClOrdId"] = req.ClOrdID
+	}
+	log.Printf("Sending algo order request: %v", bodyMap)
+
+	var response struct {
+		Code string `json:"code"`
+		Msg  string `json:"msg"`
+		Data []struct {
+			AlgoId string `json:"algoId"`
+			SCode  string `json:"sCode"`
+			SMsg   string `json:"sMsg"`
+		} `json:"data"`
+	}
+	if err := c.makeRequest("POST", "/api/v5/trade/order-algo", bodyMap, &response); err != nil {
+		return "", fmt.Errorf("error placing algo order: %v", err)
+	}
+	if len(response.Data) == 0 {
+		return "", fmt.Errorf("OKX API algo order error: code=%s, msg=%s", response.Code, response.Msg)
+	}
+	if response.Code != "0" || response.Data[0].SCode != "0" {
+		return "", fmt.Errorf("OKX API algo order error: code=%s, msg=%s", response.Data[0].SCode, response.Data[0].SMsg)
+	}
+	log.Printf("Algo order placed for %s: algoId=%s", req.Ticker, response.Data[0].AlgoId)
+	return response.Data[0].AlgoId, nil
+}
+
+func (c *Client) GetAlgoOrders(ticker string) ([]exchange.AlgoOrder, error) {
+	endpoint := fmt.Sprintf("/api/v5/trade/orders-algo-pending?ordType=conditional,oco&instId=%s", exchange.InstID(ticker))
+	var response struct {
+		Code string `json:"code"`
+		Msg  string `json:"msg"`
+		Data []struct {
+			AlgoId      string `json:"algoId"`
+			Side        string `json:"side"`
+			Sz          string `json:"sz"`
+			SlTriggerPx string `json:"slTriggerPx"`
+			TpTriggerPx string `json:"tpTriggerPx"`
+			State       string `json:"state"`
+		} `json:"data"`
+	}
+	if err := c.makeRequest("GET", endpoint, nil, &response); err != nil {
+		return nil, fmt.Errorf("error fetching algo orders: %v", err)
+	}
+	if response.Code != "0" {
+		return nil, fmt.Errorf("OKX API algo orders error: code=%s, msg=%s", response.Code, response.Msg)
+	}
+	parse := func(v string) float64 {
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	}
+	var orders []exchange.AlgoOrder
+	for _, d := range response.Data {
+		orders = append(orders, exchange.AlgoOrder{
+			AlgoID:     d.AlgoId,
+			Ticker:     ticker,
+			Side:       d.Side,
+			Size:       parse(d.Sz),
+			StopLoss:   parse(d.SlTriggerPx),
+			TakeProfit: parse(d.TpTriggerPx),
+			State:      d.State,
+		})
+	}
+	return orders, nil
+}
+
+// GetAlgoOrder fetches an algo order in any state. A triggered order's
+// OrdID is the market order it placed.
+func (c *Client) GetAlgoOrder(ticker, algoID string) (exchange.AlgoOrder, error) {
+	endpoint := fmt.Sprintf("/api/v5/trade/order-algo?algoId=%s", algoID)
+	var response struct {
+		Code string `json:"code"`
+		Msg  string `json:"msg"`
+		Data []struct {
+			AlgoId      string   `json:"algoId"`
+			Side        string   `json:"side"`
+			Sz          string   `json:"sz"`
+			SlTriggerPx string   `json:"slTriggerPx"`
+			TpTriggerPx string   `json:"tpTriggerPx"`
+			State       string   `json:"state"`
+			OrdId       string   `json:"ordId"`
+			OrdIdList   []string `json:"ordIdList"`
+		} `json:"data"`
+	}
+	if err := c.makeRequest("GET", endpoint, nil, &response); err != nil {
+		return exchange.AlgoOrder{}, fmt.Errorf("error fetching algo order: %v", err)
+	}
+	if response.Code != "0" || len(response.Data) == 0 {
+		return exchange.AlgoOrder{}, fmt.Errorf("OKX API algo order error: code=%s, msg=%s", response.Code, response.Msg)
+	}
+	d := response.Data[0]
+	parse := func(v string) float64 {
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	}
+	ordID := d.OrdId
+	if ordID == "" && len(d.OrdIdList) > 0 {
+		ordID = d.OrdIdList[len(d.OrdIdList)-1]
+	}
+	return exchange.AlgoOrder{
+		AlgoID:     d.AlgoId,
+		Ticker:     ticker,
+		Side:       d.Side,
+		Size:       parse(d.Sz),
+		StopLoss:   parse(d.SlTriggerPx),
+		TakeProfit: parse(d.TpTriggerPx),
+		State:      d.State,
+		OrdID:      ordID,
+	}, nil
+}
+
+func (c *Client) CancelAlgoOrders(ticker string, algoIDs []string) error {
+	if len(algoIDs) == 0 {
+		return nil
+	}
+	var body []map[string]string
+	for _, id := range algoIDs {
+		body = append(body, map[string]string{"algoId": id, "instId": exchange.InstID(ticker)})
+	}
+	var response struct {
+		Code string `json:"code"`
+		Msg  string `json:"msg"`
+		Data []struct {
+			AlgoId string `json:"algoId"`
+			SCode  string `json:"sCode"`
+			SMsg   string `json:"sMsg"`
+		} `json:"data"`
+	}
+	if err := c.makeRequest("POST", "/api/v5/trade/cancel-algos", body, &response); err != nil {
+		return fmt.Errorf("error canceling algo orders: %v", err)
+	}
+	for _, d := range response.Data {
+		if d.SCode != "0" {
+			return fmt.Errorf("OKX API cancel algo error for %s: code=%s, msg=%s", d.AlgoId, d.SCode, d.SMsg)
+		}
+	}
+	if response.Code != "0" {
+		return fmt.Errorf("OKX API cancel algo error: code=%s, msg=%s", response.Code, response.Msg)
+	}
 	return nil
 }
 
@@ -249,8 +659,7 @@ func (c *Client) GetPositions() (map[string]float64, error) {
 		Data []struct {
 			Details []struct {
 				Ccy     string `json:"ccy"`
-				AvailEq string `json:"availEq"`
-				AvailBal string `json:"availBal"`
+				CashBal string `json:"cashBal"`
 			} `json:"details"`
 		} `json:"data"`
 	}
@@ -262,21 +671,21 @@ func (c *Client) GetPositions() (map[string]float64, error) {
 		return nil, fmt.Errorf("OKX API balance error: code=%s", balance.Code)
 	}
 
+	// Match coins to registered instruments by exact base currency, so SUI
+	// is never mistaken for SUIX
+	registered := exchange.Registered()
 	positions := make(map[string]float64)
 	for _, detail := range balance.Data[0].Details {
-		for _, pair := range []string{"BTCUSDT", "TRXUSDT", "SUIUSDT", "SOLUSDT", "NEARUSDT", "TONUSDT", "ICPUSDT"} {
-			if strings.HasPrefix(pair, detail.Ccy) {
-				// Try availEq first, fall back to availBal if empty or invalid
-				availVal := detail.AvailEq
-				if availVal == "" {
-					availVal = detail.AvailBal
-				}
-				availEq, err := strconv.ParseFloat(availVal, 64)
-				if err != nil {
-					log.Printf("Error parsing availEq/availBal for %s: %v", detail.Ccy, err)
-					continue
-				}
-				positions[pair] = availEq
+		// cashBal includes coins frozen by open and algo orders, which are
+		// still held
+		cashBal, err := strconv.ParseFloat(detail.CashBal, 64)
+		if err != nil {
+			log.Printf("Error parsing cashBal for %s: %v", detail.Ccy, err)
+			continue
+		}
+		for _, inst := range registered {
+			if inst.Base == detail.Ccy {
+				positions[inst.Ticker()] = cashBal
 			}
 		}
 	}
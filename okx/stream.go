@@ -0,0 +1,342 @@
+package okx
+
+import (
+	"crypto_trader/exchange"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// PrivateURL is OKX's private WebSocket.
+const PrivateURL = "wss://ws.okx.com:8443/ws/v5/private"
+
+const (
+	streamPingInterval = 20 * time.Second
+	streamReadTimeout  = 30 * time.Second
+	streamMinBackoff   = time.Second
+	streamMaxBackoff   = time.Minute
+)
+
+// Balance is a currency's balance as the account channel last reported it.
+type Balance struct {
+	Avail float64 // availBal, free to trade
+	Cash  float64 // cashBal, including what open and algo orders hold
+}
+
+// OrderUpdate is an order pushed on the orders channel. AlgoID is set for
+// orders placed by a triggered algo order.
+type OrderUpdate struct {
+	exchange.Order
+	ClOrdID     string
+	AlgoID      string
+	AlgoClOrdID string
+}
+
+// Stream logs in to the private WebSocket with a client's API key and
+// follows the orders and account channels. It keeps the account's balances
+// and hands fills to OnFill as they happen. It reconnects with exponential
+// backoff, and its methods are safe to call from any goroutine.
+type Stream struct {
+	URL string
+	// OnFill, if set, is called from the stream's goroutine with every order
+	// update that filled more of the order
+	OnFill func(OrderUpdate)
+
+	client *Client
+
+	mu        sync.RWMutex
+	balances  map[string]Balance
+	fills     map[string]float64 // ordId -> accFillSz seen on the orders channel
+	connected bool
+	// current is cleared by anything that changes the account and set again
+	// by the next account push
+	current bool
+}
+
+// NewStream returns a stream for client's account. Call Start to connect.
+func NewStream(client *Client, url string) *Stream {
+	return &Stream{
+		URL:      url,
+		client:   client,
+		balances: make(map[string]Balance),
+		fills:    make(map[string]float64),
+	}
+}
+
+// Start connects in the background and keeps the stream connected until the
+// returned function is called.
+func (s *Stream) Start() func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run(stop)
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// Balances returns the cached balances by currency. ok is false while the
+// stream is disconnected or an account change hasn't been pushed yet.
+func (s *Stream) Balances() (balances map[string]Balance, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.connected || !s.current {
+		return nil, false
+	}
+	balances = make(map[string]Balance, len(s.balances))
+	for ccy, b := range s.balances {
+		balances[ccy] = b
+	}
+	return balances, true
+}
+
+// Connected reports whether the stream is logged in and subscribed.
+func (s *Stream) Connected() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.connected
+}
+
+// Invalidate marks the cached balances out of date until the next account
+// push, e.g. because an order was just placed.
+func (s *Stream) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = false
+}
+
+// Seen reports how much of an order the orders channel has reported filled.
+func (s *Stream) Seen(ordID string) float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.fills[ordID]
+}
+
+func (s *Stream) reset(connected bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connected = connected
+	s.current = false
+	// A new connection starts with a fresh account snapshot
+	s.balances = make(map[string]Balance)
+	s.fills = make(map[string]float64)
+}
+
+func (s *Stream) run(stop chan struct{}) {
+	backoff := streamMinBackoff
+	for {
+		received, err := s.session(stop)
+		s.reset(false)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if received {
+			backoff = streamMinBackoff
+		}
+		log.Printf("Private stream connection lost: %v, reconnecting in %s", err, backoff)
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, streamMaxBackoff)
+	}
+}
+
+// login authenticates the connection the way OKX's private WebSocket
+// expects: the REST signature of a GET to /users/self/verify.
+func (s *Stream) login(conn *websocket.Conn) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	err := conn.WriteJSON(map[string]interface{}{
+		"op": "login",
+		"args": []map[string]string{{
+			"apiKey":     s.client.APIKey,
+			"passphrase": s.client.Passphrase,
+			"timestamp":  timestamp,
+			"sign":       s.client.sign(timestamp + "GET/users/self/verify"),
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("error sending login: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(streamReadTimeout))
+	var resp struct {
+		Event string `json:"event"`
+		Code  string `json:"code"`
+		Msg   string `json:"msg"`
+	}
+	if err := conn.ReadJSON(&resp); err != nil {
+		return fmt.Errorf("error reading login response: %v", err)
+	}
+	if resp.Event != "login" || resp.Code != "0" {
+		return fmt.Errorf("login failed: code=%s, msg=%s", resp.Code, resp.Msg)
+	}
+	return nil
+}
+
+// session connects, logs in, subscribes and reads pushes until the
+// connection fails or stop is closed. It reports whether any push arrived.
+func (s *Stream) session(stop chan struct{}) (bool, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(s.URL, nil)
+	if err != nil {
+		return false, fmt.Errorf("error connecting to %s: %v", s.URL, err)
+	}
+	defer conn.Close()
+
+	if err := s.login(conn); err != nil {
+		return false, err
+	}
+	err = conn.WriteJSON(map[string]interface{}{
+		"op": "subscribe",
+		"args": []map[string]string{
+			{"channel": "account"},
+			{"channel": "orders", "instType": "SPOT"},
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("error subscribing: %v", err)
+	}
+
+	// The pinger is the only writer from here on. Closing the connection
+	// unblocks the read below when the stream is stopped.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ping := time.NewTicker(streamPingInterval)
+		defer ping.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-stop:
+				conn.Close()
+				return
+			case <-ping.C:
+				conn.WriteMessage(websocket.TextMessage, []byte("ping"))
+			}
+		}
+	}()
+
+	received := false
+	for {
+		conn.SetReadDeadline(time.Now().Add(streamReadTimeout))
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return received, err
+		}
+		if string(msg) == "pong" {
+			continue
+		}
+		var push struct {
+			Event string `json:"event"`
+			Code  string `json:"code"`
+			Msg   string `json:"msg"`
+			Arg   struct {
+				Channel string `json:"channel"`
+			} `json:"arg"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(msg, &push); err != nil {
+			log.Printf("Invalid private stream message %q: %v", msg, err)
+			continue
+		}
+		switch push.Event {
+		case "error":
+			return received, fmt.Errorf("OKX WebSocket error: code=%s, msg=%s", push.Code, push.Msg)
+		case "subscribe":
+			if push.Arg.Channel == "account" {
+				s.reset(true)
+			}
+			continue
+		case "":
+		default:
+			continue
+		}
+
+		switch push.Arg.Channel {
+		case "account":
+			err = s.applyAccount(push.Data)
+		case "orders":
+			err = s.applyOrders(push.Data)
+		}
+		if err != nil {
+			log.Printf("Invalid %s push %q: %v", push.Arg.Channel, msg, err)
+			continue
+		}
+		received = true
+	}
+}
+
+// applyAccount merges an account push into the cached balances. OKX pushes
+// every currency periodically and only the changed ones on an event.
+func (s *Stream) applyAccount(data json.RawMessage) error {
+	var accounts []struct {
+		Details []struct {
+			Ccy      string `json:"ccy"`
+			AvailBal string `json:"availBal"`
+			CashBal  string `json:"cashBal"`
+		} `json:"details"`
+	}
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, account := range accounts {
+		for _, d := range account.Details {
+			var b Balance
+			b.Avail, _ = strconv.ParseFloat(d.AvailBal, 64)
+			b.Cash, _ = strconv.ParseFloat(d.CashBal, 64)
+			s.balances[d.Ccy] = b
+		}
+	}
+	s.current = true
+	return nil
+}
+
+// applyOrders hands fills to OnFill. A fill changes the account, so the
+// cached balances wait for the account push that follows it.
+func (s *Stream) applyOrders(data json.RawMessage) error {
+	var orders []struct {
+		orderData
+		FillSz      string `json:"fillSz"`
+		AlgoId      string `json:"algoId"`
+		AlgoClOrdId string `json:"algoClOrdId"`
+	}
+	if err := json.Unmarshal(data, &orders); err != nil {
+		return err
+	}
+
+	for _, d := range orders {
+		if fillSz, _ := strconv.ParseFloat(d.FillSz, 64); fillSz <= 0 {
+			continue
+		}
+		// Spot instrument IDs are the ticker with a dash
+		u := OrderUpdate{
+			Order:       d.order(strings.Replace(d.InstId, "-", "", 1)),
+			ClOrdID:     d.ClOrdId,
+			AlgoID:      d.AlgoId,
+			AlgoClOrdID: d.AlgoClOrdId,
+		}
+		s.mu.Lock()
+		s.fills[u.OrdID] = u.FillSize
+		s.current = false
+		s.mu.Unlock()
+		if s.OnFill != nil {
+			s.OnFill(u)
+		}
+	}
+	return nil
+}
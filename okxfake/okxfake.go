@@ -0,0 +1,1089 @@
+// Package okxfake is an in-memory stand-in for the OKX v5 REST API, for tests
+// that need to drive okx.Client without touching okx.com.
+package okxfake
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto_trader/exchange"
+	"crypto_trader/okx"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	APIKey     = "fake-api-key"
+	SecretKey  = "fake-secret-key"
+	Passphrase = "fake-passphrase"
+)
+
+type Order struct {
+	OrdId   string
+	ClOrdId string
+	InstId  string
+	Type    string // limit, market or post_only
+	Side    string
+	Size    float64
+	Price   float64
+	Filled  float64
+	Value   float64 // sum of fill size * fill price
+	Amends  int
+	Fee     float64 // in the currency received: base for buys, quote for sells
+	State   string  // live, partially_filled, filled
+	AlgoId  string  // set when a triggered algo order placed it
+}
+
+// AlgoOrder is a conditional or OCO order. When the price reaches a trigger
+// it becomes effective and sells at market through a new Order.
+type AlgoOrder struct {
+	AlgoId      string
+	AlgoClOrdId string
+	InstId      string
+	Type        string // conditional or oco
+	Side        string
+	Size        float64
+	StopLoss    float64 // trigger prices, 0 when unset
+	TakeProfit  float64
+	State       string // live, effective, canceled
+	OrdId       string // the market order it placed once effective
+}
+
+type apiError struct {
+	code string
+	msg  string
+}
+
+// Server scripts the market and account the client sees. All setters are safe
+// to call while requests are in flight.
+type Server struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	prices      map[string]float64           // instId -> last
+	candles     map[string][]exchange.Candle // instId + "/" + bar -> oldest first
+	lotSizes    map[string]float64           // instId -> lotSz
+	balances    map[string]float64           // ccy -> availBal
+	frozen      map[string]float64           // ccy -> held by open and algo orders
+	orders      []*Order
+	algoOrders  []*AlgoOrder
+	fillRatio   float64
+	feeRate     float64
+	rejects     []apiError
+	failures    map[string][]apiError // path -> queued top-level errors
+	nextOrderID int
+	// tickers subscriptions on the public WebSocket, conn -> instIds
+	subscribers map[*websocket.Conn]map[string]bool
+	// private WebSocket connections, conn -> subscribed channels, with
+	// "login" set once the connection has logged in
+	privateConns map[*websocket.Conn]map[string]bool
+}
+
+func New() *Server {
+	s := &Server{
+		prices:    make(map[string]float64),
+		candles:   make(map[string][]exchange.Candle),
+		lotSizes:  make(map[string]float64),
+		balances:  make(map[string]float64),
+		frozen:    make(map[string]float64),
+		failures:  make(map[string][]apiError),
+		fillRatio: 1,
+
+		subscribers:  make(map[*websocket.Conn]map[string]bool),
+		privateConns: make(map[*websocket.Conn]map[string]bool),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v5/account/balance", s.private(s.handleBalance))
+	mux.HandleFunc("/api/v5/trade/order", s.private(s.handleOrder))
+	mux.HandleFunc("/api/v5/trade/orders-pending", s.private(s.handleOrdersPending))
+	mux.HandleFunc("/api/v5/trade/amend-order", s.private(s.handleAmendOrder))
+	mux.HandleFunc("/api/v5/trade/cancel-order", s.private(s.handleCancelOrder))
+	mux.HandleFunc("/api/v5/trade/order-algo", s.private(s.handleAlgoOrder))
+	mux.HandleFunc("/api/v5/trade/orders-algo-pending", s.private(s.handleAlgoOrdersPending))
+	mux.HandleFunc("/api/v5/trade/cancel-algos", s.private(s.handleCancelAlgos))
+	mux.HandleFunc("/api/v5/market/ticker", s.public(s.handleTicker))
+	mux.HandleFunc("/api/v5/market/candles", s.public(s.handleCandles))
+	mux.HandleFunc("/api/v5/market/history-candles", s.public(s.handleCandles))
+	mux.HandleFunc("/api/v5/public/instruments", s.public(s.handleInstruments))
+	mux.HandleFunc("/ws/v5/public", s.handlePublicWS)
+	mux.HandleFunc("/ws/v5/private", s.handlePrivateWS)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Client returns an okx.Client pointed at the fake with valid credentials.
+func (s *Server) Client() *okx.Client {
+	c := okx.NewClient(APIKey, SecretKey, Passphrase)
+	c.BaseURL = s.URL
+	return c
+}
+
+// WSURL is the fake's public WebSocket, which serves the tickers channel.
+func (s *Server) WSURL() string {
+	return "ws" + strings.TrimPrefix(s.URL, "http") + "/ws/v5/public"
+}
+
+// PrivateWSURL is the fake's private WebSocket, which serves the account and
+// orders channels.
+func (s *Server) PrivateWSURL() string {
+	return "ws" + strings.TrimPrefix(s.URL, "http") + "/ws/v5/private"
+}
+
+// SetPrice moves the last price, pushing it to tickers subscribers and
+// triggering any algo orders it reaches.
+func (s *Server) SetPrice(instId string, last float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prices[instId] = last
+	for conn, instIds := range s.subscribers {
+		if instIds[instId] {
+			s.pushTicker(conn, instId)
+		}
+	}
+	for _, a := range s.algoOrders {
+		if a.InstId != instId || a.State != "live" {
+			continue
+		}
+		if (a.StopLoss > 0 && last <= a.StopLoss) || (a.TakeProfit > 0 && last >= a.TakeProfit) {
+			s.trigger(a, last)
+			s.pushAccount()
+		}
+	}
+}
+
+// SetCandles scripts the candles served for an instrument and bar size by
+// both candle endpoints, oldest first.
+func (s *Server) SetCandles(instId, bar string, candles []exchange.Candle) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.candles[instId+"/"+bar] = candles
+}
+
+func (s *Server) SetInstrument(instId string, lotSz float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lotSizes[instId] = lotSz
+}
+
+func (s *Server) SetBalance(ccy string, amount float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.balances[ccy] = amount
+	s.pushAccount()
+}
+
+func (s *Server) Balance(ccy string) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.balances[ccy]
+}
+
+// SetFillRatio sets how much of an order fills when it is placed or amended:
+// 1 fills it completely, 0 leaves it resting and anything between fills that
+// fraction of what is still open.
+func (s *Server) SetFillRatio(ratio float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fillRatio = ratio
+}
+
+// SetFeeRate sets the fee charged on fills as a fraction of the amount received.
+func (s *Server) SetFeeRate(rate float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.feeRate = rate
+}
+
+// RejectNextOrder makes the next order placement fail with the given sCode.
+func (s *Server) RejectNextOrder(sCode, sMsg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejects = append(s.rejects, apiError{sCode, sMsg})
+}
+
+// FailNext makes the next request to path return the given top-level code.
+func (s *Server) FailNext(path, code, msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[path] = append(s.failures[path], apiError{code, msg})
+}
+
+func (s *Server) AlgoOrders() []AlgoOrder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	orders := make([]AlgoOrder, len(s.algoOrders))
+	for i, o := range s.algoOrders {
+		orders[i] = *o
+	}
+	return orders
+}
+
+func (s *Server) Orders() []Order {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	orders := make([]Order, len(s.orders))
+	for i, o := range s.orders {
+		orders[i] = *o
+	}
+	return orders
+}
+
+func writeJSON(w http.ResponseWriter, status int, code, msg string, data interface{}) {
+	if data == nil {
+		data = []interface{}{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"code": code, "msg": msg, "data": data})
+}
+
+func (s *Server) public(h func(http.ResponseWriter, *http.Request, []byte)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if s.popFailure(w, r) {
+			return
+		}
+		h(w, r, body)
+	}
+}
+
+// private checks the OK-ACCESS-* headers the same way OKX does before
+// handing the request on.
+func (s *Server) private(h func(http.ResponseWriter, *http.Request, []byte)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("OK-ACCESS-KEY") != APIKey {
+			writeJSON(w, http.StatusUnauthorized, "50111", "Invalid OK-ACCESS-KEY", nil)
+			return
+		}
+		if r.Header.Get("OK-ACCESS-PASSPHRASE") != Passphrase {
+			writeJSON(w, http.StatusUnauthorized, "50105", "Invalid OK-ACCESS-PASSPHRASE", nil)
+			return
+		}
+		timestamp := r.Header.Get("OK-ACCESS-TIMESTAMP")
+		if timestamp == "" {
+			writeJSON(w, http.StatusUnauthorized, "50107", "OK-ACCESS-TIMESTAMP can not be empty", nil)
+			return
+		}
+		mac := hmac.New(sha256.New, []byte(SecretKey))
+		mac.Write([]byte(timestamp + r.Method + r.URL.RequestURI() + string(body)))
+		expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(expected), []byte(r.Header.Get("OK-ACCESS-SIGN"))) {
+			writeJSON(w, http.StatusUnauthorized, "50113", "Invalid Sign", nil)
+			return
+		}
+		if s.popFailure(w, r) {
+			return
+		}
+		h(w, r, body)
+	}
+}
+
+func (s *Server) popFailure(w http.ResponseWriter, r *http.Request) bool {
+	s.mu.Lock()
+	queued := s.failures[r.URL.Path]
+	if len(queued) == 0 {
+		s.mu.Unlock()
+		return false
+	}
+	failure := queued[0]
+	s.failures[r.URL.Path] = queued[1:]
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, failure.code, failure.msg, nil)
+	return true
+}
+
+func format(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func (s *Server) handleBalance(w http.ResponseWriter, r *http.Request, _ []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ccyFilter := r.URL.Query().Get("ccy")
+	var details []map[string]string
+	for ccy, amount := range s.balances {
+		if ccyFilter != "" && ccy != ccyFilter {
+			continue
+		}
+		details = append(details, map[string]string{
+			"ccy":      ccy,
+			"cashBal":  format(amount + s.frozen[ccy]),
+			"availBal": format(amount),
+			"availEq":  format(amount),
+		})
+	}
+	writeJSON(w, http.StatusOK, "0", "", []interface{}{map[string]interface{}{"details": details}})
+}
+
+func (s *Server) handleOrder(w http.ResponseWriter, r *http.Request, body []byte) {
+	if r.Method == http.MethodGet {
+		s.handleGetOrder(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, "405", "method not allowed", nil)
+		return
+	}
+	var req map[string]string
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, "50002", "JSON syntax error", nil)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reject := func(sCode, sMsg string) {
+		writeJSON(w, http.StatusOK, "1", "Operation failed.", []map[string]string{{"ordId": "", "sCode": sCode, "sMsg": sMsg}})
+	}
+	if len(s.rejects) > 0 {
+		rej := s.rejects[0]
+		s.rejects = s.rejects[1:]
+		reject(rej.code, rej.msg)
+		return
+	}
+
+	if req["clOrdId"] != "" {
+		for _, o := range s.orders {
+			if o.ClOrdId == req["clOrdId"] {
+				reject("51016", "Duplicated clOrdId")
+				return
+			}
+		}
+	}
+
+	instId := req["instId"]
+	parts := strings.SplitN(instId, "-", 2)
+	if len(parts) != 2 {
+		reject("51001", "Instrument ID does not exist")
+		return
+	}
+	base, quote := parts[0], parts[1]
+	ordType := req["ordType"]
+	size, err1 := strconv.ParseFloat(req["sz"], 64)
+	var price float64
+	var err2 error
+	if ordType == "market" {
+		// Market orders fill at the last price; buys are sized in the quote
+		// currency unless tgtCcy says otherwise
+		price = s.prices[instId]
+		if req["side"] == "buy" && req["tgtCcy"] != "base_ccy" && price > 0 {
+			size /= price
+		}
+	} else {
+		price, err2 = strconv.ParseFloat(req["px"], 64)
+	}
+	if err1 != nil || err2 != nil || size <= 0 || price <= 0 {
+		reject("51000", "Parameter sz or px error")
+		return
+	}
+	if req["side"] != "buy" && req["side"] != "sell" {
+		reject("51000", "Parameter side error")
+		return
+	}
+
+	// Funds for the whole order are frozen up front; fills credit the other side
+	if req["side"] == "buy" {
+		if s.balances[quote] < size*price {
+			reject("51008", "Order failed. Insufficient balance")
+			return
+		}
+		s.freeze(quote, size*price)
+	} else {
+		if s.balances[base] < size-1e-12 {
+			reject("51008", "Order failed. Insufficient balance")
+			return
+		}
+		s.freeze(base, size)
+	}
+
+	s.nextOrderID++
+	order := &Order{
+		OrdId:   strconv.Itoa(s.nextOrderID),
+		ClOrdId: req["clOrdId"],
+		InstId:  instId,
+		Type:    ordType,
+		Side:    req["side"],
+		Size:    size,
+		Price:   price,
+		State:   "live",
+	}
+	last := s.prices[instId]
+	crosses := (order.Side == "buy" && price >= last) || (order.Side == "sell" && price <= last)
+	switch {
+	case ordType == "post_only" && crosses:
+		// OKX accepts a post-only order that would take liquidity, then cancels it
+		s.release(order)
+		order.State = "canceled"
+	case ordType == "market":
+		s.fill(order, size)
+	default:
+		s.fill(order, size*s.fillRatio)
+	}
+	s.orders = append(s.orders, order)
+	s.pushAccount()
+
+	writeJSON(w, http.StatusOK, "0", "", []map[string]string{{"ordId": order.OrdId, "sCode": "0", "sMsg": ""}})
+}
+
+// freeze moves amount of ccy from the available to the frozen balance.
+// Callers hold s.mu.
+func (s *Server) freeze(ccy string, amount float64) {
+	s.balances[ccy] -= amount
+	s.frozen[ccy] += amount
+}
+
+// fill executes qty more of the order at its limit price. Callers hold s.mu.
+func (s *Server) fill(o *Order, qty float64) {
+	if qty <= 0 {
+		return
+	}
+	parts := strings.SplitN(o.InstId, "-", 2)
+	if o.Side == "buy" {
+		s.frozen[parts[1]] -= qty * o.Price
+		fee := qty * s.feeRate
+		s.balances[parts[0]] += qty - fee
+		o.Fee += fee
+	} else {
+		s.frozen[parts[0]] -= qty
+		fee := qty * o.Price * s.feeRate
+		s.balances[parts[1]] += qty*o.Price - fee
+		o.Fee += fee
+	}
+	o.Filled += qty
+	o.Value += qty * o.Price
+	if o.Filled >= o.Size-1e-12 {
+		o.State = "filled"
+	} else {
+		o.State = "partially_filled"
+	}
+	s.pushOrder(o, qty)
+}
+
+// release unfreezes the funds held for an order's unfilled remainder.
+// Callers hold s.mu.
+func (s *Server) release(o *Order) {
+	parts := strings.SplitN(o.InstId, "-", 2)
+	if o.Side == "buy" {
+		s.freeze(parts[1], -(o.Size-o.Filled)*o.Price)
+	} else {
+		s.freeze(parts[0], -(o.Size - o.Filled))
+	}
+}
+
+func (s *Server) findOrder(instId, ordId string) *Order {
+	for _, o := range s.orders {
+		if o.InstId == instId && o.OrdId == ordId {
+			return o
+		}
+	}
+	return nil
+}
+
+func orderData(o *Order) map[string]string {
+	parts := strings.SplitN(o.InstId, "-", 2)
+	feeCcy := parts[1]
+	if o.Side == "buy" {
+		feeCcy = parts[0]
+	}
+	avgPx := ""
+	if o.Filled > 0 {
+		avgPx = format(o.Value / o.Filled)
+	}
+	return map[string]string{
+		"ordId":     o.OrdId,
+		"clOrdId":   o.ClOrdId,
+		"instId":    o.InstId,
+		"side":      o.Side,
+		"ordType":   o.Type,
+		"sz":        format(o.Size),
+		"px":        format(o.Price),
+		"accFillSz": format(o.Filled),
+		"avgPx":     avgPx,
+		"fee":       format(-o.Fee),
+		"feeCcy":    feeCcy,
+		"state":     o.State,
+		"algoId":    o.AlgoId,
+	}
+}
+
+func (s *Server) handleGetOrder(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := r.URL.Query()
+	o := s.findOrder(q.Get("instId"), q.Get("ordId"))
+	if clOrdId := q.Get("clOrdId"); clOrdId != "" {
+		o = nil
+		for _, order := range s.orders {
+			if order.InstId == q.Get("instId") && order.ClOrdId == clOrdId {
+				o = order
+			}
+		}
+	}
+	if o == nil {
+		writeJSON(w, http.StatusOK, "51603", "Order does not exist", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, "0", "", []map[string]string{orderData(o)})
+}
+
+// orderAction decodes an amend or cancel request and finds the open order it
+// refers to, writing the OKX error response itself when there is none.
+func (s *Server) orderAction(w http.ResponseWriter, body []byte) (*Order, map[string]string) {
+	var req map[string]string
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, "50002", "JSON syntax error", nil)
+		return nil, nil
+	}
+	o := s.findOrder(req["instId"], req["ordId"])
+	if o == nil || o.State == "filled" || o.State == "canceled" {
+		writeJSON(w, http.StatusOK, "1", "Operation failed.", []map[string]string{{"ordId": req["ordId"], "sCode": "51503", "sMsg": "Order does not exist or is already complete"}})
+		return nil, nil
+	}
+	return o, req
+}
+
+func (s *Server) handleAmendOrder(w http.ResponseWriter, r *http.Request, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, req := s.orderAction(w, body)
+	if o == nil {
+		return
+	}
+	newPx, err := strconv.ParseFloat(req["newPx"], 64)
+	if err != nil || newPx <= 0 {
+		writeJSON(w, http.StatusOK, "1", "Operation failed.", []map[string]string{{"ordId": o.OrdId, "sCode": "51000", "sMsg": "Parameter newPx error"}})
+		return
+	}
+	// Re-freeze the open part of a buy at the new price
+	if o.Side == "buy" {
+		quote := strings.SplitN(o.InstId, "-", 2)[1]
+		s.freeze(quote, (o.Size-o.Filled)*(newPx-o.Price))
+	}
+	o.Price = newPx
+	o.Amends++
+	s.fill(o, (o.Size-o.Filled)*s.fillRatio)
+	s.pushAccount()
+	writeJSON(w, http.StatusOK, "0", "", []map[string]string{{"ordId": o.OrdId, "sCode": "0", "sMsg": ""}})
+}
+
+func (s *Server) handleCancelOrder(w http.ResponseWriter, r *http.Request, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, _ := s.orderAction(w, body)
+	if o == nil {
+		return
+	}
+	s.release(o)
+	o.State = "canceled"
+	s.pushAccount()
+	writeJSON(w, http.StatusOK, "0", "", []map[string]string{{"ordId": o.OrdId, "sCode": "0", "sMsg": ""}})
+}
+
+func (s *Server) handleOrdersPending(w http.ResponseWriter, r *http.Request, _ []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	instId := r.URL.Query().Get("instId")
+	var data []map[string]string
+	for _, o := range s.orders {
+		if (instId == "" || o.InstId == instId) && (o.State == "live" || o.State == "partially_filled") {
+			data = append(data, orderData(o))
+		}
+	}
+	writeJSON(w, http.StatusOK, "0", "", data)
+}
+
+func (s *Server) handleTicker(w http.ResponseWriter, r *http.Request, _ []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	instId := r.URL.Query().Get("instId")
+	last, ok := s.prices[instId]
+	if !ok {
+		writeJSON(w, http.StatusOK, "51001", fmt.Sprintf("Instrument ID %s does not exist", instId), nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, "0", "", []map[string]string{{"instId": instId, "last": format(last)}})
+}
+
+func (s *Server) handleCandles(w http.ResponseWriter, r *http.Request, _ []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := r.URL.Query()
+	candles := s.candles[q.Get("instId")+"/"+q.Get("bar")]
+	// after pages back through history: only candles that opened before it
+	if after, err := strconv.ParseInt(q.Get("after"), 10, 64); err == nil {
+		n := sort.Search(len(candles), func(i int) bool { return candles[i].Time.UnixMilli() >= after })
+		candles = candles[:n]
+	}
+	if limit, err := strconv.Atoi(q.Get("limit")); err == nil && limit < len(candles) {
+		candles = candles[len(candles)-limit:]
+	}
+	// Newest first, as OKX sends them
+	data := make([][]string, 0, len(candles))
+	for i := len(candles) - 1; i >= 0; i-- {
+		c := candles[i]
+		data = append(data, []string{
+			strconv.FormatInt(c.Time.UnixMilli(), 10),
+			format(c.Open), format(c.High), format(c.Low), format(c.Close), format(c.Volume),
+			"0", "0", "1",
+		})
+	}
+	writeJSON(w, http.StatusOK, "0", "", data)
+}
+
+func (s *Server) handleInstruments(w http.ResponseWriter, r *http.Request, _ []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var data []map[string]string
+	for instId, lotSz := range s.lotSizes {
+		parts := strings.SplitN(instId, "-", 2)
+		data = append(data, map[string]string{
+			"instId":   instId,
+			"instType": "SPOT",
+			"baseCcy":  parts[0],
+			"quoteCcy": parts[len(parts)-1],
+			"lotSz":    format(lotSz),
+			"minSz":    format(lotSz),
+		})
+	}
+	writeJSON(w, http.StatusOK, "0", "", data)
+}
+
+// handleAlgoOrder places a conditional or OCO sell, freezing the coins it
+// would sell. Buys aren't simulated.
+func (s *Server) handleAlgoOrder(w http.ResponseWriter, r *http.Request, body []byte) {
+	if r.Method == http.MethodGet {
+		s.handleGetAlgoOrder(w, r)
+		return
+	}
+	var req map[string]string
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, "50002", "JSON syntax error", nil)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reject := func(sCode, sMsg string) {
+		writeJSON(w, http.StatusOK, "1", "Operation failed.", []map[string]string{{"algoId": "", "sCode": sCode, "sMsg": sMsg}})
+	}
+	instId := req["instId"]
+	parts := strings.SplitN(instId, "-", 2)
+	if len(parts) != 2 {
+		reject("51001", "Instrument ID does not exist")
+		return
+	}
+	size, err := strconv.ParseFloat(req["sz"], 64)
+	if err != nil || size <= 0 {
+		reject("51000", "Parameter sz error")
+		return
+	}
+	if req["side"] != "sell" {
+		reject("51000", "Parameter side error")
+		return
+	}
+	a := &AlgoOrder{
+		AlgoClOrdId: req["algoClOrdId"],
+		InstId:      instId,
+		Type:        req["ordType"],
+		Side:        req["side"],
+		Size:        size,
+		State:       "live",
+	}
+	a.StopLoss, _ = strconv.ParseFloat(req["slTriggerPx"], 64)
+	a.TakeProfit, _ = strconv.ParseFloat(req["tpTriggerPx"], 64)
+	switch {
+	case a.Type == "oco" && (a.StopLoss <= 0 || a.TakeProfit <= 0):
+		reject("51000", "Parameter slTriggerPx or tpTriggerPx error")
+		return
+	case a.Type == "conditional" && a.StopLoss <= 0 && a.TakeProfit <= 0:
+		reject("51000", "Parameter slTriggerPx or tpTriggerPx error")
+		return
+	case a.Type != "oco" && a.Type != "conditional":
+		reject("51000", "Parameter ordType error")
+		return
+	}
+	if s.balances[parts[0]] < size-1e-12 {
+		reject("51008", "Order failed. Insufficient balance")
+		return
+	}
+	s.freeze(parts[0], size)
+
+	s.nextOrderID++
+	a.AlgoId = "algo" + strconv.Itoa(s.nextOrderID)
+	s.algoOrders = append(s.algoOrders, a)
+	s.pushAccount()
+	writeJSON(w, http.StatusOK, "0", "", []map[string]string{{"algoId": a.AlgoId, "algoClOrdId": a.AlgoClOrdId, "sCode": "0", "sMsg": ""}})
+}
+
+// trigger makes an algo order effective and sells its coins at last.
+// Callers hold s.mu.
+func (s *Server) trigger(a *AlgoOrder, last float64) {
+	a.State = "effective"
+	s.nextOrderID++
+	order := &Order{
+		OrdId:  strconv.Itoa(s.nextOrderID),
+		InstId: a.InstId,
+		Type:   "market",
+		Side:   a.Side,
+		Size:   a.Size,
+		Price:  last,
+		State:  "live",
+		AlgoId: a.AlgoId,
+	}
+	a.OrdId = order.OrdId
+	// The coins stay frozen, now for the market order
+	s.fill(order, a.Size)
+	s.orders = append(s.orders, order)
+}
+
+// handleGetAlgoOrder reports an algo order in any state, with the order it
+// placed once effective.
+func (s *Server) handleGetAlgoOrder(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	algoId := r.URL.Query().Get("algoId")
+	for _, a := range s.algoOrders {
+		if a.AlgoId != algoId {
+			continue
+		}
+		d := map[string]interface{}{
+			"algoId":      a.AlgoId,
+			"algoClOrdId": a.AlgoClOrdId,
+			"instId":      a.InstId,
+			"ordType":     a.Type,
+			"side":        a.Side,
+			"sz":          format(a.Size),
+			"slTriggerPx": "",
+			"tpTriggerPx": "",
+			"state":       a.State,
+			"ordId":       a.OrdId,
+			"ordIdList":   []string{},
+		}
+		if a.StopLoss > 0 {
+			d["slTriggerPx"] = format(a.StopLoss)
+		}
+		if a.TakeProfit > 0 {
+			d["tpTriggerPx"] = format(a.TakeProfit)
+		}
+		if a.OrdId != "" {
+			d["ordIdList"] = []string{a.OrdId}
+		}
+		writeJSON(w, http.StatusOK, "0", "", []map[string]interface{}{d})
+		return
+	}
+	writeJSON(w, http.StatusOK, "51603", "Order does not exist", nil)
+}
+
+func (s *Server) handleAlgoOrdersPending(w http.ResponseWriter, r *http.Request, _ []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := r.URL.Query()
+	if q.Get("ordType") == "" {
+		writeJSON(w, http.StatusOK, "51000", "Parameter ordType error", nil)
+		return
+	}
+	types := strings.Split(q.Get("ordType"), ",")
+	var data []map[string]string
+	for _, a := range s.algoOrders {
+		if a.State != "live" || (q.Get("instId") != "" && a.InstId != q.Get("instId")) {
+			continue
+		}
+		matched := false
+		for _, t := range types {
+			matched = matched || t == a.Type
+		}
+		if !matched {
+			continue
+		}
+		d := map[string]string{
+			"algoId":      a.AlgoId,
+			"algoClOrdId": a.AlgoClOrdId,
+			"instId":      a.InstId,
+			"ordType":     a.Type,
+			"side":        a.Side,
+			"sz":          format(a.Size),
+			"slTriggerPx": "",
+			"tpTriggerPx": "",
+			"state":       a.State,
+		}
+		if a.StopLoss > 0 {
+			d["slTriggerPx"] = format(a.StopLoss)
+		}
+		if a.TakeProfit > 0 {
+			d["tpTriggerPx"] = format(a.TakeProfit)
+		}
+		data = append(data, d)
+	}
+	writeJSON(w, http.StatusOK, "0", "", data)
+}
+
+func (s *Server) handleCancelAlgos(w http.ResponseWriter, r *http.Request, body []byte) {
+	var reqs []map[string]string
+	if err := json.Unmarshal(body, &reqs); err != nil {
+		writeJSON(w, http.StatusBadRequest, "50002", "JSON syntax error", nil)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code := "0"
+	var data []map[string]string
+	for _, req := range reqs {
+		var found *AlgoOrder
+		for _, a := range s.algoOrders {
+			if a.AlgoId == req["algoId"] && a.InstId == req["instId"] && a.State == "live" {
+				found = a
+			}
+		}
+		if found == nil {
+			code = "1"
+			data = append(data, map[string]string{"algoId": req["algoId"], "sCode": "51603", "sMsg": "Order does not exist"})
+			continue
+		}
+		found.State = "canceled"
+		s.freeze(strings.SplitN(found.InstId, "-", 2)[0], -found.Size)
+		data = append(data, map[string]string{"algoId": found.AlgoId, "sCode": "0", "sMsg": ""})
+	}
+	s.pushAccount()
+	writeJSON(w, http.StatusOK, code, "", data)
+}
+
+// DropWebSockets closes every WebSocket connection, as OKX does during
+// maintenance.
+func (s *Server) DropWebSockets() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.subscribers {
+		conn.Close()
+		delete(s.subscribers, conn)
+	}
+	for conn := range s.privateConns {
+		conn.Close()
+		delete(s.privateConns, conn)
+	}
+}
+
+var upgrader = websocket.Upgrader{}
+
+// handlePublicWS serves the tickers channel: subscribers get the current
+// price straight away and every SetPrice after that. Writes happen under
+// s.mu, which keeps them to one at a time per connection.
+func (s *Server) handlePublicWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.subscribers[conn] = make(map[string]bool)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.subscribers, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if _, ok := s.subscribers[conn]; !ok {
+			s.mu.Unlock()
+			return
+		}
+		if string(msg) == "ping" {
+			conn.WriteMessage(websocket.TextMessage, []byte("pong"))
+			s.mu.Unlock()
+			continue
+		}
+		var req struct {
+			Op   string              `json:"op"`
+			Args []map[string]string `json:"args"`
+		}
+		if err := json.Unmarshal(msg, &req); err != nil || req.Op != "subscribe" {
+			conn.WriteJSON(map[string]string{"event": "error", "code": "60012", "msg": "Invalid request: " + string(msg)})
+			s.mu.Unlock()
+			continue
+		}
+		for _, arg := range req.Args {
+			if arg["channel"] != "tickers" {
+				conn.WriteJSON(map[string]string{"event": "error", "code": "60018", "msg": "Wrong URL or channel:" + arg["channel"] + " doesn't exist."})
+				continue
+			}
+			s.subscribers[conn][arg["instId"]] = true
+			conn.WriteJSON(map[string]interface{}{"event": "subscribe", "arg": arg})
+			if _, ok := s.prices[arg["instId"]]; ok {
+				s.pushTicker(conn, arg["instId"])
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// pushTicker sends the current price of instId. Callers hold s.mu.
+func (s *Server) pushTicker(conn *websocket.Conn, instId string) {
+	last := format(s.prices[instId])
+	conn.WriteJSON(map[string]interface{}{
+		"arg": map[string]string{"channel": "tickers", "instId": instId},
+		"data": []map[string]string{{
+			"instId": instId,
+			"last":   last,
+			"bidPx":  last,
+			"askPx":  last,
+			"ts":     strconv.FormatInt(time.Now().UnixMilli(), 10),
+		}},
+	})
+}
+
+// handlePrivateWS serves the account and orders channels to connections
+// that log in with the fake's credentials. Account subscribers get every
+// balance straight away and again after each change; orders subscribers get
+// every fill.
+func (s *Server) handlePrivateWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.privateConns[conn] = make(map[string]bool)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.privateConns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		channels, ok := s.privateConns[conn]
+		if !ok {
+			s.mu.Unlock()
+			return
+		}
+		if string(msg) == "ping" {
+			conn.WriteMessage(websocket.TextMessage, []byte("pong"))
+			s.mu.Unlock()
+			continue
+		}
+		var req struct {
+			Op   string              `json:"op"`
+			Args []map[string]string `json:"args"`
+		}
+		if err := json.Unmarshal(msg, &req); err != nil || (req.Op != "login" && req.Op != "subscribe") {
+			conn.WriteJSON(map[string]string{"event": "error", "code": "60012", "msg": "Invalid request: " + string(msg)})
+			s.mu.Unlock()
+			continue
+		}
+		if req.Op == "login" {
+			if len(req.Args) == 1 && validLogin(req.Args[0]) {
+				channels["login"] = true
+				conn.WriteJSON(map[string]string{"event": "login", "code": "0", "msg": ""})
+			} else {
+				conn.WriteJSON(map[string]string{"event": "error", "code": "60009", "msg": "Login failed."})
+			}
+			s.mu.Unlock()
+			continue
+		}
+		for _, arg := range req.Args {
+			switch {
+			case !channels["login"]:
+				conn.WriteJSON(map[string]string{"event": "error", "code": "60011", "msg": "Please log in"})
+			case arg["channel"] != "account" && arg["channel"] != "orders":
+				conn.WriteJSON(map[string]string{"event": "error", "code": "60018", "msg": "Wrong URL or channel:" + arg["channel"] + " doesn't exist."})
+			default:
+				channels[arg["channel"]] = true
+				conn.WriteJSON(map[string]interface{}{"event": "subscribe", "arg": arg})
+				if arg["channel"] == "account" {
+					s.writeAccount(conn)
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// validLogin checks a login request's signature of the timestamp, GET and
+// /users/self/verify, as OKX does.
+func validLogin(args map[string]string) bool {
+	if args["apiKey"] != APIKey || args["passphrase"] != Passphrase || args["timestamp"] == "" {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(SecretKey))
+	mac.Write([]byte(args["timestamp"] + "GET/users/self/verify"))
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(args["sign"]))
+}
+
+// pushAccount sends every balance to account subscribers. Callers hold s.mu.
+func (s *Server) pushAccount() {
+	for conn, channels := range s.privateConns {
+		if channels["account"] {
+			s.writeAccount(conn)
+		}
+	}
+}
+
+// writeAccount sends every balance on conn. Callers hold s.mu.
+func (s *Server) writeAccount(conn *websocket.Conn) {
+	var details []map[string]string
+	for ccy, amount := range s.balances {
+		details = append(details, map[string]string{
+			"ccy":      ccy,
+			"cashBal":  format(amount + s.frozen[ccy]),
+			"availBal": format(amount),
+		})
+	}
+	conn.WriteJSON(map[string]interface{}{
+		"arg":  map[string]string{"channel": "account"},
+		"data": []interface{}{map[string]interface{}{"details": details}},
+	})
+}
+
+// pushOrder sends an order that just filled qty more to orders subscribers.
+// Callers hold s.mu.
+func (s *Server) pushOrder(o *Order, qty float64) {
+	d := orderData(o)
+	d["fillSz"] = format(qty)
+	d["fillPx"] = format(o.Price)
+	d["tradeId"] = strconv.Itoa(len(s.orders) + 1)
+	for conn, channels := range s.privateConns {
+		if channels["orders"] {
+			conn.WriteJSON(map[string]interface{}{
+				"arg":  map[string]string{"channel": "orders", "instType": "SPOT"},
+				"data": []map[string]string{d},
+			})
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package okxfake
+
+import (
+	"crypto_trader/exchange"
+	"crypto_trader/okx"
+	"testing"
+	"time"
+)
+
+func TestRejectsBadSignature(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.SetBalance("USDT", 100)
+
+	if _, err := s.Client().GetSpotBalance("USDT"); err != nil {
+		t.Fatalf("valid client: %v", err)
+	}
+
+	c := okx.NewClient(APIKey, "wrong-secret", Passphrase)
+	c.BaseURL = s.URL
+	if _, err := c.GetSpotBalance("USDT"); err == nil {
+		t.Errorf("expected an error for a bad signature")
+	}
+}
+
+func TestDuplicateClientOrderIDReturnsOriginal(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.SetInstrument("TRX-USDT", 0.1)
+	s.SetPrice("TRX-USDT", 0.25)
+	s.SetBalance("USDT", 100)
+	c := s.Client()
+
+	first, err := c.PlaceOrder(exchange.OrderRequest{Ticker: "TRXUSDT", Side: "buy", Size: 40, LotSize: 0.1, ClOrdID: "ct1a1l2"})
+	if err != nil {
+		t.Fatalf("first order: %v", err)
+	}
+	second, err := c.PlaceOrder(exchange.OrderRequest{Ticker: "TRXUSDT", Side: "buy", Size: 40, LotSize: 0.1, ClOrdID: "ct1a1l2"})
+	if err != nil {
+		t.Fatalf("retried order: %v", err)
+	}
+	if first != second || len(s.Orders()) != 1 {
+		t.Errorf("expected the retry to return order %s, got %s with %d orders", first, second, len(s.Orders()))
+	}
+}
+
+func TestStreamCachesBalancesAndReportsFills(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.SetInstrument("TRX-USDT", 0.1)
+	s.SetPrice("TRX-USDT", 0.25)
+	s.SetBalance("USDT", 100)
+	exchange.Register(exchange.Instrument{InstID: "TRX-USDT", Base: "TRX", Quote: "USDT", LotSize: 0.1})
+	c := s.Client()
+
+	fills := make(chan okx.OrderUpdate, 10)
+	stream := okx.NewStream(c, s.PrivateWSURL())
+	stream.OnFill = func(u okx.OrderUpdate) { fills <- u }
+	defer stream.Start()()
+	cached := &okx.Cached{Exchange: c, Stream: stream}
+	waitForBalances := func() {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for _, ok := stream.Balances(); !ok; _, ok = stream.Balances() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for the account push")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitForBalances()
+
+	// Both reads below must come from the cache, as REST is failing
+	s.FailNext("/api/v5/account/balance", "50001", "Service temporarily unavailable")
+	if balance, err := cached.GetSpotBalance("USDT"); err != nil || balance != 100 {
+		t.Fatalf("expected 100 USDT from the cache, got %f (%v)", balance, err)
+	}
+
+	ordID, err := cached.PlaceOrder(exchange.OrderRequest{Ticker: "TRXUSDT", Side: "buy", Size: 40, LotSize: 0.1, ClOrdID: "ct1a1l2"})
+	if err != nil {
+		t.Fatalf("placing order: %v", err)
+	}
+	select {
+	case u := <-fills:
+		if u.OrdID != ordID || u.ClOrdID != "ct1a1l2" || u.Ticker != "TRXUSDT" || u.Side != "buy" || u.FillSize != 40 {
+			t.Errorf("expected order %s to fill 40 TRX, got %+v", ordID, u)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no fill pushed for order %s", ordID)
+	}
+
+	waitForBalances()
+	if positions, err := cached.GetPositions(); err != nil || positions["TRXUSDT"] != 40 {
+		t.Errorf("expected 40 TRX from the cache, got %v (%v)", positions, err)
+	}
+}
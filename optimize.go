@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bytes"
+	"crypto_trader/backtest"
+	"crypto_trader/config"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const optimizeUsage = `Usage: crypto_trader optimize -candles FILE[,FILE...] [-signals FILE] -param NAME=V1,V2,... [flags]
+
+Backtests every combination of the -param values, in parallel, and ranks
+them. With -train and -test it also walks forward: in each window the best
+combination on the training period is backtested on the test period after
+it, and the test periods are reported together as the out-of-sample result.
+
+Parameters (override the config-wide settings, not per-pair or per-strategy ones):
+  stop_loss, take_profit, trailing_stop   protection, as fractions of the price
+  sizing_fraction                         fixed_fraction sizing, 0 for equal weight
+  rebalance_threshold                     rebalance threshold
+  max_open_pairs                          risk limit on pairs held at once
+
+Flags:
+`
+
+// optimizeParams set the parameters a sweep can vary on a config.
+var optimizeParams = map[string]func(c *config.Config, v float64){
+	"stop_loss":     func(c *config.Config, v float64) { protectionOf(c).StopLoss = v },
+	"take_profit":   func(c *config.Config, v float64) { protectionOf(c).TakeProfit = v },
+	"trailing_stop": func(c *config.Config, v float64) { protectionOf(c).TrailingStop = v },
+	"sizing_fraction": func(c *config.Config, v float64) {
+		c.Sizing = nil
+		if v > 0 {
+			c.Sizing = &config.Sizing{Method: config.SizingFixedFraction, Fraction: v}
+		}
+	},
+	"rebalance_threshold": func(c *config.Config, v float64) { c.Rebalance.Threshold = v },
+	"max_open_pairs":      func(c *config.Config, v float64) { c.Risk.MaxOpenPairs = int(v) },
+}
+
+func protectionOf(c *config.Config) *config.Protection {
+	if c.Protection == nil {
+		c.Protection = &config.Protection{}
+	}
+	return c.Protection
+}
+
+// Metrics results can be ranked by.
+var rankMetrics = map[string]func(s backtest.Summary) float64{
+	"sharpe": func(s backtest.Summary) float64 { return s.Sharpe },
+	"cagr":   func(s backtest.Summary) float64 { return s.CAGR },
+	"return": func(s backtest.Summary) float64 { return s.Return },
+	// Less drawdown ranks higher
+	"drawdown": func(s backtest.Summary) float64 { return -s.MaxDrawdown },
+}
+
+type sweepParam struct {
+	name   string
+	values []float64
+}
+
+// paramFlag collects repeated -param NAME=V1,V2 flags.
+type paramFlag []sweepParam
+
+func (f *paramFlag) String() string {
+	var parts []string
+	for _, p := range *f {
+		parts = append(parts, p.name)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *paramFlag) Set(v string) error {
+	name, list, ok := strings.Cut(v, "=")
+	if !ok {
+		return fmt.Errorf("expected NAME=V1,V2,...")
+	}
+	if _, ok := optimizeParams[name]; !ok {
+		return fmt.Errorf("unknown parameter %q", name)
+	}
+	for _, p := range *f {
+		if p.name == name {
+			return fmt.Errorf("%s is given twice", name)
+		}
+	}
+	p := sweepParam{name: name}
+	for _, s := range strings.Split(list, ",") {
+		value, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s value %q", name, s)
+		}
+		p.values = append(p.values, value)
+	}
+	*f = append(*f, p)
+	return nil
+}
+
+// combinations is every combination of the parameters' values, each in the
+// order of params.
+func combinations(params []sweepParam) [][]float64 {
+	combos := [][]float64{nil}
+	for _, p := range params {
+		var next [][]float64
+		for _, combo := range combos {
+			for _, v := range p.values {
+				next = append(next, append(append([]float64(nil), combo...), v))
+			}
+		}
+		combos = next
+	}
+	return combos
+}
+
+// backtestRun is one backtest of a combination over a period.
+type backtestRun struct {
+	combo    int
+	from, to time.Time
+	summary  backtest.Summary
+	equity   []backtest.EquityPoint
+	err      error
+}
+
+// optimizer runs backtests as separate processes of this binary, since a
+// backtest drives the bot's global state and only one can run per process.
+type optimizer struct {
+	args     []string // passed to every backtest
+	configs  []string // config file for each combination
+	dir      string
+	parallel int
+}
+
+func (o *optimizer) run(runs []*backtestRun) {
+	exe, err := os.Executable()
+	if err != nil {
+		for _, r := range runs {
+			r.err = err
+		}
+		return
+	}
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < o.parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				o.runOne(exe, runs[i])
+			}
+		}()
+	}
+	for i := range runs {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+}
+
+func (o *optimizer) runOne(exe string, r *backtestRun) {
+	out, err := os.MkdirTemp(o.dir, "run")
+	if err != nil {
+		r.err = err
+		return
+	}
+	defer os.RemoveAll(out)
+
+	// The configs are complete, and the environment or defaults must not
+	// replace the values swept
+	args := append([]string{"backtest", "-config", o.configs[r.combo], "-exact-config", "-out", out}, o.args...)
+	if !r.from.IsZero() {
+		args = append(args, "-from", r.from.Format(time.RFC3339), "-to", r.to.Format(time.RFC3339))
+	}
+	cmd := exec.Command(exe, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		r.err = fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+		return
+	}
+
+	data, err := os.ReadFile(filepath.Join(out, "summary.json"))
+	if err != nil {
+		r.err = err
+		return
+	}
+	if err := json.Unmarshal(data, &r.summary); err != nil {
+		r.err = fmt.Errorf("error reading summary: %v", err)
+		return
+	}
+	f, err := os.Open(filepath.Join(out, "equity.csv"))
+	if err != nil {
+		r.err = err
+		return
+	}
+	defer f.Close()
+	if r.equity, err = backtest.ReadEquity(f); err != nil {
+		r.err = fmt.Errorf("error reading equity: %v", err)
+	}
+}
+
+// walkWindow is one walk-forward window: the combination that ranked best
+// on the training period and how it did on the test period after it.
+type walkWindow struct {
+	train, test *backtestRun
+}
+
+func runOptimize(args []string) int {
+	fs := flag.NewFlagSet("optimize", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, optimizeUsage)
+		fs.PrintDefaults()
+	}
+	configPath := fs.String("config", "config.yaml", "path to the YAML config file the parameters are applied to")
+	candlesFlag := fs.String("candles", "", "comma-separated CSV files of OHLCV candles")
+	signalsPath := fs.String("signals", "", "CSV file of timestamped signals")
+	outDir := fs.String("out", "optimize-results", "directory to write the results to")
+	rankBy := fs.String("rank", "sharpe", "metric to rank by: sharpe, cagr, return or drawdown")
+	train := fs.Duration("train", 0, "walk-forward training period, e.g. 2160h; 0 skips walking forward")
+	test := fs.Duration("test", 0, "walk-forward test period, 720h by default")
+	parallel := fs.Int("parallel", runtime.NumCPU(), "backtests to run at once")
+	var params paramFlag
+	fs.Var(&params, "param", "parameter and the values to try, e.g. stop_loss=0.03,0.05 (repeatable)")
+	usdt := fs.String("usdt", "10000", "starting USDT balance")
+	takerFee := fs.String("taker-fee", "0.001", "taker fee as a fraction of notional")
+	makerFee := fs.String("maker-fee", "0.0008", "maker fee as a fraction of notional")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	metric, ok := rankMetrics[*rankBy]
+	if *candlesFlag == "" || len(params) == 0 || !ok || *parallel < 1 {
+		fs.Usage()
+		return 2
+	}
+	if *train > 0 && *test == 0 {
+		*test = 720 * time.Hour
+	}
+	fail := func(format string, args ...interface{}) int {
+		fmt.Fprintf(os.Stderr, "optimize: "+format+"\n", args...)
+		return 1
+	}
+
+	base, err := config.Load(*configPath)
+	if err != nil {
+		return fail("failed to load config: %v", err)
+	}
+	baseYAML, err := yaml.Marshal(base)
+	if err != nil {
+		return fail("%v", err)
+	}
+	candles, err := loadBacktestCandles(strings.Split(*candlesFlag, ","))
+	if err != nil {
+		return fail("%v", err)
+	}
+	closes := backtest.NewMarket(candles).Closes()
+	if len(closes) == 0 {
+		return fail("no candles to replay")
+	}
+
+	dir, err := os.MkdirTemp("", "optimize")
+	if err != nil {
+		return fail("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	o := &optimizer{dir: dir, parallel: *parallel, args: []string{"-candles", *candlesFlag, "-usdt", *usdt, "-taker-fee", *takerFee, "-maker-fee", *makerFee}}
+	if *signalsPath != "" {
+		o.args = append(o.args, "-signals", *signalsPath)
+	}
+	combos := combinations(params)
+	for i, combo := range combos {
+		var c config.Config
+		if err := yaml.Unmarshal(baseYAML, &c); err != nil {
+			return fail("%v", err)
+		}
+		for j, p := range params {
+			optimizeParams[p.name](&c, combo[j])
+		}
+		if err := c.Validate(); err != nil {
+			return fail("%s: %v", describeCombo(params, combo), err)
+		}
+		data, err := yaml.Marshal(&c)
+		if err != nil {
+			return fail("%v", err)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("config-%d.yaml", i))
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			return fail("%v", err)
+		}
+		o.configs = append(o.configs, path)
+	}
+
+	// Every combination over the whole period, then every combination over
+	// each training period, then the winners over the test periods
+	var grid, trainRuns []*backtestRun
+	for i := range combos {
+		grid = append(grid, &backtestRun{combo: i})
+	}
+	var windows []walkWindow
+	if *train > 0 {
+		start, end := closes[0], closes[len(closes)-1]
+		for from := start; from.Add(*train).Before(end); from = from.Add(*test) {
+			w := walkWindow{train: &backtestRun{from: from, to: from.Add(*train)}}
+			w.test = &backtestRun{from: w.train.to, to: w.train.to.Add(*test)}
+			windows = append(windows, w)
+		}
+		if len(windows) == 0 {
+			return fail("the candles cover less than one training period")
+		}
+		for _, w := range windows {
+			for i := range combos {
+				trainRuns = append(trainRuns, &backtestRun{combo: i, from: w.train.from, to: w.train.to})
+			}
+		}
+	}
+	fmt.Fprintf(os.Stderr, "optimize: %d combinations, %d walk-forward windows, %d backtests on %d workers\n",
+		len(combos), len(windows), len(grid)+len(trainRuns)+len(windows), *parallel)
+	o.run(append(grid, trainRuns...))
+
+	for _, r := range grid {
+		if r.err != nil {
+			return fail("backtest of %s failed: %v", describeCombo(params, combos[r.combo]), r.err)
+		}
+	}
+	ranked := rankRuns(grid, metric)
+
+	if len(windows) > 0 {
+		var tests []*backtestRun
+		for i := range windows {
+			best := rankRuns(trainRuns[i*len(combos):(i+1)*len(combos)], metric)
+			if len(best) == 0 {
+				return fail("every backtest of window %d failed, e.g. %v", i+1, trainRuns[i*len(combos)].err)
+			}
+			windows[i].train = best[0]
+			windows[i].test.combo = best[0].combo
+			tests = append(tests, windows[i].test)
+		}
+		o.run(tests)
+		for i, w := range windows {
+			if w.test.err != nil {
+				return fail("test backtest of window %d failed: %v", i+1, w.test.err)
+			}
+		}
+	}
+	outOfSample := stitchWindows(windows)
+
+	if err := os.MkdirAll(*outDir, 0o755); err != nil {
+		return fail("%v", err)
+	}
+	for name, write := range map[string]func(io.Writer) error{
+		"results.csv": func(w io.Writer) error { return writeGridCSV(w, params, combos, ranked) },
+		"results.json": func(w io.Writer) error {
+			return writeOptimizeJSON(w, *rankBy, params, combos, ranked, windows, outOfSample)
+		},
+	} {
+		if err := writeFile(filepath.Join(*outDir, name), write); err != nil {
+			return fail("%v", err)
+		}
+	}
+	if len(windows) > 0 {
+		if err := writeFile(filepath.Join(*outDir, "walkforward.csv"), func(w io.Writer) error {
+			return writeWalkForwardCSV(w, params, combos, windows)
+		}); err != nil {
+			return fail("%v", err)
+		}
+	}
+
+	fmt.Printf("Top combinations by %s over the whole period:\n", *rankBy)
+	for i, r := range ranked[:min(10, len(ranked))] {
+		s := r.summary
+		fmt.Printf("%3d. %s: sharpe %.2f, cagr %.2f%%, return %.2f%%, max drawdown %.2f%%, %d trades\n",
+			i+1, describeCombo(params, combos[r.combo]), s.Sharpe, s.CAGR*100, s.Return*100, s.MaxDrawdown*100, s.Trades)
+	}
+	if len(windows) > 0 {
+		fmt.Printf("\nWalk-forward out-of-sample over %d windows:\n", len(windows))
+		outOfSample.Write(os.Stdout)
+	}
+	return 0
+}
+
+// rankRuns returns the runs that succeeded, best first by metric, with
+// ties going to the higher return.
+func rankRuns(runs []*backtestRun, metric func(backtest.Summary) float64) []*backtestRun {
+	var ranked []*backtestRun
+	for _, r := range runs {
+		if r.err == nil {
+			ranked = append(ranked, r)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := metric(ranked[i].summary), metric(ranked[j].summary)
+		if a != b {
+			return a > b
+		}
+		return ranked[i].summary.Return > ranked[j].summary.Return
+	})
+	return ranked
+}
+
+// stitchWindows joins the test periods' equity curves into one, each
+// carrying on from where the last ended, and summarizes it.
+func stitchWindows(windows []walkWindow) backtest.Summary {
+	var equity []backtest.EquityPoint
+	scale := 1.0
+	var trades backtest.Summary
+	for _, w := range windows {
+		points := w.test.equity
+		if len(points) == 0 || points[0].Equity == 0 {
+			continue
+		}
+		if len(equity) > 0 {
+			scale = equity[len(equity)-1].Equity / points[0].Equity
+		}
+		for _, p := range points {
+			equity = append(equity, backtest.EquityPoint{Time: p.Time, Equity: p.Equity * scale})
+		}
+		trades.Trades += w.test.summary.Trades
+		trades.Buys += w.test.summary.Buys
+		trades.Sells += w.test.summary.Sells
+		trades.Wins += w.test.summary.Wins
+		trades.Fees += w.test.summary.Fees
+	}
+	s := backtest.Summarize(equity, nil)
+	s.Trades, s.Buys, s.Sells, s.Wins, s.Fees = trades.Trades, trades.Buys, trades.Sells, trades.Wins, trades.Fees
+	return s
+}
+
+func describeCombo(params []sweepParam, combo []float64) string {
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = fmt.Sprintf("%s=%g", p.name, combo[i])
+	}
+	return strings.Join(parts, " ")
+}
+
+func comboMap(params []sweepParam, combo []float64) map[string]float64 {
+	m := make(map[string]float64)
+	for i, p := range params {
+		m[p.name] = combo[i]
+	}
+	return m
+}
+
+var summaryColumns = []string{"return", "cagr", "sharpe", "max_drawdown", "trades", "win_rate", "fees"}
+
+func summaryRow(s backtest.Summary) []string {
+	winRate := 0.0
+	if s.Sells > 0 {
+		winRate = float64(s.Wins) / float64(s.Sells)
+	}
+	row := []string{}
+	for _, v := range []float64{s.Return, s.CAGR, s.Sharpe, s.MaxDrawdown} {
+		row = append(row, strconv.FormatFloat(roundTo(v, 6), 'f', -1, 64))
+	}
+	return append(row, strconv.Itoa(s.Trades), strconv.FormatFloat(roundTo(winRate, 4), 'f', -1, 64), strconv.FormatFloat(roundTo(s.Fees, 6), 'f', -1, 64))
+}
+
+func roundTo(v float64, places int) float64 {
+	p := math.Pow(10, float64(places))
+	return math.Round(v*p) / p
+}
+
+func paramColumns(params []sweepParam) []string {
+	names := make([]string, len(params))
+	for i, p := range params {
+		names[i] = p.name
+	}
+	return names
+}
+
+func comboRow(combo []float64) []string {
+	row := make([]string, len(combo))
+	for i, v := range combo {
+		row[i] = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return row
+}
+
+func writeGridCSV(w io.Writer, params []sweepParam, combos [][]float64, ranked []*backtestRun) error {
+	cw := csv.NewWriter(w)
+	cw.Write(append(append([]string{"rank"}, paramColumns(params)...), summaryColumns...))
+	for i, r := range ranked {
+		row := append([]string{strconv.Itoa(i + 1)}, comboRow(combos[r.combo])...)
+		cw.Write(append(row, summaryRow(r.summary)...))
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeWalkForwardCSV(w io.Writer, params []sweepParam, combos [][]float64, windows []walkWindow) error {
+	cw := csv.NewWriter(w)
+	header := []string{"window", "train_from", "train_to", "test_from", "test_to"}
+	header = append(header, paramColumns(params)...)
+	for _, c := range summaryColumns {
+		header = append(header, "train_"+c)
+	}
+	for _, c := range summaryColumns {
+		header = append(header, "test_"+c)
+	}
+	cw.Write(header)
+	for i, win := range windows {
+		row := []string{strconv.Itoa(i + 1),
+			win.train.from.Format(time.RFC3339), win.train.to.Format(time.RFC3339),
+			win.test.from.Format(time.RFC3339), win.test.to.Format(time.RFC3339)}
+		row = append(row, comboRow(combos[win.train.combo])...)
+		row = append(row, summaryRow(win.train.summary)...)
+		cw.Write(append(row, summaryRow(win.test.summary)...))
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeOptimizeJSON(w io.Writer, rankBy string, params []sweepParam, combos [][]float64, ranked []*backtestRun, windows []walkWindow, outOfSample backtest.Summary) error {
+	type result struct {
+		Params  map[string]float64 `json:"params"`
+		Summary backtest.Summary   `json:"summary"`
+	}
+	type window struct {
+		TrainFrom time.Time          `json:"train_from"`
+		TrainTo   time.Time          `json:"train_to"`
+		TestFrom  time.Time          `json:"test_from"`
+		TestTo    time.Time          `json:"test_to"`
+		Params    map[string]float64 `json:"params"`
+		Train     backtest.Summary   `json:"train"`
+		Test      backtest.Summary   `json:"test"`
+	}
+	doc := struct {
+		RankBy      string            `json:"rank_by"`
+		Results     []result          `json:"results"`
+		WalkForward []window          `json:"walk_forward,omitempty"`
+		OutOfSample *backtest.Summary `json:"out_of_sample,omitempty"`
+	}{RankBy: rankBy}
+	for _, r := range ranked {
+		doc.Results = append(doc.Results, result{comboMap(params, combos[r.combo]), r.summary})
+	}
+	for _, win := range windows {
+		doc.WalkForward = append(doc.WalkForward, window{
+			TrainFrom: win.train.from, TrainTo: win.train.to,
+			TestFrom: win.test.from, TestTo: win.test.to,
+			Params: comboMap(params, combos[win.train.combo]),
+			Train:  win.train.summary, Test: win.test.summary,
+		})
+	}
+	if len(windows) > 0 {
+		doc.OutOfSample = &outOfSample
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
@@ -0,0 +1,609 @@
+package paper
+
+import (
+	"crypto_trader/db"
+	"crypto_trader/exchange"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Market supplies the prices and instrument metadata the simulation fills
+// against. okx.Client serves live data; a replay source can serve history.
+type Market interface {
+	GetPrice(ticker string) (float64, error)
+	GetCandles(ticker, bar string, limit int) ([]exchange.Candle, error)
+	GetInstruments() ([]exchange.Instrument, error)
+}
+
+// CandleMarket is a Market that replays candles. Against one, algo orders
+// trigger on the range of a candle that closed after they were placed, not
+// only its close, and sell at their trigger price, or at the candle's open
+// when it opened past the trigger.
+type CandleMarket interface {
+	Market
+	LastCandle(ticker string) (candle exchange.Candle, closed time.Time, ok bool)
+}
+
+type Config struct {
+	StartingUSDT float64
+	TakerFee     float64 // fraction of notional, e.g. 0.001 for 0.1%
+	MakerFee     float64
+	// FillRatio is the share of a limit order filled when the price first
+	// reaches it; the rest fills the next time the price is there. 0 fills
+	// orders whole.
+	FillRatio float64
+}
+
+// Exchange is a simulated spot account whose balances and orders live in
+// SQLite. Orders are priced exactly like okx.Client.PlaceOrder; an order that
+// crosses the current price fills at its limit price and pays the taker fee,
+// otherwise it rests and pays the maker fee when the price reaches it. Algo
+// orders reserve the coins they would sell and sell them at the last price,
+// paying the taker fee, once a trigger is reached; see CandleMarket for
+// replays.
+type Exchange struct {
+	market Market
+	cfg    Config
+	mu     sync.Mutex
+}
+
+var _ exchange.Exchange = (*Exchange)(nil)
+
+func New(market Market, cfg Config) (*Exchange, error) {
+	if err := db.InitPaperBalance("USDT", cfg.StartingUSDT); err != nil {
+		return nil, fmt.Errorf("error seeding paper balance: %v", err)
+	}
+	return &Exchange{market: market, cfg: cfg}, nil
+}
+
+func currencies(ticker string) (base, quote string, err error) {
+	inst, ok := exchange.ParseTicker(ticker)
+	if !ok {
+		return "", "", fmt.Errorf("unknown instrument %s", ticker)
+	}
+	return inst.Base, inst.Quote, nil
+}
+
+func (e *Exchange) GetSpotBalance(ccy string) (float64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.sweep()
+	return db.GetPaperBalance(ccy)
+}
+
+func (e *Exchange) GetPositions() (map[string]float64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.sweep()
+	balances, err := db.GetPaperBalances()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching paper balances: %v", err)
+	}
+	// Like OKX's cashBal, positions include coins reserved by live sells
+	orders, err := db.GetPaperOrders("live")
+	if err != nil {
+		return nil, fmt.Errorf("error fetching paper orders: %v", err)
+	}
+	algos, err := db.GetPaperAlgoOrders("")
+	if err != nil {
+		return nil, fmt.Errorf("error fetching paper algo orders: %v", err)
+	}
+	reserved := make(map[string]float64)
+	for _, o := range orders {
+		if o.Side == "sell" {
+			reserved[o.Ticker] += o.Size - o.Filled
+		}
+	}
+	for _, o := range algos {
+		reserved[o.Ticker] += o.Size
+	}
+	positions := make(map[string]float64)
+	for _, inst := range exchange.Registered() {
+		if amount, ok := balances[inst.Base]; ok {
+			positions[inst.Ticker()] = amount + reserved[inst.Ticker()]
+		}
+	}
+	return positions, nil
+}
+
+func (e *Exchange) GetOpenOrders(ticker string) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.sweep()
+	orders, err := db.GetPaperOrders("live")
+	if err != nil {
+		return false, fmt.Errorf("error fetching paper orders: %v", err)
+	}
+	for _, o := range orders {
+		if o.Ticker == ticker {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (e *Exchange) GetInstruments() ([]exchange.Instrument, error) {
+	return e.market.GetInstruments()
+}
+
+func (e *Exchange) GetPrice(ticker string) (float64, error) {
+	return e.market.GetPrice(ticker)
+}
+
+func (e *Exchange) GetCandles(ticker, bar string, limit int) ([]exchange.Candle, error) {
+	return e.market.GetCandles(ticker, bar, limit)
+}
+
+func (e *Exchange) PlaceOrder(req exchange.OrderRequest) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ticker, side, size, clOrdID := req.Ticker, req.Side, req.Size, req.ClOrdID
+	if clOrdID != "" {
+		id, found, err := db.FindPaperOrder(clOrdID)
+		if err != nil {
+			return "", fmt.Errorf("error looking up paper order %s: %v", clOrdID, err)
+		}
+		if found {
+			log.Printf("Paper order %s for %s was already placed: id=%d", clOrdID, ticker, id)
+			return strconv.FormatInt(id, 10), nil
+		}
+	}
+
+	if side != "buy" && side != "sell" {
+		return "", fmt.Errorf("invalid order side %q", side)
+	}
+	if req.LotSize > 0 {
+		size = math.Floor(size/req.LotSize+1e-9) * req.LotSize
+	}
+	if size <= 0 {
+		return "", fmt.Errorf("order size for %s rounds to zero", ticker)
+	}
+
+	base, quote, err := currencies(ticker)
+	if err != nil {
+		return "", err
+	}
+	last, err := e.market.GetPrice(ticker)
+	if err != nil {
+		return "", fmt.Errorf("failed to get price for %s: %v", ticker, err)
+	}
+	// Market orders are simulated as limit orders at the last price
+	price := req.OrderPrice(last)
+	if req.Type == exchange.OrderMarket {
+		price = last
+	}
+
+	// Reserve the funds the order would spend, as OKX freezes them
+	spendCcy, spend := quote, size*price
+	if side == "sell" {
+		spendCcy, spend = base, size
+	}
+	available, err := db.GetPaperBalance(spendCcy)
+	if err != nil {
+		return "", fmt.Errorf("error fetching paper balance: %v", err)
+	}
+	if spend > available+1e-12 {
+		return "", fmt.Errorf("paper order error: insufficient %s, need %f, have %f", spendCcy, spend, available)
+	}
+	if err := db.AdjustPaperBalance(spendCcy, -spend); err != nil {
+		return "", fmt.Errorf("error reserving paper balance: %v", err)
+	}
+
+	order := db.PaperOrder{Ticker: ticker, Side: side, Size: size, Price: price, Status: "live", ClOrdID: clOrdID}
+	order.ID, err = db.InsertPaperOrder(order)
+	if err != nil {
+		return "", fmt.Errorf("error recording paper order: %v", err)
+	}
+	log.Printf("Paper order placed for %s: id=%d side=%s size=%f px=%f", ticker, order.ID, side, size, price)
+
+	if crosses(order, last) {
+		// OKX cancels a post-only order that would take liquidity
+		if req.Type == exchange.OrderPostOnly {
+			return strconv.FormatInt(order.ID, 10), e.cancel(order)
+		}
+		qty := e.fillSize(order)
+		if req.Type == exchange.OrderMarket {
+			qty = size
+		}
+		if err := e.fill(order, qty, e.cfg.TakerFee); err != nil {
+			return "", err
+		}
+	}
+	return strconv.FormatInt(order.ID, 10), nil
+}
+
+func (e *Exchange) GetOrder(ticker, ordID string) (exchange.Order, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.sweep()
+	id, err := strconv.ParseInt(ordID, 10, 64)
+	if err != nil {
+		return exchange.Order{}, fmt.Errorf("invalid paper order id %q", ordID)
+	}
+	o, err := db.GetPaperOrder(id)
+	if err != nil {
+		return exchange.Order{}, fmt.Errorf("error fetching paper order %s: %v", ordID, err)
+	}
+	if o.Ticker != ticker {
+		return exchange.Order{}, fmt.Errorf("paper order %s is not for %s", ordID, ticker)
+	}
+	state := o.Status
+	if state == "live" && o.Filled > 0 {
+		state = "partially_filled"
+	}
+	return exchange.Order{
+		OrdID:    ordID,
+		Ticker:   o.Ticker,
+		Side:     o.Side,
+		State:    state,
+		Price:    o.Price,
+		Size:     o.Size,
+		FillSize: o.Filled,
+		AvgPrice: o.AvgPrice,
+		Fee:      o.Fee,
+	}, nil
+}
+
+func (e *Exchange) liveOrder(ticker, ordID string) (db.PaperOrder, error) {
+	id, err := strconv.ParseInt(ordID, 10, 64)
+	if err != nil {
+		return db.PaperOrder{}, fmt.Errorf("invalid paper order id %q", ordID)
+	}
+	o, err := db.GetPaperOrder(id)
+	if err != nil {
+		return db.PaperOrder{}, fmt.Errorf("error fetching paper order %s: %v", ordID, err)
+	}
+	if o.Ticker != ticker {
+		return db.PaperOrder{}, fmt.Errorf("paper order %s is not for %s", ordID, ticker)
+	}
+	if o.Status != "live" {
+		return db.PaperOrder{}, fmt.Errorf("paper order %s is already %s", ordID, o.Status)
+	}
+	return o, nil
+}
+
+func (e *Exchange) AmendOrder(ticker, ordID string, price float64) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	o, err := e.liveOrder(ticker, ordID)
+	if err != nil {
+		return err
+	}
+	_, quote, err := currencies(ticker)
+	if err != nil {
+		return err
+	}
+	// Only buys reserve an amount that depends on the price
+	if o.Side == "buy" {
+		if err := db.AdjustPaperBalance(quote, (o.Size-o.Filled)*(o.Price-price)); err != nil {
+			return fmt.Errorf("error adjusting paper reservation: %v", err)
+		}
+	}
+	o.Price = price
+	if err := db.UpdatePaperOrder(o); err != nil {
+		return fmt.Errorf("error updating paper order: %v", err)
+	}
+
+	last, err := e.market.GetPrice(ticker)
+	if err != nil {
+		return nil
+	}
+	if crosses(o, last) {
+		return e.fill(o, e.fillSize(o), e.cfg.TakerFee)
+	}
+	return nil
+}
+
+func (e *Exchange) CancelOrder(ticker, ordID string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	o, err := e.liveOrder(ticker, ordID)
+	if err != nil {
+		return err
+	}
+	return e.cancel(o)
+}
+
+// cancel releases what a live order still reserves. Callers hold e.mu.
+func (e *Exchange) cancel(o db.PaperOrder) error {
+	base, quote, err := currencies(o.Ticker)
+	if err != nil {
+		return err
+	}
+	unfilled := o.Size - o.Filled
+	if o.Side == "buy" {
+		err = db.AdjustPaperBalance(quote, unfilled*o.Price)
+	} else {
+		err = db.AdjustPaperBalance(base, unfilled)
+	}
+	if err != nil {
+		return fmt.Errorf("error releasing paper reservation: %v", err)
+	}
+	o.Status = "canceled"
+	if err := db.UpdatePaperOrder(o); err != nil {
+		return fmt.Errorf("error updating paper order: %v", err)
+	}
+	log.Printf("Paper order canceled for %s: id=%d", o.Ticker, o.ID)
+	return nil
+}
+
+func crosses(o db.PaperOrder, last float64) bool {
+	if o.Side == "buy" {
+		return last <= o.Price
+	}
+	return last >= o.Price
+}
+
+// fillSize is how much of a live order fills when the price reaches it:
+// FillRatio of it the first time, and whatever is left after that.
+func (e *Exchange) fillSize(o db.PaperOrder) float64 {
+	if o.Filled == 0 && e.cfg.FillRatio > 0 && e.cfg.FillRatio < 1 {
+		return o.Size * e.cfg.FillRatio
+	}
+	return o.Size - o.Filled
+}
+
+// fill executes qty more of an order at its limit price, completing it once
+// nothing is left. Like OKX spot, buys pay the fee in the coin received and
+// sells pay it in the quote currency. The recorded fee is always in the
+// quote currency.
+func (e *Exchange) fill(o db.PaperOrder, qty, feeRate float64) error {
+	base, quote, err := currencies(o.Ticker)
+	if err != nil {
+		return err
+	}
+	notional := qty * o.Price
+	fee := notional * feeRate
+	if o.Side == "buy" {
+		err = db.AdjustPaperBalance(base, qty*(1-feeRate))
+	} else {
+		err = db.AdjustPaperBalance(quote, notional-fee)
+	}
+	if err != nil {
+		return fmt.Errorf("error crediting paper fill: %v", err)
+	}
+
+	// An amend between fills changes the price, so the average is weighted
+	o.AvgPrice = (o.AvgPrice*o.Filled + notional) / (o.Filled + qty)
+	o.Filled += qty
+	o.Fee += fee
+	if o.Filled >= o.Size-1e-12 {
+		o.Status = "filled"
+	}
+	if err := db.UpdatePaperOrder(o); err != nil {
+		return fmt.Errorf("error updating paper order: %v", err)
+	}
+	log.Printf("Paper order %s for %s: id=%d side=%s size=%f/%f px=%f fee=%f %s", o.Status, o.Ticker, o.ID, o.Side, o.Filled, o.Size, o.Price, o.Fee, quote)
+	return nil
+}
+
+// PlaceAlgoOrder reserves the coins to sell until a trigger is reached.
+// Only sells are simulated, which is all protective orders need.
+func (e *Exchange) PlaceAlgoOrder(req exchange.AlgoRequest) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if req.ClOrdID != "" {
+		id, found, err := db.FindPaperAlgoOrder(req.ClOrdID)
+		if err != nil {
+			return "", fmt.Errorf("error looking up paper algo order %s: %v", req.ClOrdID, err)
+		}
+		if found {
+			log.Printf("Paper algo order %s for %s was already placed: id=%d", req.ClOrdID, req.Ticker, id)
+			return strconv.FormatInt(id, 10), nil
+		}
+	}
+	if req.Side != "sell" {
+		return "", fmt.Errorf("paper algo orders must be sells, got %q", req.Side)
+	}
+	if req.StopLoss <= 0 && req.TakeProfit <= 0 {
+		return "", fmt.Errorf("algo order for %s has no trigger price", req.Ticker)
+	}
+	size := req.Size
+	if req.LotSize > 0 {
+		size = math.Floor(size/req.LotSize+1e-9) * req.LotSize
+	}
+	if size <= 0 {
+		return "", fmt.Errorf("algo order size for %s rounds to zero", req.Ticker)
+	}
+
+	base, _, err := currencies(req.Ticker)
+	if err != nil {
+		return "", err
+	}
+	available, err := db.GetPaperBalance(base)
+	if err != nil {
+		return "", fmt.Errorf("error fetching paper balance: %v", err)
+	}
+	if size > available+1e-12 {
+		return "", fmt.Errorf("paper algo order error: insufficient %s, need %f, have %f", base, size, available)
+	}
+	if err := db.AdjustPaperBalance(base, -size); err != nil {
+		return "", fmt.Errorf("error reserving paper balance: %v", err)
+	}
+
+	o := db.PaperAlgoOrder{Ticker: req.Ticker, Side: req.Side, Size: size, StopLoss: req.StopLoss, TakeProfit: req.TakeProfit, Status: "live", ClOrdID: req.ClOrdID}
+	o.ID, err = db.InsertPaperAlgoOrder(o)
+	if err != nil {
+		return "", fmt.Errorf("error recording paper algo order: %v", err)
+	}
+	log.Printf("Paper algo order placed for %s: id=%d size=%f sl=%f tp=%f", req.Ticker, o.ID, size, req.StopLoss, req.TakeProfit)
+	return strconv.FormatInt(o.ID, 10), nil
+}
+
+func (e *Exchange) GetAlgoOrders(ticker string) ([]exchange.AlgoOrder, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.sweep()
+	algos, err := db.GetPaperAlgoOrders(ticker)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching paper algo orders: %v", err)
+	}
+	var orders []exchange.AlgoOrder
+	for _, o := range algos {
+		orders = append(orders, exchange.AlgoOrder{
+			AlgoID:     strconv.FormatInt(o.ID, 10),
+			Ticker:     o.Ticker,
+			Side:       o.Side,
+			Size:       o.Size,
+			StopLoss:   o.StopLoss,
+			TakeProfit: o.TakeProfit,
+			State:      o.Status,
+		})
+	}
+	return orders, nil
+}
+
+func (e *Exchange) GetAlgoOrder(ticker, algoID string) (exchange.AlgoOrder, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.sweep()
+	id, err := strconv.ParseInt(algoID, 10, 64)
+	if err != nil {
+		return exchange.AlgoOrder{}, fmt.Errorf("invalid paper algo order id %q", algoID)
+	}
+	o, err := db.GetPaperAlgoOrder(id)
+	if err != nil {
+		return exchange.AlgoOrder{}, err
+	}
+	algo := exchange.AlgoOrder{
+		AlgoID:     algoID,
+		Ticker:     o.Ticker,
+		Side:       o.Side,
+		Size:       o.Size,
+		StopLoss:   o.StopLoss,
+		TakeProfit: o.TakeProfit,
+		State:      o.Status,
+	}
+	if o.OrdID > 0 {
+		algo.OrdID = strconv.FormatInt(o.OrdID, 10)
+	}
+	return algo, nil
+}
+
+func (e *Exchange) CancelAlgoOrders(ticker string, algoIDs []string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	algos, err := db.GetPaperAlgoOrders(ticker)
+	if err != nil {
+		return fmt.Errorf("error fetching paper algo orders: %v", err)
+	}
+	live := make(map[string]db.PaperAlgoOrder)
+	for _, o := range algos {
+		live[strconv.FormatInt(o.ID, 10)] = o
+	}
+	base, _, err := currencies(ticker)
+	if err != nil {
+		return err
+	}
+	for _, id := range algoIDs {
+		o, ok := live[id]
+		if !ok {
+			return fmt.Errorf("no live paper algo order %s for %s", id, ticker)
+		}
+		if err := db.AdjustPaperBalance(base, o.Size); err != nil {
+			return fmt.Errorf("error releasing paper reservation: %v", err)
+		}
+		if err := db.UpdatePaperAlgoOrderStatus(o.ID, "canceled"); err != nil {
+			return fmt.Errorf("error updating paper algo order: %v", err)
+		}
+		log.Printf("Paper algo order canceled for %s: id=%d", ticker, o.ID)
+	}
+	return nil
+}
+
+func triggered(o db.PaperAlgoOrder, last float64) bool {
+	return (o.StopLoss > 0 && last <= o.StopLoss) || (o.TakeProfit > 0 && last >= o.TakeProfit)
+}
+
+// triggerPrice is the price an algo order sells at if the market has reached
+// one of its triggers.
+func (e *Exchange) triggerPrice(o db.PaperAlgoOrder) (float64, bool, error) {
+	if m, ok := e.market.(CandleMarket); ok {
+		c, closed, ok := m.LastCandle(o.Ticker)
+		if ok && closed.After(o.Timestamp) {
+			// A candle that reached both triggers is taken to have hit the
+			// stop-loss first, since there's no telling which it did
+			switch {
+			case o.StopLoss > 0 && c.Low <= o.StopLoss:
+				return math.Min(o.StopLoss, c.Open), true, nil
+			case o.TakeProfit > 0 && c.High >= o.TakeProfit:
+				return math.Max(o.TakeProfit, c.Open), true, nil
+			}
+			return 0, false, nil
+		}
+	}
+	last, err := e.market.GetPrice(o.Ticker)
+	if err != nil {
+		return 0, false, err
+	}
+	return last, triggered(o, last), nil
+}
+
+// trigger sells an algo order's reserved coins at price. Callers hold e.mu.
+func (e *Exchange) trigger(o db.PaperAlgoOrder, price float64) error {
+	order := db.PaperOrder{Ticker: o.Ticker, Side: o.Side, Size: o.Size, Price: price, Status: "live"}
+	var err error
+	order.ID, err = db.InsertPaperOrder(order)
+	if err != nil {
+		return fmt.Errorf("error recording paper order: %v", err)
+	}
+	if err := db.TriggerPaperAlgoOrder(o.ID, order.ID); err != nil {
+		return fmt.Errorf("error updating paper algo order: %v", err)
+	}
+	log.Printf("Paper algo order triggered for %s: id=%d px=%f, order id=%d", o.Ticker, o.ID, price, order.ID)
+	return e.fill(order, order.Size, e.cfg.TakerFee)
+}
+
+// sweep fills resting orders the market has since reached and triggers algo
+// orders. Callers hold e.mu.
+func (e *Exchange) sweep() {
+	algos, err := db.GetPaperAlgoOrders("")
+	if err != nil {
+		log.Printf("Error fetching live paper algo orders: %v", err)
+	}
+	for _, o := range algos {
+		price, ok, err := e.triggerPrice(o)
+		if err != nil {
+			log.Printf("Error fetching price for paper algo order %d: %v", o.ID, err)
+			continue
+		}
+		if ok {
+			if err := e.trigger(o, price); err != nil {
+				log.Printf("Error triggering paper algo order %d: %v", o.ID, err)
+			}
+		}
+	}
+
+	orders, err := db.GetPaperOrders("live")
+	if err != nil {
+		log.Printf("Error fetching live paper orders: %v", err)
+		return
+	}
+	for _, o := range orders {
+		last, err := e.market.GetPrice(o.Ticker)
+		if err != nil {
+			log.Printf("Error fetching price for paper order %d: %v", o.ID, err)
+			continue
+		}
+		if crosses(o, last) {
+			if err := e.fill(o, e.fillSize(o), e.cfg.MakerFee); err != nil {
+				log.Printf("Error filling paper order %d: %v", o.ID, err)
+			}
+		}
+	}
+}
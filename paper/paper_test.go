@@ -0,0 +1,227 @@
+package paper
+
+import (
+	"crypto_trader/config"
+	"crypto_trader/db"
+	"crypto_trader/exchange"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+// market serves prices the test sets.
+type market struct {
+	prices map[string]float64
+}
+
+func (m *market) GetPrice(ticker string) (float64, error) {
+	return m.prices[ticker], nil
+}
+
+func (m *market) GetCandles(ticker, bar string, limit int) ([]exchange.Candle, error) {
+	return nil, nil
+}
+
+func (m *market) GetInstruments() ([]exchange.Instrument, error) {
+	return nil, nil
+}
+
+func newTestExchange(t *testing.T, cfg Config) (*Exchange, *market) {
+	t.Helper()
+	db.InitDB(filepath.Join(t.TempDir(), "paper.db"), config.Default())
+	t.Cleanup(db.Close)
+	exchange.Register(exchange.Instrument{InstID: "TRX-USDT", Base: "TRX", Quote: "USDT", LotSize: 0.1})
+
+	m := &market{prices: map[string]float64{"TRXUSDT": 0.25}}
+	cfg.StartingUSDT = 100
+	e, err := New(m, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e, m
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func expectBalance(t *testing.T, e *Exchange, ccy string, want float64) {
+	t.Helper()
+	got, err := e.GetSpotBalance(ccy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(got, want) {
+		t.Errorf("expected %v %s available, got %v", want, ccy, got)
+	}
+}
+
+func getOrder(t *testing.T, e *Exchange, ordID string) exchange.Order {
+	t.Helper()
+	order, err := e.GetOrder("TRXUSDT", ordID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+func TestCrossingOrdersPayTheTakerFee(t *testing.T) {
+	e, _ := newTestExchange(t, Config{TakerFee: 0.001, MakerFee: 0.002})
+
+	// A limit buy is priced 0.1% over the last price and fills at once
+	ordID, err := e.PlaceOrder(exchange.OrderRequest{Ticker: "TRXUSDT", Side: "buy", Size: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := getOrder(t, e, ordID)
+	if order.State != "filled" || order.FillSize != 100 || !near(order.AvgPrice, 0.25025) || !near(order.Fee, 25.025*0.001) {
+		t.Errorf("expected 100 TRX filled at 0.25025 with the taker fee, got %+v", order)
+	}
+	// The fee on a buy comes out of the coins received
+	expectBalance(t, e, "TRX", 99.9)
+	expectBalance(t, e, "USDT", 100-25.025)
+
+	// A market sell fills at the last price, its fee out of the proceeds
+	ordID, err = e.PlaceOrder(exchange.OrderRequest{Ticker: "TRXUSDT", Side: "sell", Type: exchange.OrderMarket, Size: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order := getOrder(t, e, ordID); order.State != "filled" || order.AvgPrice != 0.25 || !near(order.Fee, 12.5*0.001) {
+		t.Errorf("expected 50 TRX sold at 0.25 with the taker fee, got %+v", order)
+	}
+	expectBalance(t, e, "TRX", 49.9)
+	expectBalance(t, e, "USDT", 100-25.025+12.5-0.0125)
+}
+
+func TestRestingOrdersPayTheMakerFee(t *testing.T) {
+	e, m := newTestExchange(t, Config{TakerFee: 0.001, MakerFee: 0.002})
+
+	// A post-only buy rests 0.1% under the last price
+	ordID, err := e.PlaceOrder(exchange.OrderRequest{Ticker: "TRXUSDT", Side: "buy", Type: exchange.OrderPostOnly, Size: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order := getOrder(t, e, ordID); order.State != "live" || order.FillSize != 0 || !near(order.Price, 0.24975) {
+		t.Fatalf("expected the order to rest at 0.24975, got %+v", order)
+	}
+
+	m.prices["TRXUSDT"] = 0.2
+	order := getOrder(t, e, ordID)
+	if order.State != "filled" || !near(order.AvgPrice, 0.24975) || !near(order.Fee, 24.975*0.002) {
+		t.Errorf("expected the order to fill at its price with the maker fee, got %+v", order)
+	}
+	expectBalance(t, e, "TRX", 100*(1-0.002))
+	expectBalance(t, e, "USDT", 100-24.975)
+
+	// One that would take liquidity is canceled, as OKX does
+	ordID, err = e.PlaceOrder(exchange.OrderRequest{Ticker: "TRXUSDT", Side: "buy", Type: exchange.OrderPostOnly, Size: 10, Price: 0.21})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order := getOrder(t, e, ordID); order.State != "canceled" || order.FillSize != 0 {
+		t.Errorf("expected a crossing post-only order to be canceled, got %+v", order)
+	}
+	expectBalance(t, e, "USDT", 100-24.975)
+}
+
+func TestOrdersReserveBalances(t *testing.T) {
+	e, _ := newTestExchange(t, Config{})
+	if _, err := e.PlaceOrder(exchange.OrderRequest{Ticker: "TRXUSDT", Side: "buy", Size: 100, Price: 0.25}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A resting buy reserves its cost, and an amend reprices the reservation
+	buyID, err := e.PlaceOrder(exchange.OrderRequest{Ticker: "TRXUSDT", Side: "buy", Size: 100, Price: 0.2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectBalance(t, e, "USDT", 55)
+	if err := e.AmendOrder("TRXUSDT", buyID, 0.21); err != nil {
+		t.Fatal(err)
+	}
+	expectBalance(t, e, "USDT", 54)
+
+	// Resting sells and algo orders hold the coins they'd sell, which still
+	// count toward the position
+	sellID, err := e.PlaceOrder(exchange.OrderRequest{Ticker: "TRXUSDT", Side: "sell", Size: 50, Price: 0.3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	algoID, err := e.PlaceAlgoOrder(exchange.AlgoRequest{Ticker: "TRXUSDT", Side: "sell", Size: 40, StopLoss: 0.2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectBalance(t, e, "TRX", 10)
+	positions, err := e.GetPositions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(positions["TRXUSDT"], 100) {
+		t.Errorf("expected a position of 100 TRX, got %v", positions["TRXUSDT"])
+	}
+	if _, err := e.PlaceOrder(exchange.OrderRequest{Ticker: "TRXUSDT", Side: "sell", Size: 20, Price: 0.3}); err == nil {
+		t.Error("expected a sell of reserved coins to be rejected")
+	}
+	if _, err := e.PlaceOrder(exchange.OrderRequest{Ticker: "TRXUSDT", Side: "buy", Size: 300, Price: 0.2}); err == nil {
+		t.Error("expected a buy of more than the free USDT to be rejected")
+	}
+
+	// Canceling gives everything back
+	if err := e.CancelOrder("TRXUSDT", buyID); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.CancelOrder("TRXUSDT", sellID); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.CancelAlgoOrders("TRXUSDT", []string{algoID}); err != nil {
+		t.Fatal(err)
+	}
+	expectBalance(t, e, "USDT", 75)
+	expectBalance(t, e, "TRX", 100)
+	if err := e.CancelOrder("TRXUSDT", buyID); err == nil {
+		t.Error("expected canceling a canceled order to fail")
+	}
+}
+
+func TestPartialFills(t *testing.T) {
+	e, m := newTestExchange(t, Config{TakerFee: 0.001, MakerFee: 0.002, FillRatio: 0.5})
+
+	// Half fills when the order crosses; the rest waits for the price
+	ordID, err := e.PlaceOrder(exchange.OrderRequest{Ticker: "TRXUSDT", Side: "buy", Size: 100, Price: 0.26})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.prices["TRXUSDT"] = 0.3
+	order := getOrder(t, e, ordID)
+	if order.State != "partially_filled" || order.FillSize != 50 || order.AvgPrice != 0.26 || !near(order.Fee, 13*0.001) {
+		t.Fatalf("expected 50 of 100 TRX filled at 0.26, got %+v", order)
+	}
+	expectBalance(t, e, "TRX", 50*(1-0.001))
+	expectBalance(t, e, "USDT", 74)
+
+	// Only the unfilled half is repriced and released
+	if err := e.AmendOrder("TRXUSDT", ordID, 0.27); err != nil {
+		t.Fatal(err)
+	}
+	expectBalance(t, e, "USDT", 73.5)
+	result, err := exchange.Chase(e, "TRXUSDT", ordID, exchange.ChasePolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Outcome != "partial" || result.Order.FillSize != 50 {
+		t.Errorf("expected the order to end partially filled, got %+v", result)
+	}
+	expectBalance(t, e, "USDT", 87)
+
+	// The rest fills as a maker once the price comes back
+	ordID, err = e.PlaceOrder(exchange.OrderRequest{Ticker: "TRXUSDT", Side: "buy", Size: 10, Price: 0.35})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.prices["TRXUSDT"] = 0.34
+	order = getOrder(t, e, ordID)
+	if order.State != "filled" || order.FillSize != 10 || !near(order.AvgPrice, 0.35) || !near(order.Fee, 1.75*0.001+1.75*0.002) {
+		t.Errorf("expected the order filled half as taker and half as maker, got %+v", order)
+	}
+	expectBalance(t, e, "TRX", 50*(1-0.001)+5*(1-0.001)+5*(1-0.002))
+}
@@ -0,0 +1,132 @@
+// Package pnl keeps the tax lots of a position from its fills and works out
+// its cost basis and realized and unrealized profit. Amounts are in the
+// pair's quote currency, and fees count against the position: a buy's fee
+// is paid in the coin received, so the lot holds less than was bought for
+// the same cost, and a sell's fee comes out of its proceeds.
+package pnl
+
+import (
+	"crypto_trader/config"
+	"time"
+)
+
+// Lot is a buy, or what is left of it after sells.
+type Lot struct {
+	Opened time.Time
+	Size   float64 // base currency held
+	Cost   float64 // what Size cost, fees included
+}
+
+// Book matches sells against the lots bought before them, oldest first with
+// FIFO, or against their pooled average cost.
+type Book struct {
+	method string
+	lots   []Lot
+
+	Realized float64 // profit of sells over the cost of what they sold
+	Bought   float64 // cost of every buy
+	Fees     float64
+}
+
+// dust is the smallest lot kept after a sell, below which float rounding
+// would leave phantom holdings.
+const dust = 1e-12
+
+func NewBook(method string) *Book {
+	if method == "" {
+		method = config.PnLFIFO
+	}
+	return &Book{method: method}
+}
+
+// Buy adds a lot of size bought at price, fee included.
+func (b *Book) Buy(at time.Time, size, price, fee float64) {
+	if size <= 0 || price <= 0 {
+		return
+	}
+	lot := Lot{Opened: at, Size: size - fee/price, Cost: size * price}
+	b.Bought += lot.Cost
+	b.Fees += fee
+	if b.method == config.PnLAverageCost && len(b.lots) > 0 {
+		// One pooled lot, dated by its first buy
+		b.lots[0].Size += lot.Size
+		b.lots[0].Cost += lot.Cost
+		return
+	}
+	b.lots = append(b.lots, lot)
+}
+
+// Sell takes size out of the lots and returns the profit it realized. A
+// sell of more than the lots hold only realizes the part they cover.
+func (b *Book) Sell(size, price, fee float64) float64 {
+	if size <= 0 {
+		return 0
+	}
+	b.Fees += fee
+	proceeds := size*price - fee
+	var matched, basis float64
+	for len(b.lots) > 0 && matched < size {
+		lot := &b.lots[0]
+		take := min(lot.Size, size-matched)
+		cost := lot.Cost * take / lot.Size
+		matched += take
+		basis += cost
+		lot.Size -= take
+		lot.Cost -= cost
+		if lot.Size <= dust {
+			b.lots = b.lots[1:]
+		}
+	}
+	realized := proceeds*matched/size - basis
+	b.Realized += realized
+	return realized
+}
+
+// Lots are the open lots, oldest first.
+func (b *Book) Lots() []Lot {
+	return append([]Lot(nil), b.lots...)
+}
+
+// Size is how much of the base currency the lots hold.
+func (b *Book) Size() float64 {
+	var size float64
+	for _, lot := range b.lots {
+		size += lot.Size
+	}
+	return size
+}
+
+// CostBasis is what the open lots cost.
+func (b *Book) CostBasis() float64 {
+	var cost float64
+	for _, lot := range b.lots {
+		cost += lot.Cost
+	}
+	return cost
+}
+
+// AvgEntry is the cost basis per coin held, 0 when nothing is.
+func (b *Book) AvgEntry() float64 {
+	if size := b.Size(); size > 0 {
+		return b.CostBasis() / size
+	}
+	return 0
+}
+
+// Unrealized is what the open lots would gain or lose if sold at price,
+// before fees.
+func (b *Book) Unrealized(price float64) float64 {
+	if price <= 0 {
+		return 0
+	}
+	return b.Size()*price - b.CostBasis()
+}
+
+// Return is the realized and unrealized profit at price as a fraction of
+// everything bought.
+func (b *Book) Return(price float64) float64 {
+	if b.Bought == 0 {
+		return 0
+	}
+	return (b.Realized + b.Unrealized(price)) / b.Bought
+}
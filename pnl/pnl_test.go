@@ -0,0 +1,58 @@
+package pnl
+
+import (
+	"crypto_trader/config"
+	"math"
+	"testing"
+	"time"
+)
+
+func near(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+
+// Two buys then a sell of the first one's size: FIFO sells the cheap lot,
+// average cost sells at the blended price.
+func TestMethods(t *testing.T) {
+	tests := []struct {
+		method               string
+		realized, basis      float64
+		avgEntry, unrealized float64
+	}{
+		{config.PnLFIFO, 10, 120, 12, 30},
+		{config.PnLAverageCost, 0, 110, 11, 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			b := NewBook(tt.method)
+			b.Buy(time.Unix(1, 0), 10, 10, 0)
+			b.Buy(time.Unix(2, 0), 10, 12, 0)
+			if got := b.Sell(10, 11, 0); !near(got, tt.realized) {
+				t.Errorf("realized %v, want %v", got, tt.realized)
+			}
+			if !near(b.Size(), 10) || !near(b.CostBasis(), tt.basis) || !near(b.AvgEntry(), tt.avgEntry) {
+				t.Errorf("got size %v, basis %v, entry %v, want 10, %v, %v", b.Size(), b.CostBasis(), b.AvgEntry(), tt.basis, tt.avgEntry)
+			}
+			if got := b.Unrealized(15); !near(got, tt.unrealized) {
+				t.Errorf("unrealized %v, want %v", got, tt.unrealized)
+			}
+		})
+	}
+}
+
+func TestFeesCountAgainstThePosition(t *testing.T) {
+	b := NewBook(config.PnLFIFO)
+	// The 1 USDT fee is taken as 0.1 of the coin bought
+	b.Buy(time.Unix(1, 0), 10, 10, 1)
+	if !near(b.Size(), 9.9) || !near(b.CostBasis(), 100) {
+		t.Fatalf("expected 9.9 held at a cost of 100, got %v at %v", b.Size(), b.CostBasis())
+	}
+	// An open position at an unchanged price is down only by its fee
+	if got := b.Return(10); !near(got, -0.01) {
+		t.Errorf("expected -1%% open at the entry price, got %v", got)
+	}
+	if got := b.Sell(9.9, 12, 1); !near(got, 9.9*12-1-100) {
+		t.Errorf("realized %v, want %v", got, 9.9*12-1-100)
+	}
+	if len(b.Lots()) != 0 || b.Unrealized(12) != 0 || !near(b.Fees, 2) {
+		t.Errorf("expected the position closed with 2 in fees, got lots %+v, fees %v", b.Lots(), b.Fees)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto_trader/config"
+	"crypto_trader/db"
+	"crypto_trader/exchange"
+	"crypto_trader/indicator"
+	"fmt"
+	"log"
+	"math"
+)
+
+// protectionATR is ticker's current ATR over the candles p describes.
+func protectionATR(p config.Protection, ticker string) (float64, error) {
+	bar, period := p.Bar, p.Period
+	if bar == "" {
+		bar = "1H"
+	}
+	if period == 0 {
+		period = 14
+	}
+	// ATR's smoothing settles with a few periods of history
+	candles, err := ex.GetCandles(ticker, bar, period*3+1)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get candles: %v", err)
+	}
+	high := make([]float64, len(candles))
+	low := make([]float64, len(candles))
+	closes := make([]float64, len(candles))
+	for i, c := range candles {
+		high[i], low[i], closes[i] = c.High, c.Low, c.Close
+	}
+	atr := indicator.ATR(high, low, closes, period)
+	if atr == 0 {
+		return 0, fmt.Errorf("not enough %s candles for a %d bar ATR", bar, period)
+	}
+	return atr, nil
+}
+
+// protectionLevels are the stop-loss and take-profit trigger prices for a
+// strategy's position in ticker bought at entry, 0 for a side that is off.
+func protectionLevels(strategy, ticker string, entry float64) (float64, float64, error) {
+	p := cfg.ProtectionFor(strategy, ticker)
+	var atr float64
+	if p.StopLossATR > 0 || p.TakeProfitATR > 0 {
+		var err error
+		if atr, err = protectionATR(p, ticker); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	var stopLoss, takeProfit float64
+	switch {
+	case p.StopLoss > 0:
+		stopLoss = entry * (1 - p.StopLoss)
+	case p.StopLossATR > 0:
+		stopLoss = entry - p.StopLossATR*atr
+	}
+	switch {
+	case p.TakeProfit > 0:
+		takeProfit = entry * (1 + p.TakeProfit)
+	case p.TakeProfitATR > 0:
+		takeProfit = entry + p.TakeProfitATR*atr
+	}
+	if stopLoss < 0 {
+		stopLoss = 0
+	}
+	return stopLoss, takeProfit, nil
+}
+
+// protect places a stop-loss and take-profit covering a strategy's whole
+// position in ticker after a buy filled at entry, and starts its trailing
+// stop.
+func protect(strategy, ticker string, entry float64, ref string) {
+	if cfg.ProtectionFor(strategy, ticker).Trails() {
+		startTrailing(strategy, ticker, entry)
+	}
+	if !cfg.ProtectionFor(strategy, ticker).Enabled() {
+		return
+	}
+	stopLoss, takeProfit, err := protectionLevels(strategy, ticker, entry)
+	if err != nil {
+		log.Printf("Error calculating protection for %s %s: %v", strategy, ticker, err)
+		return
+	}
+	placeProtection(strategy, ticker, stopLoss, takeProfit, ref)
+}
+
+// placeProtection replaces a strategy's protective orders in ticker with one
+// covering its current position at the given trigger prices.
+func placeProtection(strategy, ticker string, stopLoss, takeProfit float64, ref string) {
+	if stopLoss <= 0 && takeProfit <= 0 {
+		return
+	}
+	// The old orders hold the coins the new one needs
+	if _, err := unprotect(strategy, ticker); err != nil {
+		log.Printf("Error replacing protection for %s %s: %v", strategy, ticker, err)
+		return
+	}
+	state, err := db.GetState(strategy, ticker)
+	if err != nil {
+		log.Printf("Error getting state for %s %s: %v", strategy, ticker, err)
+		return
+	}
+	inst, _ := exchange.ParseTicker(ticker)
+	size := state.Position
+	if inst.LotSize > 0 {
+		size = math.Floor(size/inst.LotSize+1e-9) * inst.LotSize
+	}
+	if size <= 0 {
+		log.Printf("Nothing left of %s for %s to protect", ticker, strategy)
+		return
+	}
+
+	clOrdID := ref + "p"
+	algoID, err := ex.PlaceAlgoOrder(exchange.AlgoRequest{
+		Ticker:     ticker,
+		Side:       "sell",
+		Size:       size,
+		LotSize:    inst.LotSize,
+		StopLoss:   stopLoss,
+		TakeProfit: takeProfit,
+		ClOrdID:    clOrdID,
+	})
+	if err != nil {
+		log.Printf("Error placing protection for %s %s: %v", strategy, ticker, err)
+		return
+	}
+	err = db.RecordProtectiveOrder(db.ProtectiveOrder{
+		Strategy:   strategy,
+		Ticker:     ticker,
+		AlgoID:     algoID,
+		ClOrdID:    clOrdID,
+		Size:       size,
+		StopLoss:   stopLoss,
+		TakeProfit: takeProfit,
+	})
+	if err != nil {
+		log.Printf("Error recording protective order %s: %v", algoID, err)
+	}
+	log.Printf("Protected %s %s: size=%.8f stop-loss=%.8f take-profit=%.8f algoId=%s", strategy, ticker, size, stopLoss, takeProfit, algoID)
+}
+
+// pendingProtection returns a strategy's recorded protective orders in
+// ticker that are still pending on the exchange. The rest are marked closed
+// and returned as closed: a stop-loss or take-profit has sold the position.
+func pendingProtection(strategy, ticker string) (pending, closed []db.ProtectiveOrder, err error) {
+	live, err := db.GetLiveProtectiveOrders(strategy, ticker)
+	if err != nil || len(live) == 0 {
+		return nil, nil, err
+	}
+	algos, err := ex.GetAlgoOrders(ticker)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get algo orders: %v", err)
+	}
+	onExchange := make(map[string]bool)
+	for _, a := range algos {
+		onExchange[a.AlgoID] = true
+	}
+	for _, p := range live {
+		if onExchange[p.AlgoID] {
+			pending = append(pending, p)
+			continue
+		}
+		log.Printf("Protective order %s for %s %s is no longer pending, marking it closed", p.AlgoID, strategy, ticker)
+		if err := db.UpdateProtectiveOrderStatus(p.AlgoID, "closed"); err != nil {
+			log.Printf("Error updating protective order %s: %v", p.AlgoID, err)
+		}
+		closed = append(closed, p)
+	}
+	return pending, closed, nil
+}
+
+// recordTriggered records the sale a closed protective order made as the
+// strategy's transaction, as the private stream does when it is on; both
+// write the same order's row.
+func recordTriggered(strategy string, p db.ProtectiveOrder) {
+	algo, err := ex.GetAlgoOrder(p.Ticker, p.AlgoID)
+	if err != nil {
+		log.Printf("Error getting protective order %s: %v", p.AlgoID, err)
+		return
+	}
+	if algo.OrdID == "" {
+		log.Printf("Protective order %s for %s %s placed no order (state %s)", p.AlgoID, strategy, p.Ticker, algo.State)
+		return
+	}
+	order, err := exchange.WaitForOrder(ex, p.Ticker, algo.OrdID, chasePolicy.Interval, chasePolicy.PollInterval)
+	if err != nil {
+		log.Printf("Error getting order %s placed by protective order %s: %v", algo.OrdID, p.AlgoID, err)
+		return
+	}
+	if order.FillSize == 0 {
+		return
+	}
+	value := order.FillSize * order.AvgPrice
+	if err := db.UpsertTransaction(algo.OrdID, strategy, p.Ticker, algo.Side, order.FillSize, order.AvgPrice, value, order.Fee); err != nil {
+		log.Printf("Error recording transaction for order %s: %v", algo.OrdID, err)
+		return
+	}
+	log.Printf("Protective order %s for %s %s sold %.8f at %.8f in order %s", p.AlgoID, strategy, p.Ticker, order.FillSize, order.AvgPrice, algo.OrdID)
+}
+
+// unprotect cancels a strategy's protective orders in ticker so its coins
+// can be sold. It returns the last order it canceled, if any, so the rest of
+// a trimmed position can be protected at the same prices.
+func unprotect(strategy, ticker string) (db.ProtectiveOrder, error) {
+	pending, closed, err := pendingProtection(strategy, ticker)
+	for _, p := range closed {
+		recordTriggered(strategy, p)
+	}
+	if err != nil || len(pending) == 0 {
+		return db.ProtectiveOrder{}, err
+	}
+	ids := make([]string, len(pending))
+	for i, p := range pending {
+		ids[i] = p.AlgoID
+	}
+	if err := ex.CancelAlgoOrders(ticker, ids); err != nil {
+		return db.ProtectiveOrder{}, fmt.Errorf("failed to cancel protective orders: %v", err)
+	}
+	for _, id := range ids {
+		if err := db.UpdateProtectiveOrderStatus(id, "canceled"); err != nil {
+			log.Printf("Error updating protective order %s: %v", id, err)
+		}
+	}
+	log.Printf("Canceled protective orders %v for %s %s", ids, strategy, ticker)
+	return pending[len(pending)-1], nil
+}
+
+// syncProtection records the sale and moves a strategy to the sell state
+// once a stop-loss or take-profit has closed its position in ticker, so the
+// next buy signal opens a new one. It returns the updated state.
+func syncProtection(strategy, ticker string, state db.State) db.State {
+	if state.Position <= 0 {
+		return state
+	}
+	_, closed, err := pendingProtection(strategy, ticker)
+	if err != nil {
+		log.Printf("Error checking protection for %s %s: %v", strategy, ticker, err)
+		return state
+	}
+	if len(closed) == 0 {
+		return state
+	}
+	for _, p := range closed {
+		recordTriggered(strategy, p)
+	}
+	positions, err := ex.GetPositions()
+	if err != nil {
+		log.Printf("Error getting positions: %v", err)
+		return state
+	}
+	state.Position = nettedPosition(strategy, ticker, state.Position, 0, positions[ticker])
+	state.Signal = "sell"
+	db.UpdateState(strategy, ticker, state.Signal, state.Position)
+	stopTrailing(strategy, ticker)
+	log.Printf("Protection closed %s %s, updated state: Signal=%s, Position=%.8f", strategy, ticker, state.Signal, state.Position)
+	return state
+}
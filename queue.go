@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto_trader/clock"
+	"crypto_trader/db"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// portfolioMu is held while an alert reads balances, sizes and places its
+// orders, so two tickers never size against the same funds.
+var portfolioMu sync.Mutex
+
+// alertQueued wakes an idle worker when an alert is enqueued.
+var alertQueued = make(chan struct{}, 1)
+
+func notifyWorkers() {
+	select {
+	case alertQueued <- struct{}{}:
+	default:
+	}
+}
+
+// dedupeKey identifies repeats of an alert: by the sender's id, else by its
+// timestamp, else by the exact body. Keys only match within the dedupe window.
+func dedupeKey(alert Alert, body []byte) string {
+	if alert.ID != "" {
+		return "id:" + alert.ID
+	}
+	if alert.Timestamp != "" {
+		return fmt.Sprintf("ts:%s:%s:%s:%s", alertStrategy(alert), alert.Ticker, alert.Signal, alert.Timestamp)
+	}
+	sum := sha256.Sum256(body)
+	return "body:" + hex.EncodeToString(sum[:])
+}
+
+// enqueueAlert stores an alert for the workers and returns its ID. A repeat
+// of an alert queued within the dedupe window isn't stored; the first
+// alert's ID is returned instead.
+func enqueueAlert(alert Alert, key string) (int64, bool, error) {
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return 0, false, err
+	}
+	id, duplicate, err := db.EnqueueAlert(alert.Ticker, alert.Signal, string(payload), key, clock.Now().Add(-cfg.DedupeWindow))
+	if err != nil {
+		return 0, false, err
+	}
+	if !duplicate {
+		notifyWorkers()
+	}
+	return id, duplicate, nil
+}
+
+// orderRef is the client order ID prefix for an alert's orders. It only
+// depends on the stored alert, so it is the same every time the alert is
+// processed, and the creation time keeps it unique if the database is reset.
+func orderRef(record db.Alert) string {
+	return fmt.Sprintf("ct%da%d", record.CreatedAt.Unix(), record.ID)
+}
+
+// startWorkers starts n workers taking alerts off the queue. Alerts for the
+// same ticker are processed one at a time in the order they arrived. The
+// returned function stops the workers once their current alerts finish.
+func startWorkers(n int) func() {
+	if n < 1 {
+		n = 1
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker(stop)
+		}()
+	}
+	return func() {
+		close(stop)
+		wg.Wait()
+	}
+}
+
+func worker(stop chan struct{}) {
+	poll := time.NewTicker(time.Second)
+	defer poll.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		record, ok, err := db.ClaimAlert()
+		if err != nil {
+			log.Printf("Error claiming alert: %v", err)
+		}
+		if !ok {
+			select {
+			case <-stop:
+				return
+			case <-alertQueued:
+			case <-poll.C:
+			}
+			continue
+		}
+		// There may be more queued for other tickers
+		notifyWorkers()
+		runAlert(record)
+	}
+}
+
+func runAlert(record db.Alert) {
+	var alert Alert
+	status, result := "done", ""
+	if err := json.Unmarshal([]byte(record.Payload), &alert); err != nil {
+		status, result = "failed", fmt.Sprintf("invalid payload: %v", err)
+	} else {
+		log.Printf("Processing alert %d: Ticker=%s, Signal=%s", record.ID, alert.Ticker, alert.Signal)
+		result, err = processAlert(alert, orderRef(record))
+		if err != nil {
+			status, result = "failed", err.Error()
+		}
+	}
+	log.Printf("Alert %d %s: %s", record.ID, status, result)
+	if err := db.CompleteAlert(record.ID, status, result); err != nil {
+		log.Printf("Error completing alert %d: %v", record.ID, err)
+	}
+}
+
+// waitForAlert polls an alert until it is done or failed or timeout passes.
+// With no timeout it reads the alert once.
+func waitForAlert(id int64, timeout time.Duration) (db.Alert, bool) {
+	deadline := time.Now().Add(timeout)
+	for {
+		record, err := db.GetAlert(id)
+		if err == nil && (record.Status == "done" || record.Status == "failed") {
+			return record, true
+		}
+		if time.Now().After(deadline) {
+			return record, false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+type alertStatus struct {
+	ID        int64     `json:"id"`
+	Ticker    string    `json:"ticker"`
+	Signal    string    `json:"signal"`
+	Status    string    `json:"status"`
+	Result    string    `json:"result,omitempty"`
+	Duplicate bool      `json:"duplicate,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func writeAlertStatus(w http.ResponseWriter, code int, a db.Alert, duplicate bool) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(alertStatus{
+		ID:        a.ID,
+		Ticker:    a.Ticker,
+		Signal:    a.Signal,
+		Status:    a.Status,
+		Result:    a.Result,
+		Duplicate: duplicate,
+		CreatedAt: a.CreatedAt,
+		UpdatedAt: a.UpdatedAt,
+	})
+}
+
+// alertsHandler reports where a queued alert is: GET /alerts?id=42. Like
+// /admin, it needs the ADMIN_TOKEN bearer token.
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	if !authenticateAdmin(r) {
+		log.Printf("Rejected unauthenticated alert status request from %s", clientIP(r))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid alert id", http.StatusBadRequest)
+		return
+	}
+	record, err := db.GetAlert(id)
+	if err != nil {
+		http.Error(w, "Alert not found", http.StatusNotFound)
+		return
+	}
+	writeAlertStatus(w, http.StatusOK, record, false)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto_trader/exchange"
+	"fmt"
+	"log"
+)
+
+// minOrderValueUSDT is OKX's minimum order value, which the bot applies to
+// every pair after converting it to the pair's quote currency.
+const minOrderValueUSDT = 10.0
+
+type quoteBalance struct {
+	Ccy      string
+	Balance  float64
+	USDTRate float64
+}
+
+// quoteCurrencies lists the distinct quote currencies of the configured pairs.
+func quoteCurrencies() []string {
+	var quotes []string
+	seen := make(map[string]bool)
+	for _, ticker := range cfg.Tickers() {
+		inst, ok := exchange.ParseTicker(ticker)
+		if ok && !seen[inst.Quote] {
+			seen[inst.Quote] = true
+			quotes = append(quotes, inst.Quote)
+		}
+	}
+	return quotes
+}
+
+// streamedTickers are the pairs the market data feed subscribes to: every
+// configured pair plus the USDT pairs that price its quote currencies.
+func streamedTickers() []string {
+	tickers := cfg.Tickers()
+	seen := make(map[string]bool)
+	for _, ticker := range tickers {
+		seen[ticker] = true
+	}
+	for _, quote := range quoteCurrencies() {
+		if quote != "USDT" && !seen[quote+"USDT"] {
+			tickers = append(tickers, quote+"USDT")
+		}
+	}
+	return tickers
+}
+
+// quoteToUSDT is the USDT value of one unit of ccy, or 0 if it can't be priced.
+func quoteToUSDT(ccy string) float64 {
+	if ccy == "USDT" {
+		return 1
+	}
+	return getCurrentPrice(ccy + "USDT")
+}
+
+// minOrderValue is the 10 USDT minimum order value in the given quote currency.
+func minOrderValue(quote string) (float64, error) {
+	rate := quoteToUSDT(quote)
+	if rate == 0 {
+		return 0, fmt.Errorf("no USDT price for %s", quote)
+	}
+	return minOrderValueUSDT / rate, nil
+}
+
+// accountValue totals every quote balance and configured position in USDT.
+// A quote currency that is also traded as a base (BTC in BTCUSDT and ETHBTC)
+// is only counted once, through its position.
+func accountValue(positions, prices map[string]float64) (float64, []quoteBalance) {
+	bases := make(map[string]bool)
+	for _, ticker := range cfg.Tickers() {
+		if inst, ok := exchange.ParseTicker(ticker); ok {
+			bases[inst.Base] = true
+		}
+	}
+
+	rates := make(map[string]float64)
+	var balances []quoteBalance
+	var total float64
+	for _, quote := range quoteCurrencies() {
+		rates[quote] = quoteToUSDT(quote)
+		balance, err := ex.GetSpotBalance(quote)
+		if err != nil {
+			log.Printf("Error getting %s balance: %v", quote, err)
+		}
+		balances = append(balances, quoteBalance{Ccy: quote, Balance: balance, USDTRate: rates[quote]})
+		if !bases[quote] {
+			total += balance * rates[quote]
+		}
+	}
+
+	for _, ticker := range cfg.Tickers() {
+		inst, ok := exchange.ParseTicker(ticker)
+		if !ok {
+			continue
+		}
+		total += positions[ticker] * prices[ticker] * rates[inst.Quote]
+	}
+	return total, balances
+}
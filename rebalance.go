@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto_trader/clock"
+	"crypto_trader/db"
+	"crypto_trader/exchange"
+	"crypto_trader/sizing"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rebalanceMu stops two rebalances from running at once.
+var rebalanceMu sync.Mutex
+
+var errRebalanceRunning = errors.New("a rebalance is already running")
+
+// rebalanceTrade is one order a rebalance placed.
+type rebalanceTrade struct {
+	Strategy string  `json:"strategy"`
+	Ticker   string  `json:"ticker"`
+	Side     string  `json:"side"`
+	Size     float64 `json:"size"`
+	Filled   float64 `json:"filled"`
+	Drift    float64 `json:"drift"` // weight above (+) or below (-) the target, as a fraction of equity
+	Error    string  `json:"error,omitempty"`
+}
+
+// rebalance trades each strategy's pairs in buy state back to the positions
+// its sizer targets, wherever they have drifted by more than the threshold.
+// Like an alert, it holds the portfolio lock while it reads balances, sizes
+// and places each order, and releases it while the order fills.
+func rebalance() ([]rebalanceTrade, error) {
+	if !rebalanceMu.TryLock() {
+		return nil, errRebalanceRunning
+	}
+	defer rebalanceMu.Unlock()
+
+	log.Printf("Starting rebalance (threshold %.4f)", cfg.Rebalance.Threshold)
+	// Paused pairs and buys in close-only mode are skipped leg by leg below
+	controls, err := db.GetControls()
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	if c, ok := controls[db.ControlHalt]; ok {
+		return nil, fmt.Errorf("trading blocked: %s", withReason("trading is halted", c))
+	}
+	prices := getCurrentPrices(cfg.Tickers())
+
+	// Client order IDs only need to be unique per run, so each strategy and
+	// quote currency gets its own prefix
+	ref := fmt.Sprintf("rb%d", clock.Now().Unix())
+	var trades []rebalanceTrade
+	for i, strategy := range cfg.StrategyNames() {
+		for j, quote := range quoteCurrencies() {
+			t, err := rebalanceQuote(strategy, quote, prices, fmt.Sprintf("%ss%dq%d", ref, i, j))
+			trades = append(trades, t...)
+			if err != nil {
+				log.Printf("Error rebalancing %s %s pairs: %v", strategy, quote, err)
+				return trades, err
+			}
+		}
+	}
+
+	if len(trades) > 0 {
+		if positions, err := ex.GetPositions(); err == nil {
+			totalAccountValue, _ := accountValue(positions, getCurrentPrices(cfg.Tickers()))
+			db.RecordAccountValue(totalAccountValue)
+			log.Printf("Recorded total account value: %f USDT", totalAccountValue)
+		}
+	}
+	log.Printf("Rebalance finished with %d orders", len(trades))
+	return trades, nil
+}
+
+// rebalanceQuote rebalances one strategy's buy-state pairs quoted in quote.
+// Overweight pairs are trimmed first so their proceeds can fund top-ups.
+func rebalanceQuote(strategy, quote string, prices map[string]float64, ref string) ([]rebalanceTrade, error) {
+	portfolioMu.Lock()
+	legs, err := rebalanceLegs(strategy, quote, prices)
+	portfolioMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var trades []rebalanceTrade
+	for _, leg := range legs {
+		trade, placed, err := rebalanceLeg(strategy, leg, prices[leg.Ticker], fmt.Sprintf("%sp%d", ref, len(trades)))
+		if err != nil {
+			return trades, err
+		}
+		if placed {
+			trades = append(trades, trade)
+		}
+	}
+	return trades, nil
+}
+
+// rebalanceLegs works out the trades that bring a strategy's buy-state pairs
+// quoted in quote back to their targets, trims first. Callers hold
+// portfolioMu.
+func rebalanceLegs(strategy, quote string, prices map[string]float64) ([]rebalanceTrade, error) {
+	var states []db.State
+	var buys int
+	for _, ticker := range cfg.Tickers() {
+		if inst, ok := exchange.ParseTicker(ticker); !ok || inst.Quote != quote {
+			continue
+		}
+		state, err := db.GetState(strategy, ticker)
+		if err != nil {
+			return nil, fmt.Errorf("database error: %v", err)
+		}
+		states = append(states, state)
+		if state.Signal == "buy" {
+			buys++
+		}
+	}
+	if buys == 0 {
+		return nil, nil
+	}
+
+	positions, err := ex.GetPositions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get positions: %v", err)
+	}
+	spotBalance, err := ex.GetSpotBalance(quote)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get balance: %v", err)
+	}
+	cash, err := strategyCash(strategy, quote, spotBalance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get strategy cash: %v", err)
+	}
+
+	// Equity is valued the same way processAlert sizes against it, with each
+	// position capped at what the account really holds
+	held := make(map[string]float64)
+	equity := cash
+	for _, state := range states {
+		held[state.Ticker] = nettedPosition(strategy, state.Ticker, state.Position, 0, positions[state.Ticker])
+		equity += held[state.Ticker] * prices[state.Ticker]
+	}
+	if equity <= 0 {
+		return nil, nil
+	}
+	log.Printf("Rebalancing %s %s pairs: cash=%.8f equity=%.8f buy signals=%d", strategy, quote, cash, equity, buys)
+
+	var legs []rebalanceTrade
+	for _, state := range states {
+		ticker, price := state.Ticker, prices[state.Ticker]
+		if state.Signal != "buy" {
+			continue
+		}
+		if price == 0 {
+			log.Printf("No price for %s, not rebalancing it", ticker)
+			continue
+		}
+		sizer, err := sizing.New(cfg.SizingFor(strategy, ticker), ex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sizing for %s: %v", ticker, err)
+		}
+		// Cash is set to equity so equal weight isn't capped by what happens
+		// to be uninvested; top-ups are limited by the real cash when placed
+		target, err := sizer.Target(sizing.Input{
+			Ticker:     ticker,
+			Price:      price,
+			Cash:       equity,
+			Equity:     equity,
+			Position:   held[ticker],
+			BuySignals: buys - 1,
+		})
+		if err != nil {
+			log.Printf("Error sizing %s for %s: %v", ticker, strategy, err)
+			continue
+		}
+		drift := (held[ticker] - target) * price / equity
+		log.Printf("%s %s: held %.8f, target %.8f, drift %.4f", strategy, ticker, held[ticker], target, drift)
+		if math.Abs(drift) <= cfg.Rebalance.Threshold {
+			continue
+		}
+		leg := rebalanceTrade{Strategy: strategy, Ticker: ticker, Side: "buy", Size: target - held[ticker], Drift: drift}
+		if drift > 0 {
+			leg.Side, leg.Size = "sell", held[ticker]-target
+		}
+		legs = append(legs, leg)
+	}
+	sort.SliceStable(legs, func(i, j int) bool { return legs[i].Side == "sell" && legs[j].Side == "buy" })
+	return legs, nil
+}
+
+// rebalanceLeg places one leg and waits for it to fill. Alerts may have
+// traded since the legs were worked out, so the leg is sized again against
+// the current cash and position under the portfolio lock, which is released
+// once the order is placed. It reports whether an order was placed.
+func rebalanceLeg(strategy string, leg rebalanceTrade, price float64, clOrdID string) (rebalanceTrade, bool, error) {
+	portfolioMu.Lock()
+	locked := true
+	unlock := func() {
+		if locked {
+			portfolioMu.Unlock()
+			locked = false
+		}
+	}
+	defer unlock()
+
+	inst, _ := exchange.ParseTicker(leg.Ticker)
+	state, err := db.GetState(strategy, leg.Ticker)
+	if err != nil {
+		return leg, false, fmt.Errorf("database error: %v", err)
+	}
+	if state.Signal != "buy" {
+		log.Printf("%s %s was sold since the rebalance started, not rebalancing it", strategy, leg.Ticker)
+		return leg, false, nil
+	}
+	if leg.Side == "buy" {
+		spotBalance, err := ex.GetSpotBalance(inst.Quote)
+		if err != nil {
+			return leg, false, fmt.Errorf("failed to get balance: %v", err)
+		}
+		cash, err := strategyCash(strategy, inst.Quote, spotBalance)
+		if err != nil {
+			return leg, false, fmt.Errorf("failed to get strategy cash: %v", err)
+		}
+		leg.Size = math.Min(leg.Size, cash/exchange.LimitPrice("buy", price))
+	} else {
+		positions, err := ex.GetPositions()
+		if err != nil {
+			return leg, false, fmt.Errorf("failed to get positions: %v", err)
+		}
+		leg.Size = math.Min(leg.Size, nettedPosition(strategy, leg.Ticker, state.Position, 0, positions[leg.Ticker]))
+	}
+	if inst.LotSize > 0 {
+		leg.Size = math.Floor(leg.Size/inst.LotSize+1e-9) * inst.LotSize
+	}
+	minOrderValueQuote, err := minOrderValue(inst.Quote)
+	if err != nil {
+		return leg, false, fmt.Errorf("failed to get price: %v", err)
+	}
+	if leg.Size*price < minOrderValueQuote {
+		log.Printf("Rebalancing %s %s needs %.8f, below the minimum order value, skipping", strategy, leg.Ticker, leg.Size)
+		return leg, false, nil
+	}
+
+	if blocked, err := tradingBlocked(leg.Ticker, leg.Side); err != nil || blocked != "" {
+		log.Printf("Not rebalancing %s %s: %s (%v)", leg.Side, leg.Ticker, blocked, err)
+		return leg, false, nil
+	}
+	if open, err := ex.GetOpenOrders(leg.Ticker); err != nil || open {
+		log.Printf("Open orders for %s or failed to check them (%v), not rebalancing it", leg.Ticker, err)
+		return leg, false, nil
+	}
+
+	// A trimmed position keeps the protection prices it had
+	var kept db.ProtectiveOrder
+	if leg.Side == "sell" {
+		if kept, err = unprotect(strategy, leg.Ticker); err != nil {
+			log.Printf("Not rebalancing %s: %v", leg.Ticker, err)
+			return leg, false, nil
+		}
+	}
+
+	log.Printf("Rebalancing %s %s: %s %.8f", strategy, leg.Ticker, leg.Side, leg.Size)
+	req := exchange.OrderRequest{
+		Ticker:  leg.Ticker,
+		Side:    leg.Side,
+		Size:    leg.Size,
+		LotSize: inst.LotSize,
+		ClOrdID: clOrdID,
+	}
+	var order exchange.Order
+	ordID, err := placeOrder(strategy, req)
+	unlock()
+	if err == nil {
+		order, err = settleOrder(strategy, req.Ticker, req.Side, ordID, chasePolicy)
+	}
+	leg.Filled = order.FillSize
+	if err != nil {
+		log.Printf("Failed to rebalance %s %s: %v", strategy, leg.Ticker, err)
+		leg.Error = err.Error()
+	}
+	if order.FillSize == 0 {
+		if kept.AlgoID != "" {
+			placeProtection(strategy, leg.Ticker, kept.StopLoss, kept.TakeProfit, clOrdID)
+		}
+		return leg, true, nil
+	}
+
+	real, err := ex.GetPositions()
+	if err != nil {
+		log.Printf("Error updating positions after rebalance order: %v", err)
+		return leg, true, nil
+	}
+	if state, err = db.GetState(strategy, leg.Ticker); err != nil {
+		log.Printf("Error getting state after rebalance order: %v", err)
+		return leg, true, nil
+	}
+	newPosition := nettedPosition(strategy, leg.Ticker, state.Position, positionChange(order), real[leg.Ticker])
+	db.UpdateState(strategy, leg.Ticker, state.Signal, newPosition)
+	log.Printf("Updated state for %s %s: Position=%.8f", strategy, leg.Ticker, newPosition)
+	if leg.Side == "buy" {
+		protect(strategy, leg.Ticker, order.AvgPrice, clOrdID)
+	} else if kept.AlgoID != "" {
+		placeProtection(strategy, leg.Ticker, kept.StopLoss, kept.TakeProfit, clOrdID)
+	}
+	return leg, true, nil
+}
+
+// rebalanceHandler runs a rebalance on POST /rebalance. It is authenticated
+// like a webhook alert: a passphrase in the JSON body or an X-Signature header.
+func rebalanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Passphrase string `json:"passphrase"`
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+			return
+		}
+	}
+	if !authenticateAlert(r, body, req.Passphrase) {
+		log.Printf("Rejected unauthenticated rebalance from %s", clientIP(r))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	trades, err := rebalance()
+	status := http.StatusOK
+	resp := struct {
+		Trades []rebalanceTrade `json:"trades"`
+		Error  string           `json:"error,omitempty"`
+	}{Trades: trades}
+	if errors.Is(err, errRebalanceRunning) {
+		status = http.StatusConflict
+	} else if err != nil {
+		status = http.StatusInternalServerError
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	if resp.Trades == nil {
+		resp.Trades = []rebalanceTrade{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// startRebalancer rebalances every interval until the returned function is
+// called.
+func startRebalancer(interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	stop := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if _, err := rebalance(); err != nil {
+					log.Printf("Scheduled rebalance failed: %v", err)
+				}
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
@@ -0,0 +1,236 @@
+// Package risk checks every order against the account-wide limits in the
+// config before it reaches the exchange. Check is pure so the rules can be
+// tested on their own; Guard gathers what they need and wraps an Exchange.
+package risk
+
+import (
+	"crypto_trader/clock"
+	"crypto_trader/config"
+	"crypto_trader/db"
+	"crypto_trader/exchange"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Rules a Rejection can name.
+const (
+	RuleMaxPairNotional  = "max_pair_notional"
+	RuleMaxExposure      = "max_exposure"
+	RuleMaxOrdersPerHour = "max_orders_per_hour"
+	RuleMaxDailyLoss     = "max_daily_loss"
+	RuleMaxOpenPairs     = "max_open_pairs"
+)
+
+// OpenPairValue is the least a holding is worth, in USDT, for its pair to
+// count as open. Smaller ones are dust left over by lot sizes.
+const OpenPairValue = 1.0
+
+// Rejection is returned for an order that would break a limit.
+type Rejection struct {
+	Rule   string
+	Reason string
+}
+
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("rejected by risk limit %s: %s", r.Rule, r.Reason)
+}
+
+// Snapshot is the account an order would be placed against. Values are in
+// USDT.
+type Snapshot struct {
+	PairValue      float64 // held in the order's pair
+	Exposure       float64 // held in every configured pair
+	OpenPairs      int     // pairs holding at least OpenPairValue
+	OrdersLastHour int
+	AccountValue   float64
+	DayStartValue  float64 // the first account value recorded today
+}
+
+// Check returns a *Rejection if an order worth notional USDT would break one
+// of the limits. Sells only reduce exposure, so apart from the order rate
+// they are always allowed, even past the daily loss limit.
+func Check(limits config.Risk, side string, notional float64, s Snapshot) error {
+	if limits.MaxOrdersPerHour > 0 && s.OrdersLastHour >= limits.MaxOrdersPerHour {
+		return &Rejection{RuleMaxOrdersPerHour, fmt.Sprintf("%d orders in the last hour, limit %d", s.OrdersLastHour, limits.MaxOrdersPerHour)}
+	}
+	if side != "buy" {
+		return nil
+	}
+	if limits.MaxDailyLoss > 0 && s.DayStartValue > 0 {
+		if loss := s.DayStartValue - s.AccountValue; loss >= limits.MaxDailyLoss {
+			return &Rejection{RuleMaxDailyLoss, fmt.Sprintf("account lost %.2f USDT today (%.2f to %.2f), limit %.2f", loss, s.DayStartValue, s.AccountValue, limits.MaxDailyLoss)}
+		}
+	}
+	if limits.MaxPairNotional > 0 && s.PairValue+notional > limits.MaxPairNotional {
+		return &Rejection{RuleMaxPairNotional, fmt.Sprintf("buying %.2f USDT would bring the pair to %.2f USDT, limit %.2f", notional, s.PairValue+notional, limits.MaxPairNotional)}
+	}
+	if limits.MaxExposure > 0 && s.Exposure+notional > limits.MaxExposure {
+		return &Rejection{RuleMaxExposure, fmt.Sprintf("buying %.2f USDT would bring crypto exposure to %.2f USDT, limit %.2f", notional, s.Exposure+notional, limits.MaxExposure)}
+	}
+	if limits.MaxOpenPairs > 0 && s.PairValue < OpenPairValue && s.OpenPairs >= limits.MaxOpenPairs {
+		return &Rejection{RuleMaxOpenPairs, fmt.Sprintf("buying would open a pair while %d are held, limit %d", s.OpenPairs, limits.MaxOpenPairs)}
+	}
+	return nil
+}
+
+// Guard is an Exchange whose PlaceOrder refuses orders that break Limits.
+// Rejections are recorded in the risk_rejections table, and with AutoHalt a
+// daily loss rejection switches trading to close-only, so positions can
+// still be sold. If the account can't be read the order
+// is refused too.
+type Guard struct {
+	exchange.Exchange
+	Limits config.Risk
+}
+
+var _ exchange.Exchange = (*Guard)(nil)
+
+func (g *Guard) PlaceOrder(req exchange.OrderRequest) (string, error) {
+	if g.Limits == (config.Risk{}) {
+		return g.Exchange.PlaceOrder(req)
+	}
+
+	price, notional, err := g.notional(req)
+	if err != nil {
+		return "", fmt.Errorf("risk check failed: %v", err)
+	}
+	snapshot, err := g.snapshot(req.Ticker)
+	if err != nil {
+		return "", fmt.Errorf("risk check failed: %v", err)
+	}
+	err = Check(g.Limits, req.Side, notional, snapshot)
+	var rejection *Rejection
+	if errors.As(err, &rejection) {
+		log.Printf("Risk check rejected %s %s %f: %s", req.Side, req.Ticker, req.Size, err)
+		if dbErr := db.RecordRiskRejection(db.RiskRejection{
+			Ticker: req.Ticker,
+			Side:   req.Side,
+			Size:   req.Size,
+			Price:  price,
+			Rule:   rejection.Rule,
+			Reason: rejection.Reason,
+		}); dbErr != nil {
+			log.Printf("Error recording risk rejection: %v", dbErr)
+		}
+		if rejection.Rule == RuleMaxDailyLoss && g.Limits.AutoHalt {
+			log.Printf("Daily loss limit hit, switching to close-only")
+			if dbErr := db.SetControl(db.ControlCloseOnly, true, "risk: "+rejection.Reason); dbErr != nil {
+				log.Printf("Error switching to close-only: %v", dbErr)
+			}
+		}
+		return "", err
+	}
+	return g.Exchange.PlaceOrder(req)
+}
+
+// notional is the price an order would be placed at and its value in USDT.
+func (g *Guard) notional(req exchange.OrderRequest) (float64, float64, error) {
+	last, err := g.GetPrice(req.Ticker)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get price for %s: %v", req.Ticker, err)
+	}
+	price := req.OrderPrice(last)
+	if price == 0 {
+		price = last // market order
+	}
+	inst, _ := exchange.ParseTicker(req.Ticker)
+	rate, err := g.usdtRate(inst.Quote)
+	if err != nil {
+		return 0, 0, err
+	}
+	return price, req.Size * price * rate, nil
+}
+
+func (g *Guard) usdtRate(ccy string) (float64, error) {
+	if ccy == "USDT" {
+		return 1, nil
+	}
+	rate, err := g.GetPrice(ccy + "USDT")
+	if err != nil {
+		return 0, fmt.Errorf("no USDT price for %s: %v", ccy, err)
+	}
+	return rate, nil
+}
+
+// snapshot values the account's holdings at current prices. A quote currency
+// that is also traded as a base is counted once, through its position.
+func (g *Guard) snapshot(ticker string) (Snapshot, error) {
+	var s Snapshot
+	if g.Limits.MaxOrdersPerHour > 0 {
+		n, err := db.CountOrdersSince(clock.Now().Add(-time.Hour))
+		if err != nil {
+			return s, fmt.Errorf("error counting orders: %v", err)
+		}
+		s.OrdersLastHour = n
+	}
+
+	positions, err := g.GetPositions()
+	if err != nil {
+		return s, fmt.Errorf("failed to get positions: %v", err)
+	}
+	bases := make(map[string]bool)
+	quotes := make(map[string]bool)
+	for _, inst := range exchange.Registered() {
+		bases[inst.Base] = true
+		quotes[inst.Quote] = true
+		if positions[inst.Ticker()] <= 0 {
+			continue
+		}
+		price, err := g.GetPrice(inst.Ticker())
+		if err != nil {
+			return s, fmt.Errorf("failed to get price for %s: %v", inst.Ticker(), err)
+		}
+		rate, err := g.usdtRate(inst.Quote)
+		if err != nil {
+			return s, err
+		}
+		value := positions[inst.Ticker()] * price * rate
+		s.Exposure += value
+		if value >= OpenPairValue {
+			s.OpenPairs++
+		}
+		if inst.Ticker() == ticker {
+			s.PairValue = value
+		}
+	}
+
+	if g.Limits.MaxDailyLoss > 0 {
+		s.AccountValue = s.Exposure
+		for quote := range quotes {
+			if bases[quote] {
+				continue
+			}
+			balance, err := g.GetSpotBalance(quote)
+			if err != nil {
+				return s, fmt.Errorf("failed to get %s balance: %v", quote, err)
+			}
+			if balance == 0 {
+				continue
+			}
+			rate, err := g.usdtRate(quote)
+			if err != nil {
+				return s, err
+			}
+			s.AccountValue += balance * rate
+		}
+
+		// Fills record the account's value, but a quiet account can go days
+		// without one, so the first check of the UTC day records the value
+		// the day is measured from
+		year, month, day := clock.Now().UTC().Date()
+		start, ok, err := db.FirstAccountValueSince(time.Date(year, month, day, 0, 0, 0, 0, time.UTC))
+		if err != nil {
+			return s, fmt.Errorf("error getting account value: %v", err)
+		}
+		if !ok {
+			if err := db.RecordAccountValue(s.AccountValue); err != nil {
+				return s, fmt.Errorf("error recording account value: %v", err)
+			}
+			start = s.AccountValue
+		}
+		s.DayStartValue = start
+	}
+	return s, nil
+}
@@ -0,0 +1,49 @@
+package risk
+
+import (
+	"crypto_trader/config"
+	"errors"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	limits := config.Risk{MaxPairNotional: 100, MaxExposure: 500, MaxOrdersPerHour: 10, MaxDailyLoss: 50, MaxOpenPairs: 3}
+	healthy := Snapshot{PairValue: 50, Exposure: 300, OrdersLastHour: 2, AccountValue: 1000, DayStartValue: 1020}
+
+	tests := []struct {
+		name     string
+		side     string
+		notional float64
+		snapshot Snapshot
+		rule     string // "" when the order is allowed
+	}{
+		{"within limits", "buy", 40, healthy, ""},
+		{"pair cap", "buy", 60, healthy, RuleMaxPairNotional},
+		{"exposure cap", "buy", 40, Snapshot{PairValue: 0, Exposure: 480, AccountValue: 1000}, RuleMaxExposure},
+		{"order rate", "sell", 10, Snapshot{OrdersLastHour: 10}, RuleMaxOrdersPerHour},
+		{"daily loss", "buy", 10, Snapshot{AccountValue: 940, DayStartValue: 1000}, RuleMaxDailyLoss},
+		{"sells past the daily loss", "sell", 200, Snapshot{PairValue: 200, Exposure: 600, AccountValue: 900, DayStartValue: 1000}, ""},
+		{"no day start", "buy", 10, Snapshot{AccountValue: 10}, ""},
+		{"open pair cap", "buy", 10, Snapshot{Exposure: 300, OpenPairs: 3}, RuleMaxOpenPairs},
+		{"top-up at the open pair cap", "buy", 10, Snapshot{PairValue: 50, Exposure: 300, OpenPairs: 3}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Check(limits, tt.side, tt.notional, tt.snapshot)
+			var rejection *Rejection
+			switch {
+			case tt.rule == "" && err != nil:
+				t.Errorf("expected the order to be allowed, got %v", err)
+			case tt.rule != "" && (!errors.As(err, &rejection) || rejection.Rule != tt.rule):
+				t.Errorf("expected a %s rejection, got %v", tt.rule, err)
+			}
+		})
+	}
+}
+
+func TestZeroLimitsAllowEverything(t *testing.T) {
+	s := Snapshot{PairValue: 1e6, Exposure: 1e6, OrdersLastHour: 1000, AccountValue: 1, DayStartValue: 1e6}
+	if err := Check(config.Risk{}, "buy", 1e6, s); err != nil {
+		t.Errorf("expected no limits to be enforced, got %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto_trader/strategy"
+	"fmt"
+	"log"
+	"time"
+)
+
+// signalCheckInterval is how often the signal rules are checked for closed
+// bars, and so the most a signal can lag its bar's close.
+const signalCheckInterval = 5 * time.Second
+
+// queueSignal queues a signal from the pairs' indicator rules as an alert.
+// Its comment keeps the indicator values that triggered it.
+func queueSignal(s strategy.Signal) {
+	alert := Alert{
+		Ticker:   s.Ticker,
+		Signal:   s.Signal,
+		Strategy: s.Strategy,
+		Comment:  s.Describe(),
+	}
+	key := fmt.Sprintf("signal:%s:%s:%s:%d", s.Strategy, s.Ticker, s.Rule, s.Close.Unix())
+	id, duplicate, err := enqueueAlert(alert, key)
+	if err != nil {
+		log.Printf("Error queueing %s signal for %s %s: %v", s.Signal, s.Strategy, s.Ticker, err)
+		return
+	}
+	if duplicate {
+		return
+	}
+	log.Printf("Signal %s %s for %s from %s, queued alert %d", s.Signal, s.Ticker, s.Strategy, s.Describe(), id)
+}
@@ -0,0 +1,179 @@
+// Package sizing decides how large a position a buy signal should open when
+// the alert doesn't say. Sizers only see the numbers in Input, plus candles
+// for the volatility-targeted sizer, so each can be tested on its own.
+package sizing
+
+import (
+	"crypto_trader/config"
+	"crypto_trader/exchange"
+	"crypto_trader/indicator"
+	"fmt"
+	"math"
+)
+
+// Input is the account as a strategy sees it, in the pair's quote currency.
+type Input struct {
+	Ticker     string
+	Price      float64
+	Cash       float64 // what the strategy may spend
+	Equity     float64 // Cash plus the strategy's positions in the same quote currency
+	Position   float64 // the strategy's position in the pair, in the base currency
+	BuySignals int     // pairs in the same quote currency the strategy is long
+}
+
+// Sizer returns the position, in the base currency, a strategy should hold
+// in a pair after a buy signal. The caller buys up to it, limited by Cash,
+// or trims down to it.
+type Sizer interface {
+	Target(in Input) (float64, error)
+}
+
+// CandleSource supplies the candles VolTarget measures volatility from.
+type CandleSource interface {
+	GetCandles(ticker, bar string, limit int) ([]exchange.Candle, error)
+}
+
+// New builds the Sizer a config describes.
+func New(cfg config.Sizing, candles CandleSource) (Sizer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	maxFraction := cfg.MaxFraction
+	if maxFraction == 0 {
+		maxFraction = 1
+	}
+	switch cfg.Method {
+	case config.SizingFixedQuote:
+		return FixedQuote{Amount: cfg.Amount}, nil
+	case config.SizingFixedFraction:
+		return FixedFraction{Fraction: cfg.Fraction}, nil
+	case config.SizingVolTarget:
+		v := VolTarget{
+			TargetVol:   cfg.TargetVol,
+			Stdev:       cfg.Volatility == "stdev",
+			Bar:         cfg.Bar,
+			Period:      cfg.Period,
+			MaxFraction: maxFraction,
+			Candles:     candles,
+		}
+		if v.Bar == "" {
+			v.Bar = "1D"
+		}
+		if v.Period == 0 {
+			v.Period = 14
+		}
+		return v, nil
+	case config.SizingKelly:
+		k := Kelly{WinRate: cfg.WinRate, Payoff: cfg.Payoff, Fraction: cfg.Fraction, MaxFraction: maxFraction}
+		if k.Fraction == 0 {
+			k.Fraction = 0.5
+		}
+		return k, nil
+	}
+	return EqualWeight{}, nil
+}
+
+// EqualWeight splits equity evenly between the pairs the strategy is long,
+// counting this one, but never targets more than the cash on hand.
+type EqualWeight struct{}
+
+func (EqualWeight) Target(in Input) (float64, error) {
+	if in.Price <= 0 {
+		return 0, fmt.Errorf("no price for %s", in.Ticker)
+	}
+	allocation := math.Min(in.Cash, in.Equity/float64(in.BuySignals+1))
+	return allocation / in.Price, nil
+}
+
+// FixedQuote holds a position worth Amount of the quote currency.
+type FixedQuote struct {
+	Amount float64
+}
+
+func (f FixedQuote) Target(in Input) (float64, error) {
+	if in.Price <= 0 {
+		return 0, fmt.Errorf("no price for %s", in.Ticker)
+	}
+	return f.Amount / in.Price, nil
+}
+
+// FixedFraction holds a position worth Fraction of equity.
+type FixedFraction struct {
+	Fraction float64
+}
+
+func (f FixedFraction) Target(in Input) (float64, error) {
+	if in.Price <= 0 {
+		return 0, fmt.Errorf("no price for %s", in.Ticker)
+	}
+	return in.Equity * f.Fraction / in.Price, nil
+}
+
+// VolTarget sizes the position so that one bar's typical move, measured by
+// ATR or the stdev of returns, changes equity by TargetVol. Calm markets get
+// larger positions, up to MaxFraction of equity.
+type VolTarget struct {
+	TargetVol   float64
+	Stdev       bool // measure volatility by stdev of returns rather than ATR
+	Bar         string
+	Period      int
+	MaxFraction float64
+	Candles     CandleSource
+}
+
+func (v VolTarget) Target(in Input) (float64, error) {
+	if in.Price <= 0 {
+		return 0, fmt.Errorf("no price for %s", in.Ticker)
+	}
+	vol, err := v.volatility(in.Ticker, in.Price)
+	if err != nil {
+		return 0, err
+	}
+	fraction := math.Min(v.TargetVol/vol, v.MaxFraction)
+	return in.Equity * fraction / in.Price, nil
+}
+
+// volatility is one bar's typical move as a fraction of price.
+func (v VolTarget) volatility(ticker string, price float64) (float64, error) {
+	// ATR's smoothing settles with a few periods of history
+	candles, err := v.Candles.GetCandles(ticker, v.Bar, v.Period*3+1)
+	if err != nil {
+		return 0, fmt.Errorf("error getting candles for %s: %v", ticker, err)
+	}
+	high := make([]float64, len(candles))
+	low := make([]float64, len(candles))
+	closes := make([]float64, len(candles))
+	for i, c := range candles {
+		high[i], low[i], closes[i] = c.High, c.Low, c.Close
+	}
+
+	var vol float64
+	if v.Stdev {
+		vol = indicator.StdDev(indicator.Returns(closes), v.Period)
+	} else {
+		vol = indicator.ATR(high, low, closes, v.Period) / price
+	}
+	if vol <= 0 {
+		return 0, fmt.Errorf("not enough %s candles for %s to measure volatility", v.Bar, ticker)
+	}
+	return vol, nil
+}
+
+// Kelly bets Fraction of the Kelly criterion for a strategy that wins
+// WinRate of its trades with an average win Payoff times its average loss,
+// capped at MaxFraction of equity.
+type Kelly struct {
+	WinRate     float64
+	Payoff      float64
+	Fraction    float64
+	MaxFraction float64
+}
+
+func (k Kelly) Target(in Input) (float64, error) {
+	if in.Price <= 0 {
+		return 0, fmt.Errorf("no price for %s", in.Ticker)
+	}
+	f := (k.WinRate - (1-k.WinRate)/k.Payoff) * k.Fraction
+	f = math.Max(0, math.Min(f, k.MaxFraction))
+	return in.Equity * f / in.Price, nil
+}
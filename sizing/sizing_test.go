@@ -0,0 +1,80 @@
+package sizing
+
+import (
+	"crypto_trader/config"
+	"crypto_trader/exchange"
+	"math"
+	"testing"
+	"time"
+)
+
+// fakeCandles serves bars that each range 2% around a flat price of 100.
+type fakeCandles struct{}
+
+func (fakeCandles) GetCandles(ticker, bar string, limit int) ([]exchange.Candle, error) {
+	candles := make([]exchange.Candle, limit)
+	for i := range candles {
+		close := 100.0
+		if i%2 == 1 {
+			close = 101
+		}
+		candles[i] = exchange.Candle{Time: time.Unix(int64(i)*86400, 0), Open: 100, High: 101, Low: 99, Close: close}
+	}
+	return candles, nil
+}
+
+func TestSizers(t *testing.T) {
+	in := Input{Ticker: "BTCUSDT", Price: 100, Cash: 600, Equity: 1000, BuySignals: 1}
+
+	tests := []struct {
+		name string
+		cfg  config.Sizing
+		want float64
+	}{
+		{"equal weight", config.Sizing{Method: config.SizingEqualWeight}, 5},
+		{"fixed quote", config.Sizing{Method: config.SizingFixedQuote, Amount: 250}, 2.5},
+		{"fixed fraction", config.Sizing{Method: config.SizingFixedFraction, Fraction: 0.1}, 1},
+		// ATR is 2 on a price of 100, so 1% risk is half of equity
+		{"vol target atr", config.Sizing{Method: config.SizingVolTarget, TargetVol: 0.01}, 5},
+		{"vol target capped", config.Sizing{Method: config.SizingVolTarget, TargetVol: 0.05, MaxFraction: 0.8}, 8},
+		// Kelly: 0.6 - 0.4/2 = 0.4, halved
+		{"half kelly", config.Sizing{Method: config.SizingKelly, WinRate: 0.6, Payoff: 2}, 2},
+		{"kelly capped", config.Sizing{Method: config.SizingKelly, WinRate: 0.6, Payoff: 2, Fraction: 1, MaxFraction: 0.25}, 2.5},
+		{"kelly with no edge", config.Sizing{Method: config.SizingKelly, WinRate: 0.3, Payoff: 1}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sizer, err := New(tt.cfg, fakeCandles{})
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			got, err := sizer.Target(in)
+			if err != nil {
+				t.Fatalf("Target: %v", err)
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("got %f, want %f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEqualWeightIsCappedByCash(t *testing.T) {
+	got, _ := EqualWeight{}.Target(Input{Price: 10, Cash: 100, Equity: 1000})
+	if got != 10 {
+		t.Errorf("got %f, want 10", got)
+	}
+}
+
+func TestVolTargetNeedsCandles(t *testing.T) {
+	v := VolTarget{TargetVol: 0.01, Bar: "1D", Period: 14, MaxFraction: 1, Candles: noCandles{}}
+	if _, err := v.Target(Input{Ticker: "BTCUSDT", Price: 100, Equity: 1000}); err == nil {
+		t.Errorf("expected an error without candles")
+	}
+}
+
+type noCandles struct{}
+
+func (noCandles) GetCandles(ticker, bar string, limit int) ([]exchange.Candle, error) {
+	return nil, nil
+}
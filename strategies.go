@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto_trader/config"
+	"crypto_trader/db"
+	"crypto_trader/exchange"
+	"crypto_trader/pnl"
+	"fmt"
+	"log"
+	"math"
+)
+
+// alertStrategy is the strategy an alert trades for.
+func alertStrategy(alert Alert) string {
+	if alert.Strategy == "" {
+		return config.DefaultStrategy
+	}
+	return alert.Strategy
+}
+
+// netSpent is what a strategy's trades have cost it in USDT so far: its buys
+// less what its sells returned after fees, converted at today's rates.
+func netSpent(strategy string) (float64, error) {
+	rates := make(map[string]float64)
+	var spent float64
+	for _, ticker := range cfg.Tickers() {
+		transactions, err := db.GetTransactions(strategy, ticker)
+		if err != nil {
+			return 0, fmt.Errorf("error getting transactions for %s %s: %v", strategy, ticker, err)
+		}
+		if len(transactions) == 0 {
+			continue
+		}
+		inst, _ := exchange.ParseTicker(ticker)
+		rate, ok := rates[inst.Quote]
+		if !ok {
+			rate = quoteToUSDT(inst.Quote)
+			if rate == 0 {
+				return 0, fmt.Errorf("no USDT price for %s", inst.Quote)
+			}
+			rates[inst.Quote] = rate
+		}
+		for _, t := range transactions {
+			if t.Signal == "buy" {
+				spent += t.USDTValue * rate
+			} else {
+				spent -= (t.USDTValue - t.Fee) * rate
+			}
+		}
+	}
+	return spent, nil
+}
+
+// remainingBudget is how much of a budgeted strategy's budget is left to
+// spend, in USDT.
+func remainingBudget(strategy config.Strategy) (float64, error) {
+	spent, err := netSpent(strategy.Name)
+	if err != nil {
+		return 0, err
+	}
+	return math.Max(0, strategy.Budget-spent), nil
+}
+
+// strategyCash is how much of the real quote balance a strategy may spend.
+// A strategy with a budget gets what is left of it; the others share what the
+// budgeted strategies haven't set aside.
+func strategyCash(name, quote string, spotBalance float64) (float64, error) {
+	rate := quoteToUSDT(quote)
+	if rate == 0 {
+		return 0, fmt.Errorf("no USDT price for %s", quote)
+	}
+
+	strategy, _ := cfg.Strategy(name)
+	if strategy.Budget > 0 {
+		remaining, err := remainingBudget(strategy)
+		if err != nil {
+			return 0, err
+		}
+		return math.Min(spotBalance, remaining/rate), nil
+	}
+
+	var reserved float64
+	for _, other := range cfg.Strategies {
+		if other.Budget <= 0 {
+			continue
+		}
+		remaining, err := remainingBudget(other)
+		if err != nil {
+			return 0, err
+		}
+		reserved += remaining
+	}
+	return math.Max(0, spotBalance-reserved/rate), nil
+}
+
+// nettedPosition is a strategy's position after a fill moved it by delta,
+// capped at what the real balance holds beyond the other strategies' shares
+// so the sub-ledgers never add up to more than the account has.
+func nettedPosition(strategy, ticker string, position, delta, real float64) float64 {
+	var others float64
+	for _, name := range cfg.StrategyNames() {
+		if name == strategy {
+			continue
+		}
+		state, err := db.GetState(name, ticker)
+		if err != nil {
+			continue
+		}
+		others += state.Position
+	}
+	return math.Max(0, math.Min(position+delta, real-others))
+}
+
+// positionChange is how much an order moved the position in the base
+// currency. Buys pay their fee in the coin received.
+func positionChange(order exchange.Order) float64 {
+	if order.FillSize == 0 {
+		return 0
+	}
+	if order.Side == "sell" {
+		return -order.FillSize
+	}
+	return order.FillSize - order.Fee/order.AvgPrice
+}
+
+// pairPnL builds a strategy's lots in one pair from its transactions.
+func pairPnL(strategy, ticker string) (*pnl.Book, error) {
+	transactions, err := db.GetTransactions(strategy, ticker)
+	if err != nil {
+		return nil, fmt.Errorf("error getting transactions for %s %s: %v", strategy, ticker, err)
+	}
+	book := pnl.NewBook(cfg.PnLMethod)
+	for _, t := range transactions {
+		if t.Signal == "buy" {
+			book.Buy(t.Timestamp, t.Amount, t.Price, t.Fee)
+		} else if t.Signal == "sell" {
+			book.Sell(t.Amount, t.Price, t.Fee)
+		}
+	}
+	return book, nil
+}
+
+type strategySummary struct {
+	Name           string
+	Budget         float64
+	Unspent        float64 // USDT
+	PositionsValue float64 // USDT
+}
+
+// summarizeStrategies totals each strategy's sub-ledger for the dashboard.
+func summarizeStrategies(states []db.State, prices map[string]float64) []strategySummary {
+	rates := make(map[string]float64)
+	var summaries []strategySummary
+	for _, strategy := range cfg.Strategies {
+		summary := strategySummary{Name: strategy.Name, Budget: strategy.Budget}
+		if strategy.Budget > 0 {
+			unspent, err := remainingBudget(strategy)
+			if err != nil {
+				log.Printf("Error getting remaining budget for %s: %v", strategy.Name, err)
+			}
+			summary.Unspent = unspent
+		}
+		for _, state := range states {
+			if state.Strategy != strategy.Name || state.Position == 0 {
+				continue
+			}
+			inst, _ := exchange.ParseTicker(state.Ticker)
+			rate, ok := rates[inst.Quote]
+			if !ok {
+				rate = quoteToUSDT(inst.Quote)
+				rates[inst.Quote] = rate
+			}
+			summary.PositionsValue += state.Position * prices[state.Ticker] * rate
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries
+}
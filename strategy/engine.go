@@ -0,0 +1,124 @@
+package strategy
+
+import (
+	"crypto_trader/clock"
+	"crypto_trader/config"
+	"crypto_trader/exchange"
+	"log"
+	"sync"
+	"time"
+)
+
+// CandleSource supplies the candles rules are evaluated on.
+type CandleSource interface {
+	GetCandles(ticker, bar string, limit int) ([]exchange.Candle, error)
+}
+
+type pairRule struct {
+	ticker string
+	rule   config.SignalRule
+	bar    time.Duration
+	// last is the open time of the last bar the rule was evaluated on, and
+	// next when the bar after it closes
+	last time.Time
+	next time.Time
+}
+
+// Engine evaluates every pair's signal rules as their bars close and passes
+// the signals they give to Emit.
+type Engine struct {
+	Candles CandleSource
+	Emit    func(Signal)
+
+	mu    sync.Mutex
+	rules []*pairRule
+}
+
+func NewEngine(pairs []config.Pair, candles CandleSource, emit func(Signal)) *Engine {
+	e := &Engine{Candles: candles, Emit: emit}
+	for _, pair := range pairs {
+		for _, rule := range pair.Signals {
+			rule = rule.WithDefaults()
+			bar, _ := config.BarDuration(rule.Bar)
+			e.rules = append(e.rules, &pairRule{ticker: pair.Ticker, rule: rule, bar: bar})
+		}
+	}
+	return e
+}
+
+// Rules is how many rules the engine evaluates.
+func (e *Engine) Rules() int {
+	return len(e.rules)
+}
+
+// Check evaluates each rule whose next bar has closed. The first check of a
+// rule only notes the latest closed bar, so a restart doesn't act on a
+// crossover that happened while the bot was down.
+func (e *Engine) Check() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := clock.Now()
+	for _, r := range e.rules {
+		if now.Before(r.next) {
+			continue
+		}
+		candles, err := e.Candles.GetCandles(r.ticker, r.rule.Bar, Lookback(r.rule))
+		if err != nil {
+			log.Printf("Error getting %s candles for %s: %v", r.rule.Bar, r.ticker, err)
+			continue
+		}
+		// The newest candle is still forming until its bar has passed
+		for len(candles) > 0 && candles[len(candles)-1].Time.Add(r.bar).After(now) {
+			candles = candles[:len(candles)-1]
+		}
+		if len(candles) == 0 {
+			continue
+		}
+		bar := candles[len(candles)-1]
+		if !bar.Time.After(r.last) {
+			continue
+		}
+		first := r.last.IsZero()
+		r.last = bar.Time
+		r.next = bar.Time.Add(2 * r.bar)
+		if first {
+			continue
+		}
+
+		signal, values := Evaluate(r.rule, candles)
+		if signal == "" {
+			continue
+		}
+		e.Emit(Signal{
+			Ticker:   r.ticker,
+			Strategy: r.rule.Strategy,
+			Signal:   signal,
+			Rule:     r.rule,
+			Close:    bar.Time.Add(r.bar),
+			Price:    bar.Close,
+			Values:   values,
+		})
+	}
+}
+
+// Start checks the rules every interval until the returned function is
+// called. Rules are only fetched once their next bar is due, so the interval
+// only bounds how late after a close a signal can be.
+func (e *Engine) Start(interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	stop := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		e.Check()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				e.Check()
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
@@ -0,0 +1,157 @@
+// Package strategy turns candles into buy and sell signals with the
+// indicator rules configured for each pair, so the bot can trade without
+// TradingView alerts. Rules are only ever evaluated on closed bars.
+package strategy
+
+import (
+	"crypto_trader/config"
+	"crypto_trader/exchange"
+	"crypto_trader/indicator"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxCandles is the most candles OKX returns in one request.
+const maxCandles = 300
+
+// atrPeriod is the ATR logged alongside every signal, for context.
+const atrPeriod = 14
+
+// Value is an indicator value a signal was based on.
+type Value struct {
+	Name  string
+	Value float64
+}
+
+// Signal is a buy or sell a rule gave on a closed bar.
+type Signal struct {
+	Ticker   string
+	Strategy string
+	Signal   string // buy or sell
+	Rule     config.SignalRule
+	Close    time.Time // when the bar closed
+	Price    float64   // the bar's close
+	Values   []Value
+}
+
+// Describe is the rule and the indicator values behind the signal, e.g.
+// "ema_cross 20/50 4H: close=101.2 ema20=100.9 ema50=100.7".
+func (s Signal) Describe() string {
+	parts := []string{fmt.Sprintf("%s: close=%.8g", s.Rule, s.Price)}
+	for _, v := range s.Values {
+		parts = append(parts, fmt.Sprintf("%s=%.8g", v.Name, v.Value))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Lookback is how many candles Evaluate is given for rule, enough for its
+// exponential averages to forget where they were seeded.
+func Lookback(rule config.SignalRule) int {
+	rule = rule.WithDefaults()
+	var n int
+	switch rule.Type {
+	case config.RuleEMACross:
+		n = rule.Slow*3 + 1
+	case config.RuleSMACross:
+		n = rule.Slow + 1
+	case config.RuleMACD:
+		n = (rule.Slow+rule.SignalPeriod)*3 + 1
+	case config.RuleRSI:
+		n = rule.Period*4 + 1
+	case config.RuleBollinger:
+		n = rule.Period + 1
+	}
+	return min(max(n, atrPeriod+1), maxCandles)
+}
+
+// minBars is the fewest candles rule can give a signal on: enough for its
+// indicators on the last bar and the one before it.
+func minBars(rule config.SignalRule) int {
+	switch rule.Type {
+	case config.RuleEMACross, config.RuleSMACross:
+		return rule.Slow + 1
+	case config.RuleMACD:
+		return rule.Slow + rule.SignalPeriod
+	case config.RuleRSI:
+		return rule.Period + 2
+	case config.RuleBollinger:
+		return rule.Period + 1
+	}
+	return 0
+}
+
+// Evaluate returns the signal rule gives on the last of candles, which must
+// all have closed, and the indicator values it was based on. The signal is
+// empty when the rule gives none.
+func Evaluate(rule config.SignalRule, candles []exchange.Candle) (string, []Value) {
+	rule = rule.WithDefaults()
+	n := len(candles)
+	if n == 0 || n < minBars(rule) {
+		return "", nil
+	}
+	closes := make([]float64, n)
+	for i, c := range candles {
+		closes[i] = c.Close
+	}
+	prev := closes[:n-1]
+
+	var signal string
+	var values []Value
+	switch rule.Type {
+	case config.RuleEMACross, config.RuleSMACross:
+		ma, name := indicator.EMA, "ema"
+		if rule.Type == config.RuleSMACross {
+			ma, name = indicator.SMA, "sma"
+		}
+		fast, slow := ma(closes, rule.Fast), ma(closes, rule.Slow)
+		prevFast, prevSlow := ma(prev, rule.Fast), ma(prev, rule.Slow)
+		signal = cross(prevFast-prevSlow, fast-slow)
+		values = []Value{{fmt.Sprintf("%s%d", name, rule.Fast), fast}, {fmt.Sprintf("%s%d", name, rule.Slow), slow}}
+	case config.RuleMACD:
+		macd, line, hist := indicator.MACD(closes, rule.Fast, rule.Slow, rule.SignalPeriod)
+		_, _, prevHist := indicator.MACD(prev, rule.Fast, rule.Slow, rule.SignalPeriod)
+		signal = cross(prevHist, hist)
+		values = []Value{{"macd", macd}, {"signal", line}, {"histogram", hist}}
+	case config.RuleRSI:
+		rsi, prevRSI := indicator.RSI(closes, rule.Period), indicator.RSI(prev, rule.Period)
+		if prevRSI < rule.Oversold && rsi >= rule.Oversold {
+			signal = "buy"
+		} else if prevRSI > rule.Overbought && rsi <= rule.Overbought {
+			signal = "sell"
+		}
+		values = []Value{{fmt.Sprintf("rsi%d", rule.Period), rsi}}
+	case config.RuleBollinger:
+		middle, upper, lower := indicator.Bollinger(closes, rule.Period, rule.Width)
+		_, prevUpper, prevLower := indicator.Bollinger(prev, rule.Period, rule.Width)
+		last, prevLast := closes[n-1], prev[n-2]
+		if prevLast >= prevLower && last < lower {
+			signal = "buy"
+		} else if prevLast <= prevUpper && last > upper {
+			signal = "sell"
+		}
+		values = []Value{{"middle", middle}, {"upper", upper}, {"lower", lower}}
+	}
+
+	high := make([]float64, n)
+	low := make([]float64, n)
+	for i, c := range candles {
+		high[i], low[i] = c.High, c.Low
+	}
+	if atr := indicator.ATR(high, low, closes, atrPeriod); atr > 0 {
+		values = append(values, Value{fmt.Sprintf("atr%d", atrPeriod), atr})
+	}
+	return signal, values
+}
+
+// cross is buy when a difference turns positive and sell when it turns
+// negative.
+func cross(prev, cur float64) string {
+	if prev <= 0 && cur > 0 {
+		return "buy"
+	}
+	if prev >= 0 && cur < 0 {
+		return "sell"
+	}
+	return ""
+}
@@ -0,0 +1,109 @@
+package strategy
+
+import (
+	"crypto_trader/clock"
+	"crypto_trader/config"
+	"crypto_trader/exchange"
+	"crypto_trader/indicator"
+	"math"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// hourly makes 1H candles closing at closes, the first opening at start.
+func hourly(closes ...float64) []exchange.Candle {
+	candles := make([]exchange.Candle, len(closes))
+	for i, c := range closes {
+		candles[i] = exchange.Candle{Time: start.Add(time.Duration(i) * time.Hour), Open: c, High: c + 1, Low: c - 1, Close: c}
+	}
+	return candles
+}
+
+func TestIndicators(t *testing.T) {
+	values := []float64{1, 2, 3, 4, 5, 6}
+	if got := indicator.SMA(values, 3); got != 5 {
+		t.Errorf("SMA = %v, want 5", got)
+	}
+	// Seeded with 2 then k = 0.5: 3, 4, 5
+	if got := indicator.EMA(values, 3); got != 5 {
+		t.Errorf("EMA = %v, want 5", got)
+	}
+	if got := indicator.RSI(values, 3); got != 100 {
+		t.Errorf("RSI of a rising series = %v, want 100", got)
+	}
+	middle, upper, lower := indicator.Bollinger([]float64{1, 3}, 2, 2)
+	if middle != 2 || upper != 4 || lower != 0 {
+		t.Errorf("Bollinger = %v %v %v, want 2 4 0", middle, upper, lower)
+	}
+	if macd, signal, hist := indicator.MACD(values, 2, 3, 2); math.Abs(macd-0.5) > 1e-9 || math.Abs(hist) > 1e-9 || signal != macd {
+		t.Errorf("MACD of a straight line = %v %v %v, want 0.5 0.5 0", macd, signal, hist)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    config.SignalRule
+		candles []exchange.Candle
+		want    string
+	}{
+		{"sma crosses up", config.SignalRule{Type: config.RuleSMACross, Fast: 2, Slow: 3}, hourly(5, 4, 3, 6), "buy"},
+		{"sma stays above", config.SignalRule{Type: config.RuleSMACross, Fast: 2, Slow: 3}, hourly(3, 4, 5, 6), ""},
+		{"ema crosses down", config.SignalRule{Type: config.RuleEMACross, Fast: 2, Slow: 3}, hourly(1, 2, 3, 4, 1), "sell"},
+		{"rsi leaves oversold", config.SignalRule{Type: config.RuleRSI, Period: 3}, hourly(10, 9, 8, 7, 6, 9), "buy"},
+		{"rsi leaves overbought", config.SignalRule{Type: config.RuleRSI, Period: 3}, hourly(1, 2, 3, 4, 5, 2), "sell"},
+		{"close below lower band", config.SignalRule{Type: config.RuleBollinger, Period: 3, Width: 1}, hourly(5, 5, 5, 5, 1), "buy"},
+		{"close above upper band", config.SignalRule{Type: config.RuleBollinger, Period: 3, Width: 1}, hourly(5, 5, 5, 5, 9), "sell"},
+		{"macd turns up", config.SignalRule{Type: config.RuleMACD, Fast: 2, Slow: 3, SignalPeriod: 2}, hourly(9, 8, 7, 6, 5, 8), "buy"},
+		{"not enough bars", config.SignalRule{Type: config.RuleSMACross, Fast: 2, Slow: 3}, hourly(5, 3, 6), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, values := Evaluate(tt.rule, tt.candles); got != tt.want {
+				t.Errorf("got %q with %v, want %q", got, values, tt.want)
+			}
+		})
+	}
+}
+
+type fakeCandles []exchange.Candle
+
+func (f fakeCandles) GetCandles(ticker, bar string, limit int) ([]exchange.Candle, error) {
+	if len(f) > limit {
+		return f[len(f)-limit:], nil
+	}
+	return f, nil
+}
+
+func TestEngineSignalsOnClosedBars(t *testing.T) {
+	vclock := clock.NewVirtual(start)
+	clock.Use(vclock)
+	defer clock.Use(nil)
+
+	var signals []Signal
+	pairs := []config.Pair{{Ticker: "BTCUSDT", Signals: []config.SignalRule{{Type: config.RuleSMACross, Fast: 2, Slow: 3}}}}
+	// The cross only shows in the last candle
+	candles := fakeCandles(hourly(5, 4, 3, 2, 6))
+	e := NewEngine(pairs, candles, func(s Signal) { signals = append(signals, s) })
+
+	// Three closed bars and one forming: the first check only notes the
+	// latest bar
+	vclock.AdvanceTo(start.Add(3*time.Hour + 30*time.Minute))
+	e.Check()
+	vclock.AdvanceTo(start.Add(4*time.Hour + 30*time.Minute))
+	e.Check()
+	if len(signals) != 0 {
+		t.Fatalf("expected no signal before the crossing bar closes, got %+v", signals)
+	}
+	vclock.AdvanceTo(start.Add(5 * time.Hour))
+	e.Check()
+	e.Check()
+	if len(signals) != 1 || signals[0].Signal != "buy" || !signals[0].Close.Equal(start.Add(5*time.Hour)) || signals[0].Price != 6 {
+		t.Fatalf("expected one buy on the bar closing at 05:00, got %+v", signals)
+	}
+	if got := signals[0].Describe(); got != "sma_cross 2/3 1H: close=6 sma2=4 sma3=3.6666667" {
+		t.Errorf("unexpected description %q", got)
+	}
+}
@@ -2,36 +2,45 @@ package crypto_trader
 
 import (
 	"bytes"
+	"crypto_trader/config"
 	"crypto_trader/db"
-	"crypto_trader/okx"
+	"crypto_trader/exchange"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 )
 
+// SettleDelay is how long RunTests waits after each alert before checking the
+// resulting position. Tests against a fake exchange can set it to zero.
+var SettleDelay = 3 * time.Second
+
 type TestResult struct {
 	Step    string
 	Success bool
 	Details string
 }
 
-func RunTests(webhookURL string, client *okx.Client) []TestResult {
+func RunTests(webhookURL, passphrase string, ex exchange.Exchange) []TestResult {
 	var results []TestResult
 
+	// Hold each response until the queued alert has been processed
+	webhookURL += "?wait=30s"
+	// Each run's alerts need their own IDs or a rerun would be taken for a repeat
+	runID := strconv.FormatInt(time.Now().UnixNano(), 36)
+
 	// Test 1: Buy TRX (Simulated TradingView Buy Signal)
 	log.Println("=== Test 1: Buy TRX ===")
 	results = append(results, TestResult{Step: "Buy TRX", Success: true, Details: "Starting test"})
 
-	db.ResetState("TRXUSDT", "sell", 0.0)
+	db.ResetState(config.DefaultStrategy, "TRXUSDT", "sell", 0.0)
 
 	// Simulate TradingView buy signal
-	payload := []byte(`{"ticker":"TRXUSDT","signal":"buy"}`)
-	log.Printf("Simulating TradingView buy signal: %s", payload)
+	payload, _ := json.Marshal(map[string]string{"ticker": "TRXUSDT", "signal": "buy", "passphrase": passphrase, "id": "test-" + runID + "-buy"})
+	log.Println("Simulating TradingView buy signal")
 
 	req, err := http.NewRequest("POST", webhookURL, bytes.NewBuffer(payload))
 	if err != nil {
@@ -60,10 +69,10 @@ func RunTests(webhookURL string, client *okx.Client) []TestResult {
 	}
 
 	// Wait for the order to process
-	time.Sleep(3 * time.Second)
+	time.Sleep(SettleDelay)
 
 	// Check position
-	positions, err := client.GetPositions()
+	positions, err := ex.GetPositions()
 	if err != nil {
 		log.Printf("Error checking positions: %v", err)
 		results[0].Success = false
@@ -79,10 +88,10 @@ func RunTests(webhookURL string, client *okx.Client) []TestResult {
 		return results
 	}
 
-	price := getCurrentPrice("TRXUSDT")
-	if price == 0 {
+	price, err := ex.GetPrice("TRXUSDT")
+	if err != nil {
 		results[0].Success = false
-		results[0].Details = "Failed to get current price"
+		results[0].Details = fmt.Sprintf("Failed to get current price: %v", err)
 		return results
 	}
 	expectedSize := 10.0 / price
@@ -100,8 +109,8 @@ func RunTests(webhookURL string, client *okx.Client) []TestResult {
 	log.Println("=== Test 2: Sell TRX ===")
 	results = append(results, TestResult{Step: "Sell TRX", Success: true, Details: "Starting test"})
 
-	payload = []byte(`{"ticker":"TRXUSDT","signal":"sell"}`)
-	log.Printf("Simulating TradingView sell signal: %s", payload)
+	payload, _ = json.Marshal(map[string]string{"ticker": "TRXUSDT", "signal": "sell", "passphrase": passphrase, "id": "test-" + runID + "-sell"})
+	log.Println("Simulating TradingView sell signal")
 
 	req, err = http.NewRequest("POST", webhookURL, bytes.NewBuffer(payload))
 	if err != nil {
@@ -130,10 +139,10 @@ func RunTests(webhookURL string, client *okx.Client) []TestResult {
 	}
 
 	// Wait for the order to process
-	time.Sleep(3 * time.Second)
+	time.Sleep(SettleDelay)
 
 	// Check position
-	positions, err = client.GetPositions()
+	positions, err = ex.GetPositions()
 	if err != nil {
 		log.Printf("Error checking positions: %v", err)
 		results[1].Success = false
@@ -155,44 +164,3 @@ func RunTests(webhookURL string, client *okx.Client) []TestResult {
 	log.Println("Test suite completed.")
 	return results
 }
-
-func getCurrentPrice(ticker string) float64 {
-	baseURL := "https://www.okx.com"
-	endpoint := "/api/v5/market/ticker"
-	instId := strings.Replace(ticker, "USDT", "-USDT", 1)
-	url := fmt.Sprintf("%s%s?instId=%s", baseURL, endpoint, instId)
-
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Printf("Error fetching price for %s: %v", ticker, err)
-		return 0
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("OKX API error for %s: status %d", ticker, resp.StatusCode)
-		return 0
-	}
-
-	var result struct {
-		Data []struct {
-			Last string `json:"last"`
-		} `json:"data"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		log.Printf("Error decoding price for %s: %v", ticker, err)
-		return 0
-	}
-
-	if len(result.Data) == 0 {
-		log.Printf("No price data for %s", ticker)
-		return 0
-	}
-
-	price, err := strconv.ParseFloat(result.Data[0].Last, 64)
-	if err != nil {
-		log.Printf("Error parsing price for %s: %v", ticker, err)
-		return 0
-	}
-	return price
-}
\ No newline at end of file
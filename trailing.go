@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto_trader/db"
+	"fmt"
+	"log"
+	"time"
+)
+
+// startTrailing starts the trailing stop for a strategy's position in
+// ticker, bought at entry. A position that is already trailed keeps its
+// high-water mark.
+func startTrailing(strategy, ticker string, entry float64) {
+	p := cfg.ProtectionFor(strategy, ticker)
+	t := db.TrailingStop{Strategy: strategy, Ticker: ticker, EntryPrice: entry, HighWater: entry, Percent: p.TrailingStop}
+	if p.TrailingStopATR > 0 {
+		// The distance is fixed at entry so the stop only ever moves up
+		atr, err := protectionATR(p, ticker)
+		if err != nil {
+			log.Printf("Error starting trailing stop for %s %s: %v", strategy, ticker, err)
+			return
+		}
+		t.Distance = p.TrailingStopATR * atr
+	}
+	t.StopPrice = t.Level(entry)
+	if err := db.StartTrailingStop(t); err != nil {
+		log.Printf("Error starting trailing stop for %s %s: %v", strategy, ticker, err)
+		return
+	}
+	log.Printf("Trailing %s %s from %.8f, stop at %.8f", strategy, ticker, entry, t.StopPrice)
+}
+
+// stopTrailing drops the trailing stop of a position that has been closed,
+// so a new position starts its own.
+func stopTrailing(strategy, ticker string) {
+	if err := db.DeleteTrailingStop(strategy, ticker); err != nil {
+		log.Printf("Error deleting trailing stop for %s %s: %v", strategy, ticker, err)
+	}
+}
+
+// checkTrailingStops raises each trailing stop to follow the price and
+// queues a sell alert for positions that have fallen to their stop. Stops
+// for positions that have been sold are dropped.
+func checkTrailingStops() {
+	stops, err := db.GetTrailingStops()
+	if err != nil {
+		log.Printf("Error getting trailing stops: %v", err)
+		return
+	}
+	if len(stops) == 0 {
+		return
+	}
+	var tickers []string
+	seen := make(map[string]bool)
+	for _, t := range stops {
+		if !seen[t.Ticker] {
+			seen[t.Ticker] = true
+			tickers = append(tickers, t.Ticker)
+		}
+	}
+	prices := getCurrentPrices(tickers)
+
+	for _, t := range stops {
+		state, err := db.GetState(t.Strategy, t.Ticker)
+		if err != nil {
+			log.Printf("Error getting state for %s %s: %v", t.Strategy, t.Ticker, err)
+			continue
+		}
+		if state.Signal != "buy" || state.Position <= 0 {
+			log.Printf("%s no longer holds %s, dropping its trailing stop", t.Strategy, t.Ticker)
+			stopTrailing(t.Strategy, t.Ticker)
+			continue
+		}
+		if price := prices[t.Ticker]; price > 0 {
+			trail(t, price)
+		}
+	}
+}
+
+// trail raises a trailing stop to follow price, or queues the sell alert
+// if price has fallen to the stop.
+func trail(t db.TrailingStop, price float64) {
+	if price > t.HighWater {
+		t.HighWater, t.StopPrice = price, t.Level(price)
+		if err := db.RaiseTrailingStop(t.Strategy, t.Ticker, t.HighWater, t.StopPrice); err != nil {
+			log.Printf("Error raising trailing stop for %s %s: %v", t.Strategy, t.Ticker, err)
+		}
+		return
+	}
+	if price > t.StopPrice {
+		return
+	}
+
+	// Repeats within the dedupe window are dropped, so a sell that
+	// fails is retried once the window has passed
+	alert := Alert{
+		Ticker:   t.Ticker,
+		Signal:   "sell",
+		Strategy: t.Strategy,
+		Comment:  fmt.Sprintf("trailing stop at %.8g, high %.8g", t.StopPrice, t.HighWater),
+	}
+	key := fmt.Sprintf("trailing:%s:%s:%d", t.Strategy, t.Ticker, t.CreatedAt.UnixNano())
+	id, duplicate, err := enqueueAlert(alert, key)
+	if err != nil {
+		log.Printf("Error queueing trailing stop sell for %s %s: %v", t.Strategy, t.Ticker, err)
+	} else if !duplicate {
+		log.Printf("Trailing stop hit for %s %s at %.8f (stop %.8f), queued alert %d", t.Strategy, t.Ticker, price, t.StopPrice, id)
+	}
+}
+
+// trailingStatus is a trailing stop as shown on the dashboard.
+type trailingStatus struct {
+	db.TrailingStop
+	Price float64
+	Room  float64 // % the price can fall before the stop is hit
+}
+
+func trailingStatuses(prices map[string]float64) ([]trailingStatus, error) {
+	stops, err := db.GetTrailingStops()
+	if err != nil {
+		return nil, err
+	}
+	var statuses []trailingStatus
+	for _, t := range stops {
+		status := trailingStatus{TrailingStop: t, Price: prices[t.Ticker]}
+		if status.Price > 0 {
+			status.Room = (status.Price - t.StopPrice) / status.Price * 100
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// startTrailingMonitor checks the trailing stops every interval until the
+// returned function is called.
+func startTrailingMonitor(interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	stop := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				checkTrailingStops()
+			}
+		}
+	}()
+	return func() { close(stop) }
+}